@@ -121,7 +121,10 @@ func (p *portProxy) run() error {
 	}
 
 	if proxy != nil {
-		proxy.Run()
+		if err := proxy.Run(); err != nil {
+			ctl.Close()
+			return fmt.Errorf("proxy for port %s stopped – %v", desc, err)
+		}
 	} else {
 		return fmt.Errorf("unexpected error – proxy for %s is nil", desc)
 	}
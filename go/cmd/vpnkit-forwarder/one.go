@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"os"
 
 	"github.com/moby/vpnkit/go/pkg/libproxy"
@@ -28,7 +29,9 @@ func onePort() {
 	// TODO: avoid this line if we are running in a TTY
 	sendOK()
 	if ipP != nil {
-		ipP.Run()
+		if err := ipP.Run(); err != nil {
+			log.Printf("Proxy stopped: %s", err)
+		}
 	} else {
 		select {} // sleep forever
 	}
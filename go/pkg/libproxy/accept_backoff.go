@@ -0,0 +1,61 @@
+package libproxy
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// DefaultAcceptBackoff is the longest a TCP proxy waits between retries of a
+// temporary Accept error unless WithAcceptBackoff says otherwise.
+const DefaultAcceptBackoff = time.Second
+
+// WithAcceptBackoff sets the longest a TCP proxy waits before retrying Accept
+// after a temporary error, such as running out of file descriptors. The wait
+// starts at 5ms and doubles with each consecutive error up to max. Other
+// Accept errors stop the proxy and are returned by Run. The default is
+// DefaultAcceptBackoff.
+func WithAcceptBackoff(max time.Duration) Option {
+	return func(o *options) {
+		o.acceptBackoff = max
+	}
+}
+
+// acceptBackoff is the wait before the next Accept after temporary errors.
+type acceptBackoff struct {
+	delay time.Duration
+	max   time.Duration
+}
+
+// wait sleeps for the next delay. It returns false if stopping is closed
+// meanwhile.
+func (b *acceptBackoff) wait(stopping <-chan struct{}) bool {
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else {
+		b.delay *= 2
+	}
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stopping:
+		return false
+	}
+}
+
+func (b *acceptBackoff) reset() { b.delay = 0 }
+
+// isTemporaryAcceptError reports whether Accept might succeed if retried.
+func isTemporaryAcceptError(err error) bool {
+	switch bindErrno(err) {
+	case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM:
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Temporary()
+}
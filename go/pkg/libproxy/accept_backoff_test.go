@@ -0,0 +1,104 @@
+package libproxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyListener fails Accept with err the first n times.
+type flakyListener struct {
+	net.Listener
+	m        sync.Mutex
+	n        int
+	err      error
+	failures []time.Time
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.m.Lock()
+	if len(l.failures) < l.n {
+		l.failures = append(l.failures, time.Now())
+		l.m.Unlock()
+		return nil, l.err
+	}
+	l.m.Unlock()
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	flaky := &flakyListener{Listener: listener, n: 6, err: emfile}
+	max := 20 * time.Millisecond
+	proxy, err := NewIPProxyWithListener(flaky, backend.LocalAddr(), WithAcceptBackoff(max), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+
+	flaky.m.Lock()
+	defer flaky.m.Unlock()
+	// 5ms, 10ms, then capped at 20ms.
+	for i, expected := range []time.Duration{5, 10, 20, 20, 20} {
+		if gap := flaky.failures[i+1].Sub(flaky.failures[i]); gap < expected*time.Millisecond || gap > time.Second {
+			t.Errorf("Expected retry %d after about %dms but it took %s", i+1, expected, gap)
+		}
+	}
+}
+
+func TestAcceptBackoffClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	proxy, err := NewIPProxyWithListener(&flakyListener{Listener: listener, n: 1 << 30, err: emfile}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithAcceptBackoff(time.Hour), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- proxy.Run() }()
+	time.Sleep(50 * time.Millisecond)
+	proxy.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil after Close but got %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after Close while backing off")
+	}
+}
+
+func TestAcceptPermanentError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyListener{Listener: listener, n: 1, err: errors.New("accept failed")}
+	proxy, err := NewIPProxyWithListener(flaky, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Run(); err == nil {
+		t.Fatal("Expected Run to return the Accept error")
+	}
+}
@@ -0,0 +1,36 @@
+package libproxy
+
+import "time"
+
+// WithAcceptRateLimit caps how many connections a TCP proxy accepts per
+// second, to protect its backend from connection storms, whereas
+// WithMaxConnections caps how many are open at once. The accept loop waits
+// before each Accept until the rate allows it, so the connections in excess
+// wait in the kernel's accept queue, and are refused by it once the queue is
+// full. Short bursts of up to a fiftieth of a second's allowance are
+// accepted at once. Zero means unlimited.
+func WithAcceptRateLimit(perSecond int) Option {
+	return func(o *options) {
+		o.acceptRate = perSecond
+	}
+}
+
+// acceptToken waits until the accept rate limit allows another connection
+// to be accepted. It returns false if the proxy stops accepting meanwhile.
+func (proxy *TCPProxy) acceptToken() bool {
+	if proxy.acceptRate == nil {
+		return true
+	}
+	wait := proxy.acceptRate.reserve(1)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-proxy.stopping:
+		return false
+	}
+}
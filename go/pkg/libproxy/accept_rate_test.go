@@ -0,0 +1,77 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptRateLimit(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithAcceptRateLimit(20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	const clients = 6
+	start := time.Now()
+	for i := 0; i < clients; i++ {
+		// The kernel completes the handshakes: the connections wait in
+		// its accept queue.
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	waitFor(t, func() bool { return proxy.Stats().TotalConns == clients }, func() string { return fmt.Sprintf("Timed out waiting for TotalConns == clients in %+v", proxy.Stats()) })
+	// One connection is accepted every 50ms.
+	if elapsed := time.Since(start); elapsed < (clients-1)*50*time.Millisecond*9/10 {
+		t.Fatalf("Expected %d connections to take at least 250ms to be accepted but they took %s", clients, elapsed)
+	}
+}
+
+func TestAcceptRateLimitClose(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithAcceptRateLimit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- proxy.Run() }()
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	// The second connection waits for a whole second: Close interrupts the
+	// wait.
+	waitFor(t, func() bool { return proxy.Stats().TotalConns == 1 }, func() string { return fmt.Sprintf("Timed out waiting for TotalConns == 1 in %+v", proxy.Stats()) })
+	start := time.Now()
+	proxy.Close()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after Close")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Run took %s to return after Close", elapsed)
+	}
+	if stats := proxy.Stats(); stats.TotalConns != 1 {
+		t.Fatalf("Expected the waiting connection not to be accepted but got %+v", stats)
+	}
+}
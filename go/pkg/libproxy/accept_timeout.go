@@ -0,0 +1,104 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// WithAcceptTimeout closes a TCP client which hasn't got through the first
+// phase of its connection within d: completing the TLS handshake on a
+// NewTLSProxy, sending its request to a SOCKS5 or HTTP CONNECT proxy, or
+// the first bytes to be forwarded in either direction on a plain one, so that
+// protocols where the server speaks first aren't cut off. The time spent
+// dialing the backend of a plain proxy doesn't count. This stops clients
+// which connect and then sit idle from holding on to a connection slot. The
+// timeout no longer applies once the connection is being forwarded.
+func WithAcceptTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.acceptTimeout = d
+	}
+}
+
+// acceptTimer closes a newly accepted client unless it is stopped within the
+// accept timeout.
+type acceptTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+	client  net.Addr
+	m       sync.Mutex
+	stopped bool
+	paused  bool
+	expired bool
+}
+
+// startAcceptTimer returns nil if there is no accept timeout.
+func (o *options) startAcceptTimer(client Conn) *acceptTimer {
+	if o.acceptTimeout <= 0 {
+		return nil
+	}
+	return &acceptTimer{
+		timer:   time.AfterFunc(o.acceptTimeout, func() { client.Close() }),
+		timeout: o.acceptTimeout,
+		client:  remoteAddr(client),
+	}
+}
+
+// stop ends the initial phase of the connection. It returns false if the
+// client has already been closed for taking too long. Only the first call
+// has any effect.
+func (a *acceptTimer) stop() bool {
+	if a == nil {
+		return true
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if !a.stopped {
+		a.stopped = true
+		if !a.paused && !a.timer.Stop() {
+			a.expired = true
+		}
+	}
+	return !a.expired
+}
+
+// pause stops the timer while the backend is dialed, until resume is
+// called.
+func (a *acceptTimer) pause() {
+	if a == nil {
+		return
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.stopped || a.paused {
+		return
+	}
+	a.paused = true
+	if !a.timer.Stop() {
+		a.expired = true
+	}
+}
+
+// resume restarts a paused timer with the whole timeout.
+func (a *acceptTimer) resume() {
+	if a == nil {
+		return
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.stopped || !a.paused || a.expired {
+		return
+	}
+	a.paused = false
+	a.timer.Reset(a.timeout)
+}
+
+// end stops the timer at the end of a phase which finished with err. If the
+// client was closed by the timer, that is reported instead of err.
+func (a *acceptTimer) end(err error) error {
+	if !a.stop() {
+		return fmt.Errorf("Closing connection from %v which was idle for %s after it was accepted", a.client, a.timeout)
+	}
+	return err
+}
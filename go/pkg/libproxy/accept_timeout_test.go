@@ -0,0 +1,166 @@
+package libproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// expectDisconnected checks that the proxy closes client even though it
+// never sends anything.
+func expectDisconnected(t *testing.T, client net.Conn) {
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(client); isTimeout(err) {
+		t.Fatal("Expected the idle client to be disconnected")
+	}
+}
+
+func TestAcceptTimeout(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	var m sync.Mutex
+	var closedErrs []error
+	timeout := 200 * time.Millisecond
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithAcceptTimeout(timeout), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnClosed {
+			m.Lock()
+			closedErrs = append(closedErrs, e.Err)
+			m.Unlock()
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	idle, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	active, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	roundTrip(t, active)
+
+	expectDisconnected(t, idle)
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 1
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 1 in %+v", stats) })
+	if stats.TotalConns != 2 {
+		t.Fatalf("Expected 2 connections but got %+v", stats)
+	}
+	m.Lock()
+	if len(closedErrs) != 1 || closedErrs[0] == nil || !strings.Contains(closedErrs[0].Error(), "idle") {
+		t.Errorf("Expected the idle connection to be closed for being idle, got %v", closedErrs)
+	}
+	m.Unlock()
+
+	// Once forwarding, a connection may go quiet for longer than the
+	// timeout.
+	time.Sleep(2 * timeout)
+	roundTrip(t, active)
+}
+
+func TestAcceptTimeoutServerFirst(t *testing.T) {
+	// A backend which greets its clients before they send anything, as
+	// SSH and SMTP servers do.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	banner := []byte("220 ready\r\n")
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(banner)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	timeout := 200 * time.Millisecond
+	proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.Addr(), WithAcceptTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	received := make([]byte, len(banner))
+	if _, err := io.ReadFull(client, received); err != nil {
+		t.Fatal(err)
+	}
+	// The banner started forwarding, so the client may take its time.
+	time.Sleep(2 * timeout)
+	roundTrip(t, client)
+}
+
+func TestAcceptTimeoutHTTPConnect(t *testing.T) {
+	proxy := newTestHTTPConnectProxy(t, WithAcceptTimeout(100*time.Millisecond))
+	defer proxy.Close()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// A request which is never finished counts as idle.
+	fmt.Fprintf(client, "CONNECT 127.0.0.1:1 HTTP/1.1\r\n")
+	expectDisconnected(t, client)
+}
+
+func TestAcceptTimeoutTLS(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	cert, pool := selfSignedCert(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := 200 * time.Millisecond
+	proxy, err := NewTLSProxy(listener, backend.LocalAddr(), &tls.Config{Certificates: []tls.Certificate{cert}}, WithAcceptTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	idle, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	expectDisconnected(t, idle)
+
+	// After the handshake the client doesn't have to send anything.
+	client, err := tls.Dial("tcp", proxy.FrontendAddr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	time.Sleep(2 * timeout)
+	roundTrip(t, client)
+}
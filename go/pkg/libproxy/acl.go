@@ -0,0 +1,82 @@
+package libproxy
+
+import (
+	"net"
+)
+
+// WithAllowCIDRs restricts a proxy to clients whose source IP is in one of
+// the given networks. TCP connections from anywhere else are closed as soon
+// as they are accepted, and UDP datagrams are dropped without a backend
+// session being created. Clients without an IP address, such as vsock
+// clients, are refused too.
+func WithAllowCIDRs(nets []*net.IPNet) Option {
+	return func(o *options) {
+		o.sources.allow = nets
+	}
+}
+
+// WithDenyCIDRs refuses clients whose source IP is in one of the given
+// networks, in the same way as WithAllowCIDRs. The deny list takes precedence
+// over the allow list.
+func WithDenyCIDRs(nets []*net.IPNet) Option {
+	return func(o *options) {
+		o.sources.deny = nets
+	}
+}
+
+// WithAllowDestinationCIDRs restricts the destinations which clients of a
+// SOCKS5 or HTTP CONNECT proxy may ask for to the given networks. Host names
+// are resolved and checked before they are dialed.
+func WithAllowDestinationCIDRs(nets []*net.IPNet) Option {
+	return func(o *options) {
+		o.destinations.allow = nets
+	}
+}
+
+// WithDenyDestinationCIDRs refuses SOCKS5 or HTTP CONNECT destinations in the
+// given networks. It takes precedence over WithAllowDestinationCIDRs.
+func WithDenyDestinationCIDRs(nets []*net.IPNet) Option {
+	return func(o *options) {
+		o.destinations.deny = nets
+	}
+}
+
+// cidrFilter is a pair of allow and deny lists.
+type cidrFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// permits checks ip against the lists. A nil ip is only permitted if there is
+// no allow list.
+func (f *cidrFilter) permits(ip net.IP) bool {
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitted checks the address of a client against the allow and deny lists.
+func (o *options) permitted(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	return o.sources.permits(ip)
+}
@@ -0,0 +1,99 @@
+package libproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func TestPermitted(t *testing.T) {
+	o := newOptions([]Option{
+		WithAllowCIDRs(mustParseCIDRs(t, "10.0.0.0/8", "192.168.1.0/24")),
+		WithDenyCIDRs(mustParseCIDRs(t, "10.1.0.0/16")),
+	})
+	tests := []struct {
+		addr net.Addr
+		ok   bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.7")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("172.16.0.1")}, false},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, false},
+	}
+	for _, test := range tests {
+		if ok := o.permitted(test.addr); ok != test.ok {
+			t.Errorf("Expected permitted(%v) = %t", test.addr, test.ok)
+		}
+	}
+	o = newOptions(nil)
+	if !o.permitted(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}) {
+		t.Error("Expected everything to be permitted without an allow list")
+	}
+}
+
+func TestTCPProxyDenied(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithDenyCIDRs(mustParseCIDRs(t, "127.0.0.0/8")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but got %v", err)
+	}
+	if total := proxy.Stats().TotalConns; total != 0 {
+		t.Fatalf("Expected no connections to be forwarded but got %d", total)
+	}
+}
+
+func TestUDPProxyDenied(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithAllowCIDRs(mustParseCIDRs(t, "10.0.0.0/8")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := client.Read(make([]byte, testBufSize)); err == nil {
+		t.Fatal("Expected the datagram to be dropped")
+	}
+	if total := proxy.Stats().TotalConns; total != 0 {
+		t.Fatalf("Expected no sessions to be created but got %d", total)
+	}
+}
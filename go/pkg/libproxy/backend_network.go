@@ -0,0 +1,68 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// WithBackendNetwork pins the network which the proxy dials its backend
+// with, for example "tcp4" to only ever connect to the IPv4 addresses of a
+// backend host name when IPv6 is broken. It applies to TCP and UDP backends,
+// including host names and the destinations asked for by SOCKS5 and HTTP
+// CONNECT clients, and must be "tcp", "tcp4" or "tcp6" for the former and
+// "udp", "udp4" or "udp6" for the latter: the proxy's constructor fails
+// otherwise.
+func WithBackendNetwork(network string) Option {
+	return func(o *options) {
+		o.backendNetwork = network
+	}
+}
+
+// checkBackendNetwork returns an error if the pinned network can't be used
+// to dial backendAddr.
+func (o *options) checkBackendNetwork(backendAddr net.Addr) error {
+	if o.backendNetwork == "" {
+		return nil
+	}
+	var kind string
+	switch backendAddr.(type) {
+	case *net.TCPAddr:
+		kind = "tcp"
+	case *net.UDPAddr:
+		kind = "udp"
+	default:
+		return fmt.Errorf("Can't pin the network of backend %s/%v to %s", backendAddr.Network(), backendAddr, o.backendNetwork)
+	}
+	switch o.backendNetwork {
+	case kind, kind + "4", kind + "6":
+		return nil
+	}
+	return fmt.Errorf("Unsupported backend network %s for %s/%v", o.backendNetwork, backendAddr.Network(), backendAddr)
+}
+
+// network returns the network to dial addr with.
+func (o *options) network(addr net.Addr) string {
+	if o.backendNetwork != "" {
+		return o.backendNetwork
+	}
+	return addr.Network()
+}
+
+// reachable returns the addresses which the pinned network can dial.
+func (o *options) reachable(addrs []net.IPAddr) []net.IPAddr {
+	var ipv4 bool
+	switch o.backendNetwork {
+	case "tcp4", "udp4":
+		ipv4 = true
+	case "tcp6", "udp6":
+	default:
+		return addrs
+	}
+	var result []net.IPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == ipv4 {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package libproxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingDialer dials with a net.Dialer, recording the network and address
+// of every dial.
+type recordingDialer struct {
+	m     sync.Mutex
+	dials []string
+}
+
+func (d *recordingDialer) Dial(network, address string) (net.Conn, error) {
+	d.m.Lock()
+	d.dials = append(d.dials, network+" "+address)
+	d.m.Unlock()
+	return net.Dial(network, address)
+}
+
+func (d *recordingDialer) recorded() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]string(nil), d.dials...)
+}
+
+func TestBackendNetworkValidation(t *testing.T) {
+	tcpBackend := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	udpBackend := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	tcpFrontend := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	udpFrontend := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	for _, tc := range []struct {
+		frontend, backend net.Addr
+		network           string
+		ok                bool
+	}{
+		{tcpFrontend, tcpBackend, "tcp4", true},
+		{tcpFrontend, tcpBackend, "tcp6", true},
+		{tcpFrontend, tcpBackend, "udp4", false},
+		{tcpFrontend, tcpBackend, "tcp5", false},
+		{udpFrontend, udpBackend, "udp", true},
+		{udpFrontend, udpBackend, "tcp", false},
+		{tcpFrontend, &net.UnixAddr{Name: "/tmp/backend.sock", Net: "unix"}, "tcp", false},
+	} {
+		proxy, err := NewIPProxy(tc.frontend, tc.backend, WithBackendNetwork(tc.network))
+		if err == nil {
+			proxy.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("WithBackendNetwork(%q) for %s/%v: unexpected error %v", tc.network, tc.backend.Network(), tc.backend, err)
+		}
+	}
+}
+
+func TestBackendNetworkHostname(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	port := backend.LocalAddr().(*net.TCPAddr).Port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &recordingDialer{}
+	proxy, err := NewTCPProxyHostname(listener, net.JoinHostPort("backend", strconv.Itoa(port)), WithBackendNetwork("tcp4"), WithBackendDialer(dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Resolver = &fakeResolver{addrs: []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.IPv4(127, 0, 0, 1)}}}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	dials := dialer.recorded()
+	if len(dials) != 1 || !strings.HasPrefix(dials[0], "tcp4 127.0.0.1:") {
+		t.Fatalf("Expected a single tcp4 dial of 127.0.0.1 but got %v", dials)
+	}
+}
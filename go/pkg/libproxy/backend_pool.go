@@ -0,0 +1,299 @@
+package libproxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBackendPoolIdleTimeout is how long a pooled backend connection is
+// kept unused unless WithBackendPoolIdleTimeout says otherwise.
+const DefaultBackendPoolIdleTimeout = 90 * time.Second
+
+const (
+	// backendPoolQuiet is how long a backend has to send nothing, once
+	// its client has finished, to be thought done with the client.
+	backendPoolQuiet = 100 * time.Millisecond
+	// backendPoolDrainTimeout is how long a backend can keep sending
+	// once its client has finished before it is closed instead of pooled.
+	backendPoolDrainTimeout = time.Second
+)
+
+// WithBackendPool makes a TCP proxy keep up to size backend connections
+// which its clients have finished with, and hand them to later clients
+// instead of dialing again. This is only safe for protocols which are known
+// to be poolable: ones in which nothing a client does on its connection,
+// including closing it, affects the next client to use it, and the backend
+// never has anything left to send when a client has finished. A client is
+// finished as soon as it closes its side of the connection. What the backend
+// sends after that is still passed on until it has been quiet for
+// backendPoolQuiet, for up to backendPoolDrainTimeout; the backend
+// connection is only pooled if it went quiet and both directions were still
+// healthy. Pooled connections are closed once they have been idle for too
+// long, see WithBackendPoolIdleTimeout, and when the proxy is closed. A
+// backend which closes a pooled connection is only found out by the next
+// client to get it. It can't be combined with
+// WithProxyProtocol, and doesn't apply to proxies whose clients choose their
+// backend.
+func WithBackendPool(size int) Option {
+	return func(o *options) {
+		o.backendPool = size
+	}
+}
+
+// WithBackendPoolIdleTimeout sets how long WithBackendPool keeps an unused
+// backend connection before closing it. 0 keeps them until the proxy is
+// closed.
+func WithBackendPoolIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.backendPoolIdle = d
+	}
+}
+
+// backendPool holds idle backend connections for reuse. A nil pool holds
+// nothing.
+type backendPool struct {
+	m           sync.Mutex
+	size        int
+	idleTimeout time.Duration
+	idle        []*pooledConn // most recently used last
+	closed      bool
+	gen         uint64 // incremented by drain
+}
+
+type pooledConn struct {
+	conn  Conn
+	timer *time.Timer // closes conn once it has been idle too long
+}
+
+func (o *options) newBackendPool() (*backendPool, error) {
+	if o.backendPool <= 0 {
+		return nil, nil
+	}
+	if o.proxyProtocol != 0 {
+		return nil, fmt.Errorf("Can't pool backend connections which start with a PROXY protocol header")
+	}
+	if o.unidirectional {
+		return nil, fmt.Errorf("Can't pool backend connections of a unidirectional proxy")
+	}
+	if o.backendSelector != nil {
+		return nil, fmt.Errorf("Can't pool backend connections chosen by a backend selector")
+	}
+	if o.backendCompression != NoCompression {
+		return nil, fmt.Errorf("Can't pool compressed backend connections")
+	}
+	return &backendPool{size: o.backendPool, idleTimeout: o.backendPoolIdle}, nil
+}
+
+// get returns the most recently used idle connection, or nil if there isn't
+// one.
+func (p *backendPool) get() Conn {
+	if p == nil {
+		return nil
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if pc.timer == nil || pc.timer.Stop() {
+			return pc.conn
+		}
+		// Expiring already: expire closes it.
+	}
+	return nil
+}
+
+// put keeps conn, taken from the pool or dialed at generation gen, for
+// reuse. It returns false, leaving conn to the caller, if the pool is full or
+// closed, or has been drained since.
+func (p *backendPool) put(conn Conn, gen uint64) bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed || gen != p.gen || len(p.idle) >= p.size {
+		return false
+	}
+	pc := &pooledConn{conn: conn}
+	if p.idleTimeout > 0 {
+		pc.timer = time.AfterFunc(p.idleTimeout, func() { p.expire(pc) })
+	}
+	p.idle = append(p.idle, pc)
+	return true
+}
+
+func (p *backendPool) expire(pc *pooledConn) {
+	p.m.Lock()
+	for i, idle := range p.idle {
+		if idle == pc {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			break
+		}
+	}
+	p.m.Unlock()
+	pc.conn.Close()
+}
+
+// count returns the number of idle connections.
+func (p *backendPool) count() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.idle)
+}
+
+// generation returns the pool's generation, which put compares with the
+// one a connection was taken or dialed at.
+func (p *backendPool) generation() uint64 {
+	if p == nil {
+		return 0
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.gen
+}
+
+// drain closes the idle connections and refuses the ones in use when they
+// are put back, but carries on pooling new ones.
+func (p *backendPool) drain() {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.gen++
+	p.closeIdle()
+}
+
+// close closes the idle connections and stops any more being kept.
+func (p *backendPool) close() {
+	if p == nil {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.closed = true
+	p.closeIdle()
+}
+
+// closeIdle closes the idle connections. p.m must be held.
+func (p *backendPool) closeIdle() {
+	for _, pc := range p.idle {
+		if pc.timer != nil {
+			pc.timer.Stop()
+		}
+		pc.conn.Close()
+	}
+	p.idle = nil
+}
+
+// forwardPooled copies traffic both ways between client and backend, like
+// forwardTCP, until the client has finished. The backend is returned to the
+// pool if it is still usable, and closed otherwise.
+func (proxy *TCPProxy) forwardPooled(client, backend Conn, gen uint64, quit chan struct{}, c *connection) error {
+	deadliner, ok := backend.(readDeadliner)
+	if !ok {
+		return forwardTCP(client, backend, quit, c, &proxy.opts)
+	}
+	o := &proxy.opts
+	copyTo := func(to, from Conn, add func(int), done chan<- error) {
+		w, r := o.withDeadlines(&countingWriter{w: to, add: add}, from, to, from)
+		r = c.teeing(r, to == backend)
+		uncork := func() {}
+		if to == backend {
+			uncork = o.corkBackend(to)
+		}
+		source, err := o.copySides(o.withRateLimit(w), r, to == backend)
+		if err == nil || (to == client && isTimeout(err)) {
+			if flushSource, flushErr := flushTo(to, to == backend); flushErr != nil {
+				source, err = flushSource, flushErr
+			}
+		}
+		uncork()
+		// Reading from the backend is interrupted with a deadline
+		// once the client has finished.
+		if err != nil && !(to == client && isTimeout(err)) {
+			select {
+			case <-quit:
+			default:
+				c.copyFailed(source)
+			}
+		}
+		done <- err
+	}
+	toBackend := make(chan error, 1)
+	toClient := make(chan error, 1)
+	go copyTo(backend, client, c.addToBackend, toBackend)
+	go copyTo(client, backend, c.addToFrontend, toClient)
+
+	select {
+	case err := <-toBackend:
+		// The client has finished: stop reading from the backend once
+		// it has gone quiet.
+		quiet, backendErr := drainPooled(deadliner, toClient, c)
+		if err == nil && isTimeout(backendErr) && quiet {
+			deadliner.SetReadDeadline(time.Time{})
+			if proxy.pool.put(backend, gen) {
+				return nil
+			}
+		} else if err == nil && !isTimeout(backendErr) {
+			err = backendErr
+		}
+		backend.Close()
+		return err
+	case err := <-toClient:
+		// The backend has finished or failed, so it can't be reused.
+		client.CloseWrite()
+		select {
+		case clientErr := <-toBackend:
+			if err == nil {
+				err = clientErr
+			}
+		case <-quit:
+			client.Close()
+			backend.Close()
+			<-toBackend
+		}
+		backend.Close()
+		return err
+	case <-quit:
+		client.Close()
+		backend.Close()
+		<-toBackend
+		<-toClient
+		return nil
+	}
+}
+
+// drainPooled waits for the copy from a backend, whose client has finished,
+// to return its error on toClient. The copy carries on until the backend has
+// sent nothing for backendPoolQuiet, and is then interrupted with a read
+// deadline, which is set again on every tick in case a rolling read deadline
+// pushed it back. It returns whether the backend went quiet, rather than
+// still sending when backendPoolDrainTimeout ran out, along with the error.
+func drainPooled(deadliner readDeadliner, toClient <-chan error, c *connection) (bool, error) {
+	start := time.Now()
+	limit := start.Add(backendPoolDrainTimeout)
+	sent := atomic.LoadUint64(&c.bytesToFrontend)
+	last := start
+	ticker := time.NewTicker(backendPoolQuiet / 10)
+	defer ticker.Stop()
+	for {
+		if n := atomic.LoadUint64(&c.bytesToFrontend); n != sent {
+			sent, last = n, time.Now()
+		}
+		quietAt := last.Add(backendPoolQuiet)
+		deadline := quietAt
+		if deadline.After(limit) {
+			deadline = limit
+		}
+		deadliner.SetReadDeadline(deadline)
+		select {
+		case err := <-toClient:
+			if n := atomic.LoadUint64(&c.bytesToFrontend); n != sent {
+				last = time.Now()
+			}
+			return !last.Add(backendPoolQuiet).After(limit), err
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package libproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingEchoServer echoes on every connection it accepts, counting them,
+// and reports each connection closing on closed.
+func countingEchoServer(t *testing.T) (net.Listener, *int32, chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	closed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return listener, &accepted, closed
+}
+
+func TestBackendPool(t *testing.T) {
+	backend, accepted, _ := countingEchoServer(t)
+	defer backend.Close()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendPool(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	tcp := proxy.(*TCPProxy)
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+		waitFor(t, func() bool { return tcp.pool.count() == 1 }, func() string {
+			return fmt.Sprintf("Expected 1 pooled connections but got %d", tcp.pool.count())
+		})
+	}
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatalf("Expected one backend connection to be reused but %d were made", n)
+	}
+	if stats := proxy.Stats(); stats.TotalConns != 3 {
+		t.Fatalf("Expected 3 frontend connections but got %+v", stats)
+	}
+}
+
+func TestBackendPoolSize(t *testing.T) {
+	backend, accepted, closed := countingEchoServer(t)
+	defer backend.Close()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendPool(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		clients = append(clients, client)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Fatalf("Expected 2 backend connections but got %d", n)
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+	// Only one fits in the pool: the other is closed.
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the backend connection which didn't fit to be closed")
+	}
+	waitFor(t, func() bool { return proxy.(*TCPProxy).pool.count() == 1 }, func() string {
+		return fmt.Sprintf("Expected 1 pooled connections but got %d", proxy.(*TCPProxy).pool.count())
+	})
+
+	// Closing the proxy closes the pooled one too.
+	proxy.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the pooled connection to be closed with the proxy")
+	}
+}
+
+func TestBackendPoolIdleTimeout(t *testing.T) {
+	backend, _, closed := countingEchoServer(t)
+	defer backend.Close()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendPool(1), WithBackendPoolIdleTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the idle pooled connection to be closed")
+	}
+	waitFor(t, func() bool { return proxy.(*TCPProxy).pool.count() == 0 }, func() string {
+		return fmt.Sprintf("Expected 0 pooled connections but got %d", proxy.(*TCPProxy).pool.count())
+	})
+}
+
+func TestBackendPoolBackendCloses(t *testing.T) {
+	// A backend which answers once and then closes can't be reused.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, testBufSize)
+			if _, err := io.ReadFull(conn, buf); err == nil {
+				conn.Write(buf)
+			}
+			conn.Close()
+		}
+	}()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendPool(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	// The backend's EOF is passed on.
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 0 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", proxy.Stats()) })
+	if n := proxy.(*TCPProxy).pool.count(); n != 0 {
+		t.Fatalf("Expected nothing to be pooled but got %d", n)
+	}
+}
+
+func TestBackendPoolDrainsAfterHalfClose(t *testing.T) {
+	// A backend which replies a little after the client has finished
+	// writing still gets its reply through, and is then pooled.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, testBufSize)
+				for {
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					time.Sleep(backendPoolQuiet / 5)
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendPool(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	conn, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := conn.(*net.TCPConn)
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, testBufSize)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("Expected the reply sent after the half-close: %s", err)
+	}
+	waitFor(t, func() bool { return proxy.(*TCPProxy).pool.count() == 1 }, func() string {
+		return fmt.Sprintf("Expected 1 pooled connections but got %d", proxy.(*TCPProxy).pool.count())
+	})
+}
+
+func TestBackendPoolProxyProtocol(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	if _, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithBackendPool(1), WithProxyProtocol(1)); err == nil {
+		t.Fatal("Expected pooling to be refused with the PROXY protocol")
+	}
+}
@@ -0,0 +1,98 @@
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// udpProbeWait is how long WithBackendProbe waits for a UDP backend to
+// refuse its probe.
+const udpProbeWait = 100 * time.Millisecond
+
+// WithBackendProbe makes the constructor of a TCP or UDP proxy connect to
+// its backend once, and fail if it can't, so that a backend which isn't
+// listening is found out before the first client. The connection is closed
+// straight away, within the dial timeout of WithDialTimeout. A UDP backend
+// can only be probed by sending it an empty datagram: it is taken to be
+// listening unless it answers within 100ms, or the dial timeout if shorter,
+// with an ICMP port unreachable. Proxies created with NewTCPProxyMulti need
+// one of their backends to answer. Backends given as host names, which may
+// not resolve yet, and the ones chosen for each connection aren't probed.
+func WithBackendProbe() Option {
+	return func(o *options) {
+		o.backendProbe = true
+	}
+}
+
+// withoutBackendProbe stops a constructor probing the backend which its
+// caller is going to probe itself.
+func withoutBackendProbe() Option {
+	return func(o *options) {
+		o.backendProbe = false
+	}
+}
+
+// probeStream connects to the stream backend addr, unless it is the nil
+// placeholder of a proxy whose backend is chosen later.
+func (o *options) probeStream(addr net.Addr) error {
+	if !o.backendProbe || o.originalDst || o.backendSelector != nil {
+		return nil
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); addr == nil || ok && tcpAddr == nil {
+		return nil
+	}
+	conn, err := o.dialStreamContext(context.Background(), addr)
+	if err != nil {
+		return fmt.Errorf("Can't reach backend %s/%v: %s", addr.Network(), addr, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// probeDatagram opens a socket to the datagram backend addr and, for UDP,
+// waits briefly for it to be refused.
+func (o *options) probeDatagram(addr net.Addr) error {
+	if !o.backendProbe {
+		return nil
+	}
+	conn, err := o.dialDatagram(addr, &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return fmt.Errorf("Can't reach backend %s/%v: %s", addr.Network(), addr, err)
+	}
+	defer conn.Close()
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return nil
+	}
+	wait := udpProbeWait
+	if o.dialTimeout > 0 && o.dialTimeout < wait {
+		wait = o.dialTimeout
+	}
+	if _, err := conn.Write(nil); err != nil {
+		return fmt.Errorf("Can't reach backend %s/%v: %s", addr.Network(), addr, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	if _, err := conn.Read(make([]byte, 1)); bindErrno(err) == syscall.ECONNREFUSED {
+		return fmt.Errorf("Can't reach backend %s/%v: %s", addr.Network(), addr, err)
+	}
+	return nil
+}
+
+// probeMulti connects to each of backends in turn until one of them
+// answers.
+func (o *options) probeMulti(backends []*net.TCPAddr) error {
+	if !o.backendProbe {
+		return nil
+	}
+	var errs multiError
+	for _, backend := range backends {
+		err := o.probeStream(backend)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errs
+}
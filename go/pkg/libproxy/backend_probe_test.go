@@ -0,0 +1,85 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func unusedUDPAddr(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestBackendProbe(t *testing.T) {
+	tcpBackend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer tcpBackend.Close()
+	tcpBackend.Run()
+	udpBackend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer udpBackend.Close()
+	udpBackend.Run()
+	tcpFrontend := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	udpFrontend := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	for _, addrs := range [][2]net.Addr{{tcpFrontend, tcpBackend.LocalAddr()}, {udpFrontend, udpBackend.LocalAddr()}} {
+		proxy, err := NewIPProxy(addrs[0], addrs[1], WithBackendProbe())
+		if err != nil {
+			t.Fatalf("Expected %s/%v to answer the probe but got %s", addrs[1].Network(), addrs[1], err)
+		}
+		proxy.Close()
+	}
+	for _, addrs := range [][2]net.Addr{{tcpFrontend, unusedTCPAddr(t)}, {udpFrontend, unusedUDPAddr(t)}} {
+		if proxy, err := NewIPProxy(addrs[0], addrs[1], WithBackendProbe()); err == nil {
+			proxy.Close()
+			t.Fatalf("Expected the probe of %s/%v to fail", addrs[1].Network(), addrs[1])
+		}
+		// Without the probe the proxy starts regardless.
+		proxy, err := NewIPProxy(addrs[0], addrs[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.Close()
+	}
+}
+
+func TestBackendProbeMulti(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	for _, test := range []struct {
+		backends []*net.TCPAddr
+		ok       bool
+	}{
+		{[]*net.TCPAddr{unusedTCPAddr(t), backend.LocalAddr().(*net.TCPAddr)}, true},
+		{[]*net.TCPAddr{unusedTCPAddr(t), unusedTCPAddr(t)}, false},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := NewTCPProxyMulti(listener, test.backends, WithBackendProbe())
+		if (err == nil) != test.ok {
+			t.Fatalf("Expected success %v probing %v but got %v", test.ok, test.backends, err)
+		}
+		if err == nil {
+			proxy.Close()
+		}
+		listener.Close()
+	}
+}
+
+func TestBackendProbeSkipsHostnames(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	proxy, err := NewTCPProxyHostname(listener, "backend.invalid:80", WithBackendProbe())
+	if err != nil {
+		t.Fatalf("Expected a host name backend not to be probed but got %s", err)
+	}
+	proxy.Close()
+}
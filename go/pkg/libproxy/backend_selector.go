@@ -0,0 +1,108 @@
+package libproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// WithBackendSelector makes a TCP proxy call fn for every accepted
+// connection to choose the backend to forward it to, for example from the
+// client's address or from the first bytes it sends. fn may read from
+// frontendConn, or look ahead without reading with its Peeker interface:
+// either way what the client sent is still forwarded to the backend. It
+// should clear any deadline it sets. Returning a nil address uses the
+// proxy's own backend; returning an error closes the connection and logs the
+// error. TCP addresses chosen are checked against WithAllowDestinationCIDRs
+// and WithDenyDestinationCIDRs. Proxies whose clients choose their own
+// backend, such as SOCKS5 proxies, don't call fn. The selector can't be
+// combined with WithBackendPool.
+func WithBackendSelector(fn func(frontendConn net.Conn) (net.Addr, error)) Option {
+	return func(o *options) {
+		o.backendSelector = fn
+	}
+}
+
+// Peeker is implemented by the connection given to a backend selector. Peek
+// returns the first n bytes the client sent after those already read,
+// without reading them. It waits for up to timeout for them to arrive; if
+// they don't, or the client stops sending, it returns what did arrive along
+// with the timeout error or io.EOF. A timeout of 0 means no timeout.
+type Peeker interface {
+	Peek(n int, timeout time.Duration) ([]byte, error)
+}
+
+// selectingConn is the net.Conn given to a backend selector. It keeps what
+// is read from it so that it can be forwarded once the backend is chosen.
+type selectingConn struct {
+	net.Conn
+	received []byte // everything read from Conn so far
+	off      int    // how much of received the selector has read
+}
+
+func (s *selectingConn) Read(b []byte) (int, error) {
+	if s.off < len(s.received) {
+		n := copy(b, s.received[s.off:])
+		s.off += n
+		return n, nil
+	}
+	n, err := s.Conn.Read(b)
+	s.received = append(s.received, b[:n]...)
+	s.off += n
+	return n, err
+}
+
+func (s *selectingConn) Peek(n int, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		s.Conn.SetReadDeadline(time.Now().Add(timeout))
+		defer s.Conn.SetReadDeadline(time.Time{})
+	}
+	buf := make([]byte, 4096)
+	for len(s.received)-s.off < n {
+		read, err := s.Conn.Read(buf)
+		s.received = append(s.received, buf[:read]...)
+		if err != nil {
+			return append([]byte(nil), s.received[s.off:]...), err
+		}
+	}
+	return append([]byte(nil), s.received[s.off:s.off+n]...), nil
+}
+
+// selectBackend asks the backend selector where client should go and
+// connects to it. accepted is stopped once the selector has returned. The
+// returned client replays what the selector read.
+func (proxy *TCPProxy) selectBackend(ctx context.Context, c *connection, client Conn, accepted *acceptTimer) (Conn, Conn, error) {
+	conn, ok := client.(net.Conn)
+	if !ok {
+		return nil, nil, fmt.Errorf("Can't choose a backend for %v: not a net.Conn", remoteAddr(client))
+	}
+	selecting := &selectingConn{Conn: conn}
+	addr, err := proxy.opts.backendSelector(selecting)
+	if err != nil {
+		err = fmt.Errorf("Can't choose a backend for %v: %s", remoteAddr(client), err)
+	}
+	if err = accepted.end(err); err != nil {
+		return nil, nil, err
+	}
+	if len(selecting.received) > 0 {
+		client = &bufferedConn{Conn: client, r: bufio.NewReader(io.MultiReader(bytes.NewReader(selecting.received), client))}
+	}
+	if addr == nil {
+		backend, err := proxy.dialBackendWithRetry(ctx)
+		c.dialFailed = err != nil
+		return client, backend, err
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok && !proxy.opts.destinations.permits(tcp.IP) {
+		return nil, nil, fmt.Errorf("Can't forward traffic from %v to backend %s/%v: %s", remoteAddr(client), addr.Network(), addr, errNotPermitted)
+	}
+	backend, err := proxy.opts.dialStreamContext(ctx, addr)
+	if err != nil {
+		c.dialFailed = true
+		return nil, nil, fmt.Errorf("Can't forward traffic to backend %s/%v: %s", addr.Network(), addr, err)
+	}
+	return client, backend, nil
+}
@@ -0,0 +1,179 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendSelector(t *testing.T) {
+	static := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer static.Close()
+	static.Run()
+	chosen := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer chosen.Close()
+	chosen.Run()
+	opened := make(chan net.Addr, 2)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, static.LocalAddr(), WithBackendSelector(func(conn net.Conn) (net.Addr, error) {
+		// Route on the first byte, which must still reach the backend.
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(conn, first); err != nil {
+			return nil, err
+		}
+		if first[0] == 'c' {
+			return chosen.LocalAddr(), nil
+		}
+		return nil, nil
+	}), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnOpened {
+			opened <- e.BackendAddr
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	for _, test := range []struct {
+		message string
+		backend net.Addr
+	}{
+		{"chosen backend", chosen.LocalAddr()},
+		{"static backend", static.LocalAddr()},
+	} {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := client.Write([]byte(test.message)); err != nil {
+			t.Fatal(err)
+		}
+		echoed := make([]byte, len(test.message))
+		if _, err := io.ReadFull(client, echoed); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		if !bytes.Equal(echoed, []byte(test.message)) {
+			t.Fatalf("Expected %q to be echoed but got %q", test.message, echoed)
+		}
+		if backend := <-opened; backend.String() != test.backend.String() {
+			t.Fatalf("Expected %q to go to %v but it went to %v", test.message, test.backend, backend)
+		}
+	}
+}
+
+func TestBackendSelectorError(t *testing.T) {
+	logger := &recordingLogger{}
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithLogger(logger), WithBackendSelector(func(conn net.Conn) (net.Addr, error) {
+		return nil, errors.New("no route for this client")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but got %v", err)
+	}
+	logger.waitFor(t, "no route for this client")
+
+	if _, err := NewIPProxy(frontendAddr, proxy.BackendAddr(), WithBackendPool(1), WithBackendSelector(func(net.Conn) (net.Addr, error) { return nil, nil })); err == nil {
+		t.Fatal("Expected WithBackendPool and WithBackendSelector to be refused together")
+	}
+}
+
+func TestBackendSelectorPeekSNI(t *testing.T) {
+	static := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer static.Close()
+	static.Run()
+	chosen := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer chosen.Close()
+	chosen.Run()
+	opened := make(chan net.Addr, 1)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, static.LocalAddr(), WithBackendSelector(func(conn net.Conn) (net.Addr, error) {
+		peeker := conn.(Peeker)
+		header, err := peeker.Peek(5, time.Second)
+		if err != nil {
+			return nil, err
+		}
+		hello, err := peeker.Peek(5+int(binary.BigEndian.Uint16(header[3:])), time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if name, err := ParseTLSClientHelloSNI(hello); err != nil || name != "chosen.example.com" {
+			return nil, err
+		}
+		return chosen.LocalAddr(), nil
+	}), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnOpened {
+			opened <- e.BackendAddr
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	// The peeked ClientHello reaches the backend, and is echoed, unchanged.
+	hello := clientHello(t, "chosen.example.com")
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len(hello))
+	if _, err := io.ReadFull(client, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, hello) {
+		t.Fatal("Expected the ClientHello to be forwarded unchanged")
+	}
+	if backend := <-opened; backend.String() != chosen.LocalAddr().String() {
+		t.Fatalf("Expected the connection to go to %v but it went to %v", chosen.LocalAddr(), backend)
+	}
+}
+
+func TestBackendSelectorPeekTimeout(t *testing.T) {
+	logger := &recordingLogger{}
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithLogger(logger), WithBackendSelector(func(conn net.Conn) (net.Addr, error) {
+		_, err := conn.(Peeker).Peek(1, 100*time.Millisecond)
+		return nil, err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	// A client which sends nothing is given up on after the timeout.
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed but got %v", err)
+	}
+	logger.waitFor(t, "timeout")
+}
@@ -0,0 +1,219 @@
+package libproxy
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultBindRetryInterval is how often a proxy created with
+// NewDeferredIPProxy tries to bind again unless WithBindRetryInterval is
+// given.
+const DefaultBindRetryInterval = time.Second
+
+// WithBindRetryInterval sets how often a proxy created with
+// NewDeferredIPProxy tries to bind its frontend again while it can't.
+func WithBindRetryInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.bindRetryInterval = d
+	}
+}
+
+// DeferredProxy is a Proxy whose frontend is bound in the background once
+// its address is available. See NewDeferredIPProxy.
+type DeferredProxy struct {
+	host, container net.Addr
+	opts            []Option
+	o               options
+	ready           chan struct{} // closed once bound
+	quit            chan struct{} // closed by Close
+	done            chan struct{} // closed once stopped
+	closeOnce       sync.Once
+	m               sync.Mutex
+	proxy           Proxy // set once bound
+	closed          bool
+	err             error // why the retries gave up
+}
+
+// NewDeferredIPProxy creates a Proxy like NewIPProxy which, if host can't be
+// bound yet because the address doesn't exist in the VM, its address family
+// isn't configured or the port is still in use, keeps trying to bind it in
+// the background rather than failing as NewIPProxy does or giving up as
+// NewBestEffortIPProxy does. This handles VMs whose interface addresses are
+// configured shortly after the proxy is created. Ready is closed once host is
+// bound, and Run starts forwarding from then on. Close stops the retries
+// whether or not host was ever bound. Other errors are returned straight
+// away.
+func NewDeferredIPProxy(host net.Addr, container net.Addr, opts ...Option) (*DeferredProxy, error) {
+	p := &DeferredProxy{
+		host:      host,
+		container: container,
+		opts:      opts,
+		o:         newOptions(opts),
+		ready:     make(chan struct{}),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if p.o.bindRetryInterval <= 0 {
+		p.o.bindRetryInterval = DefaultBindRetryInterval
+	}
+	proxy, err := NewIPProxy(host, container, opts...)
+	if err == nil {
+		p.bound(proxy)
+		return p, nil
+	}
+	if !transientBindError(err) {
+		return nil, err
+	}
+	p.o.logf("Can't bind %s/%v yet, retrying every %s: %s", host.Network(), host, p.o.bindRetryInterval, err)
+	go p.retry()
+	return p, nil
+}
+
+// transientBindError reports whether err may go away by itself.
+func transientBindError(err error) bool {
+	switch bindErrno(err) {
+	case syscall.EADDRNOTAVAIL, syscall.EAFNOSUPPORT, syscall.EADDRINUSE:
+		return true
+	}
+	return false
+}
+
+func (p *DeferredProxy) retry() {
+	ticker := time.NewTicker(p.o.bindRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.quit:
+			close(p.done)
+			return
+		}
+		proxy, err := NewIPProxy(p.host, p.container, p.opts...)
+		if err == nil {
+			p.o.logf("Bound %s/%v", p.host.Network(), p.host)
+			p.bound(proxy)
+			return
+		}
+		if !transientBindError(err) {
+			p.m.Lock()
+			p.err = err
+			p.m.Unlock()
+			p.Close()
+			close(p.done)
+			return
+		}
+	}
+}
+
+// bound makes proxy the one which forwards the traffic, unless p has been
+// closed meanwhile.
+func (p *DeferredProxy) bound(proxy Proxy) {
+	p.m.Lock()
+	if p.closed {
+		p.m.Unlock()
+		proxy.Close()
+		close(p.done)
+		return
+	}
+	p.proxy = proxy
+	p.m.Unlock()
+	close(p.ready)
+	go func() {
+		<-proxy.Done()
+		close(p.done)
+	}()
+}
+
+// current returns the proxy once host is bound, or nil.
+func (p *DeferredProxy) current() Proxy {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.proxy
+}
+
+// Ready returns a channel which is closed once the frontend is bound. It is
+// the same channel on every call.
+func (p *DeferredProxy) Ready() <-chan struct{} { return p.ready }
+
+// Run waits for the frontend to be bound and then forwards traffic until the
+// proxy is closed. If it is closed before the frontend is bound Run returns
+// nil, unless the retries gave up on an error which won't go away by itself,
+// which it returns.
+func (p *DeferredProxy) Run() error {
+	select {
+	case <-p.ready:
+		return p.current().Run()
+	case <-p.quit:
+		p.m.Lock()
+		defer p.m.Unlock()
+		return p.err
+	}
+}
+
+// Close stops the retries, or the proxy once it is bound.
+func (p *DeferredProxy) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		p.m.Lock()
+		p.closed = true
+		proxy := p.proxy
+		p.m.Unlock()
+		close(p.quit)
+		if proxy != nil {
+			err = proxy.Close()
+		}
+	})
+	return err
+}
+
+// Wait blocks until the proxy has stopped: once bound, as for the proxy
+// doing the forwarding, and otherwise once closed.
+func (p *DeferredProxy) Wait() { <-p.done }
+
+// Done returns a channel which is closed when Wait would return.
+func (p *DeferredProxy) Done() <-chan struct{} { return p.done }
+
+// FrontendAddr returns the bound address once the frontend is bound, and
+// the address it will be bound to until then.
+func (p *DeferredProxy) FrontendAddr() net.Addr {
+	if proxy := p.current(); proxy != nil {
+		return proxy.FrontendAddr()
+	}
+	return p.host
+}
+
+// BackendAddr returns the backend address.
+func (p *DeferredProxy) BackendAddr() net.Addr {
+	if proxy := p.current(); proxy != nil {
+		return proxy.BackendAddr()
+	}
+	return p.container
+}
+
+// BackendAddrs returns the backend address.
+func (p *DeferredProxy) BackendAddrs() []net.Addr {
+	if proxy := p.current(); proxy != nil {
+		return proxy.BackendAddrs()
+	}
+	return []net.Addr{p.container}
+}
+
+// Stats returns the stats of the proxy once the frontend is bound, and
+// empty ones until then.
+func (p *DeferredProxy) Stats() ProxyStats {
+	if proxy := p.current(); proxy != nil {
+		return proxy.Stats()
+	}
+	return ProxyStats{Tag: p.o.tag}
+}
+
+// Connections returns the connections being forwarded, none until the
+// frontend is bound.
+func (p *DeferredProxy) Connections() []ConnInfo {
+	if proxy := p.current(); proxy != nil {
+		return proxy.Connections()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeferredIPProxy(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	// Hold the frontend port so that the first attempts fail.
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontendAddr := blocker.Addr()
+	logger := &recordingLogger{}
+	proxy, err := NewDeferredIPProxy(frontendAddr, backend.LocalAddr(), WithBindRetryInterval(10*time.Millisecond), WithLogger(logger))
+	if err != nil {
+		blocker.Close()
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	ran := make(chan error, 1)
+	go func() { ran <- proxy.Run() }()
+	logger.waitFor(t, "retrying every 10ms")
+	select {
+	case <-proxy.Ready():
+		t.Fatal("Ready while the port was in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if proxy.FrontendAddr() != frontendAddr || proxy.BackendAddr() != backend.LocalAddr() {
+		t.Fatalf("Expected the configured addresses but got %v and %v", proxy.FrontendAddr(), proxy.BackendAddr())
+	}
+	blocker.Close()
+	select {
+	case <-proxy.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Not ready once the port was free")
+	}
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	client.Close()
+	if stats := proxy.Stats(); stats.TotalConns != 1 {
+		t.Fatalf("Expected the bound proxy's stats but got %+v", stats)
+	}
+	proxy.Close()
+	if err := <-ran; err != nil {
+		t.Fatalf("Expected Run to return nil after Close but got %s", err)
+	}
+	waitReturns(t, proxy)
+}
+
+func TestDeferredIPProxyBindsStraightAway(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewDeferredIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	select {
+	case <-proxy.Ready():
+	default:
+		t.Fatal("Expected to be ready straight away")
+	}
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+}
+
+func TestDeferredIPProxyCloseBeforeBinding(t *testing.T) {
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	proxy, err := NewDeferredIPProxy(blocker.Addr(), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithBindRetryInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- proxy.Run() }()
+	proxy.Close()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil after Close but got %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after Close")
+	}
+	waitReturns(t, proxy)
+	// The port is never bound once closed.
+	blocker.Close()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-proxy.Ready():
+		t.Fatal("Bound after Close")
+	default:
+	}
+}
+
+func TestDeferredIPProxyOtherErrors(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if _, err := NewDeferredIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithCork(), WithNoDelay(true)); err == nil {
+		t.Fatal("Expected conflicting options to fail straight away")
+	}
+}
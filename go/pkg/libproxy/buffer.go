@@ -0,0 +1,45 @@
+package libproxy
+
+import (
+	"io"
+	"sync"
+)
+
+// WithBufferSize makes a TCP proxy copy each direction of a connection
+// through a buffer of n bytes rather than io.Copy's default of 32KB. Larger
+// buffers mean fewer, larger writes on fast links. Buffers are pooled and
+// shared between all proxies using the same size.
+func WithBufferSize(n int) Option {
+	return func(o *options) {
+		o.bufferSize = n
+	}
+}
+
+// bufferPools maps a buffer size to the *sync.Pool of buffers of that size.
+var bufferPools sync.Map
+
+func bufferPool(size int) *sync.Pool {
+	if pool, ok := bufferPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	})
+	return pool.(*sync.Pool)
+}
+
+// copyBuffered copies from r to w using a pooled buffer of the configured
+// size, or plain io.Copy if no size is configured.
+func (o *options) copyBuffered(w io.Writer, r io.Reader) (int64, error) {
+	if o.bufferSize <= 0 {
+		return io.Copy(w, r)
+	}
+	pool := bufferPool(o.bufferSize)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	// Hide any WriterTo on r, which would make io.CopyBuffer ignore buf.
+	return io.CopyBuffer(w, struct{ io.Reader }{r}, *buf)
+}
@@ -0,0 +1,95 @@
+package libproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestTCPProxyBufferSize(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithBufferSize(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sent := bytes.Repeat(testBuf, 100)
+	go client.Write(sent)
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(client, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Fatal("Data was corrupted by a small copy buffer")
+	}
+}
+
+func TestBufferPoolSizes(t *testing.T) {
+	for _, size := range []int{1024, 4096} {
+		buf := bufferPool(size).Get().(*[]byte)
+		if len(*buf) != size {
+			t.Fatalf("Expected a buffer of %d bytes but got %d", size, len(*buf))
+		}
+		bufferPool(size).Put(buf)
+	}
+}
+
+func benchmarkTCPTransfer(b *testing.B, opts ...Option) {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, sink.Addr(), opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	chunk := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTCPTransferDefaultBuffer(b *testing.B) {
+	benchmarkTCPTransfer(b)
+}
+
+func BenchmarkTCPTransfer256KBuffer(b *testing.B) {
+	benchmarkTCPTransfer(b, WithBufferSize(256*1024))
+}
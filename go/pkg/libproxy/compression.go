@@ -0,0 +1,206 @@
+package libproxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Compression is a streaming codec for WithBackendCompression and
+// WithFrontendCompression.
+type Compression int
+
+const (
+	// NoCompression leaves the connection as it is.
+	NoCompression Compression = iota
+	// GzipCompression compresses with gzip, which is always available.
+	GzipCompression
+	// ZstdCompression compresses with zstd, which compresses about as well
+	// as gzip for much less CPU.
+	ZstdCompression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case GzipCompression:
+		return "gzip"
+	case ZstdCompression:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// WithBackendCompression makes a TCP proxy compress what it sends to the
+// backend with codec, and decompress what the backend sends back, for
+// example to save bandwidth on a slow link between the host and a VM. The
+// backend must therefore be another proxy given WithFrontendCompression with
+// the same codec, which undoes it: the two are a matched pair, and nothing
+// else can make sense of the connection. Each write is flushed as it is
+// made, so interactive protocols aren't held up, and closing the connection
+// for writing ends the compressed stream first, so that nothing is lost.
+//
+// Only the payload is compressed: a PROXY protocol header, the request made
+// to a SOCKS5 or HTTP CONNECT proxy and what a backend selector peeks at are
+// sent as they are. Stats and events count the bytes before compression. It
+// can't be combined with WithBackendPool.
+func WithBackendCompression(codec Compression) Option {
+	return func(o *options) {
+		o.backendCompression = codec
+	}
+}
+
+// WithFrontendCompression makes a TCP proxy decompress what its clients send
+// with codec, and compress what it sends back to them. It is the other half
+// of WithBackendCompression, and its clients must be proxies given that with
+// the same codec.
+func WithFrontendCompression(codec Compression) Option {
+	return func(o *options) {
+		o.frontendCompression = codec
+	}
+}
+
+// checkCompression returns an error if a codec can't be used.
+func (o *options) checkCompression() error {
+	for _, codec := range []Compression{o.backendCompression, o.frontendCompression} {
+		if codec < NoCompression || codec > ZstdCompression {
+			return fmt.Errorf("Unsupported compression %s", codec)
+		}
+	}
+	return nil
+}
+
+// compress wraps the client and backend of a connection in the codecs given
+// with WithFrontendCompression and WithBackendCompression.
+func (o *options) compress(client, backend Conn) (Conn, Conn) {
+	if o.frontendCompression != NoCompression {
+		client = &compressedConn{Conn: client, codec: o.frontendCompression}
+	}
+	if o.backendCompression != NoCompression {
+		backend = &compressedConn{Conn: backend, codec: o.backendCompression}
+	}
+	return client, backend
+}
+
+// compressor is a streaming compressor, such as a *gzip.Writer.
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+func (c Compression) newWriter(w io.Writer) (compressor, error) {
+	if c == ZstdCompression {
+		return newZstdWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	if c == ZstdCompression {
+		return newZstdReader(r)
+	}
+	return gzip.NewReader(r)
+}
+
+// compressedConn is a Conn whose traffic is compressed with codec. The
+// compressor and decompressor are made by the first Write and Read, so that
+// creating the connection doesn't wait for the other end, and are closed
+// along with the connection.
+type compressedConn struct {
+	Conn
+	codec   Compression
+	rm      sync.Mutex // held while reading
+	r       io.ReadCloser
+	rClosed bool
+	wm      sync.Mutex // held while writing
+	w       compressor
+	wClosed bool
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	if c.rClosed {
+		return 0, net.ErrClosed
+	}
+	if c.r == nil {
+		r, err := c.codec.newReader(c.Conn)
+		if err != nil {
+			if err == io.EOF {
+				// The other end closed without sending anything.
+				return 0, io.EOF
+			}
+			return 0, fmt.Errorf("Can't decompress %s stream: %s", c.codec, err)
+		}
+		c.r = r
+	}
+	return c.r.Read(b)
+}
+
+// writer returns the compressor, with wm held.
+func (c *compressedConn) writer() (compressor, error) {
+	if c.wClosed {
+		return nil, net.ErrClosed
+	}
+	if c.w == nil {
+		w, err := c.codec.newWriter(c.Conn)
+		if err != nil {
+			return nil, fmt.Errorf("Can't compress with %s: %s", c.codec, err)
+		}
+		c.w = w
+	}
+	return c.w, nil
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	w, err := c.writer()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	if err == nil {
+		err = w.Flush()
+	}
+	return n, err
+}
+
+// CloseWrite ends the compressed stream, so that the other end sees all of
+// it, and then shuts down the write side of the connection.
+func (c *compressedConn) CloseWrite() error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	w, err := c.writer()
+	if err != nil {
+		return err
+	}
+	c.wClosed = true
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Conn.CloseWrite()
+}
+
+// Close closes the connection first, so that a Read or Write blocked on it
+// returns, and then the compressor and decompressor.
+func (c *compressedConn) Close() error {
+	err := c.Conn.Close()
+	c.rm.Lock()
+	if c.r != nil && !c.rClosed {
+		c.r.Close()
+	}
+	c.rClosed = true
+	c.rm.Unlock()
+	c.wm.Lock()
+	if c.w != nil && !c.wClosed {
+		c.w.Close()
+	}
+	c.wClosed = true
+	c.wm.Unlock()
+	return err
+}
@@ -0,0 +1,169 @@
+package libproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// compressedPair starts a proxy with WithBackendCompression, near, in front
+// of one with WithFrontendCompression, far, which forwards to backendAddr.
+func compressedPair(t *testing.T, codec Compression, backendAddr *net.TCPAddr) (near, far *TCPProxy) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	far, err = NewTCPProxy(listener, backendAddr, WithFrontendCompression(codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go far.Run()
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	near, err = NewTCPProxy(listener, far.FrontendAddr().(*net.TCPAddr), WithBackendCompression(codec))
+	if err != nil {
+		far.Close()
+		t.Fatal(err)
+	}
+	go near.Run()
+	return near, far
+}
+
+var testCompressions = []Compression{GzipCompression, ZstdCompression}
+
+func TestBackendCompression(t *testing.T) {
+	for _, codec := range testCompressions {
+		t.Run(codec.String(), func(t *testing.T) {
+			backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+			defer backend.Close()
+			backend.Run()
+			proxy, far := compressedPair(t, codec, backend.LocalAddr().(*net.TCPAddr))
+			defer far.Close()
+			defer proxy.Close()
+			client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			roundTrip(t, client)
+			roundTrip(t, client)
+			// The bytes counted are those before compression.
+			var stats ProxyStats
+			waitFor(t, func() bool {
+				stats = proxy.Stats()
+				return stats.BytesToBackend == uint64(2*testBufSize) && stats.BytesToFrontend == uint64(2*testBufSize)
+			}, func() string {
+				return fmt.Sprintf("Timed out waiting for %d bytes each way in %+v", 2*testBufSize, stats)
+			})
+		})
+	}
+}
+
+func TestBackendCompressionHalfClose(t *testing.T) {
+	for _, codec := range testCompressions {
+		t.Run(codec.String(), func(t *testing.T) {
+			testBackendCompressionHalfClose(t, codec)
+		})
+	}
+}
+
+func testBackendCompressionHalfClose(t *testing.T, codec Compression) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	replyAfterEOF(t, backend)
+	proxy, far := compressedPair(t, codec, backend.Addr().(*net.TCPAddr))
+	defer far.Close()
+	defer proxy.Close()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	// Everything written before the half-close reaches the backend, and
+	// everything it replies with reaches the client.
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]byte(nil), testBuf...), "done"...)
+	if !bytes.Equal(reply, expected) {
+		t.Fatalf("Expected %q but got %q", expected, reply)
+	}
+}
+
+func TestBackendCompressionIsGzip(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, backend.Addr().(*net.TCPAddr), WithBackendCompression(GzipCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r, err := gzip.NewReader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, testBufSize)
+	if _, err := io.ReadFull(r, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, testBuf) {
+		t.Fatalf("Expected %q but got %q", testBuf, received)
+	}
+}
+
+func TestCompressionOptions(t *testing.T) {
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	for _, opts := range [][]Option{
+		{WithBackendCompression(GzipCompression), WithBackendPool(1)},
+		{WithFrontendCompression(Compression(42))},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewTCPProxy(listener, backendAddr, opts...); err == nil {
+			t.Fatal("Expected an error")
+		}
+		listener.Close()
+	}
+}
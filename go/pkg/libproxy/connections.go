@@ -0,0 +1,69 @@
+package libproxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a connection (or UDP session) which a proxy is
+// currently forwarding.
+type ConnInfo struct {
+	// FrontendAddr is the remote address of the frontend client.
+	FrontendAddr    net.Addr
+	BackendAddr     net.Addr
+	Start           time.Time
+	BytesToBackend  uint64
+	BytesToFrontend uint64
+	// Tag is the proxy's WithTag label.
+	Tag string
+	// TraceID is the ID given by WithTraceIDs.
+	TraceID string
+}
+
+// connRegistry holds the connections a proxy is currently forwarding.
+type connRegistry struct {
+	m     sync.Mutex
+	conns map[*connection]struct{}
+}
+
+func (r *connRegistry) add(c *connection) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[*connection]struct{})
+	}
+	r.conns[c] = struct{}{}
+}
+
+func (r *connRegistry) remove(c *connection) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.conns, c)
+}
+
+// snapshot returns a copy of the registered connections, oldest first.
+func (r *connRegistry) snapshot() []ConnInfo {
+	r.m.Lock()
+	defer r.m.Unlock()
+	result := make([]ConnInfo, 0, len(r.conns))
+	for c := range r.conns {
+		result = append(result, ConnInfo{
+			FrontendAddr:    c.frontendAddr,
+			BackendAddr:     c.backendAddr,
+			Start:           c.start,
+			BytesToBackend:  atomic.LoadUint64(&c.bytesToBackend),
+			BytesToFrontend: atomic.LoadUint64(&c.bytesToFrontend),
+			Tag:             c.proxyStats.tag,
+			TraceID:         c.traceID,
+		})
+	}
+	sortConnInfo(result)
+	return result
+}
+
+func sortConnInfo(conns []ConnInfo) {
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Start.Before(conns[j].Start) })
+}
@@ -0,0 +1,72 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestTCPProxyConnections(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	if conns := proxy.Connections(); len(conns) != 0 {
+		t.Fatalf("Expected no connections but got %+v", conns)
+	}
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	// The bytes are counted just after the echo is written back.
+	waitFor(t, func() bool { return proxy.Stats().BytesToFrontend == uint64(testBufSize) }, func() string {
+		return fmt.Sprintf("Timed out waiting for BytesToFrontend == uint64(testBufSize) in %+v", proxy.Stats())
+	})
+
+	conns := proxy.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Expected one connection but got %+v", conns)
+	}
+	c := conns[0]
+	if c.FrontendAddr.String() != client.LocalAddr().String() || c.BackendAddr.String() != backend.LocalAddr().String() {
+		t.Fatalf("Unexpected addresses in %+v", c)
+	}
+	if c.BytesToBackend != uint64(testBufSize) || c.BytesToFrontend != uint64(testBufSize) || c.Start.IsZero() {
+		t.Fatalf("Unexpected connection %+v", c)
+	}
+	client.Close()
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 0 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", proxy.Stats()) })
+	if conns := proxy.Connections(); len(conns) != 0 {
+		t.Fatalf("Expected the connection to be removed but got %+v", conns)
+	}
+}
+
+func TestUDPProxyConnections(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	conns := proxy.Connections()
+	if len(conns) != 1 || conns[0].FrontendAddr.String() != client.LocalAddr().String() {
+		t.Fatalf("Expected the session from %v but got %+v", client.LocalAddr(), conns)
+	}
+}
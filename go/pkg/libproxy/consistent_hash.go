@@ -0,0 +1,164 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// hashRingPointsPerBackend is the number of points each backend has on the
+// ring, as in ketama: enough for the keys to spread evenly between a handful
+// of backends.
+const hashRingPointsPerBackend = 160
+
+// WithHashSeed sets the seed which a proxy created with
+// NewTCPProxyConsistentHash mixes into its hashes, so that proxies given
+// different seeds map the same clients to different backends. The default
+// is 0.
+func WithHashSeed(seed uint32) Option {
+	return func(o *options) {
+		o.hashSeed = seed
+	}
+}
+
+// HashRingPoint is a point on the ring of a proxy created with
+// NewTCPProxyConsistentHash. A client whose IP hashes to Hash, or to a value
+// between the previous point and Hash, goes to Addr while it is healthy.
+type HashRingPoint struct {
+	Hash    uint32
+	Addr    *net.TCPAddr
+	Healthy bool
+}
+
+// hashRing is a ketama-style consistent hash ring over the backends of a
+// multiBackend.
+type hashRing struct {
+	seed   uint32
+	points []uint32 // sorted
+	owners []int    // the index of the backend owning each point
+}
+
+// NewTCPProxyConsistentHash creates a new TCPProxy which sends every
+// connection from one client IP to the same backend, by hashing the IP onto
+// a ring of points owned by the backends. A client goes to the owner of the
+// first point at or after its hash, so that when a backend goes down, fails
+// its health checks or can't be reached only the clients it owned move,
+// each to the owner of the next point, and they move back when it recovers.
+// The other options of NewTCPProxyMulti apply.
+func NewTCPProxyConsistentHash(listener net.Listener, backends []*net.TCPAddr, opts ...Option) (*TCPProxy, error) {
+	proxy, err := NewTCPProxyMulti(listener, backends, opts...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.multi.ring = newHashRing(backends, proxy.opts.hashSeed)
+	return proxy, nil
+}
+
+func newHashRing(backends []*net.TCPAddr, seed uint32) *hashRing {
+	r := &hashRing{seed: seed}
+	for n, addr := range backends {
+		// Each digest gives four points.
+		for i := 0; i < hashRingPointsPerBackend/4; i++ {
+			digest := r.digest(fmt.Sprintf("%s-%d", addr, i))
+			for j := 0; j < 4; j++ {
+				r.points = append(r.points, binary.LittleEndian.Uint32(digest[4*j:]))
+				r.owners = append(r.owners, n)
+			}
+		}
+	}
+	sort.Sort(r)
+	return r
+}
+
+func (r *hashRing) Len() int { return len(r.points) }
+
+func (r *hashRing) Less(i, j int) bool {
+	if r.points[i] == r.points[j] {
+		return r.owners[i] < r.owners[j]
+	}
+	return r.points[i] < r.points[j]
+}
+
+func (r *hashRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+func (r *hashRing) digest(key string) [md5.Size]byte {
+	var seed [4]byte
+	binary.BigEndian.PutUint32(seed[:], r.seed)
+	return md5.Sum(append(seed[:], key...))
+}
+
+// hash returns the position of client on the ring. Clients are keyed by IP
+// alone, whatever their port.
+func (r *hashRing) hash(client net.Addr) uint32 {
+	var key string
+	switch addr := client.(type) {
+	case *net.TCPAddr:
+		key = addr.IP.String()
+	case nil:
+	default:
+		key = addr.String()
+	}
+	digest := r.digest(key)
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// order returns the indexes of the backends in the order a client at hash
+// tries them: the owner of the first point at or after hash, then the owners
+// of the points after it which haven't come up yet.
+func (r *hashRing) order(hash uint32, backends int) []int {
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	seen := make([]bool, backends)
+	order := make([]int, 0, backends)
+	for i := 0; i < len(r.points) && len(order) < backends; i++ {
+		n := r.owners[(start+i)%len(r.points)]
+		if !seen[n] {
+			seen[n] = true
+			order = append(order, n)
+		}
+	}
+	return order
+}
+
+type hashClientKey struct{}
+
+// hashing returns the context to dial a backend for client with, which
+// carries the client's address when m hashes it.
+func (m *multiBackend) hashing(ctx context.Context, client net.Addr) context.Context {
+	if m == nil || m.ring == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, hashClientKey{}, client)
+}
+
+// HashRing returns the points on the ring of a proxy created with
+// NewTCPProxyConsistentHash, in order, with the current health of their
+// backends. It returns nil for other proxies.
+func (proxy *TCPProxy) HashRing() []HashRingPoint {
+	if proxy.multi == nil || proxy.multi.ring == nil {
+		return nil
+	}
+	r := proxy.multi.ring
+	points := make([]HashRingPoint, len(r.points))
+	for i, hash := range r.points {
+		n := r.owners[i]
+		points[i] = HashRingPoint{Hash: hash, Addr: proxy.multi.addrs[n], Healthy: proxy.multi.isHealthy(n)}
+	}
+	return points
+}
+
+// HashBackend returns the backend which a new connection from ip would go to
+// first, given the current health of the backends, for a proxy created with
+// NewTCPProxyConsistentHash. It returns nil for other proxies.
+func (proxy *TCPProxy) HashBackend(ip net.IP) *net.TCPAddr {
+	if proxy.multi == nil || proxy.multi.ring == nil {
+		return nil
+	}
+	order := proxy.multi.dialOrder(&net.TCPAddr{IP: ip})
+	return proxy.multi.addrs[order[0]]
+}
@@ -0,0 +1,136 @@
+package libproxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func hashProxy(t *testing.T, backends []*net.TCPAddr, opts ...Option) *TCPProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxyConsistentHash(listener, backends, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func testClientIP(i int) net.IP {
+	return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+}
+
+func TestConsistentHashRing(t *testing.T) {
+	backends := []*net.TCPAddr{
+		{IP: net.IPv4(192, 168, 0, 1), Port: 80},
+		{IP: net.IPv4(192, 168, 0, 2), Port: 80},
+		{IP: net.IPv4(192, 168, 0, 3), Port: 80},
+	}
+	proxy := hashProxy(t, backends)
+	defer proxy.Close()
+
+	ring := proxy.HashRing()
+	if len(ring) != len(backends)*hashRingPointsPerBackend {
+		t.Fatalf("Expected %d points but got %d", len(backends)*hashRingPointsPerBackend, len(ring))
+	}
+	for i := 1; i < len(ring); i++ {
+		if ring[i].Hash < ring[i-1].Hash {
+			t.Fatalf("The ring isn't sorted at point %d: %+v, %+v", i, ring[i-1], ring[i])
+		}
+	}
+
+	const clients = 3000
+	before := make([]*net.TCPAddr, clients)
+	counts := make(map[*net.TCPAddr]int)
+	for i := range before {
+		before[i] = proxy.HashBackend(testClientIP(i))
+		counts[before[i]]++
+	}
+	for _, addr := range backends {
+		if counts[addr] < clients/5 {
+			t.Fatalf("Expected the clients to spread evenly but got %v", counts)
+		}
+	}
+
+	// Ejecting a backend only moves the clients it owned.
+	atomic.StoreInt32(&proxy.multi.down[1], 1)
+	for i := range before {
+		after := proxy.HashBackend(testClientIP(i))
+		if before[i] != backends[1] && after != before[i] {
+			t.Fatalf("Client %v moved from %v to %v", testClientIP(i), before[i], after)
+		}
+		if after == backends[1] {
+			t.Fatalf("Client %v still goes to the unhealthy %v", testClientIP(i), after)
+		}
+	}
+	for _, point := range proxy.HashRing() {
+		if point.Healthy != (point.Addr != backends[1]) {
+			t.Fatalf("Expected only %v to be unhealthy but got %+v", backends[1], point)
+		}
+	}
+	atomic.StoreInt32(&proxy.multi.down[1], 0)
+	for i := range before {
+		if after := proxy.HashBackend(testClientIP(i)); after != before[i] {
+			t.Fatalf("Client %v didn't move back to %v but went to %v", testClientIP(i), before[i], after)
+		}
+	}
+
+	seeded := hashProxy(t, backends, WithHashSeed(1))
+	defer seeded.Close()
+	moved := 0
+	for i := range before {
+		if seeded.HashBackend(testClientIP(i)) != before[i] {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("Expected a different seed to map clients differently")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := NewTCPProxyMulti(listener, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Close()
+	if multi.HashRing() != nil || multi.HashBackend(testClientIP(0)) != nil {
+		t.Fatal("Expected no ring for a round-robin proxy")
+	}
+}
+
+func TestConsistentHashAffinity(t *testing.T) {
+	var backends []*net.TCPAddr
+	for i := 0; i < 3; i++ {
+		backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+		defer backend.Close()
+		backend.Run()
+		backends = append(backends, backend.LocalAddr().(*net.TCPAddr))
+	}
+	proxy := hashProxy(t, backends)
+	defer proxy.Close()
+	go proxy.Run()
+
+	for i := 0; i < 5; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+	expected := proxy.HashBackend(net.IPv4(127, 0, 0, 1))
+	for _, b := range proxy.BackendConns() {
+		want := int64(0)
+		if b.Addr == expected {
+			want = 5
+		}
+		if b.TotalConns != want {
+			t.Fatalf("Expected every connection to go to %v but got %+v", expected, proxy.BackendConns())
+		}
+	}
+}
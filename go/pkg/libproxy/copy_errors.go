@@ -0,0 +1,90 @@
+package libproxy
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// ErrSource says which side of a TCP connection, and which way, the error
+// which ended it came from. Reading from the frontend and writing to the
+// backend are the frontend to backend direction; the other two are the
+// backend to frontend direction.
+type ErrSource int32
+
+const (
+	// NoErrSource is a connection which wasn't ended by a copy error.
+	NoErrSource ErrSource = iota
+	// FrontendRead is an error reading from the client, such as a reset
+	// or a read timeout.
+	FrontendRead
+	// FrontendWrite is an error writing to the client.
+	FrontendWrite
+	// BackendRead is an error reading from the backend.
+	BackendRead
+	// BackendWrite is an error writing to the backend.
+	BackendWrite
+)
+
+func (s ErrSource) String() string {
+	switch s {
+	case NoErrSource:
+		return "none"
+	case FrontendRead:
+		return "frontend read"
+	case FrontendWrite:
+		return "frontend write"
+	case BackendRead:
+		return "backend read"
+	case BackendWrite:
+		return "backend write"
+	}
+	return "unknown"
+}
+
+// failureReader notes whether a read from its Reader failed, so that a
+// failed copy can be blamed on the reader or the writer.
+type failureReader struct {
+	io.Reader
+	failed bool
+}
+
+func (r *failureReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		r.failed = true
+	}
+	return n, err
+}
+
+// copySides copies from r to w like copyBuffered. If the copy fails it also
+// returns which side failed: r is the frontend if toBackend is set, and the
+// backend otherwise.
+func (o *options) copySides(w io.Writer, r io.Reader, toBackend bool) (ErrSource, error) {
+	reader := &failureReader{Reader: r}
+	_, err := o.copyBuffered(w, reader)
+	switch {
+	case err == nil:
+		return NoErrSource, nil
+	case toBackend && reader.failed:
+		return FrontendRead, err
+	case toBackend:
+		return BackendWrite, err
+	case reader.failed:
+		return BackendRead, err
+	}
+	return FrontendWrite, err
+}
+
+// copyFailed records source as what ended c, unless something else already
+// has, and counts it in the proxy's stats.
+func (c *connection) copyFailed(source ErrSource) {
+	if source == NoErrSource || !atomic.CompareAndSwapInt32(&c.errSource, 0, int32(source)) {
+		return
+	}
+	atomic.AddUint64(&c.proxyStats.copyErrors[source-1], 1)
+}
+
+// endedBy returns what ended c, as recorded by copyFailed.
+func (c *connection) endedBy() ErrSource {
+	return ErrSource(atomic.LoadInt32(&c.errSource))
+}
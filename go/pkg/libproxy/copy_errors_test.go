@@ -0,0 +1,125 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testCopyError proxies one connection to a backend which reads a bit and
+// hands its end to breakBackend, and returns the event for the connection
+// once breakClient has been given the client's end.
+func testCopyError(t *testing.T, breakClient func(*net.TCPConn), breakBackend func(*net.TCPConn)) (ConnEvent, ProxyStats) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, testBufSize))
+		breakBackend(conn.(*net.TCPConn))
+	}()
+	closed := make(chan ConnEvent, 1)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, listener.Addr(), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnClosed {
+			closed <- e
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	breakClient(client.(*net.TCPConn))
+	select {
+	case e := <-closed:
+		return e, proxy.Stats()
+	case <-time.After(10 * time.Second):
+		t.Fatal("The connection wasn't closed")
+	}
+	return ConnEvent{}, ProxyStats{}
+}
+
+// reset closes conn with a RST.
+func reset(conn *net.TCPConn) {
+	conn.SetLinger(0)
+	conn.Close()
+}
+
+func TestCopyErrorFromBackend(t *testing.T) {
+	e, stats := testCopyError(t, func(client *net.TCPConn) {
+		client.Read(make([]byte, 1))
+	}, func(backend *net.TCPConn) {
+		// Let the proxy's copy block on a read before the reset.
+		time.Sleep(50 * time.Millisecond)
+		reset(backend)
+	})
+	if e.ErrSource != BackendRead || e.Err == nil {
+		t.Fatalf("Expected a backend read error but got %v from %s", e.Err, e.ErrSource)
+	}
+	if stats.BackendReadErrors != 1 || stats.FrontendReadErrors != 0 {
+		t.Fatalf("Expected 1 backend read error to be counted but got %+v", stats)
+	}
+}
+
+func TestCopyErrorFromFrontend(t *testing.T) {
+	e, stats := testCopyError(t, func(client *net.TCPConn) {
+		time.Sleep(50 * time.Millisecond)
+		reset(client)
+	}, func(backend *net.TCPConn) {
+		// Hold the connection open until the proxy closes it.
+		backend.Read(make([]byte, 1))
+		backend.Close()
+	})
+	if e.ErrSource != FrontendRead || e.Err == nil {
+		t.Fatalf("Expected a frontend read error but got %v from %s", e.Err, e.ErrSource)
+	}
+	if stats.FrontendReadErrors != 1 || stats.BackendReadErrors != 0 {
+		t.Fatalf("Expected 1 frontend read error to be counted but got %+v", stats)
+	}
+}
+
+func TestCopyErrorNotOnCleanClose(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	closed := make(chan ConnEvent, 1)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnClosed {
+			closed <- e
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	client.Close()
+	select {
+	case e := <-closed:
+		if e.ErrSource != NoErrSource {
+			t.Fatalf("Expected no error source but got %s", e.ErrSource)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The connection wasn't closed")
+	}
+}
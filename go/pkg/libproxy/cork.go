@@ -0,0 +1,49 @@
+package libproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// WithCork sets TCP_CORK on the backend connection while the client's
+// traffic is copied to it, so that small writes are coalesced into full
+// segments, and clears it once the client has finished to flush what is
+// left. Partial segments are held back for up to 200ms, which helps the
+// throughput of chatty protocols at the expense of latency. It is the
+// opposite of WithNoDelay(true), which it can't be combined with. Only Linux
+// supports this: on other platforms a warning is logged for each connection.
+func WithCork() Option {
+	return func(o *options) {
+		o.cork = true
+	}
+}
+
+var errCorkWithNoDelay = errors.New("Can't combine WithCork with WithNoDelay(true)")
+
+// checkCork returns an error if TCP_CORK was asked for along with
+// TCP_NODELAY.
+func (o *options) checkCork() error {
+	if o.cork && o.noDelay != nil && *o.noDelay {
+		return errCorkWithNoDelay
+	}
+	return nil
+}
+
+// corkBackend sets TCP_CORK on conn if WithCork was given, returning the
+// function which clears it again. Connections which aren't a *net.TCPConn
+// are left alone.
+func (o *options) corkBackend(conn interface{}) func() {
+	tcp, ok := conn.(*net.TCPConn)
+	if !o.cork || !ok {
+		return func() {}
+	}
+	if err := setCork(tcp, true); err != nil {
+		o.logf("Can't set TCP_CORK on %s: %s", tcp.RemoteAddr(), err)
+		return func() {}
+	}
+	return func() {
+		if err := setCork(tcp, false); err != nil {
+			o.logf("Can't clear TCP_CORK on %s: %s", tcp.RemoteAddr(), err)
+		}
+	}
+}
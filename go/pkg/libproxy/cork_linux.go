@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func setCork(conn *net.TCPConn, on bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_CORK, value)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCorkBackend(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	o := newOptions([]Option{WithCork()})
+	uncork := o.corkBackend(client)
+	if getsockopt(t, client, unix.IPPROTO_TCP, unix.TCP_CORK) == 0 {
+		t.Fatal("Expected TCP_CORK to be set")
+	}
+	uncork()
+	if getsockopt(t, client, unix.IPPROTO_TCP, unix.TCP_CORK) != 0 {
+		t.Fatal("Expected TCP_CORK to be cleared")
+	}
+
+	// Without the option nothing is touched.
+	o = newOptions(nil)
+	o.corkBackend(client)()
+	if getsockopt(t, client, unix.IPPROTO_TCP, unix.TCP_CORK) != 0 {
+		t.Fatal("Expected TCP_CORK to be left alone")
+	}
+}
+
+func TestTCPProxyWithCork(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithCork())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+
+	if _, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithCork(), WithNoDelay(true)); err != errCorkWithNoDelay {
+		t.Fatalf("Expected WithCork and WithNoDelay(true) to be refused but got %v", err)
+	}
+	proxy, err = NewIPProxy(frontendAddr, backend.LocalAddr(), WithCork(), WithNoDelay(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Close()
+}
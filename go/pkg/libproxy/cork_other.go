@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package libproxy
+
+import (
+	"errors"
+	"net"
+)
+
+func setCork(conn *net.TCPConn, on bool) error {
+	return errors.New("TCP_CORK isn't supported on this platform")
+}
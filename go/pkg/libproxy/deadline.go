@@ -0,0 +1,78 @@
+package libproxy
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// WithReadTimeout closes a TCP connection if a read from either side stalls
+// for longer than d. The deadline is pushed back before every read so slow
+// but progressing transfers are not affected.
+func WithReadTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.readTimeout = d
+	}
+}
+
+// WithWriteTimeout closes a TCP connection if a write to either side stalls
+// for longer than d, for example because the peer has stopped reading. The
+// deadline is pushed back before every write.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.writeTimeout = d
+	}
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// deadlineReader sets a fresh read deadline on conn before every Read.
+type deadlineReader struct {
+	io.Reader
+	conn    readDeadliner
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.Reader.Read(p)
+}
+
+// deadlineWriter sets a fresh write deadline on conn before every Write.
+type deadlineWriter struct {
+	io.Writer
+	conn    writeDeadliner
+	timeout time.Duration
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	return d.Writer.Write(p)
+}
+
+// withDeadlines wraps the two ends of a copy with the configured rolling
+// deadlines. Connections which don't support deadlines are left alone.
+func (o *options) withDeadlines(to io.Writer, from io.Reader, toConn, fromConn Conn) (io.Writer, io.Reader) {
+	if o.writeTimeout > 0 {
+		if conn, ok := toConn.(writeDeadliner); ok {
+			to = &deadlineWriter{Writer: to, conn: conn, timeout: o.writeTimeout}
+		}
+	}
+	if o.readTimeout > 0 {
+		if conn, ok := fromConn.(readDeadliner); ok {
+			from = &deadlineReader{Reader: from, conn: conn, timeout: o.readTimeout}
+		}
+	}
+	return to, from
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,57 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPWriteTimeout(t *testing.T) {
+	// A backend which accepts connections but never reads from them.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, backend.Addr().(*net.TCPAddr), WithWriteTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := client.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("Expected the proxy to close the stuck connection but got %v", err)
+	}
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 0 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", proxy.Stats()) })
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	default:
+	}
+}
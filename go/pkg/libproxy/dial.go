@@ -0,0 +1,228 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// BackendDialer connects a proxy to its backend. It is implemented by
+// *net.Dialer, which is what the proxies use unless WithBackendDialer is
+// given.
+type BackendDialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// WithBackendDialer makes the proxy connect to its backend with d, for
+// example to route backend traffic through an upstream proxy. WithSourceAddr
+// only applies to the default dialer. If d also has a DialContext method it
+// is used, so that dials which are no longer needed can be cancelled.
+func WithBackendDialer(d BackendDialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+// DefaultDialTimeout is how long a TCP proxy waits for each attempt to
+// connect to its backend unless WithDialTimeout says otherwise.
+const DefaultDialTimeout = 30 * time.Second
+
+// WithDialTimeout bounds each attempt to connect to the backend of a TCP
+// proxy to d, including the TLS handshake if WithBackendTLS is given. With
+// WithDialRetry every attempt gets d of its own. A custom BackendDialer
+// without a DialContext method is only bounded during the handshake. Vsock,
+// Hyper-V socket and SCTP dials can't be interrupted, so one which takes too
+// long is abandoned, and the connection closed if it is made after all. The
+// default is DefaultDialTimeout, and 0 leaves it to the operating system.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithBackendTLS makes a TCP proxy speak TLS, with config, to its backend
+// while its clients speak plaintext to it. If config has no ServerName, the
+// certificate is checked against the IP address dialed. A failed handshake
+// counts as a failed dial, so that it is retried or fails over like one.
+func WithBackendTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.backendTLS = config
+	}
+}
+
+// contextDialer is a BackendDialer which can also abandon a dial early.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (o *options) dial(network string, addr net.Addr) (net.Conn, error) {
+	return o.dialContext(context.Background(), network, addr)
+}
+
+// dialContext dials addr, giving up when ctx is cancelled unless a custom
+// BackendDialer without a DialContext method is in use.
+func (o *options) dialContext(ctx context.Context, network string, addr net.Addr) (net.Conn, error) {
+	if o.dialer != nil {
+		if d, ok := o.dialer.(contextDialer); ok {
+			return d.DialContext(ctx, network, addr.String())
+		}
+		return o.dialer.Dial(network, addr.String())
+	}
+	if client, ok := ctx.Value(clientSourceKey{}).(net.Addr); ok {
+		return dialFromClient(ctx, network, addr, client)
+	}
+	dialer := &net.Dialer{}
+	if o.sourceIP == nil {
+		return dialer.DialContext(ctx, network, addr.String())
+	}
+	if local := o.sourceAddr(network, addr); local != nil {
+		dialer.LocalAddr = local
+	}
+	conn, err := dialer.DialContext(ctx, network, addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("using source address %s: %s", o.sourceIP, err)
+	}
+	return conn, nil
+}
+
+// dialStream connects to a TCP, Unix stream, vsock or Hyper-V socket backend.
+func (o *options) dialStream(addr net.Addr) (Conn, error) {
+	return o.dialStreamContext(context.Background(), addr)
+}
+
+func (o *options) dialStreamContext(ctx context.Context, addr net.Addr) (Conn, error) {
+	if o.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.dialTimeout)
+		defer cancel()
+	}
+	if o.dialer == nil {
+		if vsockAddr, ok := addr.(*vsock.VsockAddr); ok {
+			return dialAbandoning(ctx, func() (Conn, error) { return dialVsock(vsockAddr) })
+		}
+		if isHyperVAddr(addr) || isSCTPAddr(addr) {
+			return dialAbandoning(ctx, func() (Conn, error) {
+				if conn, ok, err := dialHyperV(addr); ok {
+					return conn, err
+				}
+				conn, _, err := dialSCTP(addr)
+				return conn, err
+			})
+		}
+	}
+	conn, err := o.dialContext(ctx, o.network(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	o.tuneTCP(conn)
+	o.setSocketBuffers(conn)
+	if o.backendTLS != nil {
+		return o.originateTLS(ctx, conn, addr)
+	}
+	return asConn(conn), nil
+}
+
+// originateTLS completes a TLS handshake with the backend on conn, closing
+// it if the handshake fails.
+func (o *options) originateTLS(ctx context.Context, conn net.Conn, addr net.Addr) (Conn, error) {
+	config := o.backendTLS
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			config.ServerName = host
+		}
+	}
+	client := tls.Client(conn, config)
+	if err := client.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %v failed: %s", addr, err)
+	}
+	return &tlsConn{client}, nil
+}
+
+// dialDatagram connects to a UDP, Unix datagram or vsock backend for the
+// datagrams from the client at from. Vsock only carries streams, so the
+// datagrams are framed on a connection of their own in the same way as by
+// NewUDPConn.
+func (o *options) dialDatagram(addr net.Addr, from net.Addr) (net.Conn, error) {
+	if o.dialer == nil {
+		switch a := addr.(type) {
+		case *net.UnixAddr:
+			return dialUnixgram(a)
+		case *vsock.VsockAddr:
+			// The framing carries the client's address as a UDP one.
+			udpFrom, ok := from.(*net.UDPAddr)
+			if !ok {
+				return nil, fmt.Errorf("Can't forward datagrams from %v over vsock: not a UDP address", from)
+			}
+			conn, err := dialVsock(a)
+			if err != nil {
+				return nil, err
+			}
+			return newEncapsulatedConn(conn, udpFrom), nil
+		}
+	}
+	conn, err := o.dial(o.network(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	o.setSocketBuffers(conn)
+	return conn, nil
+}
+
+func dialVsock(addr *vsock.VsockAddr) (vsock.Conn, error) {
+	conn, err := vsock.Dial(addr.CID, addr.Port)
+	if err != nil {
+		return nil, fmt.Errorf("Can't connect to vsock %v: %s", addr, err)
+	}
+	return conn, nil
+}
+
+// dialAbandoning runs dial, which can't be interrupted, and gives up waiting
+// for it if ctx is done first. The connection is then closed as soon as it is
+// made.
+func dialAbandoning(ctx context.Context, dial func() (Conn, error)) (Conn, error) {
+	if ctx.Done() == nil {
+		return dial()
+	}
+	type result struct {
+		conn Conn
+		err  error
+	}
+	dialed := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		dialed <- result{conn, err}
+	}()
+	select {
+	case r := <-dialed:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-dialed; r.err == nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// closeWriteConn is a Conn for connections which can't be half-closed:
+// CloseRead does nothing and CloseWrite closes the whole connection.
+type closeWriteConn struct {
+	net.Conn
+}
+
+func (c *closeWriteConn) CloseRead() error  { return nil }
+func (c *closeWriteConn) CloseWrite() error { return c.Close() }
+
+func asConn(c net.Conn) Conn {
+	if conn, ok := c.(Conn); ok {
+		return conn
+	}
+	return &closeWriteConn{c}
+}
@@ -0,0 +1,124 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowDialer connects after a delay, like a backend which is slow to accept.
+type slowDialer struct {
+	delay time.Duration
+}
+
+func (d *slowDialer) Dial(network, address string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	return net.Dial(network, address)
+}
+
+func TestDialDuration(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	events := make(chan ConnEvent, 16)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	const delay = 50 * time.Millisecond
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithBackendDialer(&slowDialer{delay: delay}), OnConnection(func(e ConnEvent) { events <- e }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case e := <-events:
+			if e.DialDuration < delay || (e.Type == ConnClosed && e.DialDuration > e.Duration) {
+				t.Fatalf("Expected a dial duration of at least %s but got %+v", delay, e)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Didn't get the connection events")
+		}
+	}
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 0
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", stats) })
+	if stats.BackendDials != 2 || stats.DialTimeTotal < 2*delay || stats.LastDialTime < delay || stats.MaxDialTime < stats.LastDialTime || stats.DialTimeTotal < stats.MaxDialTime {
+		t.Fatalf("Expected 2 dials of at least %s but got %+v", delay, stats)
+	}
+}
+
+func TestDialDurationUnreachable(t *testing.T) {
+	events := make(chan ConnEvent, 1)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, unusedTCPAddr(t), OnConnection(func(e ConnEvent) { events <- e }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case e := <-events:
+		if e.DialDuration != 0 {
+			t.Fatalf("Expected no dial duration for an unreachable backend but got %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Didn't get the closed event")
+	}
+	if stats := proxy.Stats(); stats.BackendDials != 0 || stats.MaxDialTime != 0 {
+		t.Fatalf("Expected no dials to be counted but got %+v", stats)
+	}
+}
+
+func TestDialDurationIncludesProxyHeader(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	events := make(chan ConnEvent, 1)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithAcceptProxyProtocol(), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnOpened {
+			events <- e
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The client is slow to send its PROXY header.
+	const delay = 50 * time.Millisecond
+	time.Sleep(delay)
+	if _, err := client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	select {
+	case e := <-events:
+		if e.DialDuration < delay {
+			t.Fatalf("Expected the dial duration to include the PROXY header but got %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Didn't get the opened event")
+	}
+}
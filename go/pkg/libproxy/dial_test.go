@@ -0,0 +1,142 @@
+package libproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeDialer connects the proxy to an in-process echo server over net.Pipe.
+type pipeDialer struct {
+	dialed []string
+}
+
+func (d *pipeDialer) Dial(network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, network+"/"+address)
+	proxyEnd, echoEnd := net.Pipe()
+	go func() {
+		io.Copy(echoEnd, echoEnd)
+		echoEnd.Close()
+	}()
+	return proxyEnd, nil
+}
+
+func TestTCPProxyBackendDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	dialer := &pipeDialer{}
+	proxy, err := NewTCPProxy(listener, backendAddr, WithBackendDialer(dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err = io.ReadFull(client, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testBuf, recvBuf) {
+		t.Fatalf("Expected [%v] but got [%v]", testBuf, recvBuf)
+	}
+	// Half-closing the client closes the pipe, which ends the connection.
+	client.(*net.TCPConn).CloseWrite()
+	if _, err := client.Read(recvBuf); err != io.EOF {
+		t.Fatalf("Expected EOF but got %v", err)
+	}
+	if len(dialer.dialed) != 1 || dialer.dialed[0] != "tcp/10.0.0.1:80" {
+		t.Fatalf("Unexpected dials %v", dialer.dialed)
+	}
+}
+
+// hangingDialer never connects, recording how long each dial waited for.
+type hangingDialer struct {
+	m     sync.Mutex
+	waits []time.Duration
+}
+
+func (d *hangingDialer) Dial(network, address string) (net.Conn, error) {
+	return nil, errors.New("Dial isn't used when DialContext is available")
+}
+
+func (d *hangingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	start := time.Now()
+	<-ctx.Done()
+	d.m.Lock()
+	d.waits = append(d.waits, time.Since(start))
+	d.m.Unlock()
+	return nil, ctx.Err()
+}
+
+func TestDialTimeoutPerAttempt(t *testing.T) {
+	if o := newOptions(nil); o.dialTimeout != DefaultDialTimeout {
+		t.Fatalf("Expected a default dial timeout of %s but got %s", DefaultDialTimeout, o.dialTimeout)
+	}
+	dialer := &hangingDialer{}
+	timeout := 50 * time.Millisecond
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithBackendDialer(dialer), WithDialTimeout(timeout), WithDialRetry(3, 10*time.Millisecond), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the client to be disconnected after the last attempt but got %v", err)
+	}
+	dialer.m.Lock()
+	defer dialer.m.Unlock()
+	if len(dialer.waits) != 3 {
+		t.Fatalf("Expected 3 attempts but got %d", len(dialer.waits))
+	}
+	for i, wait := range dialer.waits {
+		if wait < timeout || wait > time.Second {
+			t.Errorf("Expected attempt %d to be given up after %s but it took %s", i+1, timeout, wait)
+		}
+	}
+}
+
+func TestDialAbandoning(t *testing.T) {
+	// A dial which can't be interrupted is given up on once ctx is done,
+	// and the connection it makes late is closed.
+	local, remote := net.Pipe()
+	defer remote.Close()
+	release := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := dialAbandoning(ctx, func() (Conn, error) {
+		<-release
+		return asConn(local), nil
+	})
+	if err != context.DeadlineExceeded || time.Since(start) > 5*time.Second {
+		t.Fatalf("Expected the dial to be abandoned at the deadline but got %v after %s", err, time.Since(start))
+	}
+	close(release)
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the late connection to be closed but got %v", err)
+	}
+}
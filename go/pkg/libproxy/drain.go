@@ -0,0 +1,51 @@
+package libproxy
+
+import (
+	"sync"
+)
+
+// connTracker counts the connections (or UDP sessions) of a proxy which are
+// still in flight so that Close can wait for them to drain.
+type connTracker struct {
+	m       sync.Mutex
+	n       int
+	waiters []chan struct{}
+}
+
+func (t *connTracker) add() {
+	t.m.Lock()
+	t.n++
+	t.m.Unlock()
+}
+
+func (t *connTracker) done() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.n--
+	if t.n == 0 {
+		for _, w := range t.waiters {
+			close(w)
+		}
+		t.waiters = nil
+	}
+}
+
+func (t *connTracker) count() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.n
+}
+
+// idle returns a channel which is closed once there are no connections in
+// flight.
+func (t *connTracker) idle() <-chan struct{} {
+	t.m.Lock()
+	defer t.m.Unlock()
+	c := make(chan struct{})
+	if t.n == 0 {
+		close(c)
+	} else {
+		t.waiters = append(t.waiters, c)
+	}
+	return c
+}
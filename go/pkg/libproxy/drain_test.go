@@ -0,0 +1,61 @@
+package libproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPCloseWithDeadline(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, backend.LocalAddr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+
+	finished, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuck, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 2 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 2 in %+v", proxy.Stats()) })
+
+	result := make(chan int)
+	go func() { result <- proxy.CloseWithDeadline(time.Second) }()
+
+	// The existing connections keep working while the proxy drains.
+	finished.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = finished.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err = io.ReadFull(finished, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	finished.Close()
+
+	select {
+	case forced := <-result:
+		if forced != 1 {
+			t.Fatalf("Expected 1 connection to be forcibly closed but got %d", forced)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CloseWithDeadline did not return")
+	}
+	if _, err := net.Dial("tcp", proxy.FrontendAddr().String()); err == nil {
+		t.Fatal("Expected new connections to be refused")
+	}
+}
@@ -0,0 +1,87 @@
+package libproxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// WithDualStack makes NewIPProxy listen on a TCP or UDP frontend with an
+// unspecified IP, such as 0.0.0.0 or ::, with two sockets: an IPv4 one and
+// an IPv6 one with IPV6_V6ONLY set, which forward to the same backend.
+// Whether a single IPv6 socket also accepts IPv4 clients, through IPv4-mapped
+// addresses, depends on the platform's defaults; two sockets accept both
+// everywhere. They are bound to the same port, the one picked for the IPv4
+// socket if the port is 0, and FrontendAddr returns the IPv4 address. The
+// proxy fails to start if either can't be bound. It doesn't apply to
+// frontends with a specific IP.
+func WithDualStack() Option {
+	return func(o *options) {
+		o.dualStack = true
+	}
+}
+
+// newDualStackProxy creates the two proxies of WithDualStack, if it applies
+// to frontendAddr.
+func newDualStackProxy(frontendAddr, backendAddr net.Addr, opts []Option) (Proxy, bool, error) {
+	ipv4, ipv6, ok := dualStackAddrs(frontendAddr)
+	if !ok {
+		return nil, false, nil
+	}
+	opts = opts[:len(opts):len(opts)] // so that the appends don't share an array
+	proxy4, err := NewIPProxy(ipv4, backendAddr, append(opts, bindFamily("4"))...)
+	if err != nil {
+		return nil, true, err
+	}
+	// The IPv6 socket gets the same port as the IPv4 one, whether picked
+	// for port 0 or by WithPortFallback.
+	switch addr := proxy4.FrontendAddr().(type) {
+	case *net.TCPAddr:
+		ipv6.(*net.TCPAddr).Port = addr.Port
+	case *net.UDPAddr:
+		ipv6.(*net.UDPAddr).Port = addr.Port
+	}
+	proxy6, err := NewIPProxy(ipv6, backendAddr, append(opts, bindFamily("6"))...)
+	if err != nil {
+		proxy4.Close()
+		return nil, true, err
+	}
+	return newCompositeProxy([]Proxy{proxy4, proxy6}), true, nil
+}
+
+// bindFamily makes NewIPProxy bind a single socket of the given IP version.
+func bindFamily(family string) Option {
+	return func(o *options) {
+		o.dualStack = false
+		o.frontendFamily = family
+		if family == "6" {
+			o.portFallback = 0
+		}
+	}
+}
+
+// dualStackAddrs returns the IPv4 and IPv6 unspecified addresses with the
+// port of frontendAddr, or false if it isn't a TCP or UDP address with an
+// unspecified IP.
+func dualStackAddrs(frontendAddr net.Addr) (net.Addr, net.Addr, bool) {
+	switch addr := frontendAddr.(type) {
+	case *net.TCPAddr:
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			return &net.TCPAddr{IP: net.IPv4zero, Port: addr.Port}, &net.TCPAddr{IP: net.IPv6unspecified, Port: addr.Port}, true
+		}
+	case *net.UDPAddr:
+		if addr.IP == nil || addr.IP.IsUnspecified() {
+			return &net.UDPAddr{IP: net.IPv4zero, Port: addr.Port}, &net.UDPAddr{IP: net.IPv6unspecified, Port: addr.Port}, true
+		}
+	}
+	return nil, nil, false
+}
+
+// setV6Only sets IPV6_V6ONLY on the IPv6 sockets of a WithDualStack proxy.
+// Binding with tcp6 or udp6 usually sets it already; it is set explicitly so
+// that the IPv6 socket can never conflict with the IPv4 one.
+func (o *options) setV6Only(network, address string, c syscall.RawConn) error {
+	if o.frontendFamily != "6" {
+		return nil
+	}
+	return setV6Only(o, network, address, c)
+}
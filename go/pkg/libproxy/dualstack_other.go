@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package libproxy
+
+import "syscall"
+
+func setV6Only(o *options, network, address string, c syscall.RawConn) error {
+	o.logf("IPV6_V6ONLY isn't supported on this platform: binding %s/%s without it", network, address)
+	return nil
+}
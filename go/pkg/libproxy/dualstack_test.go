@@ -0,0 +1,59 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDualStack(t *testing.T) {
+	if conn, err := net.ListenTCP("tcp6", &net.TCPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Skipf("IPv6 isn't available here: %s", err)
+	} else {
+		conn.Close()
+	}
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			backend := NewEchoServer(t, network, "127.0.0.1:0")
+			defer backend.Close()
+			backend.Run()
+			var frontendAddr net.Addr = &net.TCPAddr{}
+			if network == "udp" {
+				frontendAddr = &net.UDPAddr{}
+			}
+			proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithDualStack())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxy.Close()
+			go proxy.Run()
+			composite, ok := proxy.(*compositeProxy)
+			if !ok || len(composite.proxies) != 2 {
+				t.Fatalf("Expected an IPv4 and an IPv6 proxy but got %T", proxy)
+			}
+			port := portOf(proxy.FrontendAddr())
+			if ip := proxy.FrontendAddr().String(); portOf(composite.proxies[1].FrontendAddr()) != port {
+				t.Fatalf("Expected both frontends on the port of %s but got %v", ip, composite.proxies[1].FrontendAddr())
+			}
+			for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback} {
+				client, err := net.Dial(network, (&net.TCPAddr{IP: ip, Port: port}).String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				roundTrip(t, client)
+				client.Close()
+			}
+		})
+	}
+}
+
+func TestDualStackSpecificAddress(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithDualStack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	if _, ok := proxy.(*TCPProxy); !ok {
+		t.Fatalf("Expected a single proxy for a specific address but got %T", proxy)
+	}
+}
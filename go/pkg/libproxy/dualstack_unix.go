@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package libproxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setV6Only(o *options, network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,198 @@
+package libproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnEventType says whether a ConnEvent reports a connection being opened
+// or closed.
+type ConnEventType int
+
+const (
+	// ConnOpened is reported once the backend connection is established.
+	ConnOpened ConnEventType = iota
+	// ConnClosed is reported once forwarding has finished. A connection
+	// whose backend couldn't be reached only reports ConnClosed.
+	ConnClosed
+	// ConnDatagramTooLarge is reported, with a *DatagramTooLargeError,
+	// when a datagram is dropped from a UDP session which carries on. It
+	// is only reported with WithDatagramTooLargeEvents.
+	ConnDatagramTooLarge
+)
+
+// ConnEvent describes a change in the lifecycle of a TCP connection or UDP
+// session.
+type ConnEvent struct {
+	Type ConnEventType
+	// FrontendAddr is the remote address of the frontend client.
+	FrontendAddr net.Addr
+	// BackendAddr is the address of the backend, or nil if it couldn't be
+	// reached.
+	BackendAddr net.Addr
+	// Start is when the connection was accepted.
+	Start time.Time
+	// Tag is the proxy's WithTag label.
+	Tag string
+	// Context is the connection's context, see WithConnContext, and
+	// TraceID the ID given to it by WithTraceIDs.
+	Context context.Context
+	TraceID string
+	// DialDuration is how long a TCP connection took to reach its backend
+	// after being accepted, including reading a PROXY protocol header or
+	// TLS handshake from the client, and any retries. It is zero for UDP
+	// sessions and connections whose backend couldn't be reached.
+	DialDuration time.Duration
+	// DialFailed is set for ConnClosed when the backend couldn't be
+	// dialed, as opposed to a connection refused before dialing, for
+	// example for a malformed SOCKS5 request.
+	DialFailed bool
+	// The fields below are only set for ConnClosed.
+	Duration        time.Duration
+	BytesToBackend  uint64
+	BytesToFrontend uint64
+	// Err is the error which ended the connection, if any, or for
+	// ConnDatagramTooLarge the datagram which was dropped.
+	Err error
+	// ErrSource says where Err came from when it is an error copying
+	// through a TCP connection, and is NoErrSource otherwise.
+	ErrSource ErrSource
+}
+
+// OnConnection makes the proxy call fn when a connection (or UDP session) is
+// opened and when it is closed. The calls are made in order from a separate
+// goroutine, so a slow fn delays later events but never forwarding. Up to
+// 1024 events are queued for fn: if it falls further behind than that, new
+// events are dropped and counted in the DroppedEvents of Stats. Given more
+// than once, every fn is called in the order the options were given.
+func OnConnection(fn func(ConnEvent)) Option {
+	return func(o *options) {
+		if fn == nil {
+			return
+		}
+		if previous := o.onConnection; previous != nil {
+			o.onConnection = func(event ConnEvent) {
+				previous(event)
+				fn(event)
+			}
+			return
+		}
+		o.onConnection = fn
+	}
+}
+
+// eventQueueLength is how many events are queued for a slow OnConnection
+// callback before more are dropped.
+const eventQueueLength = 1024
+
+// eventDispatcher queues events and delivers them from a goroutine which only
+// runs while there are events to deliver. A nil dispatcher drops events.
+type eventDispatcher struct {
+	fn      func(ConnEvent)
+	queue   chan ConnEvent
+	dropped *uint64 // the proxy's count of dropped events, updated atomically
+	m       sync.Mutex
+	running bool
+}
+
+func newEventDispatcher(fn func(ConnEvent), s *stats) *eventDispatcher {
+	if fn == nil {
+		return nil
+	}
+	return &eventDispatcher{fn: fn, queue: make(chan ConnEvent, eventQueueLength), dropped: &s.droppedEvents}
+}
+
+func (d *eventDispatcher) emit(event ConnEvent) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.queue <- event:
+	default:
+		atomic.AddUint64(d.dropped, 1)
+		return
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if !d.running {
+		d.running = true
+		go d.deliver()
+	}
+}
+
+func (d *eventDispatcher) deliver() {
+	for {
+		select {
+		case event := <-d.queue:
+			d.fn(event)
+			continue
+		default:
+		}
+		// An event queued after the check above is either seen here or
+		// starts another goroutine once running is cleared.
+		d.m.Lock()
+		if len(d.queue) == 0 {
+			d.running = false
+			d.m.Unlock()
+			return
+		}
+		d.m.Unlock()
+	}
+}
+
+func (d *eventDispatcher) opened(c *connection) {
+	if d == nil {
+		return
+	}
+	d.emit(ConnEvent{
+		Type:         ConnOpened,
+		FrontendAddr: c.frontendAddr,
+		BackendAddr:  c.backendAddr,
+		Start:        c.start,
+		Tag:          c.proxyStats.tag,
+		Context:      c.ctx,
+		TraceID:      c.traceID,
+		DialDuration: c.dialDuration,
+	})
+}
+
+func (d *eventDispatcher) closed(c *connection, err error) {
+	if d == nil {
+		return
+	}
+	d.emit(ConnEvent{
+		Type:            ConnClosed,
+		FrontendAddr:    c.frontendAddr,
+		BackendAddr:     c.backendAddr,
+		Start:           c.start,
+		Tag:             c.proxyStats.tag,
+		Context:         c.ctx,
+		TraceID:         c.traceID,
+		DialDuration:    c.dialDuration,
+		DialFailed:      c.dialFailed,
+		Duration:        time.Since(c.start),
+		BytesToBackend:  atomic.LoadUint64(&c.bytesToBackend),
+		BytesToFrontend: atomic.LoadUint64(&c.bytesToFrontend),
+		Err:             err,
+		ErrSource:       c.endedBy(),
+	})
+}
+
+func (d *eventDispatcher) datagramTooLarge(c *connection, err error) {
+	if d == nil {
+		return
+	}
+	d.emit(ConnEvent{
+		Type:         ConnDatagramTooLarge,
+		FrontendAddr: c.frontendAddr,
+		BackendAddr:  c.backendAddr,
+		Start:        c.start,
+		Tag:          c.proxyStats.tag,
+		Context:      c.ctx,
+		TraceID:      c.traceID,
+		Err:          err,
+	})
+}
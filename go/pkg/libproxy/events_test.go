@@ -0,0 +1,131 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func collectEvents(t *testing.T, events chan ConnEvent, n int) []ConnEvent {
+	var received []ConnEvent
+	for len(received) < n {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for events, got %+v", received)
+		}
+	}
+	return received
+}
+
+func TestTCPConnectionEvents(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	events := make(chan ConnEvent, 10)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), OnConnection(func(e ConnEvent) { events <- e }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	client.Close()
+
+	received := collectEvents(t, events, 2)
+	opened, closed := received[0], received[1]
+	if opened.Type != ConnOpened || closed.Type != ConnClosed {
+		t.Fatalf("Expected an open then a close event but got %+v", received)
+	}
+	if opened.FrontendAddr.String() != client.LocalAddr().String() || opened.BackendAddr.String() != backend.LocalAddr().String() {
+		t.Fatalf("Unexpected addresses in %+v", opened)
+	}
+	if closed.BytesToBackend != uint64(testBufSize) || closed.BytesToFrontend != uint64(testBufSize) {
+		t.Fatalf("Expected %d bytes each way but got %+v", testBufSize, closed)
+	}
+	if closed.Duration <= 0 || closed.Err != nil {
+		t.Fatalf("Unexpected close event %+v", closed)
+	}
+}
+
+func TestTCPConnectionEventDialFailure(t *testing.T) {
+	events := make(chan ConnEvent, 10)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+	proxy, err := NewIPProxy(frontendAddr, backendAddr, OnConnection(func(e ConnEvent) { events <- e }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	event := collectEvents(t, events, 1)[0]
+	if event.Type != ConnClosed || event.Err == nil {
+		t.Fatalf("Expected a close event with the dial error but got %+v", event)
+	}
+}
+
+func TestUDPConnectionEvents(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	events := make(chan ConnEvent, 10)
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(),
+		OnConnection(func(e ConnEvent) { events <- e }), WithUDPIdleTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	received := collectEvents(t, events, 2)
+	if received[0].Type != ConnOpened || received[1].Type != ConnClosed {
+		t.Fatalf("Expected an open then a close event but got %+v", received)
+	}
+	if closed := received[1]; closed.BytesToBackend != uint64(testBufSize) || closed.BytesToFrontend != uint64(testBufSize) || closed.Err != nil {
+		t.Fatalf("Unexpected close event %+v", closed)
+	}
+}
+
+func TestEventsDroppedWhenCallbackIsSlow(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	delivered := make(chan ConnEvent, 2*eventQueueLength)
+	var s stats
+	d := newEventDispatcher(func(e ConnEvent) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release
+		delivered <- e
+	}, &s)
+	d.emit(ConnEvent{})
+	<-entered
+	// The first event is being delivered, so the rest fill the queue and
+	// then overflow it.
+	for i := 0; i < eventQueueLength+5; i++ {
+		d.emit(ConnEvent{})
+	}
+	if dropped := s.snapshot().DroppedEvents; dropped != 5 {
+		t.Fatalf("Expected 5 events to be dropped but got %d", dropped)
+	}
+	close(release)
+	collectEvents(t, delivered, eventQueueLength+1)
+}
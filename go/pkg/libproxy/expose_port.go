@@ -3,39 +3,41 @@ package libproxy
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"strings"
 )
 
-func ExposePort(host net.Addr, container net.Addr) (*os.File, error) {
+// ExposePort asks vpnkit to forward host to container, returning the ctl
+// file which keeps the port open. Only WithLogger applies to it.
+func ExposePort(host net.Addr, container net.Addr, opts ...Option) (*os.File, error) {
+	o := newOptions(opts)
 	name := host.Network() + ":" + host.String() + ":" + container.Network() + ":" + container.String()
-	log.Printf("exposePort %s\n", name)
+	o.logf("exposePort %s\n", name)
 	err := os.Mkdir("/port/"+name, 0)
 	if err != nil {
-		log.Printf("Failed to mkdir /port/%s: %#v\n", name, err)
+		o.logf("Failed to mkdir /port/%s: %#v\n", name, err)
 		return nil, err
 	}
 	ctl, err := os.OpenFile("/port/"+name+"/ctl", os.O_RDWR, 0)
 	if err != nil {
-		log.Printf("Failed to open /port/%s/ctl: %#v\n", name, err)
+		o.logf("Failed to open /port/%s/ctl: %#v\n", name, err)
 		return nil, err
 	}
 	_, err = ctl.WriteString(fmt.Sprintf("%s", name))
 	if err != nil {
-		log.Printf("Failed to open /port/%s/ctl: %#v\n", name, err)
+		o.logf("Failed to open /port/%s/ctl: %#v\n", name, err)
 		return nil, err
 	}
 	_, err = ctl.Seek(0, 0)
 	if err != nil {
-		log.Printf("Failed to seek on /port/%s/ctl: %#v\n", name, err)
+		o.logf("Failed to seek on /port/%s/ctl: %#v\n", name, err)
 		return nil, err
 	}
 	results := make([]byte, 100)
 	count, err := ctl.Read(results)
 	if err != nil {
-		log.Printf("Failed to read from /port/%s/ctl: %#v\n", name, err)
+		o.logf("Failed to read from /port/%s/ctl: %#v\n", name, err)
 		return nil, err
 	}
 	// We deliberately keep the control file open since 9P clunk
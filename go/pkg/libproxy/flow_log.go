@@ -0,0 +1,123 @@
+package libproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FlowRecord is the line WithFlowLog writes, as JSON, for every completed
+// TCP connection or UDP session.
+type FlowRecord struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Duration is in nanoseconds.
+	Duration time.Duration `json:"duration"`
+	Protocol string        `json:"protocol"`
+	// Src is the frontend client and Dst the backend. Addresses without
+	// a port, such as Unix sockets, only set the IP field, to the whole
+	// address, and Dst is empty if the backend couldn't be reached.
+	SrcIP           string `json:"src_ip"`
+	SrcPort         int    `json:"src_port"`
+	DstIP           string `json:"dst_ip"`
+	DstPort         int    `json:"dst_port"`
+	BytesToBackend  uint64 `json:"bytes_to_backend"`
+	BytesToFrontend uint64 `json:"bytes_to_frontend"`
+	// Reason is the error which ended the connection, or "closed" if it
+	// finished normally.
+	Reason string `json:"reason"`
+	Tag    string `json:"tag,omitempty"`
+	// TraceID is the ID given by WithTraceIDs.
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// WithFlowLog makes the proxy write a FlowRecord to w, one JSON object per
+// line, when each connection or UDP session closes. Records are written in
+// the background like OnConnection events, so a slow w never delays
+// forwarding. Proxies given the same Option share a lock and so may share w.
+func WithFlowLog(w io.Writer) Option {
+	l := &flowLog{w: w}
+	return func(o *options) {
+		o.flowLog = l
+	}
+}
+
+type flowLog struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+func (l *flowLog) write(o *options, event ConnEvent) {
+	record := newFlowRecord(event)
+	b, err := json.Marshal(&record)
+	if err != nil {
+		o.logf("Can't encode flow record for %v: %s", event.FrontendAddr, err)
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		o.logf("Can't write flow record for %v: %s", event.FrontendAddr, err)
+	}
+}
+
+func newFlowRecord(event ConnEvent) FlowRecord {
+	record := FlowRecord{
+		Start:           event.Start,
+		End:             event.Start.Add(event.Duration),
+		Duration:        event.Duration,
+		BytesToBackend:  event.BytesToBackend,
+		BytesToFrontend: event.BytesToFrontend,
+		Reason:          "closed",
+		Tag:             event.Tag,
+		TraceID:         event.TraceID,
+	}
+	if event.Err != nil {
+		record.Reason = event.Err.Error()
+	}
+	record.SrcIP, record.SrcPort = splitAddr(event.FrontendAddr)
+	record.DstIP, record.DstPort = splitAddr(event.BackendAddr)
+	if event.FrontendAddr != nil {
+		record.Protocol = event.FrontendAddr.Network()
+	} else if event.BackendAddr != nil {
+		record.Protocol = event.BackendAddr.Network()
+	}
+	return record
+}
+
+// splitAddr returns the host and port of addr, or the whole address and 0 if
+// it doesn't have a port.
+func splitAddr(addr net.Addr) (string, int) {
+	if addr == nil {
+		return "", 0
+	}
+	host, portString, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return addr.String(), 0
+	}
+	return host, port
+}
+
+// eventHandler returns what the proxy's eventDispatcher should call: the
+// OnConnection callback and the flow log, either, or nil for neither.
+func (o *options) eventHandler() func(ConnEvent) {
+	if o.flowLog == nil {
+		return o.onConnection
+	}
+	fn := o.onConnection
+	return func(event ConnEvent) {
+		if fn != nil {
+			fn(event)
+		}
+		if event.Type == ConnClosed {
+			o.flowLog.write(o, event)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flowBuffer collects flow log output.
+type flowBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (f *flowBuffer) Write(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.b.Write(p)
+}
+
+// waitForRecords waits for n lines and decodes them.
+func (f *flowBuffer) waitForRecords(t *testing.T, n int) []FlowRecord {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		f.m.Lock()
+		lines := strings.Split(strings.TrimSuffix(f.b.String(), "\n"), "\n")
+		f.m.Unlock()
+		if len(lines) >= n && lines[0] != "" {
+			var records []FlowRecord
+			for _, line := range lines {
+				var record FlowRecord
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("Can't decode flow record %q: %s", line, err)
+				}
+				records = append(records, record)
+			}
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d flow records but got %q", n, lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlowLog(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	var flows flowBuffer
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithFlowLog(&flows), WithTag("web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	client.Close()
+
+	record := flows.waitForRecords(t, 1)[0]
+	local := client.LocalAddr().(*net.TCPAddr)
+	backendAddr := backend.LocalAddr().(*net.TCPAddr)
+	if record.Protocol != "tcp" || record.SrcIP != "127.0.0.1" || record.SrcPort != local.Port || record.DstIP != "127.0.0.1" || record.DstPort != backendAddr.Port {
+		t.Fatalf("Expected a tcp flow from %v to %v but got %+v", local, backendAddr, record)
+	}
+	if record.BytesToBackend != uint64(testBufSize) || record.BytesToFrontend != uint64(testBufSize) {
+		t.Fatalf("Expected %d bytes each way but got %+v", testBufSize, record)
+	}
+	if record.Reason != "closed" || record.Tag != "web" {
+		t.Fatalf("Expected a normal close tagged web but got %+v", record)
+	}
+	if record.Start.IsZero() || record.End.Before(record.Start) || record.End.Sub(record.Start) != record.Duration {
+		t.Fatalf("Inconsistent times in %+v", record)
+	}
+}
+
+func TestFlowLogConcurrent(t *testing.T) {
+	var flows flowBuffer
+	flowLog := WithFlowLog(&flows)
+	// Two proxies, sharing the writer, whose backend can't be reached.
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	var proxies []Proxy
+	for i := 0; i < 2; i++ {
+		proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, backendAddr, flowLog, WithLogger(&recordingLogger{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+		go proxy.Run()
+		proxies = append(proxies, proxy)
+	}
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(proxy Proxy) {
+			defer wg.Done()
+			client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			client.Close()
+		}(proxies[i%2])
+	}
+	wg.Wait()
+	for _, record := range flows.waitForRecords(t, n) {
+		if record.Reason == "closed" || record.DstIP != "" {
+			t.Fatalf("Expected a dial failure but got %+v", record)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package libproxy
+
+// flusher is implemented by connections which buffer their writes, such as
+// one wrapping a *bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// flushTo flushes to, if it buffers, once a copy into it has finished, so
+// that the bytes it holds aren't lost when it is closed for writing. A
+// failure to flush is reported as a write error on that side.
+func flushTo(to interface{}, toBackend bool) (ErrSource, error) {
+	f, ok := to.(flusher)
+	if !ok {
+		return NoErrSource, nil
+	}
+	if err := f.Flush(); err != nil {
+		if toBackend {
+			return BackendWrite, err
+		}
+		return FrontendWrite, err
+	}
+	return NoErrSource, nil
+}
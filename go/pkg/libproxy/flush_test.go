@@ -0,0 +1,81 @@
+package libproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// bufferedWriteConn holds its writes until it is flushed, like a batching
+// wrapper around the backend connection.
+type bufferedWriteConn struct {
+	*net.TCPConn
+	w *bufio.Writer
+}
+
+func (c *bufferedWriteConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *bufferedWriteConn) Flush() error                { return c.w.Flush() }
+
+type bufferingDialer struct{}
+
+func (bufferingDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	tcp := conn.(*net.TCPConn)
+	return &bufferedWriteConn{TCPConn: tcp, w: bufio.NewWriterSize(tcp, 64*1024)}, nil
+}
+
+func TestFlushBufferedBackend(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithBackendDialer(bufferingDialer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	// Less than the buffer holds, so nothing reaches the backend before
+	// the copy finishes.
+	payload := []byte("trailing bytes")
+	if _, err := client.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+	echoed, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echoed, payload) {
+		t.Fatalf("Expected %q to be flushed to the backend but got %q back", payload, echoed)
+	}
+}
+
+type failingFlusher struct{}
+
+func (failingFlusher) Flush() error { return errors.New("flush failed") }
+
+func TestFlushTo(t *testing.T) {
+	if source, err := flushTo(&bytes.Buffer{}, true); source != NoErrSource || err != nil {
+		t.Fatalf("Expected nothing to flush but got %s, %v", source, err)
+	}
+	if source, err := flushTo(failingFlusher{}, true); source != BackendWrite || err == nil {
+		t.Fatalf("Expected a backend write error but got %s, %v", source, err)
+	}
+	if source, err := flushTo(failingFlusher{}, false); source != FrontendWrite || err == nil {
+		t.Fatalf("Expected a frontend write error but got %s, %v", source, err)
+	}
+}
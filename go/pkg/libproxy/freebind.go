@@ -0,0 +1,12 @@
+package libproxy
+
+// WithFreeBind makes NewIPProxy bind its TCP or UDP frontend with
+// IP_FREEBIND, so that it can listen on an address which isn't configured on
+// any interface yet and starts receiving traffic as soon as it is. Without it
+// NewBestEffortIPProxy skips such addresses. Only Linux supports this: on
+// other platforms a warning is logged and the address is bound normally.
+func WithFreeBind() Option {
+	return func(o *options) {
+		o.freeBind = true
+	}
+}
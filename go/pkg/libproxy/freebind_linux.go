@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setFreeBind sets IP_FREEBIND, which Linux also honours on IPv6 sockets.
+func setFreeBind(o *options, network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
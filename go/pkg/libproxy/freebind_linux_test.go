@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFreeBind(t *testing.T) {
+	// 192.0.2.1 is from TEST-NET-1, so shouldn't be on any interface.
+	unconfigured := net.ParseIP("192.0.2.1")
+	proxy, err := NewBestEffortIPProxy(&net.TCPAddr{IP: unconfigured}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithLogger(&recordingLogger{}))
+	if err != nil || proxy != nil {
+		t.Skipf("%v seems to be configured here: %v", unconfigured, err)
+	}
+	for _, addrs := range [][2]net.Addr{
+		{&net.TCPAddr{IP: unconfigured}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}},
+		{&net.UDPAddr{IP: unconfigured}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}},
+	} {
+		proxy, err := NewBestEffortIPProxy(addrs[0], addrs[1], WithFreeBind())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proxy == nil {
+			t.Fatalf("Expected %s/%v to be bound with IP_FREEBIND", addrs[0].Network(), addrs[0])
+		}
+		if host, _ := splitAddr(proxy.FrontendAddr()); !net.ParseIP(host).Equal(unconfigured) {
+			t.Fatalf("Expected to be bound on %v but got %v", unconfigured, proxy.FrontendAddr())
+		}
+		proxy.Close()
+	}
+}
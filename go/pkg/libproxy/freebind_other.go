@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package libproxy
+
+import "syscall"
+
+func setFreeBind(o *options, network, address string, c syscall.RawConn) error {
+	o.logf("IP_FREEBIND isn't supported on this platform: binding %s/%s without it", network, address)
+	return nil
+}
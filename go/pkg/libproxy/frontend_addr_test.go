@@ -0,0 +1,65 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+func TestFrontendAddrReportsEphemeralPort(t *testing.T) {
+	tcpBackend := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	udpBackend := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	port := func(addr net.Addr) int {
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			return a.Port
+		case *net.UDPAddr:
+			return a.Port
+		case *vsock.VsockAddr:
+			return int(a.Port)
+		}
+		t.Fatalf("Unexpected frontend address %#v", addr)
+		return 0
+	}
+	check := func(proxy Proxy, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+		if port(proxy.FrontendAddr()) == 0 {
+			t.Fatalf("Expected the port picked for %s/%v", proxy.FrontendAddr().Network(), proxy.FrontendAddr())
+		}
+	}
+	check(NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, tcpBackend))
+	check(NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, udpBackend))
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The address given is only what was asked for.
+	check(NewUDPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, udp, udpBackend))
+
+	if _, err := listenVsock(0); err != nil {
+		t.Skipf("Can't listen on vsock: %v", err)
+	}
+	check(NewIPProxy(&vsock.VsockAddr{CID: vsock.CIDAny}, tcpBackend))
+	check(NewVsockProxy(&vsock.VsockAddr{CID: vsock.CIDAny}, tcpBackend))
+	check(NewVsockProxy(&vsock.VsockAddr{CID: vsock.CIDAny}, udpBackend))
+}
+
+func TestVsockListenerClose(t *testing.T) {
+	listener, err := listenVsock(0)
+	if err != nil {
+		t.Skipf("Can't listen on vsock: %v", err)
+	}
+	proxy, err := NewIPProxyWithListener(listener, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	proxy.Close()
+	// Run is blocked in Accept, which Close must wake up.
+	waitReturns(t, proxy)
+}
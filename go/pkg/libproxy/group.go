@@ -0,0 +1,97 @@
+package libproxy
+
+import (
+	"sync"
+)
+
+// ProxyGroup manages the lifecycle of a set of proxies, running each of them
+// in its own goroutine. The zero value is an empty group ready to use.
+type ProxyGroup struct {
+	m       sync.Mutex
+	proxies []Proxy
+	running bool
+	closed  bool
+	errs    multiError // from the proxies' Run
+	runs    sync.WaitGroup
+}
+
+// Add adds proxy to the group. It is run straight away if RunAll has already
+// been called, and closed if CloseAll has.
+func (g *ProxyGroup) Add(proxy Proxy) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.closed {
+		proxy.Close()
+		return
+	}
+	g.proxies = append(g.proxies, proxy)
+	if g.running {
+		g.run(proxy)
+	}
+}
+
+// RunAll starts running every proxy in the group and returns without
+// waiting for them. A proxy whose Run fails doesn't stop the others: its
+// error is collected for Err. Calling RunAll again does nothing.
+func (g *ProxyGroup) RunAll() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.running || g.closed {
+		return
+	}
+	g.running = true
+	for _, proxy := range g.proxies {
+		g.run(proxy)
+	}
+}
+
+// run must be called with g.m held.
+func (g *ProxyGroup) run(proxy Proxy) {
+	h := RunAsync(proxy)
+	g.runs.Add(1)
+	go func() {
+		defer g.runs.Done()
+		if err := h.Wait(); err != nil {
+			g.m.Lock()
+			g.errs = append(g.errs, err)
+			g.m.Unlock()
+		}
+	}()
+}
+
+// Err returns the errors the proxies' Run have returned so far, or nil if
+// none has failed.
+func (g *ProxyGroup) Err() error {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return append(multiError(nil), g.errs...).errorOrNil()
+}
+
+// CloseAll closes every proxy in the group and waits until they have all
+// stopped. It returns the errors from closing them, if any. Proxies added
+// afterwards are closed straight away.
+func (g *ProxyGroup) CloseAll() error {
+	g.m.Lock()
+	g.closed = true
+	proxies := g.proxies
+	g.m.Unlock()
+	var errs multiError
+	for _, proxy := range proxies {
+		if err := proxy.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	g.runs.Wait()
+	for _, proxy := range proxies {
+		proxy.Wait()
+	}
+	return errs.errorOrNil()
+}
+
+// Stats returns the sum of the stats of all the proxies in the group.
+func (g *ProxyGroup) Stats() ProxyStats {
+	g.m.Lock()
+	proxies := g.proxies
+	g.m.Unlock()
+	return sumStats(proxies)
+}
@@ -0,0 +1,91 @@
+package libproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokenListener is a listener whose Accept fails.
+type brokenListener struct {
+	net.Listener
+}
+
+func (l *brokenListener) Accept() (net.Conn, error) {
+	return nil, errors.New("accept failed")
+}
+
+func TestProxyGroup(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	var g ProxyGroup
+	var proxies []Proxy
+	for i := 0; i < 2; i++ {
+		proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Add(proxy)
+		proxies = append(proxies, proxy)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := NewTCPProxy(&brokenListener{listener}, backend.LocalAddr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(broken)
+	g.RunAll()
+
+	// Added once the group is running, so run straight away.
+	late, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(late)
+	proxies = append(proxies, late)
+
+	for _, proxy := range proxies {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for g.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := g.Err(); err == nil || !strings.Contains(err.Error(), "accept failed") {
+		t.Fatalf("Expected the broken proxy's error but got %v", err)
+	}
+	if s := g.Stats(); s.TotalConns != int64(len(proxies)) {
+		t.Fatalf("Expected %d connections in total but got %+v", len(proxies), s)
+	}
+
+	if err := g.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	for _, proxy := range append(proxies, broken) {
+		select {
+		case <-proxy.Done():
+		default:
+			t.Fatalf("%v was still running after CloseAll", proxy.FrontendAddr())
+		}
+	}
+	after, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Add(after)
+	if _, err := net.Dial("tcp", after.FrontendAddr().String()); err == nil {
+		t.Fatal("Expected a proxy added after CloseAll to be closed")
+	}
+}
@@ -0,0 +1,106 @@
+package libproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// replyAfterEOF reads a whole request then writes its length back, the way
+// protocols which rely on half-close behave.
+func replyAfterEOF(t *testing.T, listener net.Listener) {
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Errorf("Can't read the request: %s", err)
+			return
+		}
+		conn.Write(request)
+		conn.Write([]byte("done"))
+	}()
+}
+
+// opaqueListener returns connections which can't be half-closed.
+type opaqueListener struct {
+	net.Listener
+}
+
+func (l *opaqueListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return struct{ net.Conn }{conn}, nil
+}
+
+func TestTCPProxyHalfClose(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	replyAfterEOF(t, backend)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(append([]byte{}, testBuf...), "done"...); !bytes.Equal(reply, expected) {
+		t.Fatalf("Expected %q after half-closing but got %q", expected, reply)
+	}
+}
+
+func TestTCPProxyWithoutHalfClose(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(&opaqueListener{listener}, backend.LocalAddr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	// The frontend can't be half-closed, so once the backend finishes
+	// the whole connection is closed.
+	client.(*net.TCPConn).CloseWrite()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected EOF but got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package libproxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// happyEyeballsDelay is how long to wait for a connection attempt before
+// starting the next one in parallel, as recommended by RFC 8305.
+var happyEyeballsDelay = 250 * time.Millisecond
+
+// WithHappyEyeballs makes a proxy created with NewTCPProxyHostname race the
+// addresses of its backend, alternating between IPv6 and IPv4, rather than
+// trying them one at a time. Each attempt gets a short head start before the
+// next one begins, the first to connect is used and the others are
+// cancelled. This avoids waiting for a connect timeout when one address
+// family is broken in the VM but DNS still returns it.
+func WithHappyEyeballs() Option {
+	return func(o *options) {
+		o.happyEyeballs = true
+	}
+}
+
+// interleaveFamilies reorders addrs to alternate between address families,
+// starting with the family of the first address.
+func interleaveFamilies(addrs []net.IPAddr) []net.IPAddr {
+	var first, second []net.IPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() == nil) == (addrs[0].IP.To4() == nil) {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	result := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+	return result
+}
+
+type dialResult struct {
+	conn Conn
+	err  error
+}
+
+// dialHappyEyeballs races connections to addrs and returns the first to
+// succeed, or the last error if none do.
+func (proxy *TCPProxy) dialHappyEyeballs(ctx context.Context, addrs []net.IPAddr) (Conn, error) {
+	addrs = interleaveFamilies(addrs)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	startNext := func() {
+		backendAddr := &net.TCPAddr{IP: addrs[next].IP, Port: proxy.backendPort, Zone: addrs[next].Zone}
+		go func() {
+			conn, err := proxy.opts.dialStreamContext(ctx, backendAddr)
+			results <- dialResult{conn, err}
+		}()
+		next++
+		pending++
+	}
+	startNext()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	var err error
+	for pending > 0 {
+		stagger := timer.C
+		if next == len(addrs) {
+			stagger = nil
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close any losers which connect before they
+				// notice the cancellation.
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if loser := <-results; loser.err == nil {
+							loser.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			err = result.err
+			// Don't wait for the stagger after a failure.
+			if next < len(addrs) {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				startNext()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-stagger:
+			startNext()
+			timer.Reset(happyEyeballsDelay)
+		}
+	}
+	return nil, err
+}
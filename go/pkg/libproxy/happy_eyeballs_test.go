@@ -0,0 +1,70 @@
+package libproxy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// blackholeDialer never connects to blackhole and reports when a dial to it
+// is abandoned. Other addresses are dialed normally.
+type blackholeDialer struct {
+	blackhole string
+	cancelled chan struct{}
+}
+
+func (d *blackholeDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *blackholeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if address == d.blackhole {
+		<-ctx.Done()
+		close(d.cancelled)
+		return nil, ctx.Err()
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	v6a, v6b := net.IPAddr{IP: net.ParseIP("fd00::1")}, net.IPAddr{IP: net.ParseIP("fd00::2")}
+	v4a, v4b := net.IPAddr{IP: net.ParseIP("10.0.0.1")}, net.IPAddr{IP: net.ParseIP("10.0.0.2")}
+	result := interleaveFamilies([]net.IPAddr{v6a, v6b, v4a, v4b})
+	if expected := []net.IPAddr{v6a, v4a, v6b, v4b}; !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %v but got %v", expected, result)
+	}
+}
+
+func TestTCPProxyHappyEyeballs(t *testing.T) {
+	defer func(d time.Duration) { happyEyeballsDelay = d }(happyEyeballsDelay)
+	happyEyeballsDelay = 50 * time.Millisecond
+
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	port := backend.LocalAddr().(*net.TCPAddr).Port
+	dialer := &blackholeDialer{
+		blackhole: net.JoinHostPort("::1", strconv.Itoa(port)),
+		cancelled: make(chan struct{}),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxyHostname(listener, net.JoinHostPort("service.local", strconv.Itoa(port)),
+		WithHappyEyeballs(), WithBackendDialer(dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Resolver = &fakeResolver{addrs: []net.IPAddr{{IP: net.IPv6loopback}, {IP: net.IPv4(127, 0, 0, 1)}}}
+	testProxy(t, "tcp", proxy)
+	select {
+	case <-dialer.cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The stalled IPv6 attempt wasn't cancelled")
+	}
+}
@@ -0,0 +1,130 @@
+package libproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck configures the probing of the backends of a proxy created with
+// NewTCPProxyMulti. Zero fields take the defaults given below.
+type HealthCheck struct {
+	// Interval is the time between probes of each backend. The default is
+	// 10 seconds.
+	Interval time.Duration
+	// Timeout is how long a probe may take to connect. The default is 1
+	// second.
+	Timeout time.Duration
+	// UnhealthyThreshold is the number of consecutive failed probes after
+	// which a backend is taken out of rotation. The default is 1.
+	UnhealthyThreshold int
+	// HealthyThreshold is the number of consecutive successful probes after
+	// which a backend which was taken out of rotation is put back. The
+	// default is 1.
+	HealthyThreshold int
+}
+
+// WithHealthCheck makes a proxy created with NewTCPProxyMulti probe each of
+// its backends by connecting to it periodically. Backends which fail are
+// skipped by new connections until they pass again; connections which are
+// already established are left alone. If every backend is down, new
+// connections try them all anyway.
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(o *options) {
+		if hc.Interval <= 0 {
+			hc.Interval = 10 * time.Second
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = time.Second
+		}
+		if hc.UnhealthyThreshold <= 0 {
+			hc.UnhealthyThreshold = 1
+		}
+		if hc.HealthyThreshold <= 0 {
+			hc.HealthyThreshold = 1
+		}
+		o.healthCheck = &hc
+	}
+}
+
+// WithFailFast makes a proxy created with NewTCPProxyMulti and
+// WithHealthCheck close new connections straight away, without trying to
+// dial, while every backend is failing its health checks, so that clients
+// get a prompt failure rather than waiting for dials which will probably
+// time out. The connections are reset with WithResetOnDialFailure. A backend
+// going down while WithDialRetry is retrying ends the retries too once none
+// is left.
+func WithFailFast() Option {
+	return func(o *options) {
+		o.failFast = true
+	}
+}
+
+// errNoHealthyBackend is why WithFailFast closes a connection.
+var errNoHealthyBackend = errors.New("every backend is failing its health checks")
+
+// failingFast reports whether new connections should be closed without a
+// dial.
+func (proxy *TCPProxy) failingFast() bool {
+	if !proxy.opts.failFast || proxy.opts.healthCheck == nil || proxy.multi == nil {
+		return false
+	}
+	for n := range proxy.multi.addrs {
+		if proxy.multi.isHealthy(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *multiBackend) isHealthy(n int) bool {
+	return atomic.LoadInt32(&m.down[n]) == 0
+}
+
+// checkHealth probes every backend each interval until ctx is cancelled.
+// The probes are dialed as the proxy dials its backends, so that they go
+// through WithBackendDialer and from WithSourceAddr.
+func (m *multiBackend) checkHealth(ctx context.Context, hc *HealthCheck, o *options) {
+	failures := make([]int, len(m.addrs))
+	successes := make([]int, len(m.addrs))
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		for n, addr := range m.addrs {
+			if o.probe(ctx, addr, hc.Timeout) {
+				failures[n] = 0
+				successes[n]++
+				if !m.isHealthy(n) && successes[n] >= hc.HealthyThreshold {
+					o.logf("Backend tcp/%v is healthy again", addr)
+					atomic.StoreInt32(&m.down[n], 0)
+				}
+			} else {
+				successes[n] = 0
+				failures[n]++
+				if m.isHealthy(n) && failures[n] >= hc.UnhealthyThreshold {
+					o.logf("Backend tcp/%v is unhealthy: taking it out of rotation", addr)
+					atomic.StoreInt32(&m.down[n], 1)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe reports whether a TCP connection to addr can be established.
+func (o *options) probe(ctx context.Context, addr *net.TCPAddr, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := o.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,170 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// healthIs reports whether the backends of proxy have the health given.
+func healthIs(proxy *TCPProxy, healthy ...bool) bool {
+	conns := proxy.BackendConns()
+	for i := range healthy {
+		if conns[i].Healthy != healthy[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTCPProxyHealthCheck(t *testing.T) {
+	good := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer good.Close()
+	good.Run()
+	flaky, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flakyAddr := flaky.Addr().(*net.TCPAddr)
+	flaky.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := HealthCheck{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond, UnhealthyThreshold: 2, HealthyThreshold: 2}
+	proxy, err := NewTCPProxyMulti(listener, []*net.TCPAddr{flakyAddr, good.LocalAddr().(*net.TCPAddr)}, WithHealthCheck(hc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	waitFor(t, func() bool { return healthIs(proxy, false, true) }, func() string {
+		return fmt.Sprintf("Timed out waiting for health [false true], got %+v", proxy.BackendConns())
+	})
+
+	// New connections all go to the healthy backend without trying the
+	// one which is down.
+	for i := 0; i < 4; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+	if conns := proxy.BackendConns(); conns[0].TotalConns != 0 || conns[1].TotalConns != 4 {
+		t.Fatalf("Expected every connection to go to the healthy backend but got %+v", conns)
+	}
+
+	// Once the backend comes back it is put back into rotation.
+	revived := NewEchoServer(t, "tcp", flakyAddr.String())
+	defer revived.Close()
+	revived.Run()
+	waitFor(t, func() bool { return healthIs(proxy, true, true) }, func() string {
+		return fmt.Sprintf("Timed out waiting for health [true true], got %+v", proxy.BackendConns())
+	})
+}
+
+// refusingDialer refuses to connect to one address and dials the rest.
+type refusingDialer struct {
+	refused string
+}
+
+func (d *refusingDialer) Dial(network, address string) (net.Conn, error) {
+	if address == d.refused {
+		return nil, errors.New("refused by the dialer")
+	}
+	return net.Dial(network, address)
+}
+
+func TestTCPProxyHealthCheckUsesBackendDialer(t *testing.T) {
+	var backends []*net.TCPAddr
+	for i := 0; i < 2; i++ {
+		backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+		defer backend.Close()
+		backend.Run()
+		backends = append(backends, backend.LocalAddr().(*net.TCPAddr))
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := HealthCheck{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond}
+	proxy, err := NewTCPProxyMulti(listener, backends, WithHealthCheck(hc), WithBackendDialer(&refusingDialer{refused: backends[0].String()}), WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	// The backend the dialer refuses is down, though it is listening.
+	waitFor(t, func() bool { return healthIs(proxy, false, true) }, func() string {
+		return fmt.Sprintf("Timed out waiting for health [false true], got %+v", proxy.BackendConns())
+	})
+
+	// Wait waits for the health checks to stop too.
+	proxy.Close()
+	done := make(chan struct{})
+	go func() {
+		proxy.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait didn't return after Close")
+	}
+}
+
+func TestTCPProxyFailFast(t *testing.T) {
+	backends := []*net.TCPAddr{unusedTCPAddr(t), unusedTCPAddr(t)}
+	for _, reset := range []bool{false, true} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := make(chan ConnEvent, 1)
+		hc := HealthCheck{Interval: 20 * time.Millisecond, Timeout: 100 * time.Millisecond}
+		opts := []Option{WithHealthCheck(hc), WithFailFast(), WithDialRetry(10, time.Second), OnConnection(func(e ConnEvent) { events <- e })}
+		if reset {
+			opts = append(opts, WithResetOnDialFailure())
+		}
+		proxy, err := NewTCPProxyMulti(listener, backends, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+		go proxy.Run()
+		waitFor(t, func() bool { return healthIs(proxy, false, false) }, func() string {
+			return fmt.Sprintf("Timed out waiting for health [false false], got %+v", proxy.BackendConns())
+		})
+
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		// Without fail-fast the retries would hold the connection for
+		// seconds.
+		client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = client.Read(make([]byte, 1))
+		if reset && !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("Expected the connection to be reset but got %v", err)
+		}
+		if !reset && err != io.EOF {
+			t.Fatalf("Expected the connection to be closed but got %v", err)
+		}
+		select {
+		case e := <-events:
+			if e.BackendAddr != nil || e.Err == nil || !strings.Contains(e.Err.Error(), errNoHealthyBackend.Error()) {
+				t.Fatalf("Expected the connection to fail fast but got %+v", e)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Didn't get the closed event")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Resolver looks up the IP addresses of a host. It is implemented by
+// *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// hostnameAddr is the net.Addr of a backend which is resolved per connection.
+type hostnameAddr struct {
+	network string
+	address string
+}
+
+func (a *hostnameAddr) Network() string { return a.network }
+func (a *hostnameAddr) String() string  { return a.address }
+
+// resolvedAddr is the address a backend host name was last resolved to and
+// connected to.
+type resolvedAddr struct {
+	addr net.Addr
+}
+
+func (proxy *TCPProxy) hostnameAddr() net.Addr {
+	return &hostnameAddr{network: "tcp", address: net.JoinHostPort(proxy.backendHost, strconv.Itoa(proxy.backendPort))}
+}
+
+// connectedTo records addr as the address BackendAddr reports.
+func (proxy *TCPProxy) connectedTo(addr net.Addr) {
+	if addr != nil {
+		proxy.resolved.Store(resolvedAddr{addr})
+	}
+}
+
+// NewTCPProxyHostname creates a new TCPProxy forwarding to backend, a
+// "host:port" string. The host is resolved again for every accepted
+// connection so that the proxy follows the backend when its IP changes.
+func NewTCPProxyHostname(listener net.Listener, backend string, opts ...Option) (*TCPProxy, error) {
+	host, portString, err := net.SplitHostPort(backend)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backend address %s: %s", backend, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		if port, err = net.LookupPort("tcp", portString); err != nil {
+			return nil, fmt.Errorf("Invalid backend port %s: %s", portString, err)
+		}
+	}
+	proxy, err := NewTCPProxy(listener, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.backendHost = host
+	proxy.backendPort = port
+	return proxy, nil
+}
+
+// dialHostname resolves the backend host and tries each of its addresses in
+// order until one of them connects.
+func (proxy *TCPProxy) dialHostname(ctx context.Context) (Conn, error) {
+	resolver := proxy.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, proxy.backendHost)
+	if err != nil {
+		return nil, fmt.Errorf("Can't resolve backend %s: %s", proxy.backendHost, err)
+	}
+	if addrs = proxy.opts.reachable(addrs); len(addrs) == 0 {
+		return nil, fmt.Errorf("Can't resolve backend %s: no addresses", proxy.backendHost)
+	}
+	if proxy.opts.happyEyeballs {
+		backend, dialErr := proxy.dialHappyEyeballs(ctx, addrs)
+		if dialErr == nil {
+			proxy.connectedTo(remoteAddr(backend))
+			return backend, nil
+		}
+		err = dialErr
+	} else {
+		for _, addr := range addrs {
+			backendAddr := &net.TCPAddr{IP: addr.IP, Port: proxy.backendPort, Zone: addr.Zone}
+			backend, dialErr := proxy.opts.dialStreamContext(ctx, backendAddr)
+			if dialErr == nil {
+				proxy.connectedTo(backendAddr)
+				return backend, nil
+			}
+			err = dialErr
+		}
+	}
+	return nil, fmt.Errorf("Can't forward traffic to backend %s: %s", proxy.hostnameAddr(), err)
+}
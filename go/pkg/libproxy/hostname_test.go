@@ -0,0 +1,50 @@
+package libproxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+type fakeResolver struct {
+	addrs   []net.IPAddr
+	lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	return r.addrs, nil
+}
+
+func TestTCPProxyHostname(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	port := backend.LocalAddr().(*net.TCPAddr).Port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxyHostname(listener, net.JoinHostPort("service.local", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first address refuses connections so the second must be tried.
+	resolver := &fakeResolver{addrs: []net.IPAddr{{IP: net.IPv6loopback}, {IP: net.IPv4(127, 0, 0, 1)}}}
+	proxy.Resolver = resolver
+	configured := net.JoinHostPort("service.local", strconv.Itoa(port))
+	if addr := proxy.BackendAddr().String(); addr != configured {
+		t.Fatalf("Expected %s before resolving but got %s", configured, addr)
+	}
+	testProxy(t, "tcp", proxy)
+	if resolver.lookups != 1 {
+		t.Fatalf("Expected 1 lookup but got %d", resolver.lookups)
+	}
+	if addr := proxy.BackendAddr().String(); addr != backend.LocalAddr().String() {
+		t.Fatalf("Expected the resolved address %s but got %s", backend.LocalAddr(), addr)
+	}
+	if addrs := proxy.BackendAddrs(); len(addrs) != 1 || addrs[0].String() != configured {
+		t.Fatalf("Expected just %s but got %v", configured, addrs)
+	}
+}
@@ -0,0 +1,75 @@
+package libproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// NewHTTPConnectProxy creates a new TCPProxy which acts as an HTTP proxy on
+// listener, tunnelling the connections clients ask for with the CONNECT
+// method. The destinations clients may ask for can be limited with
+// WithAllowDestinationCIDRs and WithDenyDestinationCIDRs.
+func NewHTTPConnectProxy(listener net.Listener, opts ...Option) (*TCPProxy, error) {
+	proxy, err := NewTCPProxy(listener, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.negotiator = &httpConnect{}
+	return proxy, nil
+}
+
+// httpConnect is the negotiator for HTTP CONNECT tunnels.
+type httpConnect struct{}
+
+func (h *httpConnect) String() string { return "HTTP CONNECT" }
+
+func (h *httpConnect) request(client Conn) (Conn, string, error) {
+	r := bufio.NewReader(client)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		writeHTTPStatus(client, http.StatusBadRequest)
+		return client, "", err
+	}
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(client, http.StatusMethodNotAllowed)
+		return client, "", fmt.Errorf("unsupported method %s", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		writeHTTPStatus(client, http.StatusBadRequest)
+		return client, "", err
+	}
+	// The client may have sent data after its request without waiting for
+	// the reply, in which case it is in the bufio.Reader.
+	if r.Buffered() > 0 {
+		client = &bufferedConn{Conn: client, r: r}
+	}
+	return client, req.Host, nil
+}
+
+func (h *httpConnect) reply(client Conn, backend net.Addr, err error) error {
+	if err == nil {
+		_, err = io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		return err
+	}
+	if err == errNotPermitted {
+		return writeHTTPStatus(client, http.StatusForbidden)
+	}
+	return writeHTTPStatus(client, http.StatusBadGateway)
+}
+
+func writeHTTPStatus(w io.Writer, code int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	return err
+}
+
+// bufferedConn is a Conn whose first reads come from data already buffered
+// by r.
+type bufferedConn struct {
+	Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) { return b.r.Read(p) }
@@ -0,0 +1,110 @@
+package libproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestHTTPConnectProxy(t *testing.T, opts ...Option) *TCPProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewHTTPConnectProxy(listener, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	return proxy
+}
+
+// httpRequest sends request to the proxy and returns the connection and the
+// status code of the response.
+func httpRequest(t *testing.T, proxy Proxy, request string) (net.Conn, int) {
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(client, request); err != nil {
+		t.Fatal(err)
+	}
+	// Read the status line and headers a byte at a time so that nothing
+	// after them is consumed.
+	r := bufio.NewReaderSize(&oneByteReader{client}, 16)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, resp.StatusCode
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) { return o.r.Read(p[:1]) }
+
+func TestHTTPConnect(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy := newTestHTTPConnectProxy(t)
+	defer proxy.Close()
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backend.LocalAddr(), backend.LocalAddr())
+	client, code := httpRequest(t, proxy, request)
+	defer client.Close()
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", code)
+	}
+	roundTrip(t, client)
+}
+
+func TestHTTPConnectEarlyData(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy := newTestHTTPConnectProxy(t)
+	defer proxy.Close()
+	// The data is sent along with the request, before the reply.
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n%s", backend.LocalAddr(), testBuf)
+	client, code := httpRequest(t, proxy, request)
+	defer client.Close()
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", code)
+	}
+	echo := make([]byte, testBufSize)
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(testBuf) {
+		t.Fatalf("Expected %q but got %q", testBuf, echo)
+	}
+}
+
+func TestHTTPConnectErrors(t *testing.T) {
+	proxy := newTestHTTPConnectProxy(t, WithDenyDestinationCIDRs(mustParseCIDRs(t, "10.0.0.0/8")))
+	defer proxy.Close()
+	tests := []struct {
+		request string
+		code    int
+	}{
+		{"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusMethodNotAllowed},
+		{"this isn't HTTP\r\n\r\n", http.StatusBadRequest},
+		{"CONNECT no-port HTTP/1.1\r\n\r\n", http.StatusBadRequest},
+		{"CONNECT 10.0.0.1:80 HTTP/1.1\r\n\r\n", http.StatusForbidden},
+		{fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", unusedTCPAddr(t)), http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		client, code := httpRequest(t, proxy, test.request)
+		client.Close()
+		if code != test.code {
+			t.Errorf("Expected %d for %q but got %d", test.code, test.request, code)
+		}
+	}
+}
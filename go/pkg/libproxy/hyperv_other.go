@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package libproxy
+
+import "net"
+
+// Hyper-V sockets are only used on Windows: the vendored hvsock package
+// needs cgo on Linux.
+
+func dialHyperV(addr net.Addr) (Conn, bool, error) {
+	return nil, false, nil
+}
+
+func isHyperVAddr(addr net.Addr) bool {
+	return false
+}
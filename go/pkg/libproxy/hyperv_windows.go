@@ -0,0 +1,88 @@
+//go:build windows
+// +build windows
+
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+)
+
+// NewHyperVProxy creates a Proxy listening for Hyper-V socket connections
+// from any VM to serviceGUID and forwarding them to backend, which may itself
+// be a Hyper-V socket address returned by ParseHyperVAddr.
+func NewHyperVProxy(serviceGUID string, backend net.Addr, opts ...Option) (Proxy, error) {
+	serviceID, err := parseGUID(serviceGUID)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse Hyper-V service ID %s: %s", serviceGUID, err)
+	}
+	listener, err := hvsock.Listen(hvsock.HypervAddr{VMID: hvsock.GUIDWildcard, ServiceID: serviceID})
+	if err != nil {
+		return nil, fmt.Errorf("Can't listen on Hyper-V service %s: %s", serviceGUID, err)
+	}
+	proxy, err := NewIPProxyWithListener(listener, backend, opts...)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// hyperVPartitions are the well-known VM IDs which can be given by name.
+var hyperVPartitions = map[string]hvsock.GUID{
+	"wildcard": hvsock.GUIDWildcard,
+	"children": hvsock.GUIDChildren,
+	"loopback": hvsock.GUIDLoopback,
+	"parent":   hvsock.GUIDParent,
+}
+
+// ParseHyperVAddr parses a Hyper-V socket address of the form
+// "<vm id>:<service id>", where each GUID may be wrapped in braces and the VM
+// ID may also be one of "wildcard", "children", "loopback" or "parent". A
+// service ID on its own means any VM.
+func ParseHyperVAddr(s string) (hvsock.HypervAddr, error) {
+	vm, service := "wildcard", s
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		vm, service = s[:i], s[i+1:]
+	}
+	serviceID, err := parseGUID(service)
+	if err != nil {
+		return hvsock.HypervAddr{}, fmt.Errorf("Can't parse Hyper-V service ID in %s: %s", s, err)
+	}
+	vmID, ok := hyperVPartitions[strings.ToLower(vm)]
+	if !ok {
+		if vmID, err = parseGUID(vm); err != nil {
+			return hvsock.HypervAddr{}, fmt.Errorf("Can't parse Hyper-V VM ID in %s: %s", s, err)
+		}
+	}
+	return hvsock.HypervAddr{VMID: vmID, ServiceID: serviceID}, nil
+}
+
+func parseGUID(s string) (hvsock.GUID, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	if len(s) != 36 {
+		return hvsock.GUID{}, fmt.Errorf("%q isn't a GUID", s)
+	}
+	return hvsock.GUIDFromString(s)
+}
+
+// dialHyperV connects to addr if it is a Hyper-V socket address.
+func dialHyperV(addr net.Addr) (Conn, bool, error) {
+	hvAddr, ok := addr.(hvsock.HypervAddr)
+	if !ok {
+		return nil, false, nil
+	}
+	conn, err := hvsock.Dial(hvAddr)
+	if err != nil {
+		return nil, true, err
+	}
+	return conn, true, nil
+}
+
+func isHyperVAddr(addr net.Addr) bool {
+	_, ok := addr.(hvsock.HypervAddr)
+	return ok
+}
@@ -0,0 +1,53 @@
+//go:build windows
+// +build windows
+
+package libproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+)
+
+func TestParseHyperVAddr(t *testing.T) {
+	service, _ := hvsock.GUIDFromString("0b95756a-9985-48ad-9470-78e060895be7")
+	vm, _ := hvsock.GUIDFromString("3f7bb3e2-1b0c-4a8e-9e4c-3cc4c4c2a8b1")
+	for _, c := range []struct {
+		s    string
+		addr hvsock.HypervAddr
+	}{
+		{"0b95756a-9985-48ad-9470-78e060895be7", hvsock.HypervAddr{VMID: hvsock.GUIDWildcard, ServiceID: service}},
+		{"{0B95756A-9985-48AD-9470-78E060895BE7}", hvsock.HypervAddr{VMID: hvsock.GUIDWildcard, ServiceID: service}},
+		{"parent:0b95756a-9985-48ad-9470-78e060895be7", hvsock.HypervAddr{VMID: hvsock.GUIDParent, ServiceID: service}},
+		{"3f7bb3e2-1b0c-4a8e-9e4c-3cc4c4c2a8b1:{0b95756a-9985-48ad-9470-78e060895be7}", hvsock.HypervAddr{VMID: vm, ServiceID: service}},
+	} {
+		addr, err := ParseHyperVAddr(c.s)
+		if err != nil {
+			t.Fatalf("Can't parse %s: %s", c.s, err)
+		}
+		if addr != c.addr {
+			t.Fatalf("Expected %s to parse as %s, got %s", c.s, c.addr, addr)
+		}
+	}
+	for _, s := range []string{"", "parent:", "0b95756a", "nowhere:0b95756a-9985-48ad-9470-78e060895be7", "0b95756a-9985-48ad-9470-78e060895bzz"} {
+		if _, err := ParseHyperVAddr(s); err == nil {
+			t.Fatalf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestHyperVBackendAccepted(t *testing.T) {
+	addr, err := ParseHyperVAddr("parent:0b95756a-9985-48ad-9470-78e060895be7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	if proxy.BackendAddr() != addr {
+		t.Fatalf("Expected backend %s, got %s", addr, proxy.BackendAddr())
+	}
+}
@@ -0,0 +1,76 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// InterfaceAddr returns the address to bind a frontend to on the network
+// interface called name, such as "eth1", with the given port. network is
+// one of "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6" and says both the
+// type of the address returned, *net.TCPAddr or *net.UDPAddr, and which
+// family it must be. "tcp" and "udp" prefer IPv4 but fall back to IPv6.
+// Link-local IPv6 addresses, which are returned with the interface as their
+// zone, are only used if the interface has no other address of the family.
+// It fails if the interface has no address of the family asked for.
+func InterfaceAddr(name, network string, port int) (net.Addr, error) {
+	var families []int
+	switch network {
+	case "tcp", "udp":
+		families = []int{4, 6}
+	case "tcp4", "udp4":
+		families = []int{4}
+	case "tcp6", "udp6":
+		families = []int{6}
+	default:
+		return nil, fmt.Errorf("Can't bind to interface %s: unsupported network %s", name, network)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("Can't bind to interface %s: %s", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Can't list the addresses of interface %s: %s", name, err)
+	}
+	ip, zone := pickInterfaceIP(addrs, families, name)
+	if ip == nil {
+		return nil, fmt.Errorf("Can't bind to interface %s: it has no %s address", name, network)
+	}
+	if network[:3] == "udp" {
+		return &net.UDPAddr{IP: ip, Port: port, Zone: zone}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port, Zone: zone}, nil
+}
+
+// pickInterfaceIP returns the first of addrs in the first of families, 4 or
+// 6, which has one, skipping link-local addresses unless there is nothing
+// else. Link-local addresses are returned with zone set to name.
+func pickInterfaceIP(addrs []net.Addr, families []int, name string) (net.IP, string) {
+	for _, family := range families {
+		var linkLocal net.IP
+		for _, addr := range addrs {
+			var ip net.IP
+			switch a := addr.(type) {
+			case *net.IPNet:
+				ip = a.IP
+			case *net.IPAddr:
+				ip = a.IP
+			}
+			if ip == nil || (ip.To4() != nil) != (family == 4) {
+				continue
+			}
+			if ip.IsLinkLocalUnicast() {
+				if linkLocal == nil {
+					linkLocal = ip
+				}
+				continue
+			}
+			return ip, ""
+		}
+		if linkLocal != nil {
+			return linkLocal, name
+		}
+	}
+	return nil, ""
+}
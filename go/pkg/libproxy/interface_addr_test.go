@@ -0,0 +1,88 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPickInterfaceIP(t *testing.T) {
+	cidr := func(s string) net.Addr {
+		ip, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipNet.IP = ip
+		return ipNet
+	}
+	addrs := []net.Addr{cidr("fe80::1/64"), cidr("2001:db8::1/64"), cidr("192.0.2.1/24")}
+	for _, test := range []struct {
+		families []int
+		addrs    []net.Addr
+		ip       string
+		zone     string
+	}{
+		{[]int{4, 6}, addrs, "192.0.2.1", ""},
+		{[]int{6}, addrs, "2001:db8::1", ""},
+		{[]int{4, 6}, addrs[:1], "fe80::1", "eth1"},
+		{[]int{4}, addrs[:2], "", ""},
+	} {
+		ip, zone := pickInterfaceIP(test.addrs, test.families, "eth1")
+		if test.ip == "" {
+			if ip != nil {
+				t.Fatalf("Expected no address of %v in %v but got %s", test.families, test.addrs, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(test.ip)) || zone != test.zone {
+			t.Fatalf("Expected %s%%%s from %v in %v but got %s%%%s", test.ip, test.zone, test.families, test.addrs, ip, zone)
+		}
+	}
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	loopback := loopbackInterface(t)
+	addr, err := InterfaceAddr(loopback, "tcp4", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || !tcp.IP.IsLoopback() {
+		t.Fatalf("Expected a loopback TCP address but got %#v", addr)
+	}
+	proxy, err := NewIPProxy(addr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Close()
+
+	if addr, err := InterfaceAddr(loopback, "udp", 53); err != nil {
+		t.Fatal(err)
+	} else if udp, ok := addr.(*net.UDPAddr); !ok || udp.Port != 53 {
+		t.Fatalf("Expected a UDP address on port 53 but got %#v", addr)
+	}
+	if _, err := InterfaceAddr("no-such-interface0", "tcp", 0); err == nil {
+		t.Fatal("Expected an error for a missing interface")
+	}
+	if _, err := InterfaceAddr(loopback, "unix", 0); err == nil {
+		t.Fatal("Expected an error for a non-IP network")
+	}
+}
+
+// loopbackInterface returns the name of an interface with an IPv4 loopback
+// address.
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.IP.IsLoopback() {
+				return iface.Name
+			}
+		}
+	}
+	t.Skip("No IPv4 loopback interface")
+	return ""
+}
@@ -0,0 +1,173 @@
+// Package libproxytest provides a fake libproxy.Proxy for testing code which
+// manages proxies, without opening any sockets.
+//
+// A FakeProxy's Run blocks until the proxy is closed, or until Fail makes it
+// return an error as a real proxy would when it stops forwarding:
+//
+//	proxy := libproxytest.NewFakeProxy(frontend, backend)
+//	go manager.Supervise(proxy)
+//	proxy.Fail(errors.New("listener went away"))
+//	proxy.Wait()
+//	if !proxy.Closed() {
+//		t.Fatal("Expected the manager to close a proxy which failed")
+//	}
+package libproxytest
+
+import (
+	"net"
+	"sync"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+)
+
+// FakeProxy is an in-memory libproxy.Proxy which records how it is used.
+type FakeProxy struct {
+	frontendAddr net.Addr
+	backendAddr  net.Addr
+	stop         chan struct{} // closed by Close or Fail
+	runs         sync.WaitGroup
+	done         chan struct{} // closed once stopped and every Run returned
+
+	m           sync.Mutex
+	stopped     bool
+	runErr      error
+	closeErr    error
+	runCalls    int
+	closeCalls  int
+	stats       libproxy.ProxyStats
+	connections []libproxy.ConnInfo
+}
+
+var _ libproxy.Proxy = &FakeProxy{}
+
+// NewFakeProxy creates a FakeProxy with the given addresses.
+func NewFakeProxy(frontend, backend net.Addr) *FakeProxy {
+	return &FakeProxy{
+		frontendAddr: frontend,
+		backendAddr:  backend,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Run blocks until the proxy is closed, when it returns nil, or until Fail is
+// called, when it returns the error given to Fail. If the proxy has already
+// stopped it returns at once.
+func (p *FakeProxy) Run() error {
+	p.m.Lock()
+	p.runCalls++
+	if !p.stopped {
+		p.runs.Add(1)
+		defer p.runs.Done()
+	}
+	p.m.Unlock()
+	<-p.stop
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.runErr
+}
+
+// Fail makes Run return err, as if forwarding had stopped on its own. It does
+// nothing if the proxy has already stopped.
+func (p *FakeProxy) Fail(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.stopped {
+		return
+	}
+	p.runErr = err
+	p.stopLocked()
+}
+
+// SetCloseError sets the error returned by the first call to Close.
+func (p *FakeProxy) SetCloseError(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.closeErr = err
+}
+
+// Close stops the proxy. The first call returns the error set with
+// SetCloseError, later calls return nil. Every call is counted.
+func (p *FakeProxy) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.closeCalls++
+	if p.closeCalls > 1 {
+		return nil
+	}
+	if !p.stopped {
+		p.stopLocked()
+	}
+	return p.closeErr
+}
+
+func (p *FakeProxy) stopLocked() {
+	p.stopped = true
+	close(p.stop)
+	go func() {
+		p.runs.Wait()
+		close(p.done)
+	}()
+}
+
+// Wait blocks until the proxy has stopped and every call to Run has returned.
+func (p *FakeProxy) Wait() { <-p.done }
+
+// Done returns a channel which is closed when Wait would return.
+func (p *FakeProxy) Done() <-chan struct{} { return p.done }
+
+// RunCalls returns the number of times Run has been called.
+func (p *FakeProxy) RunCalls() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.runCalls
+}
+
+// CloseCalls returns the number of times Close has been called.
+func (p *FakeProxy) CloseCalls() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.closeCalls
+}
+
+// Closed reports whether Close has been called.
+func (p *FakeProxy) Closed() bool {
+	return p.CloseCalls() > 0
+}
+
+// FrontendAddr returns the frontend address.
+func (p *FakeProxy) FrontendAddr() net.Addr { return p.frontendAddr }
+
+// BackendAddr returns the backend address.
+func (p *FakeProxy) BackendAddr() net.Addr { return p.backendAddr }
+
+// BackendAddrs returns the backend address.
+func (p *FakeProxy) BackendAddrs() []net.Addr { return []net.Addr{p.backendAddr} }
+
+// SetStats sets what Stats returns.
+func (p *FakeProxy) SetStats(stats libproxy.ProxyStats) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.stats = stats
+}
+
+// Stats returns the stats set with SetStats.
+func (p *FakeProxy) Stats() libproxy.ProxyStats {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.stats
+}
+
+// SetConnections sets what Connections returns.
+func (p *FakeProxy) SetConnections(conns []libproxy.ConnInfo) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.connections = conns
+}
+
+// Connections returns the connections set with SetConnections.
+func (p *FakeProxy) Connections() []libproxy.ConnInfo {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.connections
+}
@@ -0,0 +1,105 @@
+package libproxytest
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	frontend = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	backend  = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 80}
+)
+
+func runInBackground(p *FakeProxy) chan error {
+	done := make(chan error, 1)
+	go func() { done <- p.Run() }()
+	return done
+}
+
+func waitForRun(t *testing.T, done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return")
+		return nil
+	}
+}
+
+func TestFakeProxyClose(t *testing.T) {
+	p := NewFakeProxy(frontend, backend)
+	if p.FrontendAddr() != frontend || p.BackendAddr() != backend {
+		t.Fatalf("Unexpected addresses %v and %v", p.FrontendAddr(), p.BackendAddr())
+	}
+	closeErr := errors.New("close failed")
+	p.SetCloseError(closeErr)
+	done := runInBackground(p)
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v before Close", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := p.Close(); err != closeErr {
+		t.Fatalf("Expected %v from the first Close but got %v", closeErr, err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Expected nil from the second Close but got %v", err)
+	}
+	if err := waitForRun(t, done); err != nil {
+		t.Fatalf("Expected Run to return nil after Close but got %v", err)
+	}
+	p.Wait()
+	if p.RunCalls() != 1 || p.CloseCalls() != 2 || !p.Closed() {
+		t.Fatalf("Unexpected calls: %d Run, %d Close", p.RunCalls(), p.CloseCalls())
+	}
+}
+
+func TestFakeProxyFail(t *testing.T) {
+	p := NewFakeProxy(frontend, backend)
+	done := runInBackground(p)
+	failure := errors.New("listener went away")
+	p.Fail(failure)
+	if err := waitForRun(t, done); err != failure {
+		t.Fatalf("Expected %v from Run but got %v", failure, err)
+	}
+	p.Wait()
+	if p.Closed() {
+		t.Fatal("Expected Fail not to count as Close")
+	}
+	// Run after the proxy has stopped returns at once, as it does for real
+	// proxies.
+	if err := p.Run(); err != failure {
+		t.Fatalf("Expected %v from a later Run but got %v", failure, err)
+	}
+	if err := p.Close(); err != nil || !p.Closed() {
+		t.Fatalf("Unexpected Close after Fail: %v", err)
+	}
+}
+
+func TestFakeProxyWaitWithoutRun(t *testing.T) {
+	p := NewFakeProxy(frontend, backend)
+	p.Close()
+	p.Wait()
+	if p.RunCalls() != 0 {
+		t.Fatalf("Expected no Run calls but got %d", p.RunCalls())
+	}
+}
+
+func TestFakeProxyDone(t *testing.T) {
+	p := NewFakeProxy(frontend, backend)
+	done := runInBackground(p)
+	select {
+	case <-p.Done():
+		t.Fatal("Done before the proxy was stopped")
+	default:
+	}
+	p.Close()
+	waitForRun(t, done)
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not done after Close")
+	}
+}
@@ -0,0 +1,62 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPMaxConnections(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, backend.LocalAddr().(*net.TCPAddr), WithMaxConnections(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		// The third connection completes the handshake in the kernel but
+		// is not accepted by the proxy.
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 2 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 2 in %+v", proxy.Stats()) })
+	time.Sleep(100 * time.Millisecond)
+	if stats := proxy.Stats(); stats.ActiveConns != 2 || stats.TotalConns != 2 {
+		t.Fatalf("Expected the limit of 2 connections to hold but got %+v", stats)
+	}
+	clients[0].Close()
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.TotalConns == 3
+	}, func() string { return fmt.Sprintf("Timed out waiting for TotalConns == 3 in %+v", stats) })
+	if stats.ActiveConns > 2 {
+		t.Fatalf("Expected at most 2 active connections but got %+v", stats)
+	}
+	roundTrip(t, clients[2])
+
+	// Close must not block on the accept loop waiting for a slot.
+	done := make(chan struct{})
+	go func() {
+		proxy.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close blocked")
+	}
+}
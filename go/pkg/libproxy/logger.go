@@ -0,0 +1,69 @@
+package libproxy
+
+import (
+	"log"
+	"net"
+)
+
+// Logger is where a proxy writes its log messages. *log.Logger implements
+// it, and so can a few lines of adapter around most structured loggers.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// DebugLogger is a Logger with a separate debug level. The messages enabled
+// by WithVerboseLogging go to Debugf when the logger implements it.
+type DebugLogger interface {
+	Logger
+	Debugf(format string, args ...interface{})
+}
+
+// WithLogger makes the proxy log through l instead of the standard logger.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// logf logs through the configured Logger, or the standard logger if there
+// isn't one.
+func (o *options) logf(format string, args ...interface{}) {
+	if o.logger != nil {
+		o.logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// WithVerboseLogging makes the proxy log the addresses of each connection it
+// accepts and each UDP session it starts: the client's, the frontend's, and
+// the local one and the backend's of the backend connection, which is the
+// address a hostname resolved to or a selector chose, along with the ID
+// given by WithTraceIDs if any. Nothing is logged per datagram.
+func WithVerboseLogging() Option {
+	return func(o *options) {
+		o.verbose = true
+	}
+}
+
+// debugf logs at debug level if WithVerboseLogging was given.
+func (o *options) debugf(format string, args ...interface{}) {
+	if !o.verbose {
+		return
+	}
+	if l, ok := o.logger.(DebugLogger); ok {
+		l.Debugf(format, args...)
+		return
+	}
+	o.logf(format, args...)
+}
+
+// logForwarding logs the addresses of c, a new connection or UDP session
+// accepted on frontend and forwarded from local, at debug level.
+func (o *options) logForwarding(network string, c *connection, frontend, local net.Addr) {
+	if c.traceID != "" {
+		o.debugf("Forwarding %s from %v to %v via %v to %v, trace %s", network, c.frontendAddr, frontend, local, c.backendAddr, c.traceID)
+		return
+	}
+	o.debugf("Forwarding %s from %v to %v via %v to %v", network, c.frontendAddr, frontend, local, c.backendAddr)
+}
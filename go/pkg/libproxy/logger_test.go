@@ -0,0 +1,161 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingLogger keeps the messages logged through it.
+type recordingLogger struct {
+	m        sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) waitFor(t *testing.T, substr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.m.Lock()
+		for _, message := range l.messages {
+			if strings.Contains(message, substr) {
+				l.m.Unlock()
+				return
+			}
+		}
+		l.m.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected a message containing %q to be logged", substr)
+}
+
+func TestWithLoggerBestEffort(t *testing.T) {
+	logger := &recordingLogger{}
+	proxy, err := NewBestEffortIPProxy(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithLogger(logger))
+	if err != nil || proxy != nil {
+		t.Skipf("192.0.2.1 seems to be configured here: %v", err)
+	}
+	logger.waitFor(t, "doesn't exist in the VM")
+}
+
+func TestWithLoggerTCPProxy(t *testing.T) {
+	logger := &recordingLogger{}
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithLogger(logger), WithDenyCIDRs(mustParseCIDRs(t, "127.0.0.0/8")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	logger.waitFor(t, "Refusing connection")
+}
+
+// debugLogger records its debug messages with a prefix.
+type debugLogger struct {
+	recordingLogger
+}
+
+func (l *debugLogger) Debugf(format string, args ...interface{}) {
+	l.Printf("debug: "+format, args...)
+}
+
+func (l *debugLogger) count(substr string) int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	n := 0
+	for _, message := range l.messages {
+		if strings.Contains(message, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestVerboseLoggingTCP(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	logger := &debugLogger{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(backend.LocalAddr().String())
+	proxy, err := NewTCPProxyHostname(listener, net.JoinHostPort("localhost", port), WithLogger(logger), WithVerboseLogging())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	// The hostname is logged resolved.
+	logger.waitFor(t, fmt.Sprintf("debug: Forwarding tcp from %s to %s via ", client.LocalAddr(), client.RemoteAddr()))
+	logger.waitFor(t, " to 127.0.0.1:"+port)
+}
+
+func TestVerboseLoggingUDP(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	logger := &debugLogger{}
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithLogger(logger), WithVerboseLogging())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		roundTrip(t, client)
+	}
+	logger.waitFor(t, fmt.Sprintf("debug: Forwarding udp from %s to %s via ", client.LocalAddr(), client.RemoteAddr()))
+	if n := logger.count("Forwarding udp"); n != 1 {
+		t.Fatalf("Expected one message for the session rather than per datagram but got %d", n)
+	}
+}
+
+func TestVerboseLoggingOff(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	logger := &debugLogger{}
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	if n := logger.count("Forwarding"); n != 0 {
+		t.Fatalf("Expected nothing to be logged by default but got %d messages", n)
+	}
+}
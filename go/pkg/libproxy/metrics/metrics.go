@@ -0,0 +1,225 @@
+// Package metrics exposes the statistics of libproxy proxies in the
+// Prometheus text exposition format.
+//
+// A Collector gathers the per-connection events of one proxy and a Registry
+// holds the proxies being exported:
+//
+//	collector := metrics.NewCollector()
+//	proxy, err := libproxy.NewIPProxy(frontend, backend, collector.Option())
+//	...
+//	proxy = metrics.DefaultRegistry.Register(proxy, collector)
+//	http.Handle("/metrics", metrics.DefaultRegistry)
+//
+// The Proxy returned by Register removes itself from the registry when it is
+// closed, so that proxies which come and go don't leave stale series behind.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+)
+
+// DurationBuckets are the upper bounds, in seconds, of the connection
+// duration histogram buckets.
+var DurationBuckets = []float64{0.01, 0.1, 1, 10, 60, 600, 3600}
+
+// Collector gathers the connection events of a proxy. It must be passed to
+// the proxy's constructor with Option.
+type Collector struct {
+	m          sync.Mutex
+	dialErrors uint64
+	buckets    []uint64 // cumulative counts, one per DurationBuckets entry
+	count      uint64
+	sum        float64
+}
+
+// NewCollector creates a Collector for a single proxy.
+func NewCollector() *Collector {
+	return &Collector{buckets: make([]uint64, len(DurationBuckets))}
+}
+
+// Option returns the libproxy.Option which feeds the collector. It can be
+// given alongside the caller's own libproxy.OnConnection.
+func (c *Collector) Option() libproxy.Option {
+	return libproxy.OnConnection(c.observe)
+}
+
+func (c *Collector) observe(e libproxy.ConnEvent) {
+	if e.Type != libproxy.ConnClosed {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e.DialFailed {
+		c.dialErrors++
+	}
+	if e.BackendAddr == nil {
+		// The connection never got as far as the backend.
+		return
+	}
+	seconds := e.Duration.Seconds()
+	for i, bound := range DurationBuckets {
+		if seconds <= bound {
+			c.buckets[i]++
+		}
+	}
+	c.count++
+	c.sum += seconds
+}
+
+// Registry holds the proxies whose metrics are exported. It is an
+// http.Handler serving them in the Prometheus text format.
+type Registry struct {
+	m       sync.Mutex
+	proxies map[*registeredProxy]struct{}
+}
+
+// DefaultRegistry is a Registry shared by the whole program.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{proxies: make(map[*registeredProxy]struct{})}
+}
+
+// Register exports the metrics of proxy, whose connection events are fed to
+// collector. It returns a Proxy which must be used in place of proxy: closing
+// it removes the proxy from the registry.
+func (r *Registry) Register(proxy libproxy.Proxy, collector *Collector) libproxy.Proxy {
+	p := &registeredProxy{Proxy: proxy, collector: collector, registry: r}
+	r.m.Lock()
+	r.proxies[p] = struct{}{}
+	r.m.Unlock()
+	return p
+}
+
+func (r *Registry) unregister(p *registeredProxy) {
+	r.m.Lock()
+	delete(r.proxies, p)
+	r.m.Unlock()
+}
+
+// registeredProxy is a Proxy which unregisters itself on Close.
+type registeredProxy struct {
+	libproxy.Proxy
+	collector *Collector
+	registry  *Registry
+}
+
+func (p *registeredProxy) Close() error {
+	p.registry.unregister(p)
+	return p.Proxy.Close()
+}
+
+type sample struct {
+	frontend, backend string
+	stats             libproxy.ProxyStats
+	dialErrors        uint64
+	buckets           []uint64
+	count             uint64
+	sum               float64
+}
+
+func (r *Registry) gather() []sample {
+	r.m.Lock()
+	defer r.m.Unlock()
+	samples := make([]sample, 0, len(r.proxies))
+	for p := range r.proxies {
+		s := sample{
+			frontend: p.FrontendAddr().String(),
+			backend:  p.BackendAddr().String(),
+			stats:    p.Stats(),
+		}
+		if c := p.collector; c != nil {
+			c.m.Lock()
+			s.dialErrors = c.dialErrors
+			s.buckets = append([]uint64{}, c.buckets...)
+			s.count = c.count
+			s.sum = c.sum
+			c.m.Unlock()
+		}
+		samples = append(samples, s)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].frontend != samples[j].frontend {
+			return samples[i].frontend < samples[j].frontend
+		}
+		return samples[i].backend < samples[j].backend
+	})
+	return samples
+}
+
+// WriteTo writes the metrics of every registered proxy to w in the
+// Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	samples := r.gather()
+	cw := &countingWriter{w: w}
+	simple := []struct {
+		name, kind, help string
+		value            func(s sample) string
+	}{
+		{"libproxy_bytes_to_backend_total", "counter", "Bytes forwarded from the frontend to the backend.",
+			func(s sample) string { return fmt.Sprint(s.stats.BytesToBackend) }},
+		{"libproxy_bytes_to_frontend_total", "counter", "Bytes forwarded from the backend to the frontend.",
+			func(s sample) string { return fmt.Sprint(s.stats.BytesToFrontend) }},
+		{"libproxy_connections_total", "counter", "Connections or UDP sessions accepted.",
+			func(s sample) string { return fmt.Sprint(s.stats.TotalConns) }},
+		{"libproxy_active_connections", "gauge", "Connections or UDP sessions currently open.",
+			func(s sample) string { return fmt.Sprint(s.stats.ActiveConns) }},
+		{"libproxy_dial_errors_total", "counter", "Connections dropped because the backend couldn't be reached.",
+			func(s sample) string { return fmt.Sprint(s.dialErrors) }},
+	}
+	for _, metric := range simple {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, s := range samples {
+			fmt.Fprintf(cw, "%s{%s} %s\n", metric.name, labels(s), metric.value(s))
+		}
+	}
+	const duration = "libproxy_connection_duration_seconds"
+	fmt.Fprintf(cw, "# HELP %s How long connections lasted.\n# TYPE %s histogram\n", duration, duration)
+	for _, s := range samples {
+		for i, bound := range DurationBuckets {
+			var n uint64
+			if s.buckets != nil {
+				n = s.buckets[i]
+			}
+			fmt.Fprintf(cw, "%s_bucket{%s,le=\"%g\"} %d\n", duration, labels(s), bound, n)
+		}
+		fmt.Fprintf(cw, "%s_bucket{%s,le=\"+Inf\"} %d\n", duration, labels(s), s.count)
+		fmt.Fprintf(cw, "%s_sum{%s} %g\n", duration, labels(s), s.sum)
+		fmt.Fprintf(cw, "%s_count{%s} %d\n", duration, labels(s), s.count)
+	}
+	return cw.n, cw.err
+}
+
+func labels(s sample) string {
+	return fmt.Sprintf("frontend=%q,backend=%q", s.frontend, s.backend)
+}
+
+// ServeHTTP serves the metrics for a Prometheus scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// countingWriter remembers how much was written and the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/vpnkit/go/pkg/libproxy"
+)
+
+func echo(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func scrape(r *Registry) string {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	return buf.String()
+}
+
+func waitForMetric(t *testing.T, r *Registry, line string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(scrape(r), line+"\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %q in:\n%s", line, scrape(r))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	backend := echo(t)
+	defer backend.Close()
+	r := NewRegistry()
+	collector := NewCollector()
+	proxy, err := libproxy.NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.Addr(), collector.Option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy = r.Register(proxy, collector)
+	go proxy.Run()
+
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("hello"))
+	io.ReadFull(client, make([]byte, 5))
+	client.Close()
+
+	labels := `frontend="` + proxy.FrontendAddr().String() + `",backend="` + backend.Addr().String() + `"`
+	waitForMetric(t, r, "libproxy_connection_duration_seconds_count{"+labels+"} 1")
+	for _, line := range []string{
+		"# TYPE libproxy_bytes_to_backend_total counter",
+		"libproxy_bytes_to_backend_total{" + labels + "} 5",
+		"libproxy_bytes_to_frontend_total{" + labels + "} 5",
+		"libproxy_connections_total{" + labels + "} 1",
+		"libproxy_active_connections{" + labels + "} 0",
+		"libproxy_dial_errors_total{" + labels + "} 0",
+		"libproxy_connection_duration_seconds_bucket{" + labels + `,le="+Inf"} 1`,
+	} {
+		if !strings.Contains(scrape(r), line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, scrape(r))
+		}
+	}
+
+	proxy.Close()
+	if strings.Contains(scrape(r), labels) {
+		t.Fatalf("Expected the proxy to be unregistered on Close:\n%s", scrape(r))
+	}
+}
+
+func TestRegistryDialErrors(t *testing.T) {
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := unused.Addr()
+	unused.Close()
+	r := NewRegistry()
+	collector := NewCollector()
+	proxy, err := libproxy.NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backendAddr, collector.Option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy = r.Register(proxy, collector)
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	labels := `frontend="` + proxy.FrontendAddr().String() + `",backend="` + backendAddr.String() + `"`
+	waitForMetric(t, r, "libproxy_dial_errors_total{"+labels+"} 1")
+}
+
+func TestCollectorAlongsideOnConnection(t *testing.T) {
+	backend := echo(t)
+	defer backend.Close()
+	collector := NewCollector()
+	closed := make(chan libproxy.ConnEvent, 1)
+	onConnection := libproxy.OnConnection(func(e libproxy.ConnEvent) {
+		if e.Type == libproxy.ConnClosed {
+			closed <- e
+		}
+	})
+	r := NewRegistry()
+	proxy, err := libproxy.NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.Addr(), onConnection, collector.Option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy = r.Register(proxy, collector)
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("hello"))
+	io.ReadFull(client, make([]byte, 5))
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the OnConnection callback to be called")
+	}
+	labels := `frontend="` + proxy.FrontendAddr().String() + `",backend="` + backend.Addr().String() + `"`
+	waitForMetric(t, r, "libproxy_connection_duration_seconds_count{"+labels+"} 1")
+}
+
+func TestCollectorIgnoresBadRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := NewCollector()
+	closed := make(chan libproxy.ConnEvent, 1)
+	proxy, err := libproxy.NewSOCKS5Proxy(listener, collector.Option(), libproxy.OnConnection(func(e libproxy.ConnEvent) {
+		if e.Type == libproxy.ConnClosed {
+			closed <- e
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Not SOCKS version 5.
+	client.Write([]byte{4, 1, 0})
+	select {
+	case e := <-closed:
+		if e.Err == nil || e.DialFailed {
+			t.Fatalf("Expected a bad request which wasn't a dial failure but got %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the connection to be closed")
+	}
+	collector.m.Lock()
+	defer collector.m.Unlock()
+	if collector.dialErrors != 0 {
+		t.Fatalf("Expected no dial errors for a bad request but got %d", collector.dialErrors)
+	}
+}
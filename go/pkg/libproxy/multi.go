@@ -0,0 +1,128 @@
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// BackendConns is the number of connections a proxy has forwarded to one of
+// its backends.
+type BackendConns struct {
+	Addr       *net.TCPAddr
+	TotalConns int64
+	// Healthy is false while the backend is failing its health checks.
+	Healthy bool
+}
+
+// multiBackend holds the backends of a proxy created with NewTCPProxyMulti.
+type multiBackend struct {
+	addrs []*net.TCPAddr
+	conns []int64   // updated atomically
+	down  []int32   // set atomically while failing health checks
+	next  uint32    // updated atomically
+	ring  *hashRing // set by NewTCPProxyConsistentHash
+}
+
+// NewTCPProxyMulti creates a new TCPProxy which spreads connections across
+// backends in turn. If the next backend can't be reached the connection goes
+// to the one after it, and so on until every backend has been tried.
+func NewTCPProxyMulti(listener net.Listener, backends []*net.TCPAddr, opts ...Option) (*TCPProxy, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("No backends given for tcp/%v", listener.Addr())
+	}
+	o := newOptions(opts)
+	if err := o.probeMulti(backends); err != nil {
+		return nil, err
+	}
+	proxy, err := NewTCPProxy(listener, backends[0], append(opts[:len(opts):len(opts)], withoutBackendProbe())...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.multi = &multiBackend{
+		addrs: backends,
+		conns: make([]int64, len(backends)),
+		down:  make([]int32, len(backends)),
+	}
+	if proxy.opts.healthCheck != nil {
+		// Counted as a connection, so that Wait waits for it too.
+		proxy.running.conns.Add(1)
+		go func() {
+			defer proxy.running.conns.Done()
+			proxy.multi.checkHealth(proxy.ctx, proxy.opts.healthCheck, &proxy.opts)
+		}()
+	}
+	return proxy, nil
+}
+
+func (m *multiBackend) String() string {
+	addrs := make([]string, len(m.addrs))
+	for i, addr := range m.addrs {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// dialOrder returns the indexes of the backends in the order a new
+// connection from client should try them, with the unhealthy ones left out
+// unless they all are. Without a hash ring the connection starts with the
+// next backend in turn, round-robin.
+func (m *multiBackend) dialOrder(client net.Addr) []int {
+	var order []int
+	if m.ring != nil {
+		order = m.ring.order(m.ring.hash(client), len(m.addrs))
+	} else {
+		start := int(atomic.AddUint32(&m.next, 1) - 1)
+		order = make([]int, len(m.addrs))
+		for i := range order {
+			order[i] = (start + i) % len(m.addrs)
+		}
+	}
+	healthy := order[:0:0]
+	for _, n := range order {
+		if m.isHealthy(n) {
+			healthy = append(healthy, n)
+		}
+	}
+	if len(healthy) == 0 {
+		return order
+	}
+	return healthy
+}
+
+// dialMulti dials the backends in their dial order, moving on to the next
+// one if a dial fails.
+func (proxy *TCPProxy) dialMulti(ctx context.Context) (Conn, error) {
+	m := proxy.multi
+	client, _ := ctx.Value(hashClientKey{}).(net.Addr)
+	var err error
+	for _, n := range m.dialOrder(client) {
+		backend, dialErr := proxy.opts.dialStreamContext(ctx, m.addrs[n])
+		if dialErr == nil {
+			atomic.AddInt64(&m.conns[n], 1)
+			return backend, nil
+		}
+		err = dialErr
+	}
+	return nil, fmt.Errorf("Can't forward traffic to any backend of tcp/%v: %s", proxy.frontendAddr, err)
+}
+
+// BackendConns returns the number of connections forwarded to each backend of
+// a proxy created with NewTCPProxyMulti, in the order they were given. It
+// returns nil for other proxies.
+func (proxy *TCPProxy) BackendConns() []BackendConns {
+	if proxy.multi == nil {
+		return nil
+	}
+	result := make([]BackendConns, len(proxy.multi.addrs))
+	for i, addr := range proxy.multi.addrs {
+		result[i] = BackendConns{
+			Addr:       addr,
+			TotalConns: atomic.LoadInt64(&proxy.multi.conns[i]),
+			Healthy:    proxy.multi.isHealthy(i),
+		}
+	}
+	return result
+}
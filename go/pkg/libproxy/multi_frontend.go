@@ -0,0 +1,53 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// WithBestEffortFrontends makes NewMultiFrontendProxy carry on when some of
+// its frontend addresses can't be bound: those are logged and skipped, and
+// it only fails if none of them could be bound. The errors for the skipped
+// addresses are still returned, alongside the proxy.
+func WithBestEffortFrontends() Option {
+	return func(o *options) {
+		o.bestEffortFrontends = true
+	}
+}
+
+// NewMultiFrontendProxy creates a Proxy listening on every address in
+// frontends and forwarding all of them to backend. If any of the addresses
+// can't be bound, the others are closed and the errors for all the failed
+// addresses are returned, unless WithBestEffortFrontends is given.
+// FrontendAddr returns the first address which was bound.
+//
+// Each address gets a proxy of its own made with opts, so limits such as
+// WithMaxConnections, WithAcceptRateLimit and WithBackendPool, and health
+// checks, apply to each frontend separately rather than to all of them
+// together.
+func NewMultiFrontendProxy(frontends []net.Addr, backend net.Addr, opts ...Option) (Proxy, error) {
+	if len(frontends) == 0 {
+		return nil, fmt.Errorf("No frontend addresses to listen on for %s/%v", backend.Network(), backend)
+	}
+	o := newOptions(opts)
+	var proxies []Proxy
+	var errs multiError
+	for _, frontend := range frontends {
+		proxy, err := NewIPProxy(frontend, backend, opts...)
+		if err != nil {
+			if o.bestEffortFrontends {
+				o.logf("Can't listen on %s/%v, skipping it: %s", frontend.Network(), frontend, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	if len(proxies) == 0 || (len(errs) > 0 && !o.bestEffortFrontends) {
+		for _, proxy := range proxies {
+			proxy.Close()
+		}
+		return nil, errs
+	}
+	return newCompositeProxy(proxies), errs.errorOrNil()
+}
@@ -0,0 +1,82 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMultiFrontendProxy(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontends := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0},
+	}
+	proxy, err := NewMultiFrontendProxy(frontends, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	multi := proxy.(*compositeProxy)
+	if len(multi.proxies) != 2 || proxy.FrontendAddr() != multi.proxies[0].FrontendAddr() {
+		t.Fatalf("Unexpected frontends %+v", multi.proxies)
+	}
+	// Both frontends share the backend, which is listed once.
+	if addrs := proxy.BackendAddrs(); len(addrs) != 1 || addrs[0].String() != backend.LocalAddr().String() {
+		t.Fatalf("Expected just %v but got %v", backend.LocalAddr(), addrs)
+	}
+	for _, p := range multi.proxies {
+		client, err := net.Dial("tcp", p.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range multi.proxies {
+		if client, err := net.Dial("tcp", p.FrontendAddr().String()); err == nil {
+			client.Close()
+			t.Fatalf("Expected %v to be closed", p.FrontendAddr())
+		}
+	}
+}
+
+func TestMultiFrontendProxyBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	backend := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	free := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	frontends := []net.Addr{taken.Addr(), free}
+
+	if _, err := NewMultiFrontendProxy(frontends, backend); err == nil {
+		t.Fatalf("Expected binding %v to fail", taken.Addr())
+	}
+
+	logger := &recordingLogger{}
+	proxy, err := NewMultiFrontendProxy(frontends, backend, WithBestEffortFrontends(), WithLogger(logger))
+	if proxy == nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	if errs, ok := err.(multiError); !ok || len(errs) != 1 {
+		t.Fatalf("Expected the error for the skipped address but got %v", err)
+	}
+	if proxy.FrontendAddr().String() == taken.Addr().String() {
+		t.Fatalf("Expected the first bound address, not %v", proxy.FrontendAddr())
+	}
+	if n := len(proxy.(*compositeProxy).proxies); n != 1 {
+		t.Fatalf("Expected one frontend but got %d", n)
+	}
+	logger.waitFor(t, "skipping it")
+
+	if _, err := NewMultiFrontendProxy([]net.Addr{taken.Addr()}, backend, WithBestEffortFrontends()); err == nil {
+		t.Fatal("Expected an error when no frontend can be bound")
+	}
+}
@@ -0,0 +1,100 @@
+package libproxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestTCPProxyMultiRoundRobin(t *testing.T) {
+	var backends []*net.TCPAddr
+	for i := 0; i < 3; i++ {
+		backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+		defer backend.Close()
+		backend.Run()
+		backends = append(backends, backend.LocalAddr().(*net.TCPAddr))
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxyMulti(listener, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer client.Close()
+			roundTrip(t, client)
+		}()
+	}
+	wg.Wait()
+	for _, b := range proxy.BackendConns() {
+		if b.TotalConns != 10 {
+			t.Fatalf("Expected 10 connections per backend but got %+v", proxy.BackendConns())
+		}
+	}
+	if proxy.BackendAddr() != backends[0] {
+		t.Fatalf("Expected the first backend %v but got %v", backends[0], proxy.BackendAddr())
+	}
+	addrs := proxy.BackendAddrs()
+	if len(addrs) != len(backends) {
+		t.Fatalf("Expected %d backends but got %v", len(backends), addrs)
+	}
+	for i, addr := range addrs {
+		if addr != backends[i] {
+			t.Fatalf("Expected backend %d to be %v but got %v", i, backends[i], addr)
+		}
+	}
+}
+
+func TestTCPProxyMultiSkipsDeadBackend(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	backends := []*net.TCPAddr{unusedTCPAddr(t), backend.LocalAddr().(*net.TCPAddr)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxyMulti(listener, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	for i := 0; i < 4; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+	conns := proxy.BackendConns()
+	if conns[0].TotalConns != 0 || conns[1].TotalConns != 4 {
+		t.Fatalf("Expected every connection to go to the live backend but got %+v", conns)
+	}
+}
+
+func TestTCPProxyMultiNoBackends(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := NewTCPProxyMulti(listener, nil); err == nil {
+		t.Fatal("Expected an error with no backends")
+	}
+}
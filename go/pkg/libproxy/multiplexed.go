@@ -58,8 +58,7 @@ func HandleMultiplexedConnections(conn net.Conn, quit chan struct{}) error {
 		if err != nil {
 			return fmt.Errorf("Failed to setup UDP proxy for %s: %#v", backendAddr, err)
 		}
-		proxy.Run()
-		return nil
+		return proxy.Run()
 	default:
 		return fmt.Errorf("Unknown protocol: %d", d.Proto)
 	}
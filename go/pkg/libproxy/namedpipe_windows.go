@@ -0,0 +1,228 @@
+//go:build windows
+// +build windows
+
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// PipeAddr is the address of a Windows named pipe, e.g. `\\.\pipe\vpnkit`.
+type PipeAddr string
+
+// Network returns "pipe".
+func (a PipeAddr) Network() string { return "pipe" }
+
+func (a PipeAddr) String() string { return string(a) }
+
+// NewNamedPipeProxy creates a Proxy listening on the Windows named pipe
+// pipeName and forwarding each client connection to backend.
+func NewNamedPipeProxy(pipeName string, backend net.Addr, opts ...Option) (Proxy, error) {
+	listener, err := listenPipe(pipeName)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := NewIPProxyWithListener(listener, backend, opts...)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCreateEventW        = modkernel32.NewProc("CreateEventW")
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = modkernel32.NewProc("DisconnectNamedPipe")
+	procGetOverlappedResult = modkernel32.NewProc("GetOverlappedResult")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	pipeTypeByte              = 0x0
+	pipeReadModeByte          = 0x0
+	pipeWait                  = 0x0
+	pipeRejectRemoteClients   = 0x8
+	pipeUnlimitedInstances    = 255
+	fileFlagFirstPipeInstance = 0x80000
+	pipeBufferSize            = 65536
+
+	errorPipeConnected = syscall.Errno(535)
+	errorNoData        = syscall.Errno(232)
+)
+
+var errPipeListenerClosed = errors.New("named pipe listener closed")
+
+func createNamedPipe(name string, first bool) (syscall.Handle, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+	// Overlapped handles let os.NewFile hand the connected pipe to the
+	// runtime poller, so that reads and writes don't serialise each other
+	// and deadlines work.
+	mode := uint32(pipeAccessDuplex | syscall.FILE_FLAG_OVERLAPPED)
+	if first {
+		// Fail rather than share the name with a pipe someone else created.
+		mode |= fileFlagFirstPipeInstance
+	}
+	r, _, e := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(path)),
+		uintptr(mode),
+		uintptr(pipeTypeByte|pipeReadModeByte|pipeWait|pipeRejectRemoteClients),
+		uintptr(pipeUnlimitedInstances),
+		uintptr(pipeBufferSize),
+		uintptr(pipeBufferSize),
+		0,
+		0)
+	h := syscall.Handle(r)
+	if h == syscall.InvalidHandle {
+		return h, os.NewSyscallError("CreateNamedPipe", e)
+	}
+	return h, nil
+}
+
+// connectNamedPipe blocks until a client opens the pipe instance h, or the
+// wait is cancelled with CancelIoEx.
+func connectNamedPipe(h syscall.Handle) error {
+	r, _, e := procCreateEventW.Call(0, 1, 0, 0)
+	if r == 0 {
+		return os.NewSyscallError("CreateEvent", e)
+	}
+	event := syscall.Handle(r)
+	defer syscall.CloseHandle(event)
+	ov := syscall.Overlapped{HEvent: event}
+	r, _, e = procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(&ov)))
+	if r != 0 || e == errorPipeConnected {
+		return nil
+	}
+	if e != syscall.ERROR_IO_PENDING {
+		return os.NewSyscallError("ConnectNamedPipe", e)
+	}
+	var n uint32
+	r, _, e = procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(&ov)), uintptr(unsafe.Pointer(&n)), 1)
+	if r == 0 {
+		return os.NewSyscallError("ConnectNamedPipe", e)
+	}
+	return nil
+}
+
+func disconnectNamedPipe(h syscall.Handle) error {
+	r, _, e := procDisconnectNamedPipe.Call(uintptr(h))
+	if r == 0 {
+		return os.NewSyscallError("DisconnectNamedPipe", e)
+	}
+	return nil
+}
+
+// pipeListener is a net.Listener for a Windows named pipe. There is always
+// one idle pipe instance, next, waiting for the next client.
+type pipeListener struct {
+	name PipeAddr
+
+	m         sync.Mutex
+	next      syscall.Handle
+	accepting bool
+	closed    bool
+}
+
+func listenPipe(name string) (*pipeListener, error) {
+	h, err := createNamedPipe(name, true)
+	if err != nil {
+		return nil, fmt.Errorf("Can't listen on named pipe %s: %v", name, err)
+	}
+	return &pipeListener{name: PipeAddr(name), next: h}, nil
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	for {
+		l.m.Lock()
+		if l.closed {
+			l.m.Unlock()
+			return nil, errPipeListenerClosed
+		}
+		h := l.next
+		l.accepting = true
+		l.m.Unlock()
+
+		err := connectNamedPipe(h)
+
+		l.m.Lock()
+		l.accepting = false
+		if l.closed {
+			l.m.Unlock()
+			syscall.CloseHandle(h)
+			return nil, errPipeListenerClosed
+		}
+		if err != nil {
+			l.m.Unlock()
+			if errors.Is(err, errorNoData) {
+				// The client went away before we noticed it: recycle the instance.
+				disconnectNamedPipe(h)
+				continue
+			}
+			return nil, err
+		}
+		next, err := createNamedPipe(string(l.name), false)
+		if err != nil {
+			l.m.Unlock()
+			disconnectNamedPipe(h)
+			return nil, err
+		}
+		l.next = next
+		l.m.Unlock()
+		return &pipeConn{f: os.NewFile(uintptr(h), string(l.name)), addr: l.name}, nil
+	}
+}
+
+// Close stops accepting clients. Connections already accepted are left open.
+func (l *pipeListener) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.accepting {
+		// Accept closes the instance once it has woken up.
+		return syscall.CancelIoEx(l.next, nil)
+	}
+	return syscall.CloseHandle(l.next)
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.name
+}
+
+// pipeConn is the server end of a connected named pipe instance. Pipes can't
+// be half-closed, so it is used through asConn like other such connections.
+type pipeConn struct {
+	f    *os.File
+	addr PipeAddr
+}
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.f.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.f.Write(b) }
+
+// Close closes the pipe instance. Unlike DisconnectNamedPipe this leaves any
+// data the client hasn't read yet in the pipe.
+func (c *pipeConn) Close() error {
+	return c.f.Close()
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *pipeConn) SetDeadline(t time.Time) error      { return c.f.SetDeadline(t) }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return c.f.SetReadDeadline(t) }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return c.f.SetWriteDeadline(t) }
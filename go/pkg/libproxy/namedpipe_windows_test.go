@@ -0,0 +1,61 @@
+//go:build windows
+// +build windows
+
+package libproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func dialPipe(t *testing.T, name string) *os.File {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := syscall.CreateFile(path, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		t.Fatalf("Can't open named pipe %s: %v", name, err)
+	}
+	return os.NewFile(uintptr(h), name)
+}
+
+func TestNamedPipeToTCPProxy(t *testing.T) {
+	name := fmt.Sprintf(`\\.\pipe\libproxy-test-%d`, os.Getpid())
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewNamedPipeProxy(name, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.FrontendAddr().Network() != "pipe" || proxy.FrontendAddr().String() != name {
+		t.Fatalf("Unexpected frontend address %s/%v", proxy.FrontendAddr().Network(), proxy.FrontendAddr())
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	// Two clients at once, to check a new pipe instance is created for each.
+	for i := 0; i < 2; i++ {
+		client := dialPipe(t, name)
+		defer client.Close()
+		msg := []byte(fmt.Sprintf("hello pipe %d", i))
+		if _, err := client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, reply) {
+			t.Fatalf("Expected %q, got %q", msg, reply)
+		}
+	}
+	if _, err := NewNamedPipeProxy(name, backend.LocalAddr()); err == nil {
+		t.Fatalf("Expected a second listener on %s to be refused", name)
+	}
+}
@@ -0,0 +1,96 @@
+package libproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// negotiator is the frontend protocol of a proxy whose clients choose their
+// own backend, such as SOCKS5 or HTTP CONNECT.
+type negotiator interface {
+	// request reads which backend the client wants, as a "host:port"
+	// string. It returns the connection to carry on forwarding from, which
+	// may buffer data the client sent after its request. Requests which
+	// can't be served are answered before an error is returned.
+	request(client Conn) (Conn, string, error)
+	// reply tells the client whether its backend could be reached. On
+	// success backend is the local address of the backend connection.
+	reply(client Conn, backend net.Addr, err error) error
+	// String names the protocol.
+	String() string
+}
+
+// errNotPermitted is returned when the destination a client asked for is
+// refused by the destination allow or deny lists.
+var errNotPermitted = errors.New("destination not permitted")
+
+// negotiateBackend lets the client choose its backend and connects to it.
+// accepted is stopped once the request has been read.
+func (proxy *TCPProxy) negotiateBackend(ctx context.Context, c *connection, client Conn, accepted *acceptTimer) (Conn, Conn, error) {
+	conn, target, err := proxy.negotiator.request(client)
+	if err != nil {
+		err = fmt.Errorf("Bad %s request from %v: %s", proxy.negotiator, remoteAddr(client), err)
+	}
+	if err = accepted.end(err); err != nil {
+		return nil, nil, err
+	}
+	client = conn
+	backend, err := proxy.dialTarget(ctx, c, target)
+	var local net.Addr
+	if err == nil {
+		local = localAddr(backend)
+	}
+	if replyErr := proxy.negotiator.reply(client, local, err); replyErr != nil && err == nil {
+		backend.Close()
+		err = replyErr
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't forward %s traffic to %s: %s", proxy.negotiator, target, err)
+	}
+	return client, backend, nil
+}
+
+// dialTarget connects to the "host:port" a client asked for. Host names are
+// resolved here so that every address can be checked against the
+// destination lists before it is dialed.
+func (proxy *TCPProxy) dialTarget(ctx context.Context, c *connection, target string) (Conn, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %s", portString)
+	}
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		resolver := proxy.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		if addrs, err = resolver.LookupIPAddr(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	if addrs = proxy.opts.reachable(addrs); len(addrs) == 0 {
+		return nil, fmt.Errorf("No %s addresses for %s", proxy.opts.backendNetwork, host)
+	}
+	err = errNotPermitted
+	for _, addr := range addrs {
+		if !proxy.opts.destinations.permits(addr.IP) {
+			continue
+		}
+		backend, dialErr := proxy.opts.dialStreamContext(ctx, &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone})
+		if dialErr == nil {
+			return backend, nil
+		}
+		err = dialErr
+	}
+	c.dialFailed = err != errNotPermitted
+	return nil, err
+}
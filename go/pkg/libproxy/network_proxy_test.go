@@ -2,6 +2,7 @@ package libproxy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -31,7 +32,7 @@ type UDPEchoServer struct {
 
 func NewEchoServer(t *testing.T, proto, address string) EchoServer {
 	var server EchoServer
-	if strings.HasPrefix(proto, "tcp") {
+	if strings.HasPrefix(proto, "tcp") || proto == "unix" {
 		listener, err := net.Listen(proto, address)
 		if err != nil {
 			t.Fatal(err)
@@ -69,7 +70,7 @@ func (server *TCPEchoServer) Close()              { server.listener.Addr() }
 
 func (server *UDPEchoServer) Run() {
 	go func() {
-		readBuf := make([]byte, 1024)
+		readBuf := make([]byte, UDPBufSize)
 		for {
 			read, from, err := server.conn.ReadFrom(readBuf)
 			if err != nil {
@@ -119,7 +120,7 @@ func TestTCP4Proxy(t *testing.T) {
 	defer backend.Close()
 	backend.Run()
 	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
-	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -131,7 +132,7 @@ func TestTCP6Proxy(t *testing.T) {
 	defer backend.Close()
 	backend.Run()
 	frontendAddr := &net.TCPAddr{IP: net.IPv6loopback, Port: 0}
-	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,7 +147,7 @@ func TestTCPDualStackProxy(t *testing.T) {
 	defer backend.Close()
 	backend.Run()
 	frontendAddr := &net.TCPAddr{IP: net.IPv6loopback, Port: 0}
-	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -162,7 +163,7 @@ func TestUDP4Proxy(t *testing.T) {
 	defer backend.Close()
 	backend.Run()
 	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
-	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -174,7 +175,7 @@ func TestUDP6Proxy(t *testing.T) {
 	defer backend.Close()
 	backend.Run()
 	frontendAddr := &net.UDPAddr{IP: net.IPv6loopback, Port: 0}
-	proxy, err := NewProxy(frontendAddr, backend.LocalAddr())
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -185,7 +186,7 @@ func TestUDPWriteError(t *testing.T) {
 	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
 	// Hopefully, this port will be free: */
 	backendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
-	proxy, err := NewProxy(frontendAddr, backendAddr)
+	proxy, err := NewIPProxy(frontendAddr, backendAddr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -214,3 +215,191 @@ func TestUDPWriteError(t *testing.T) {
 		t.Fatal(fmt.Errorf("Expected [%v] but got [%v]", testBuf, recvBuf))
 	}
 }
+
+func TestTCPProxyRunReturnsNilOnClose(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+	proxy, err := NewIPProxy(frontendAddr, backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- proxy.Run() }()
+	proxy.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil after Close but got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+func TestUDPProxyRunReturnsNilOnClose(t *testing.T) {
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	backendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+	proxy, err := NewIPProxy(frontendAddr, backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- proxy.Run() }()
+	proxy.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil after Close but got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+// eofListener is a UDPListener torn down from under the proxy, as an
+// encapsulated one is when the host closes the vsock connection.
+type eofListener struct{}
+
+func (eofListener) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) { return 0, nil, io.EOF }
+func (eofListener) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+func (eofListener) Close() error { return nil }
+
+func TestUDPProxyRunReturnsListenerEOF(t *testing.T) {
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	backendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+	proxy, err := NewUDPProxy(frontendAddr, eofListener{}, backendAddr, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	if err := proxy.Run(); err == nil || !strings.Contains(err.Error(), io.EOF.Error()) {
+		t.Fatalf("Expected Run to return the listener's EOF but got %v", err)
+	}
+	if snapshot := proxy.Snapshot(); snapshot.LastError == "" {
+		t.Fatalf("Expected the EOF to be recorded in the snapshot but got %+v", snapshot)
+	}
+}
+
+func TestTCPProxyContextCancel(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, err := NewTCPProxyContext(ctx, listener, backend.LocalAddr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- proxy.Run() }()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatalf("Can't connect to the proxy: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err = io.ReadFull(client, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil after cancel but got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	// The in-flight connection must be torn down rather than left open.
+	if _, err := client.Read(recvBuf); err == nil {
+		t.Fatal("Expected the connection to be closed after cancel")
+	}
+}
+
+func TestTCPProxySourceAddr(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	source := net.IPv4(127, 0, 0, 2)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithSourceAddr(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if remote := conn.RemoteAddr().(*net.TCPAddr).IP; !remote.Equal(source) {
+		t.Fatalf("Expected the backend connection to come from %s but got %s", source, remote)
+	}
+}
+
+func TestTCPProxySourceAddrUnavailable(t *testing.T) {
+	options := newOptions([]Option{WithSourceAddr(net.ParseIP("192.0.2.1"))})
+	_, err := options.dialStream(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587})
+	if err == nil || !strings.Contains(err.Error(), "192.0.2.1") {
+		t.Fatalf("Expected an error mentioning the source address but got %v", err)
+	}
+}
+
+func TestTCPProxyWithListener(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewIPProxyWithListener(listener, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+}
+
+func TestUDPProxyWithPacketConn(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewIPProxyWithPacketConn(conn, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "udp", proxy)
+}
+
+func TestIPProxyWithListenerWrongBackend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := NewIPProxyWithListener(listener, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}); err == nil {
+		t.Fatal("Expected an error for a UDP backend")
+	}
+}
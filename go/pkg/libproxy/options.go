@@ -0,0 +1,141 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Option configures a proxy at construction time. Options which don't apply
+// to a particular kind of proxy are ignored by it.
+type Option func(*options)
+
+type options struct {
+	udpIdleTimeout         time.Duration
+	udpSweepInterval       time.Duration
+	udpMaxDatagram         int
+	proxyProtocol          int
+	sourceIP               net.IP
+	dialer                 BackendDialer
+	readTimeout            time.Duration
+	writeTimeout           time.Duration
+	maxConns               int
+	onConnection           func(ConnEvent)
+	reusePort              bool
+	bufferSize             int
+	noDelay                *bool
+	keepAliveIdle          time.Duration
+	keepAliveInterval      time.Duration
+	dialAttempts           int
+	dialBackoff            time.Duration
+	healthCheck            *HealthCheck
+	sources                cidrFilter
+	destinations           cidrFilter
+	rateLimit              int
+	happyEyeballs          bool
+	socks5Auth             func(username, password string) bool
+	originalDst            bool
+	logger                 Logger
+	tag                    string
+	bestEffortFrontends    bool
+	resetOnDialFailure     bool
+	udpRedialAttempts      int
+	udpRedialBackoff       time.Duration
+	udpBatchWrites         int
+	backendNetwork         string
+	dialTimeout            time.Duration
+	backendTLS             *tls.Config
+	acceptTimeout          time.Duration
+	flowLog                *flowLog
+	freeBind               bool
+	datagramTooLargeEvents bool
+	acceptBackoff          time.Duration
+	clientSource           bool
+	backendPool            int
+	backendPoolIdle        time.Duration
+	cork                   bool
+	linger                 *time.Duration
+	backendSelector        func(net.Conn) (net.Addr, error)
+	unidirectional         bool
+	receiveBuffer          int
+	sendBuffer             int
+	hashSeed               uint32
+	verbose                bool
+	bindRetryInterval      time.Duration
+	connContext            func(context.Context, net.Addr) context.Context
+	traceIDs               func(context.Context) string
+	failFast               bool
+	sampleInterval         time.Duration
+	sampler                func(ConnSample)
+	teeToBackend           *teeSink
+	teeToFrontend          *teeSink
+	portFallback           int
+	dualStack              bool
+	frontendFamily         string // "4" or "6" to bind only that IP version, set by WithDualStack
+	backendProbe           bool
+	acceptRate             int
+	shadowBackend          net.Addr
+	acceptProxyProtocol    bool
+	backendCompression     Compression
+	frontendCompression    Compression
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		udpIdleTimeout:  UDPConnTrackTimeout,
+		udpMaxDatagram:  UDPBufSize,
+		acceptBackoff:   DefaultAcceptBackoff,
+		dialTimeout:     DefaultDialTimeout,
+		backendPoolIdle: DefaultBackendPoolIdleTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithUDPIdleTimeout sets how long a UDP session may go without traffic in
+// either direction before it is closed and its backend socket released. The
+// default is UDPConnTrackTimeout.
+func WithUDPIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.udpIdleTimeout = d
+	}
+}
+
+// WithUDPMaxDatagramSize sets the size of the buffers a UDP proxy receives
+// datagrams into, in both directions. Larger datagrams are truncated, and
+// are counted in ProxyStats.TruncatedDatagrams. The default is UDPBufSize.
+// Creating a UDP proxy fails if n isn't positive.
+func WithUDPMaxDatagramSize(n int) Option {
+	return func(o *options) {
+		o.udpMaxDatagram = n
+	}
+}
+
+func (o *options) checkUDPMaxDatagram() error {
+	if o.udpMaxDatagram <= 0 {
+		return fmt.Errorf("Invalid UDP max datagram size %d", o.udpMaxDatagram)
+	}
+	return nil
+}
+
+// WithSourceAddr makes the proxy connect to its backend from the local
+// address ip, for example so that replies are routed back through a
+// particular interface of a multi-homed VM.
+func WithSourceAddr(ip net.IP) Option {
+	return func(o *options) {
+		o.sourceIP = ip
+	}
+}
+
+// WithMaxConnections limits a TCP proxy to n connections at a time. Once the
+// limit is reached no more connections are accepted, leaving them queued in
+// the kernel, until one of the active connections closes.
+func WithMaxConnections(n int) Option {
+	return func(o *options) {
+		o.maxConns = n
+	}
+}
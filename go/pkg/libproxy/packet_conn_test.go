@@ -0,0 +1,109 @@
+package libproxy
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memAddr is a client address which isn't an IP one.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memDatagram struct {
+	payload []byte
+	addr    net.Addr
+}
+
+// memPacketConn is an in-memory net.PacketConn: the test sends datagrams in
+// through send and reads the proxy's replies from replies.
+type memPacketConn struct {
+	in        chan memDatagram
+	replies   chan memDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemPacketConn() *memPacketConn {
+	return &memPacketConn{
+		in:      make(chan memDatagram, 16),
+		replies: make(chan memDatagram, 16),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *memPacketConn) send(payload []byte, from net.Addr) {
+	c.in <- memDatagram{payload: payload, addr: from}
+}
+
+func (c *memPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.in:
+		return copy(b, d.payload), d.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case c.replies <- memDatagram{payload: append([]byte(nil), b...), addr: addr}:
+		return len(b), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *memPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr                { return memAddr("proxy") }
+func (c *memPacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestPacketConnFrontend(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	conn := newMemPacketConn()
+	proxy, err := NewIPProxyWithPacketConn(conn, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	if proxy.FrontendAddr() != memAddr("proxy") {
+		t.Fatalf("Expected the packet conn's address but got %v", proxy.FrontendAddr())
+	}
+	go proxy.Run()
+
+	clients := []memAddr{"alice", "bob"}
+	for _, client := range clients {
+		conn.send([]byte("hello "+client), client)
+	}
+	replies := make(map[memAddr][]byte)
+	for range clients {
+		select {
+		case reply := <-conn.replies:
+			replies[reply.addr.(memAddr)] = reply.payload
+		case <-time.After(10 * time.Second):
+			t.Fatal("Didn't get a reply")
+		}
+	}
+	for _, client := range clients {
+		if !bytes.Equal(replies[client], []byte("hello "+client)) {
+			t.Fatalf("Expected %s to get its datagram back but got %q", client, replies[client])
+		}
+	}
+	if stats := proxy.Stats(); stats.TotalConns != 2 {
+		t.Fatalf("Expected a session per client address but got %+v", stats)
+	}
+	proxy.Close()
+	waitReturns(t, proxy)
+}
@@ -0,0 +1,70 @@
+package libproxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pauseGate holds up a TCP accept loop while the proxy is paused. The zero
+// value isn't paused.
+type pauseGate struct {
+	m       sync.Mutex
+	resumed chan struct{} // non-nil while paused, closed by resume
+}
+
+func (g *pauseGate) pause() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+func (g *pauseGate) isPaused() bool {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.resumed != nil
+}
+
+// wait blocks while the proxy is paused. It returns false if stopping is
+// closed meanwhile.
+func (g *pauseGate) wait(stopping <-chan struct{}) bool {
+	g.m.Lock()
+	resumed := g.resumed
+	g.m.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-stopping:
+		return false
+	}
+}
+
+// Pause stops the proxy accepting connections until Resume is called, while
+// the connections it already has carry on. New clients wait to be served,
+// mostly in the listen backlog, until then. Close works as usual while
+// paused.
+func (proxy *TCPProxy) Pause() { proxy.paused.pause() }
+
+// Resume undoes Pause.
+func (proxy *TCPProxy) Resume() { proxy.paused.resume() }
+
+// Pause stops the proxy creating sessions until Resume is called: datagrams
+// from clients without a session are dropped, while the existing sessions
+// carry on.
+func (proxy *UDPProxy) Pause() { atomic.StoreInt32(&proxy.paused, 1) }
+
+// Resume undoes Pause.
+func (proxy *UDPProxy) Resume() { atomic.StoreInt32(&proxy.paused, 0) }
@@ -0,0 +1,114 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPPause(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	existing, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existing.Close()
+	roundTrip(t, existing)
+
+	tcp := proxy.(*TCPProxy)
+	tcp.Pause()
+	waiting, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer waiting.Close()
+	if _, err := waiting.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	waiting.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := waiting.Read(make([]byte, testBufSize)); !isTimeout(err) {
+		t.Fatalf("Expected a new connection to wait while paused but got %v", err)
+	}
+	roundTrip(t, existing)
+	if total := proxy.Stats().TotalConns; total != 1 {
+		t.Fatalf("Expected 1 connection while paused but got %d", total)
+	}
+
+	tcp.Resume()
+	waiting.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := waiting.Read(make([]byte, testBufSize)); err != nil {
+		t.Fatalf("Expected the waiting connection to be served after Resume but got %v", err)
+	}
+}
+
+func TestTCPCloseWhilePaused(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.(*TCPProxy).Pause()
+	done := make(chan error)
+	go func() { done <- proxy.Run() }()
+	time.Sleep(50 * time.Millisecond)
+	proxy.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected Run to return nil after Close but got %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after Close while paused")
+	}
+	waitReturns(t, proxy)
+}
+
+func TestUDPPause(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	existing, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existing.Close()
+	roundTrip(t, existing)
+
+	udp := proxy.(*UDPProxy)
+	udp.Pause()
+	other, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := other.Read(make([]byte, testBufSize)); !isTimeout(err) {
+		t.Fatalf("Expected no new session while paused but got %v", err)
+	}
+	roundTrip(t, existing)
+
+	udp.Resume()
+	roundTrip(t, other)
+	if total := proxy.Stats().TotalConns; total != 2 {
+		t.Fatalf("Expected 2 sessions but got %d", total)
+	}
+}
@@ -0,0 +1,34 @@
+package libproxy
+
+import "syscall"
+
+// WithPortFallback makes NewIPProxy try each of the count ports after the
+// requested TCP or UDP frontend port in turn while the previous one is
+// already in use, and listen on the first one which is free. FrontendAddr
+// returns the port actually used. If they are all in use the error binding
+// the requested port is returned. It doesn't apply to port 0, for which any
+// free port is picked anyway.
+func WithPortFallback(count int) Option {
+	return func(o *options) {
+		o.portFallback = count
+	}
+}
+
+// bindWithFallback calls bind with port and, while it fails with
+// EADDRINUSE, with each of the ports allowed by WithPortFallback after it.
+func (o *options) bindWithFallback(port int, bind func(port int) error) error {
+	err := bind(port)
+	if port == 0 || bindErrno(err) != syscall.EADDRINUSE {
+		return err
+	}
+	for next := port + 1; next <= port+o.portFallback && next <= 65535; next++ {
+		switch fallbackErr := bind(next); {
+		case fallbackErr == nil:
+			o.logf("Port %d is in use: listening on port %d instead", port, next)
+			return nil
+		case bindErrno(fallbackErr) != syscall.EADDRINUSE:
+			return fallbackErr
+		}
+	}
+	return err
+}
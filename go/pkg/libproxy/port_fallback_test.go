@@ -0,0 +1,76 @@
+package libproxy
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// portOf returns the port of a TCP or UDP address.
+func portOf(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
+}
+
+// occupy binds port on the loopback address, returning the port bound or
+// nil if it couldn't.
+func occupy(network string, port int) (io.Closer, int) {
+	if network == "udp" {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			return nil, 0
+		}
+		return conn, portOf(conn.LocalAddr())
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		return nil, 0
+	}
+	return listener, portOf(listener.Addr())
+}
+
+func TestPortFallback(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			taken, port := occupy(network, 0)
+			if taken == nil {
+				t.Fatal("Can't bind a port")
+			}
+			defer taken.Close()
+			var frontendAddr, backendAddr net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+			if network == "udp" {
+				frontendAddr, backendAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+			}
+
+			if _, err := NewIPProxy(frontendAddr, backendAddr); bindErrno(err) != syscall.EADDRINUSE {
+				t.Fatalf("Expected EADDRINUSE without a fallback but got %v", err)
+			}
+			proxy, err := NewIPProxy(frontendAddr, backendAddr, WithPortFallback(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			chosen := portOf(proxy.FrontendAddr())
+			proxy.Close()
+			if chosen <= port || chosen > port+10 {
+				t.Fatalf("Expected a port after %d but got %v", port, proxy.FrontendAddr())
+			}
+
+			// With every candidate taken the original error is
+			// returned.
+			next, _ := occupy(network, port+1)
+			if next == nil {
+				t.Skipf("Port %d is in use already", port+1)
+			}
+			defer next.Close()
+			if _, err := NewIPProxy(frontendAddr, backendAddr, WithPortFallback(1)); bindErrno(err) != syscall.EADDRINUSE {
+				t.Fatalf("Expected EADDRINUSE with every port taken but got %v", err)
+			}
+		})
+	}
+}
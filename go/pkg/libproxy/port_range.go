@@ -0,0 +1,217 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// multiError collects the errors of several proxies.
+type multiError []error
+
+func (m multiError) Error() string {
+	messages := make([]string, len(m))
+	for i, err := range m {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// errorOrNil returns nil if no errors were collected.
+func (m multiError) errorOrNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// compositeProxy drives several proxies as one.
+type compositeProxy struct {
+	proxies      []Proxy
+	frontendAddr net.Addr
+	backendAddr  net.Addr
+	closeOnce    sync.Once
+	done         chan struct{} // closed once all the proxies are done
+}
+
+// newCompositeProxy drives proxies, of which there must be at least one, as
+// one proxy with the addresses of the first.
+func newCompositeProxy(proxies []Proxy) *compositeProxy {
+	p := &compositeProxy{
+		proxies:      proxies,
+		frontendAddr: proxies[0].FrontendAddr(),
+		backendAddr:  proxies[0].BackendAddr(),
+		done:         make(chan struct{}),
+	}
+	go func() {
+		for _, proxy := range proxies {
+			<-proxy.Done()
+		}
+		close(p.done)
+	}()
+	return p
+}
+
+// Run runs all the proxies and returns once all of them have stopped, with
+// the errors of any which failed.
+func (p *compositeProxy) Run() error {
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	var errs multiError
+	for _, proxy := range p.proxies {
+		wg.Add(1)
+		go func(proxy Proxy) {
+			defer wg.Done()
+			if err := proxy.Run(); err != nil {
+				m.Lock()
+				errs = append(errs, err)
+				m.Unlock()
+			}
+		}(proxy)
+	}
+	wg.Wait()
+	return errs.errorOrNil()
+}
+
+// Close closes all the proxies, and returns the first error any of them
+// returned. Calling it again does nothing and returns nil.
+func (p *compositeProxy) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		for _, proxy := range p.proxies {
+			if closeErr := proxy.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (p *compositeProxy) Wait() {
+	for _, proxy := range p.proxies {
+		proxy.Wait()
+	}
+}
+
+// Done returns a channel which is closed once all the proxies are done.
+func (p *compositeProxy) Done() <-chan struct{} { return p.done }
+
+// FrontendAddr returns the first frontend address.
+func (p *compositeProxy) FrontendAddr() net.Addr { return p.frontendAddr }
+
+// BackendAddr returns the first backend address.
+func (p *compositeProxy) BackendAddr() net.Addr { return p.backendAddr }
+
+// BackendAddrs returns the backend addresses of all the proxies, each once.
+func (p *compositeProxy) BackendAddrs() []net.Addr {
+	var addrs []net.Addr
+	seen := make(map[string]bool)
+	for _, proxy := range p.proxies {
+		for _, addr := range proxy.BackendAddrs() {
+			key := addr.Network() + "/" + addr.String()
+			if !seen[key] {
+				seen[key] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// Stats returns the sum of the stats of all the proxies.
+func (p *compositeProxy) Stats() ProxyStats { return sumStats(p.proxies) }
+
+// sumStats adds up the stats of proxies.
+func sumStats(proxies []Proxy) ProxyStats {
+	var total ProxyStats
+	for _, proxy := range proxies {
+		s := proxy.Stats()
+		total.BytesToBackend += s.BytesToBackend
+		total.BytesToFrontend += s.BytesToFrontend
+		total.ActiveConns += s.ActiveConns
+		total.TotalConns += s.TotalConns
+		total.TruncatedDatagrams += s.TruncatedDatagrams
+		total.OversizedDatagrams += s.OversizedDatagrams
+		total.FrontendReadErrors += s.FrontendReadErrors
+		total.FrontendWriteErrors += s.FrontendWriteErrors
+		total.BackendReadErrors += s.BackendReadErrors
+		total.BackendWriteErrors += s.BackendWriteErrors
+		total.BackendDials += s.BackendDials
+		total.DialTimeTotal += s.DialTimeTotal
+		total.DroppedEvents += s.DroppedEvents
+		if s.LastDialTime > total.LastDialTime {
+			total.LastDialTime = s.LastDialTime
+		}
+		if s.MaxDialTime > total.MaxDialTime {
+			total.MaxDialTime = s.MaxDialTime
+		}
+		total.Tag = s.Tag
+	}
+	return total
+}
+
+func (p *compositeProxy) Connections() []ConnInfo {
+	var conns []ConnInfo
+	for _, proxy := range p.proxies {
+		conns = append(conns, proxy.Connections()...)
+	}
+	sortConnInfo(conns)
+	return conns
+}
+
+// NewPortRangeProxy creates a Proxy forwarding count consecutive ports
+// starting at frontendBase to the same number of consecutive ports starting
+// at backendBase. If any of the ports can't be bound, the others are closed
+// and the errors for all the failed ports are returned.
+func NewPortRangeProxy(frontendBase, backendBase net.Addr, count int, opts ...Option) (Proxy, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("Invalid port range count %d", count)
+	}
+	var proxies []Proxy
+	var errs multiError
+	for i := 0; i < count; i++ {
+		frontendAddr, err := addrWithPortOffset(frontendBase, i)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		backendAddr, err := addrWithPortOffset(backendBase, i)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		proxy, err := NewIPProxy(frontendAddr, backendAddr, opts...)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	if len(errs) > 0 {
+		for _, proxy := range proxies {
+			proxy.Close()
+		}
+		return nil, errs
+	}
+	return newCompositeProxy(proxies), nil
+}
+
+// addrWithPortOffset returns a copy of a TCP or UDP address with offset
+// added to its port.
+func addrWithPortOffset(addr net.Addr, offset int) (net.Addr, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a.Port+offset > 65535 {
+			return nil, fmt.Errorf("Port range starting at tcp/%v is too large", a)
+		}
+		return &net.TCPAddr{IP: a.IP, Port: a.Port + offset, Zone: a.Zone}, nil
+	case *net.UDPAddr:
+		if a.Port+offset > 65535 {
+			return nil, fmt.Errorf("Port range starting at udp/%v is too large", a)
+		}
+		return &net.UDPAddr{IP: a.IP, Port: a.Port + offset, Zone: a.Zone}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported address %s/%v for a port range", addr.Network(), addr)
+	}
+}
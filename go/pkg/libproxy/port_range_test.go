@@ -0,0 +1,98 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// freePortRange finds count consecutive free TCP ports on 127.0.0.1.
+func freePortRange(t *testing.T, count int) int {
+	for attempt := 0; attempt < 20; attempt++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if base+count > 65535 {
+			continue
+		}
+		ok := true
+		for i := 0; i < count && ok; i++ {
+			l, err := net.Listen("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: base + i}).String())
+			if err != nil {
+				ok = false
+				break
+			}
+			l.Close()
+		}
+		if ok {
+			return base
+		}
+	}
+	t.Fatal("Can't find a free port range")
+	return 0
+}
+
+func TestPortRangeProxy(t *testing.T) {
+	backendBase := freePortRange(t, 3)
+	for i := 0; i < 3; i++ {
+		backend := NewEchoServer(t, "tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: backendBase + i}).String())
+		defer backend.Close()
+		backend.Run()
+	}
+	frontendBase := freePortRange(t, 3)
+	proxy, err := NewPortRangeProxy(
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: frontendBase},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: backendBase}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	addrs := proxy.BackendAddrs()
+	if len(addrs) != 3 || addrs[2].(*net.TCPAddr).Port != backendBase+2 {
+		t.Fatalf("Expected the 3 backend ports but got %v", addrs)
+	}
+	go proxy.Run()
+	for i := 0; i < 3; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: frontendBase + i}
+		client, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 0
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", stats) })
+	if stats.TotalConns != 3 {
+		t.Fatalf("Expected 3 connections but got %d", stats.TotalConns)
+	}
+}
+
+func TestPortRangeProxyPartialFailure(t *testing.T) {
+	base := freePortRange(t, 3)
+	busy, err := net.Listen("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: base + 1}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, err = NewPortRangeProxy(
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: base},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}, 3)
+	if err == nil {
+		t.Fatal("Expected an error when a port is in use")
+	}
+	// The ports which were bound must have been released again.
+	for _, port := range []int{base, base + 2} {
+		l, err := net.Listen("tcp", (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}).String())
+		if err != nil {
+			t.Fatalf("Port %d wasn't released: %v", port, err)
+		}
+		l.Close()
+	}
+}
@@ -3,6 +3,8 @@
 package libproxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -19,79 +21,247 @@ import (
 // to the backend (container) at 172.17.42.108:4000.
 type Proxy interface {
 	// Run starts forwarding traffic back and forth between the front
-	// and back-end addresses.
-	Run()
-	// Close stops forwarding traffic and close both ends of the Proxy.
-	Close()
+	// and back-end addresses. It returns nil once the proxy has been
+	// closed, or an error describing why forwarding stopped otherwise.
+	// RunAndLog runs a proxy the way Run did before it returned the error.
+	Run() error
+	// Close stops forwarding traffic and close both ends of the Proxy. It
+	// returns the first error met while releasing the listener and any
+	// other resources. Only the first call does anything: later calls
+	// return nil.
+	Close() error
+	// Wait blocks until Run has returned and all the connections have
+	// finished. It returns immediately if the proxy has already stopped,
+	// or was closed without ever being run.
+	Wait()
+	// Done returns a channel which is closed once the proxy has stopped in
+	// the same sense as Wait, so that it can be used in a select. It is
+	// the same channel on every call.
+	Done() <-chan struct{}
 	// FrontendAddr returns the address on which the proxy is listening.
 	FrontendAddr() net.Addr
-	// BackendAddr returns the proxied address.
+	// BackendAddr returns the proxied address. A proxy which resolves its
+	// backend host name per connection returns the address it connected
+	// to most recently, or the unresolved "host:port" until it has
+	// connected. A proxy with several backends returns the first of
+	// them. Use BackendAddrs to list them all.
 	BackendAddr() net.Addr
+	// BackendAddrs returns every backend the proxy was configured with,
+	// in order, unresolved for host names. It holds just BackendAddr for
+	// proxies with a single backend.
+	BackendAddrs() []net.Addr
+	// Stats returns a snapshot of the traffic forwarded so far.
+	Stats() ProxyStats
+	// Connections returns a snapshot of the connections currently being
+	// forwarded.
+	Connections() []ConnInfo
 }
 
 // NewVsockProxy creates a Proxy listening on Vsock
-func NewVsockProxy(frontendAddr *vsock.VsockAddr, backendAddr net.Addr) (Proxy, error) {
+func NewVsockProxy(frontendAddr *vsock.VsockAddr, backendAddr net.Addr, opts ...Option) (Proxy, error) {
+	return NewVsockProxyContext(context.Background(), frontendAddr, backendAddr, opts...)
+}
+
+// NewVsockProxyContext creates a Proxy listening on Vsock which is closed
+// when ctx is cancelled.
+func NewVsockProxyContext(ctx context.Context, frontendAddr *vsock.VsockAddr, backendAddr net.Addr, opts ...Option) (Proxy, error) {
 	switch backendAddr.(type) {
 	case *net.UDPAddr:
-		listener, err := vsock.Listen(vsock.CIDAny, frontendAddr.Port)
+		listener, err := listenVsock(frontendAddr.Port)
 		if err != nil {
 			return nil, err
 		}
-		return NewUDPProxy(frontendAddr, NewUDPListener(listener), backendAddr.(*net.UDPAddr))
+		return NewUDPProxyContext(ctx, listener.Addr(), NewUDPListener(listener, opts...), backendAddr.(*net.UDPAddr), opts...)
 	case *net.TCPAddr:
-		listener, err := vsock.Listen(vsock.CIDAny, frontendAddr.Port)
+		listener, err := listenVsock(frontendAddr.Port)
 		if err != nil {
 			return nil, err
 		}
-		return NewTCPProxy(listener, backendAddr.(*net.TCPAddr))
+		return NewTCPProxyContext(ctx, listener, backendAddr.(*net.TCPAddr), opts...)
 	default:
 		panic(fmt.Errorf("Unsupported protocol"))
 	}
 }
 
 // NewIPProxy creates a Proxy according to the specified frontendAddr and backendAddr.
-func NewIPProxy(frontendAddr, backendAddr net.Addr) (Proxy, error) {
+func NewIPProxy(frontendAddr, backendAddr net.Addr, opts ...Option) (Proxy, error) {
+	o := newOptions(opts)
+	if o.dualStack {
+		if proxy, ok, err := newDualStackProxy(frontendAddr, backendAddr, opts); ok {
+			return proxy, err
+		}
+	}
 	switch frontendAddr.(type) {
 	case *net.UDPAddr:
-		listener, err := net.ListenUDP("udp", frontendAddr.(*net.UDPAddr))
+		listener, err := o.listenUDP(frontendAddr.(*net.UDPAddr))
 		if err != nil {
 			return nil, err
 		}
-		return NewUDPProxy(frontendAddr, listener, backendAddr.(*net.UDPAddr))
+		proxy, err := NewIPProxyWithPacketConn(listener, backendAddr, opts...)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return proxy, nil
 	case *net.TCPAddr:
-		listener, err := net.Listen("tcp", frontendAddr.String())
+		listener, err := o.listenTCP(frontendAddr.(*net.TCPAddr))
 		if err != nil {
 			return nil, err
 		}
-		return NewTCPProxy(listener, backendAddr.(*net.TCPAddr))
+		proxy, err := NewIPProxyWithListener(listener, backendAddr, opts...)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return proxy, nil
 	case *vsock.VsockAddr:
-		listener, err := vsock.Listen(vsock.CIDAny, frontendAddr.(*vsock.VsockAddr).Port)
+		listener, err := listenVsock(frontendAddr.(*vsock.VsockAddr).Port)
 		if err != nil {
 			return nil, err
 		}
-		return NewTCPProxy(listener, backendAddr.(*net.TCPAddr))
+		proxy, err := NewIPProxyWithListener(listener, backendAddr, opts...)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return proxy, nil
+	case *net.UnixAddr:
+		return newUnixProxy(frontendAddr.(*net.UnixAddr), backendAddr, opts...)
 	default:
 		panic(fmt.Errorf("Unsupported protocol"))
 	}
 }
 
+// NewIPProxyWithListener creates a Proxy forwarding the connections accepted
+// by an existing stream listener to backendAddr.
+func NewIPProxyWithListener(listener net.Listener, backendAddr net.Addr, opts ...Option) (Proxy, error) {
+	switch backendAddr.(type) {
+	case *net.TCPAddr:
+		return NewTCPProxy(listener, backendAddr.(*net.TCPAddr), opts...)
+	case *net.UnixAddr:
+		if backendAddr.Network() == "unix" {
+			return newStreamProxy(context.Background(), listener, backendAddr, opts...)
+		}
+	case *vsock.VsockAddr:
+		return newStreamProxy(context.Background(), listener, backendAddr, opts...)
+	}
+	if isHyperVAddr(backendAddr) {
+		return newStreamProxy(context.Background(), listener, backendAddr, opts...)
+	}
+	return nil, fmt.Errorf("Unsupported backend address %s/%v for a stream listener", backendAddr.Network(), backendAddr)
+}
+
+// NewIPProxyWithPacketConn creates a Proxy forwarding the datagrams received
+// on an existing packet conn to backendAddr. The conn needn't be a
+// *net.UDPConn: datagrams from each distinct address it reports get their own
+// session, and replies are written back to that address.
+func NewIPProxyWithPacketConn(conn net.PacketConn, backendAddr net.Addr, opts ...Option) (Proxy, error) {
+	switch backendAddr.(type) {
+	case *net.UDPAddr:
+		return newDatagramProxy(context.Background(), conn.LocalAddr(), conn, backendAddr, opts...)
+	case *net.UnixAddr:
+		if backendAddr.Network() == "unixgram" {
+			return newDatagramProxy(context.Background(), conn.LocalAddr(), conn, backendAddr, opts...)
+		}
+	case *vsock.VsockAddr:
+		return newDatagramProxy(context.Background(), conn.LocalAddr(), conn, backendAddr, opts...)
+	}
+	return nil, fmt.Errorf("Unsupported backend address %s/%v for a packet conn", backendAddr.Network(), backendAddr)
+}
+
+// newUnixProxy creates a Proxy listening on a Unix stream ("unix") or
+// datagram ("unixgram") socket. Any stale socket file is removed first.
+func newUnixProxy(frontendAddr *net.UnixAddr, backendAddr net.Addr, opts ...Option) (Proxy, error) {
+	switch frontendAddr.Net {
+	case "unix":
+		listener, err := listenUnix(frontendAddr)
+		if err != nil {
+			return nil, err
+		}
+		proxy, err := NewIPProxyWithListener(listener, backendAddr, opts...)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return proxy, nil
+	case "unixgram":
+		listener, err := listenUnixgram(frontendAddr)
+		if err != nil {
+			return nil, err
+		}
+		if !isDatagramAddr(backendAddr) {
+			listener.Close()
+			return nil, fmt.Errorf("Unsupported backend address %s/%v for a unixgram socket", backendAddr.Network(), backendAddr)
+		}
+		proxy, err := newDatagramProxy(context.Background(), frontendAddr, listener, backendAddr, opts...)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return proxy, nil
+	default:
+		return nil, fmt.Errorf("Unsupported unix network %s", frontendAddr.Net)
+	}
+}
+
+func isDatagramAddr(addr net.Addr) bool {
+	switch addr.(type) {
+	case *net.UDPAddr:
+		return true
+	case *net.UnixAddr:
+		return addr.Network() == "unixgram"
+	case *vsock.VsockAddr:
+		return true
+	}
+	return false
+}
+
+// RunAndLog runs p until it stops, logging the error Run returns if not
+// closed, as Run itself did before it returned the error. It is for callers
+// which ran proxies with "go p.Run()" and relied on the log.
+func RunAndLog(p Proxy) {
+	if err := p.Run(); err != nil {
+		log.Printf("Proxy on %s/%v stopped: %s", p.FrontendAddr().Network(), p.FrontendAddr(), err)
+	}
+}
+
 // Best-effort attempt to listen on the address in the VM. This is for
 // backwards compatibility with software that expects to be able to listen on
 // 0.0.0.0 and then connect from within a container to the external port.
 // If the address doesn't exist in the VM (i.e. it exists only on the host)
-// then this is not a hard failure.
-func NewBestEffortIPProxy(host net.Addr, container net.Addr) (Proxy, error) {
-	ipP, err := NewIPProxy(host, container)
+// then this is not a hard failure. NewDeferredIPProxy binds the address
+// once it appears instead.
+func NewBestEffortIPProxy(host net.Addr, container net.Addr, opts ...Option) (Proxy, error) {
+	ipP, err := NewIPProxy(host, container, opts...)
 	if err == nil {
 		return ipP, nil
 	}
-	if opError, ok := err.(*net.OpError); ok {
-		if syscallError, ok := opError.Err.(*os.SyscallError); ok {
-			if syscallError.Err == syscall.EADDRNOTAVAIL {
-				log.Printf("Address %s doesn't exist in the VM: only binding on the host", host)
-				return nil, nil // Non-fatal error
-			}
-		}
+	o := newOptions(opts)
+	switch bindErrno(err) {
+	case syscall.EADDRNOTAVAIL:
+		o.logf("Address %s doesn't exist in the VM: only binding on the host", host)
+		return nil, nil // Non-fatal error
+	case syscall.EAFNOSUPPORT:
+		o.logf("Address family of %s isn't configured in the VM: only binding on the host", host)
+		return nil, nil // Non-fatal error
 	}
 	return nil, err
 }
+
+// bindErrno digs the errno out of an error returned when binding a listener,
+// however deeply it has been wrapped. It returns 0 if there is none.
+func bindErrno(err error) syscall.Errno {
+	for err != nil {
+		switch e := err.(type) {
+		case syscall.Errno:
+			return e
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			err = errors.Unwrap(err)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,266 @@
+package libproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ProxyProtocolV1 selects the text form of the HAProxy PROXY protocol.
+	ProxyProtocolV1 = 1
+	// ProxyProtocolV2 selects the binary form of the HAProxy PROXY protocol.
+	ProxyProtocolV2 = 2
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolV1MaxLength is the longest a v1 header can be, including the
+// CRLF.
+const proxyProtocolV1MaxLength = 107
+
+// proxyProtocolHeaderTimeout is how long a client of a proxy with
+// WithAcceptProxyProtocol has to send its header.
+var proxyProtocolHeaderTimeout = 10 * time.Second
+
+// WithProxyProtocol makes the TCP proxy send a HAProxy PROXY protocol header
+// of the given version (ProxyProtocolV1 or ProxyProtocolV2) to the backend
+// before any payload, carrying the address of the frontend client.
+func WithProxyProtocol(version int) Option {
+	return func(o *options) {
+		o.proxyProtocol = version
+	}
+}
+
+// writeProxyProtocolHeader writes a PROXY protocol header describing a
+// connection from src to dst. Addresses other than TCP are sent as UNKNOWN
+// (v1) or LOCAL (v2).
+func writeProxyProtocolHeader(w io.Writer, version int, src, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = proxyProtocolV1Header(src, dst)
+	case ProxyProtocolV2:
+		header = proxyProtocolV2Header(src, dst)
+	default:
+		return fmt.Errorf("Unsupported PROXY protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+// tcpAddrs returns the source and destination as TCP addresses and whether
+// both of them are IPv4.
+func tcpAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool, bool) {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false, false
+	}
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false, false
+	}
+	return s, d, s.IP.To4() != nil && d.IP.To4() != nil, true
+}
+
+func proxyProtocolV1Header(src, dst net.Addr) []byte {
+	s, d, ipv4, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if ipv4 {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(s.IP), ipv6String(d.IP), s.Port, d.Port))
+}
+
+// ipv6String formats ip for a TCP6 v1 header, writing an IPv4 address in
+// its IPv4-mapped form, ::ffff:a.b.c.d, rather than dotted as String does.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyProtocolV2Header(src, dst net.Addr) []byte {
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+	s, d, ipv4, ok := tcpAddrs(src, dst)
+	if !ok {
+		// LOCAL command, AF_UNSPEC, no addresses
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+	var srcIP, dstIP net.IP
+	if ipv4 {
+		// PROXY command, AF_INET over STREAM
+		header.Write([]byte{0x21, 0x11})
+		srcIP, dstIP = s.IP.To4(), d.IP.To4()
+	} else {
+		// PROXY command, AF_INET6 over STREAM
+		header.Write([]byte{0x21, 0x21})
+		srcIP, dstIP = s.IP.To16(), d.IP.To16()
+	}
+	binary.Write(&header, binary.BigEndian, uint16(2*len(srcIP)+4))
+	header.Write(srcIP)
+	header.Write(dstIP)
+	binary.Write(&header, binary.BigEndian, uint16(s.Port))
+	binary.Write(&header, binary.BigEndian, uint16(d.Port))
+	return header.Bytes()
+}
+
+// WithAcceptProxyProtocol makes the TCP proxy expect each connection it
+// accepts to start with a HAProxy PROXY protocol header, v1 or v2, as sent
+// by a load balancer in front of it. The header is removed before the
+// connection is forwarded, and the client it names is used as the remote
+// address of the connection, in logs, statistics and events and in any
+// header sent with WithProxyProtocol. Headers which name no client, such as
+// v1 UNKNOWN or v2 LOCAL ones, leave the address of the connection as it
+// is. Connections which don't send a valid header within 10 seconds are
+// closed. The CIDRs given to WithAllowCIDRs and WithDenyCIDRs still apply to
+// the address the connection comes from, that of the load balancer.
+func WithAcceptProxyProtocol() Option {
+	return func(o *options) {
+		o.acceptProxyProtocol = true
+	}
+}
+
+// proxyProtocolConn is a client whose PROXY protocol header has been read,
+// whose addresses are those the header gave.
+type proxyProtocolConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (p *proxyProtocolConn) Read(b []byte) (int, error) { return p.r.Read(b) }
+func (p *proxyProtocolConn) RemoteAddr() net.Addr       { return p.remote }
+func (p *proxyProtocolConn) LocalAddr() net.Addr        { return p.local }
+func (p *proxyProtocolConn) CloseRead() error           { return p.Conn.(Conn).CloseRead() }
+func (p *proxyProtocolConn) CloseWrite() error          { return p.Conn.(Conn).CloseWrite() }
+
+// acceptProxyProtocol reads the PROXY protocol header client starts with
+// and returns the client without it.
+func acceptProxyProtocol(client Conn) (Conn, error) {
+	raw, ok := client.(net.Conn)
+	if !ok {
+		return nil, fmt.Errorf("Can't read a PROXY protocol header from a %T", client)
+	}
+	raw.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+	defer raw.SetReadDeadline(time.Time{})
+	conn := &proxyProtocolConn{Conn: raw, r: bufio.NewReader(raw), remote: raw.RemoteAddr(), local: raw.LocalAddr()}
+	var src, dst *net.TCPAddr
+	first, err := conn.r.Peek(1)
+	if err == nil {
+		if first[0] == proxyProtocolV2Signature[0] {
+			src, dst, err = readProxyProtocolV2Header(conn.r)
+		} else {
+			src, dst, err = readProxyProtocolV1Header(conn.r)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read PROXY protocol header from %v: %s", raw.RemoteAddr(), err)
+	}
+	if src != nil {
+		conn.remote, conn.local = src, dst
+	}
+	return conn, nil
+}
+
+// readProxyProtocolV1Header reads a v1 header, returning nil addresses for
+// an UNKNOWN one.
+func readProxyProtocolV1Header(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return nil, nil, fmt.Errorf("v1 header is longer than %d bytes", proxyProtocolV1MaxLength)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	src, srcErr := parseProxyProtocolV1Addr(fields[1], fields[2], fields[4])
+	dst, dstErr := parseProxyProtocolV1Addr(fields[1], fields[3], fields[5])
+	if srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	return src, dst, nil
+}
+
+func parseProxyProtocolV1Addr(protocol, ip, port string) (*net.TCPAddr, error) {
+	// TCP6 addresses may be IPv4-mapped, but have to be written as IPv6.
+	addr := net.ParseIP(ip)
+	if addr == nil || strings.Contains(ip, ":") == (protocol == "TCP4") {
+		return nil, fmt.Errorf("invalid %s address %q", protocol, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyProtocolV2Header reads a v2 header, returning nil addresses for a
+// LOCAL one or one for anything other than TCP over IPv4 or IPv6. Any TLVs
+// are skipped.
+func readProxyProtocolV2Header(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:len(proxyProtocolV2Signature)], proxyProtocolV2Signature) {
+		return nil, nil, fmt.Errorf("invalid v2 signature %x", header[:len(proxyProtocolV2Signature)])
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0:
+		// LOCAL: the load balancer's own connection.
+		return nil, nil, nil
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", versionCommand&0xf)
+	}
+	var size int
+	switch family {
+	case 0x11: // AF_INET over STREAM
+		size = net.IPv4len
+	case 0x21: // AF_INET6 over STREAM
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("v2 addresses are truncated to %d bytes", len(body))
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return src, dst, nil
+}
@@ -0,0 +1,258 @@
+package libproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolV1Header(t *testing.T) {
+	tests := []struct {
+		src, dst net.Addr
+		expected string
+	}{
+		{
+			&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			&net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443},
+			"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			"PROXY TCP6 ::ffff:192.168.0.1 2001:db8::2 56324 443\r\n",
+		},
+		{nil, nil, "PROXY UNKNOWN\r\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := writeProxyProtocolHeader(&buf, ProxyProtocolV1, test.src, test.dst); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Fatalf("Expected %q but got %q", test.expected, buf.String())
+		}
+	}
+}
+
+func TestProxyProtocolV2Header(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 0x1234}
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 0x50}
+	var buf bytes.Buffer
+	if err := writeProxyProtocolHeader(&buf, ProxyProtocolV2, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]byte{}, proxyProtocolV2Signature...),
+		0x21, 0x11, 0x00, 0x0c,
+		10, 0, 0, 1, 10, 0, 0, 2,
+		0x12, 0x34, 0x00, 0x50)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("Expected %x but got %x", expected, buf.Bytes())
+	}
+
+	buf.Reset()
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}
+	if err := writeProxyProtocolHeader(&buf, ProxyProtocolV2, src6, dst6); err != nil {
+		t.Fatal(err)
+	}
+	header := buf.Bytes()
+	if len(header) != 16+36 || header[13] != 0x21 || header[15] != 36 {
+		t.Fatalf("Unexpected IPv6 header %x", header)
+	}
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, backend.Addr().(*net.TCPAddr), WithProxyProtocol(ProxyProtocolV1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var expected bytes.Buffer
+	writeProxyProtocolHeader(&expected, ProxyProtocolV1, client.LocalAddr(), client.RemoteAddr())
+	expected.Write(testBuf)
+	received := make([]byte, expected.Len())
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, expected.Bytes()) {
+		t.Fatalf("Expected %q but got %q", expected.Bytes(), received)
+	}
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 11), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	tests := []struct {
+		version  int
+		src, dst net.Addr
+	}{
+		{ProxyProtocolV1, src, dst},
+		{ProxyProtocolV1, src6, dst6},
+		{ProxyProtocolV1, src, dst6},
+		{ProxyProtocolV1, nil, nil},
+		{ProxyProtocolV2, src, dst},
+		{ProxyProtocolV2, src6, dst6},
+		{ProxyProtocolV2, nil, nil},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writeProxyProtocolHeader(&buf, test.version, test.src, test.dst)
+		buf.Write(testBuf)
+		r := bufio.NewReader(&buf)
+		read := readProxyProtocolV1Header
+		if test.version == ProxyProtocolV2 {
+			read = readProxyProtocolV2Header
+		}
+		gotSrc, gotDst, err := read(r)
+		if err != nil {
+			t.Fatalf("Can't read v%d header for %v: %s", test.version, test.src, err)
+		}
+		if test.src == nil {
+			if gotSrc != nil || gotDst != nil {
+				t.Fatalf("Expected no addresses from v%d header but got %v and %v", test.version, gotSrc, gotDst)
+			}
+		} else if gotSrc.String() != test.src.String() || gotDst.String() != test.dst.String() {
+			t.Fatalf("Expected %v and %v from v%d header but got %v and %v", test.src, test.dst, test.version, gotSrc, gotDst)
+		}
+		rest, _ := io.ReadAll(r)
+		if !bytes.Equal(rest, testBuf) {
+			t.Fatalf("Expected %q after the v%d header but got %q", testBuf, test.version, rest)
+		}
+	}
+}
+
+func TestReadInvalidProxyProtocolHeader(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP6 192.168.0.1 2001:db8::2 56324 443\r\n",
+		"PROXY TCP4 ::ffff:192.168.0.1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 65536\r\n",
+		"PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		"PROXY " + strings.Repeat("x", proxyProtocolV1MaxLength),
+	} {
+		if _, _, err := readProxyProtocolV1Header(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Fatalf("Expected an error reading %q", header)
+		}
+	}
+	truncated := append(append([]byte{}, proxyProtocolV2Signature...), 0x21, 0x11, 0x00, 0x04, 1, 2, 3, 4)
+	badVersion := append(append([]byte{}, proxyProtocolV2Signature...), 0x11, 0x11, 0x00, 0x00)
+	for _, header := range [][]byte{truncated, badVersion} {
+		if _, _, err := readProxyProtocolV2Header(bufio.NewReader(bytes.NewReader(header))); err == nil {
+			t.Fatalf("Expected an error reading %x", header)
+		}
+	}
+}
+
+func TestTCPAcceptProxyProtocol(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, backend.Addr().(*net.TCPAddr), WithAcceptProxyProtocol(), WithProxyProtocol(ProxyProtocolV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The real client and the address it connected to on the load
+	// balancer in front of the proxy.
+	src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+	dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+	writeProxyProtocolHeader(client, ProxyProtocolV1, src, dst)
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var expected bytes.Buffer
+	writeProxyProtocolHeader(&expected, ProxyProtocolV2, src, dst)
+	expected.Write(testBuf)
+	received := make([]byte, expected.Len())
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, expected.Bytes()) {
+		t.Fatalf("Expected %x but got %x", expected.Bytes(), received)
+	}
+}
+
+func TestTCPAcceptProxyProtocolTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { proxyProtocolHeaderTimeout = timeout }(proxyProtocolHeaderTimeout)
+	proxyProtocolHeaderTimeout = 100 * time.Millisecond
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, backend.Addr().(*net.TCPAddr), WithAcceptProxyProtocol())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Part of a header, and then nothing more.
+	if _, err := io.WriteString(client, "PROXY TCP4"); err != nil {
+		t.Fatal(err)
+	}
+	expectDisconnected(t, client)
+}
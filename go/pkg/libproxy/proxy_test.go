@@ -0,0 +1,106 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestBindErrno(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.EADDRNOTAVAIL, syscall.EAFNOSUPPORT} {
+		errs := []error{
+			errno,
+			&net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", errno)},
+			&net.OpError{Op: "listen", Net: "tcp6", Err: errno},
+			fmt.Errorf("listening: %w", &net.OpError{Op: "listen", Net: "udp6", Err: os.NewSyscallError("bind", errno)}),
+		}
+		for _, err := range errs {
+			if got := bindErrno(err); got != errno {
+				t.Errorf("Expected %v from %v but got %v", errno, err, got)
+			}
+		}
+	}
+	if got := bindErrno(fmt.Errorf("something else")); got != 0 {
+		t.Errorf("Expected no errno but got %v", got)
+	}
+}
+
+func TestBestEffortIPProxyMissingAddress(t *testing.T) {
+	// Documentation addresses which shouldn't be configured on the test
+	// machine. If IPv6 isn't available at all, binding fails with
+	// EAFNOSUPPORT which must be skipped too.
+	addrs := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 0},
+		&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 0},
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 0},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 0},
+	}
+	for _, addr := range addrs {
+		var backend net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+		if _, ok := addr.(*net.UDPAddr); ok {
+			backend = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+		}
+		proxy, err := NewBestEffortIPProxy(addr, backend)
+		if err != nil || proxy != nil {
+			t.Errorf("Expected binding %s/%s to be skipped but got %v, %v", addr.Network(), addr, proxy, err)
+		}
+	}
+}
+
+// failingListener is a listener whose Close fails.
+type failingListener struct {
+	net.Listener
+}
+
+var errListenerClose = errors.New("close failed")
+
+func (l *failingListener) Close() error {
+	l.Listener.Close()
+	return errListenerClose
+}
+
+func TestCloseReturnsFirstErrorOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(&failingListener{listener}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	if err := proxy.Close(); err != errListenerClose {
+		t.Fatalf("Expected %v from the first Close, got %v", errListenerClose, err)
+	}
+	if err := proxy.Close(); err != nil {
+		t.Fatalf("Expected the second Close to return nil, got %v", err)
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	tcp, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	composite, err := NewPortRangeProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, _ := NewStubProxy(nil, nil)
+	for _, proxy := range []Proxy{tcp, udp, composite, stub} {
+		go proxy.Run()
+		for i := 0; i < 2; i++ {
+			if err := proxy.Close(); err != nil {
+				t.Fatalf("Close %d of %T failed: %v", i, proxy, err)
+			}
+		}
+		proxy.Wait()
+	}
+}
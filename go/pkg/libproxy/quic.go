@@ -0,0 +1,185 @@
+//go:build quic
+// +build quic
+
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// NewQUICMuxProxy creates an experimental TCPProxy whose frontend is a QUIC
+// server on conn: each stream opened by a QUIC client is forwarded over a
+// connection of its own to backendAddr, so that many logical connections
+// share one UDP flow. Closing a stream for writing half-closes the backend
+// connection, and a backend EOF closes the stream for writing, as for TCP
+// clients, while a connection ended by an error resets the stream. Stats and
+// Connections count streams rather than QUIC connections.
+//
+// tlsConfig must have a certificate and set NextProtos, which QUIC requires.
+// The options are those of NewTCPProxy. This is only built with the quic
+// build tag, so that only the binaries which want it link quic-go.
+func NewQUICMuxProxy(conn net.PacketConn, backendAddr *net.TCPAddr, tlsConfig *tls.Config, opts ...Option) (*TCPProxy, error) {
+	if tlsConfig == nil || len(tlsConfig.NextProtos) == 0 {
+		return nil, fmt.Errorf("Can't serve QUIC on %v without a TLS config setting NextProtos", conn.LocalAddr())
+	}
+	ln, err := quic.Listen(conn, tlsConfig, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Can't serve QUIC on %v: %s", conn.LocalAddr(), err)
+	}
+	listener := newQUICListener(ln)
+	proxy, err := NewTCPProxy(listener, backendAddr, opts...)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// quicListener is a net.Listener accepting the streams of every connection
+// to a QUIC listener.
+type quicListener struct {
+	ln      *quic.Listener
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams chan net.Conn
+	m       sync.Mutex
+	conns   map[quic.Connection]struct{}
+	err     error // why accepting stopped, set before ctx is cancelled
+}
+
+func newQUICListener(ln *quic.Listener) *quicListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &quicListener{
+		ln:      ln,
+		ctx:     ctx,
+		cancel:  cancel,
+		streams: make(chan net.Conn),
+		conns:   make(map[quic.Connection]struct{}),
+	}
+	go l.acceptConns()
+	return l
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			l.stop(err)
+			return
+		}
+		l.m.Lock()
+		if l.err != nil {
+			l.m.Unlock()
+			conn.CloseWithError(0, "")
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.m.Unlock()
+		go l.acceptStreams(conn)
+	}
+}
+
+// acceptStreams hands the streams of conn to Accept until conn or the
+// listener is closed.
+func (l *quicListener) acceptStreams(conn quic.Connection) {
+	defer func() {
+		l.m.Lock()
+		delete(l.conns, conn)
+		l.m.Unlock()
+	}()
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &quicStreamConn{Stream: stream, conn: conn}:
+		case <-l.ctx.Done():
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			return
+		}
+	}
+}
+
+// stop makes Accept return err, and closes the QUIC connections.
+func (l *quicListener) stop(err error) {
+	l.m.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	conns := l.conns
+	l.conns = make(map[quic.Connection]struct{})
+	l.m.Unlock()
+	l.cancel()
+	for conn := range conns {
+		conn.CloseWithError(0, "")
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.ctx.Done():
+		l.m.Lock()
+		defer l.m.Unlock()
+		return nil, l.err
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.stop(net.ErrClosed)
+	return l.ln.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// quicStreamConn is a Conn carrying one QUIC stream.
+type quicStreamConn struct {
+	quic.Stream
+	conn     quic.Connection
+	m        sync.Mutex
+	finished bool // set once a FIN or a reset has been sent
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close resets the stream unless a FIN has been sent already, so that a
+// connection torn down by an error isn't taken by the client for one which
+// ended cleanly.
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	c.m.Lock()
+	defer c.m.Unlock()
+	if !c.finished {
+		c.finished = true
+		c.Stream.CancelWrite(0)
+	}
+	return nil
+}
+
+func (c *quicStreamConn) CloseRead() error {
+	c.Stream.CancelRead(0)
+	return nil
+}
+
+// CloseWrite sends a FIN on the stream, leaving it open for reading.
+func (c *quicStreamConn) CloseWrite() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.finished {
+		return nil
+	}
+	c.finished = true
+	return c.Stream.Close()
+}
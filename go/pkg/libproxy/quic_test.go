@@ -0,0 +1,138 @@
+//go:build quic
+// +build quic
+
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUICMuxProxy(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	cert, pool := selfSignedCert(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"libproxy-test"}}
+	proxy, err := NewQUICMuxProxy(conn, backend.LocalAddr().(*net.TCPAddr), serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := quic.DialAddr(ctx, proxy.FrontendAddr().String(), &tls.Config{RootCAs: pool, NextProtos: []string{"libproxy-test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseWithError(0, "")
+	const streams = 3
+	for i := 0; i < streams; i++ {
+		stream, err := client.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Write(testBuf); err != nil {
+			t.Fatal(err)
+		}
+		// Closing the stream for writing half-closes the backend
+		// connection, so the echo server finishes and closes it.
+		stream.Close()
+		stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		echoed, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(echoed) != string(testBuf) {
+			t.Fatalf("Expected %d bytes echoed on stream %d but got %d", testBufSize, i, len(echoed))
+		}
+	}
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 0
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", stats) })
+	if stats.TotalConns != streams {
+		t.Fatalf("Expected a backend connection per stream but got %+v", stats)
+	}
+	proxy.Close()
+	waitReturns(t, proxy)
+}
+
+func TestQUICMuxProxyResetsAbortedStreams(t *testing.T) {
+	// The backend resets its connection instead of closing it cleanly.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(conn, make([]byte, testBufSize))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+	cert, pool := selfSignedCert(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"libproxy-test"}}
+	proxy, err := NewQUICMuxProxy(conn, backend.Addr().(*net.TCPAddr), serverConfig, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := quic.DialAddr(ctx, proxy.FrontendAddr().String(), &tls.Config{RootCAs: pool, NextProtos: []string{"libproxy-test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.CloseWithError(0, "")
+	stream, err := client.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var streamErr *quic.StreamError
+	if _, err := io.ReadAll(stream); !errors.As(err, &streamErr) {
+		t.Fatalf("Expected the stream to be reset but got %v", err)
+	}
+}
+
+func TestQUICMuxProxyNeedsNextProtos(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := NewQUICMuxProxy(conn, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, &tls.Config{Certificates: []tls.Certificate{cert}}); err == nil {
+		t.Fatal("Expected an error without NextProtos")
+	}
+}
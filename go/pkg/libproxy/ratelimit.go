@@ -0,0 +1,95 @@
+package libproxy
+
+import (
+	"io"
+	"time"
+)
+
+// rateLimitSlice is how much of a second's allowance a rate limited writer
+// sends at a time. Small slices keep the traffic smooth instead of bursting a
+// whole second's worth and then stalling.
+const rateLimitSlice = 50
+
+// WithRateLimit caps each direction of every TCP connection forwarded by the
+// proxy at bytesPerSec. Zero means unlimited.
+func WithRateLimit(bytesPerSec int) Option {
+	return func(o *options) {
+		o.rateLimit = bytesPerSec
+	}
+}
+
+// tokenBucket allows rate bytes per second, with bursts of at most burst
+// bytes.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec int) *tokenBucket {
+	burst := float64(bytesPerSec / rateLimitSlice)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take waits until n bytes, which must be no more than the burst, may be
+// sent.
+func (b *tokenBucket) take(n int) {
+	time.Sleep(b.reserve(n))
+}
+
+// reserve takes n tokens, going into debt if there aren't enough, and
+// returns how long to wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		return time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	return 0
+}
+
+// rateLimitedWriter writes through a tokenBucket, a burst at a time.
+type rateLimitedWriter struct {
+	w      io.Writer
+	bucket *tokenBucket
+}
+
+func (r *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > int(r.bucket.burst) {
+			chunk = chunk[:int(r.bucket.burst)]
+		}
+		r.bucket.take(len(chunk))
+		n, err := r.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// withRateLimit wraps w with the configured rate limit, if any.
+func (o *options) withRateLimit(w io.Writer) io.Writer {
+	if o.rateLimit <= 0 {
+		return w
+	}
+	return &rateLimitedWriter{w: w, bucket: newTokenBucket(o.rateLimit)}
+}
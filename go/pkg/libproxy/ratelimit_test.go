@@ -0,0 +1,86 @@
+package libproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type chunkRecorder struct {
+	sizes []int
+	times []time.Time
+}
+
+func (c *chunkRecorder) Write(p []byte) (int, error) {
+	c.sizes = append(c.sizes, len(p))
+	c.times = append(c.times, time.Now())
+	return len(p), nil
+}
+
+func TestRateLimitedWriterIsSmooth(t *testing.T) {
+	rec := &chunkRecorder{}
+	o := newOptions([]Option{WithRateLimit(100000)})
+	w := o.withRateLimit(rec)
+	start := time.Now()
+	if _, err := w.Write(make([]byte, 25000)); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Expected 25000 bytes at 100000 bytes/s to take about 250ms but took %s", elapsed)
+	}
+	last := start
+	for i, size := range rec.sizes {
+		if size > 100000/rateLimitSlice {
+			t.Fatalf("Wrote a chunk of %d bytes", size)
+		}
+		if gap := rec.times[i].Sub(last); gap > 200*time.Millisecond {
+			t.Fatalf("Stalled for %s between chunks", gap)
+		}
+		last = rec.times[i]
+	}
+}
+
+func TestRateLimitUnset(t *testing.T) {
+	rec := &chunkRecorder{}
+	o := newOptions(nil)
+	if w := o.withRateLimit(rec); w != io.Writer(rec) {
+		t.Fatal("Expected no rate limit by default")
+	}
+}
+
+func TestTCPProxyRateLimit(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithRateLimit(200000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	sent := bytes.Repeat(testBuf, 1000)
+	start := time.Now()
+	go client.Write(sent)
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(client, received); err != nil {
+		t.Fatal(err)
+	}
+	// Each direction is limited independently, so the echo takes about as
+	// long as one direction.
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("Transferred %d bytes at 200000 bytes/s in only %s", len(sent), elapsed)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Fatal("Data was corrupted by the rate limit")
+	}
+}
@@ -0,0 +1,39 @@
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WithDialRetry makes a TCP proxy try to connect to its backend up to
+// attempts times before giving up on a connection, waiting backoff after the
+// first failure and twice as long after each subsequent one. The frontend
+// connection is held open meanwhile, so clients of a backend which is
+// restarting see a delay rather than a reset.
+func WithDialRetry(attempts int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.dialAttempts = attempts
+		o.dialBackoff = backoff
+	}
+}
+
+// dialBackendWithRetry dials the backend, retrying as configured. It gives up
+// early if the proxy is closed.
+func (proxy *TCPProxy) dialBackendWithRetry(ctx context.Context) (Conn, error) {
+	backoff := proxy.opts.dialBackoff
+	for attempt := 1; ; attempt++ {
+		backend, err := proxy.dialBackend(ctx)
+		if err == nil || attempt >= proxy.opts.dialAttempts || proxy.failingFast() {
+			return backend, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-proxy.quit:
+			timer.Stop()
+			return nil, fmt.Errorf("Proxy closed while retrying %v: %s", proxy.BackendAddr(), err)
+		}
+		backoff *= 2
+	}
+}
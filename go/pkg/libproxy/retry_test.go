@@ -0,0 +1,81 @@
+package libproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func unusedTCPAddr(t *testing.T) *net.TCPAddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+func TestTCPProxyDialRetry(t *testing.T) {
+	backendAddr := unusedTCPAddr(t)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backendAddr, WithDialRetry(10, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The backend comes up while the proxy is retrying.
+	time.Sleep(50 * time.Millisecond)
+	backend := NewEchoServer(t, "tcp", backendAddr.String())
+	defer backend.Close()
+	backend.Run()
+	roundTrip(t, client)
+}
+
+func TestTCPProxyDialRetryGivesUp(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, unusedTCPAddr(t), WithDialRetry(3, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	start := time.Now()
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the frontend connection to be closed but got %v", err)
+	}
+	// Two backoffs: 10ms then 20ms.
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("Gave up after %s, before retrying", elapsed)
+	}
+}
+
+func TestTCPProxyDialRetryStopsOnClose(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, unusedTCPAddr(t), WithDialRetry(100, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 1 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 1 in %+v", proxy.Stats()) })
+	proxy.Close()
+	waitReturns(t, proxy)
+}
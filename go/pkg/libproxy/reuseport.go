@@ -0,0 +1,61 @@
+package libproxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// WithReusePort makes NewIPProxy bind its TCP or UDP frontend with
+// SO_REUSEPORT, so that several proxies (in this process or others) can share
+// one frontend port and the kernel spreads connections and datagrams between
+// them. On platforms without SO_REUSEPORT a warning is logged and the port is
+// bound normally.
+func WithReusePort() Option {
+	return func(o *options) {
+		o.reusePort = true
+	}
+}
+
+func (o *options) listenConfig() *net.ListenConfig {
+	if !o.reusePort && !o.freeBind && o.receiveBuffer <= 0 && o.sendBuffer <= 0 && o.frontendFamily != "6" {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if o.reusePort {
+			if err := setReusePort(o, network, address, c); err != nil {
+				return err
+			}
+		}
+		if err := o.setListenerBuffers(network, address, c); err != nil {
+			return err
+		}
+		if err := o.setV6Only(network, address, c); err != nil {
+			return err
+		}
+		if o.freeBind {
+			return setFreeBind(o, network, address, c)
+		}
+		return nil
+	}}
+}
+
+func (o *options) listenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	var listener net.Listener
+	err := o.bindWithFallback(addr.Port, func(port int) (err error) {
+		bindAddr := &net.TCPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}
+		listener, err = o.listenConfig().Listen(context.Background(), "tcp"+o.frontendFamily, bindAddr.String())
+		return err
+	})
+	return listener, err
+}
+
+func (o *options) listenUDP(addr *net.UDPAddr) (net.PacketConn, error) {
+	var conn net.PacketConn
+	err := o.bindWithFallback(addr.Port, func(port int) (err error) {
+		bindAddr := &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}
+		conn, err = o.listenConfig().ListenPacket(context.Background(), "udp"+o.frontendFamily, bindAddr.String())
+		return err
+	})
+	return conn, err
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package libproxy
+
+import "syscall"
+
+func setReusePort(o *options, network, address string, c syscall.RawConn) error {
+	o.logf("SO_REUSEPORT isn't supported on this platform: binding %s/%s without it", network, address)
+	return nil
+}
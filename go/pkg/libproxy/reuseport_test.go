@@ -0,0 +1,70 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTCPReusePort(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	first, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, backend.LocalAddr(), WithReusePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewIPProxy(first.FrontendAddr(), backend.LocalAddr(), WithReusePort())
+	if err != nil {
+		t.Fatalf("Can't share tcp/%v: %s", first.FrontendAddr(), err)
+	}
+	defer second.Close()
+	go first.Run()
+	go second.Run()
+	for i := 0; i < 4; i++ {
+		client, err := net.Dial("tcp", first.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		client.Close()
+	}
+}
+
+func TestUDPReusePort(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	first, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, backend.LocalAddr(), WithReusePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := NewIPProxy(first.FrontendAddr(), backend.LocalAddr(), WithReusePort())
+	if err != nil {
+		t.Fatalf("Can't share udp/%v: %s", first.FrontendAddr(), err)
+	}
+	defer second.Close()
+	go first.Run()
+	go second.Run()
+	client, err := net.Dial("udp", first.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+}
+
+func TestNoReusePortByDefault(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	first, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if second, err := NewIPProxy(first.FrontendAddr(), backend.LocalAddr()); err == nil {
+		second.Close()
+		t.Fatalf("Expected binding tcp/%v twice to fail", first.FrontendAddr())
+	}
+}
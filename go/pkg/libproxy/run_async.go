@@ -0,0 +1,33 @@
+package libproxy
+
+// RunHandle is a proxy being run by RunAsync.
+type RunHandle struct {
+	proxy Proxy
+	done  chan struct{} // closed once Run has returned
+	err   error         // from Run, set before done is closed
+}
+
+// RunAsync runs p in a goroutine of its own, returning a handle to wait for
+// it and to stop it.
+func RunAsync(p Proxy) *RunHandle {
+	h := &RunHandle{proxy: p, done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		h.err = p.Run()
+	}()
+	return h
+}
+
+// Wait blocks until the proxy's Run has returned and returns its error, which
+// is nil if it was stopped by Close. It can be called any number of times.
+func (h *RunHandle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// Close closes the proxy and returns once it has stopped, as for its Wait.
+func (h *RunHandle) Close() {
+	h.proxy.Close()
+	<-h.done
+	h.proxy.Wait()
+}
@@ -0,0 +1,71 @@
+package libproxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRunAsync(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := RunAsync(proxy)
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+	select {
+	case <-proxy.Done():
+	default:
+		t.Fatal("Expected the proxy to have stopped once Close returned")
+	}
+	if err := h.Wait(); err != nil {
+		t.Fatalf("Expected Run to return nil after Close but got %s", err)
+	}
+}
+
+func TestRunAsyncError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(&brokenListener{listener}, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	h := RunAsync(proxy)
+	done := make(chan error, 1)
+	go func() { done <- h.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected the Accept error from Run")
+		}
+		if again := h.Wait(); again != err {
+			t.Fatalf("Expected Wait to keep returning %s but got %v", err, again)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait didn't return after Run failed")
+	}
+	h.Close()
+}
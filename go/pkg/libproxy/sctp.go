@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/ishidawataru/sctp"
+)
+
+// NewSCTPProxy creates a TCPProxy accepting SCTP associations on
+// frontendAddr and forwarding each one over an association of its own to
+// backendAddr, copying its stream as for TCP. Only one-to-one associations
+// using a single stream are supported. SCTP can't be half-closed, so an EOF
+// in either direction closes the association, and the ishidawataru/sctp
+// sockets don't support deadlines, so WithReadTimeout and WithWriteTimeout
+// don't apply to them. FrontendAddr and BackendAddr return *sctp.SCTPAddr.
+//
+// The options are those of NewTCPProxy. This is only built on Linux, and
+// needs the kernel's SCTP module to be available.
+func NewSCTPProxy(frontendAddr, backendAddr *sctp.SCTPAddr, opts ...Option) (*TCPProxy, error) {
+	listener, err := sctp.ListenSCTP("sctp", frontendAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Can't listen on sctp/%v: %s", frontendAddr, err)
+	}
+	proxy, err := newStreamProxy(context.Background(), listener, backendAddr, opts...)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return proxy, nil
+}
+
+// dialSCTP connects to addr if it is an SCTP address.
+func dialSCTP(addr net.Addr) (Conn, bool, error) {
+	sctpAddr, ok := addr.(*sctp.SCTPAddr)
+	if !ok {
+		return nil, false, nil
+	}
+	conn, err := sctp.DialSCTP("sctp", nil, sctpAddr)
+	if err != nil {
+		return nil, true, err
+	}
+	return asConn(conn), true, nil
+}
+
+func isSCTPAddr(addr net.Addr) bool {
+	_, ok := addr.(*sctp.SCTPAddr)
+	return ok
+}
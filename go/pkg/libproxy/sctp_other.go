@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package libproxy
+
+import "net"
+
+// SCTP is only supported on Linux, see NewSCTPProxy.
+
+func dialSCTP(addr net.Addr) (Conn, bool, error) {
+	return nil, false, nil
+}
+
+func isSCTPAddr(addr net.Addr) bool {
+	return false
+}
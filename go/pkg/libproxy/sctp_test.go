@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ishidawataru/sctp"
+)
+
+func loopbackSCTP() *sctp.SCTPAddr {
+	return &sctp.SCTPAddr{IPAddrs: []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}}
+}
+
+func TestSCTPProxy(t *testing.T) {
+	backend, err := sctp.ListenSCTP("sctp", loopbackSCTP())
+	if err != nil {
+		t.Skipf("SCTP isn't available here: %s", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	backendAddr := backend.Addr().(*sctp.SCTPAddr)
+	proxy, err := NewSCTPProxy(loopbackSCTP(), backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	if _, ok := proxy.FrontendAddr().(*sctp.SCTPAddr); !ok {
+		t.Fatalf("Expected an SCTP frontend address but got %T", proxy.FrontendAddr())
+	}
+	if proxy.BackendAddr() != backendAddr {
+		t.Fatalf("Expected the backend to be %v but got %v", backendAddr, proxy.BackendAddr())
+	}
+
+	client, err := sctp.DialSCTP("sctp", nil, proxy.FrontendAddr().(*sctp.SCTPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err := io.ReadFull(client, recvBuf); err != nil {
+		t.Fatal(err)
+	}
+	if string(recvBuf) != string(testBuf) {
+		t.Fatalf("Expected %q but got %q", testBuf, recvBuf)
+	}
+	proxy.Close()
+	waitReturns(t, proxy)
+}
@@ -0,0 +1,163 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// selfTestTimeout bounds a SelfTest whose context has a later deadline, or
+// none.
+var selfTestTimeout = 2 * time.Second
+
+// selfTestProbe is the datagram a UDP proxy's SelfTest sends.
+var selfTestProbe = []byte("libproxy self-test")
+
+// SelfTest checks that the proxy is forwarding by connecting to its own
+// frontend, over loopback if it listens on every address, and waiting for
+// the connection to reach the backend. For a proxy whose clients choose
+// their own backend, such as SOCKS5, only the connection to the frontend is
+// checked, and a NewTLSProxy frontend is connected to without checking its
+// certificate. The test connection is closed straight away, but is counted
+// in Stats like any other. Only TCP frontends can be tested.
+func (proxy *TCPProxy) SelfTest(ctx context.Context) error {
+	frontend, ok := proxy.frontendAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("Can't self-test a %s frontend", proxy.frontendAddr.Network())
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	proxy.selfTests.start()
+	defer proxy.selfTests.finish()
+	var d net.Dialer
+	client, err := d.DialContext(ctx, "tcp", selfTestAddr(frontend.IP, frontend.Zone, frontend.Port))
+	if err != nil {
+		return fmt.Errorf("Self-test can't connect to %s/%v: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+	}
+	defer client.Close()
+	result := proxy.selfTests.result(client.LocalAddr())
+	if proxy.tlsConfig != nil {
+		conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		if err := conn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("Self-test TLS handshake with %s/%v failed: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+		}
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("Self-test of %s/%v failed: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Self-test of %s/%v timed out: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, ctx.Err())
+	}
+}
+
+// selfTests passes the outcome of each connection from a TCPProxy's
+// SelfTest back to it. The proxy may get to the connection before SelfTest
+// knows its address, so while any SelfTest is running the outcome of every
+// connection is kept until the last one finishes.
+type selfTests struct {
+	m       sync.Mutex
+	pending int
+	results map[string]chan error
+}
+
+func (s *selfTests) start() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.pending++
+	if s.results == nil {
+		s.results = make(map[string]chan error)
+	}
+}
+
+func (s *selfTests) finish() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.pending--
+	if s.pending == 0 {
+		s.results = nil
+	}
+}
+
+// result returns the channel the outcome of the connection from client is
+// sent on, or nil if no SelfTest is running.
+func (s *selfTests) result(client net.Addr) chan error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.results == nil || client == nil {
+		return nil
+	}
+	key := client.String()
+	result, ok := s.results[key]
+	if !ok {
+		result = make(chan error, 1)
+		s.results[key] = result
+	}
+	return result
+}
+
+// report records err as the outcome of connecting client to the backend.
+func (s *selfTests) report(client net.Addr, err error) {
+	if result := s.result(client); result != nil {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+}
+
+// SelfTest checks that the proxy is forwarding by sending a probe datagram
+// to its own frontend, over loopback if it listens on every address, and
+// waiting for a reply. It only passes if the backend answers the probe, for
+// example because it echoes datagrams. The probe starts a session of its
+// own, which is counted in Stats and goes when it is idle.
+func (proxy *UDPProxy) SelfTest(ctx context.Context) error {
+	frontend, ok := proxy.frontendAddr.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("Can't self-test a %s frontend", proxy.frontendAddr.Network())
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	var d net.Dialer
+	client, err := d.DialContext(ctx, "udp", selfTestAddr(frontend.IP, frontend.Zone, frontend.Port))
+	if err != nil {
+		return fmt.Errorf("Self-test can't connect to %s/%v: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+	}
+	defer client.Close()
+	deadline, _ := ctx.Deadline()
+	client.SetDeadline(deadline)
+	go func() {
+		// Unblock the read if ctx is cancelled early.
+		<-ctx.Done()
+		client.SetDeadline(time.Now())
+	}()
+	if _, err := client.Write(selfTestProbe); err != nil {
+		return fmt.Errorf("Self-test can't send to %s/%v: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+	}
+	reply := make([]byte, len(selfTestProbe))
+	if _, err := client.Read(reply); err != nil {
+		return fmt.Errorf("Self-test got no reply through %s/%v: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+	}
+	return nil
+}
+
+// selfTestAddr returns the address to reach a frontend bound to ip, in zone,
+// and port at, using loopback if ip is unspecified.
+func selfTestAddr(ip net.IP, zone string, port int) string {
+	switch {
+	case ip == nil || ip.Equal(net.IPv4zero):
+		ip, zone = net.IPv4(127, 0, 0, 1), ""
+	case ip.Equal(net.IPv6unspecified):
+		ip, zone = net.IPv6loopback, ""
+	}
+	host := ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
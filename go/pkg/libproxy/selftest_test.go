@@ -0,0 +1,110 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPSelfTest(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4zero, Port: 0}, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	for i := 0; i < 3; i++ {
+		if err := proxy.(*TCPProxy).SelfTest(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTCPSelfTestBackendDown(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithLogger(&recordingLogger{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	if err := proxy.(*TCPProxy).SelfTest(context.Background()); err == nil {
+		t.Fatal("Expected the self-test to fail without a backend")
+	}
+}
+
+func TestTCPSelfTestNotRunning(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	// Nothing accepts, so the test times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := proxy.(*TCPProxy).SelfTest(ctx); err == nil {
+		t.Fatal("Expected the self-test to fail while the proxy isn't running")
+	}
+	if elapsed := time.Since(start); elapsed > selfTestTimeout {
+		t.Fatalf("Expected the context's deadline to be used but took %s", elapsed)
+	}
+}
+
+func TestTLSSelfTest(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	cert, _ := selfSignedCert(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTLSProxy(listener, backend.LocalAddr(), &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	if err := proxy.SelfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPSelfTest(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4zero, Port: 0}, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	if err := proxy.(*UDPProxy).SelfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	quiet, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, silent.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quiet.Close()
+	go quiet.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := quiet.(*UDPProxy).SelfTest(ctx); err == nil {
+		t.Fatal("Expected the self-test to fail when the backend doesn't answer")
+	}
+}
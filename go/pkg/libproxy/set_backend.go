@@ -0,0 +1,78 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// backendTarget wraps the address a proxy dials, as an atomic.Value needs
+// the same concrete type each time.
+type backendTarget struct {
+	addr net.Addr
+}
+
+// isStreamAddr returns true for the backend addresses a TCPProxy can dial.
+func isStreamAddr(addr net.Addr) bool {
+	switch addr.(type) {
+	case *net.TCPAddr, *vsock.VsockAddr:
+		return true
+	case *net.UnixAddr:
+		return addr.Network() == "unix"
+	}
+	return isHyperVAddr(addr) || isSCTPAddr(addr)
+}
+
+func (proxy *TCPProxy) backendTarget() net.Addr {
+	return proxy.target.Load().(backendTarget).addr
+}
+
+func (proxy *UDPProxy) backendTarget() net.Addr {
+	return proxy.target.Load().(backendTarget).addr
+}
+
+// SetBackend makes the proxy forward new connections to addr. Connections
+// already established carry on with the backend they were made to, and the
+// idle connections kept by WithBackendPool are closed. It is safe to call
+// while the proxy is running. It fails for proxies which don't have a single
+// backend address: ones created with NewTCPProxyMulti or
+// NewTCPProxyHostname, and the ones whose clients or a backend selector
+// choose their backend.
+func (proxy *TCPProxy) SetBackend(addr net.Addr) error {
+	current := proxy.backendTarget()
+	switch {
+	case proxy.multi != nil:
+		return fmt.Errorf("Can't set the backend of tcp/%v: it has several", proxy.frontendAddr)
+	case proxy.backendHost != "":
+		return fmt.Errorf("Can't set the backend of tcp/%v: it resolves %s", proxy.frontendAddr, proxy.hostnameAddr())
+	case proxy.negotiator != nil || proxy.opts.backendSelector != nil:
+		return fmt.Errorf("Can't set the backend of tcp/%v: it is chosen for each connection", proxy.frontendAddr)
+	case addr == nil || !isStreamAddr(addr):
+		return fmt.Errorf("Unsupported backend address %v for a stream proxy on %v", addr, proxy.frontendAddr)
+	}
+	if err := proxy.opts.checkBackendNetwork(addr); err != nil {
+		return err
+	}
+	proxy.target.Store(backendTarget{addr})
+	proxy.pool.drain()
+	proxy.opts.logf("Forwarding new connections on %v to %s/%v instead of %s/%v", proxy.frontendAddr, addr.Network(), addr, current.Network(), current)
+	return nil
+}
+
+// SetBackend makes the proxy forward the datagrams of new sessions to addr.
+// Sessions already established carry on with the backend they were made
+// to, until they re-dial it after an error, see WithUDPRedial. It is safe to
+// call while the proxy is running.
+func (proxy *UDPProxy) SetBackend(addr net.Addr) error {
+	if addr == nil || !isDatagramAddr(addr) {
+		return fmt.Errorf("Unsupported backend address %v for a datagram proxy on %v", addr, proxy.frontendAddr)
+	}
+	if err := proxy.opts.checkBackendNetwork(addr); err != nil {
+		return err
+	}
+	current := proxy.backendTarget()
+	proxy.target.Store(backendTarget{addr})
+	proxy.opts.logf("Forwarding new sessions on %v to %s/%v instead of %s/%v", proxy.frontendAddr, addr.Network(), addr, current.Network(), current)
+	return nil
+}
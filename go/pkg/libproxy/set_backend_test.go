@@ -0,0 +1,194 @@
+package libproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPProxySetBackend(t *testing.T) {
+	blue := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer blue.Close()
+	blue.Run()
+	green := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer green.Close()
+	green.Run()
+
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, blue.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	tcp := proxy.(*TCPProxy)
+
+	old, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	roundTrip(t, old)
+
+	if err := tcp.SetBackend(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}); err == nil {
+		t.Fatal("Expected a UDP backend to be refused")
+	}
+	if err := tcp.SetBackend(green.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if proxy.BackendAddr() != green.LocalAddr() {
+		t.Fatalf("Expected the backend to be %v but got %v", green.LocalAddr(), proxy.BackendAddr())
+	}
+
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	// The connection made before carries on with the old backend.
+	roundTrip(t, old)
+
+	backends := make(map[string]int)
+	for _, info := range proxy.Connections() {
+		backends[info.BackendAddr.String()]++
+	}
+	if backends[blue.LocalAddr().String()] != 1 || backends[green.LocalAddr().String()] != 1 {
+		t.Fatalf("Expected a connection to each backend but got %v", backends)
+	}
+}
+
+func TestTCPProxySetBackendDrainsPool(t *testing.T) {
+	blue := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer blue.Close()
+	blue.Run()
+	green := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer green.Close()
+	green.Run()
+
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, blue.LocalAddr(), WithBackendPool(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	tcp := proxy.(*TCPProxy)
+
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client)
+	client.(*net.TCPConn).CloseWrite()
+	client.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for tcp.pool.count() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("The backend connection wasn't pooled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := tcp.SetBackend(green.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if n := tcp.pool.count(); n != 0 {
+		t.Fatalf("Expected the pool to be drained but it holds %d", n)
+	}
+	client, err = net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	for _, info := range proxy.Connections() {
+		if info.BackendAddr.String() != green.LocalAddr().String() {
+			t.Fatalf("Expected a connection to %v but got one to %v", green.LocalAddr(), info.BackendAddr)
+		}
+	}
+}
+
+func TestTCPProxySetBackendRefused(t *testing.T) {
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := NewTCPProxyMulti(listener, []*net.TCPAddr{backendAddr, backendAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer multi.Close()
+	if err := multi.SetBackend(backendAddr); err == nil {
+		t.Fatal("Expected a proxy with several backends to refuse a single one")
+	}
+	if multi.BackendAddrs()[0] != backendAddr {
+		t.Fatalf("Expected the backends to be unchanged but got %v", multi.BackendAddrs())
+	}
+}
+
+func TestUDPProxySetBackend(t *testing.T) {
+	blue := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer blue.Close()
+	blue.Run()
+	green := newPrefixServer(t, []byte("green "))
+	defer green.Close()
+
+	conn := newMemPacketConn()
+	proxy, err := NewIPProxyWithPacketConn(conn, blue.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	udp := proxy.(*UDPProxy)
+
+	exchange := func(client memAddr, expected string) {
+		conn.send([]byte("hello"), client)
+		select {
+		case reply := <-conn.replies:
+			if reply.addr != client || !bytes.Equal(reply.payload, []byte(expected)) {
+				t.Fatalf("Expected %s to get %q but %v got %q", client, expected, reply.addr, reply.payload)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s didn't get a reply", client)
+		}
+	}
+	exchange("alice", "hello")
+
+	if err := udp.SetBackend(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}); err == nil {
+		t.Fatal("Expected a TCP backend to be refused")
+	}
+	if err := udp.SetBackend(green.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	exchange("bob", "green hello")
+	// alice's session carries on with the old backend.
+	exchange("alice", "hello")
+}
+
+// prefixServer replies to each UDP datagram with it prefixed, to tell its
+// replies apart from an echo server's.
+type prefixServer struct {
+	*net.UDPConn
+}
+
+func newPrefixServer(t *testing.T, prefix []byte) *prefixServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append(append([]byte(nil), prefix...), buf[:n]...), from)
+		}
+	}()
+	return &prefixServer{conn}
+}
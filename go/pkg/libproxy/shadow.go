@@ -0,0 +1,129 @@
+package libproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// WithShadowBackend makes a TCP proxy open a second connection to addr for
+// each connection it forwards and send it a copy of everything the client
+// sends, for example to try a new backend with real traffic. Whatever the
+// shadow backend sends back is discarded. It never holds up the connection:
+// it is dialed and written to by goroutines of its own, from a queue like
+// that of WithTee, and as soon as anything has to be dropped because it is
+// too slow nothing more is sent to it. Once the connection has closed, the
+// shadow backend has a second to take what is still queued for it, and
+// its connection is closed straight away if the proxy is closed. If it can't
+// be dialed the connection carries on without it. It is dialed with the proxy's options for dialing
+// backends, such as WithDialTimeout. It doesn't apply to proxies whose
+// clients choose their backend.
+func WithShadowBackend(addr net.Addr) Option {
+	return func(o *options) {
+		o.shadowBackend = addr
+	}
+}
+
+// shadowLinger is how long the shadow backend of a connection which has
+// closed has to take what is still queued for it before it is closed anyway.
+const shadowLinger = time.Second
+
+// shadowConn is the connection to the shadow backend of one connection.
+type shadowConn struct {
+	dialed chan struct{} // closed once conn or err is set
+	closed chan struct{} // closed by close
+	m      sync.Mutex
+	conn   Conn // guarded by m until dialed is closed
+	err    error
+	ended  bool // set by end, guarded by m
+}
+
+// startShadow starts dialing the shadow backend for c, which has just been
+// opened, and copying what the client sends to it until c.endShadow is
+// called. The shadow connection is closed straight away if the proxy is
+// closed.
+func (o *options) startShadow(c *connection) {
+	if o.shadowBackend == nil {
+		return
+	}
+	s := &shadowConn{dialed: make(chan struct{}), closed: make(chan struct{})}
+	go func() {
+		defer close(s.dialed)
+		conn, err := o.dialStreamContext(c.ctx, o.shadowBackend)
+		if err != nil {
+			o.debugf("Can't connect to shadow backend %s/%v for %v: %s", o.shadowBackend.Network(), o.shadowBackend, c.frontendAddr, err)
+		}
+		s.m.Lock()
+		defer s.m.Unlock()
+		s.conn, s.err = conn, err
+		if conn == nil {
+			return
+		}
+		if s.ended {
+			s.linger()
+		}
+		go io.Copy(ioutil.Discard, conn)
+		go func() {
+			select {
+			case <-c.ctx.Done():
+				conn.Close()
+			case <-s.closed:
+			}
+		}()
+	}()
+	c.shadowConn = s
+	c.shadow = startTee(&tee{sink: newTeeSink(&sync.Mutex{}, s), gapless: true, finished: s.close})
+}
+
+func (s *shadowConn) Write(b []byte) (int, error) {
+	<-s.dialed
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.conn.Write(b)
+}
+
+// end gives the shadow backend shadowLinger to take what is queued for it,
+// once the connection has closed, so that one which has stopped reading
+// can't keep the shadow connection open.
+func (s *shadowConn) end() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ended = true
+	if s.conn != nil {
+		s.linger()
+	}
+}
+
+// linger sets the deadline of end. s.m must be held.
+func (s *shadowConn) linger() {
+	if conn, ok := s.conn.(writeDeadliner); ok {
+		conn.SetWriteDeadline(time.Now().Add(shadowLinger))
+	} else {
+		s.conn.Close()
+	}
+}
+
+// close closes the connection, once everything has been written to it or
+// given up on.
+func (s *shadowConn) close() {
+	<-s.dialed
+	close(s.closed)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// endShadow stops copying to the shadow backend of c once c has been
+// closed.
+func (c *connection) endShadow(o *options) {
+	if c.shadow == nil {
+		return
+	}
+	c.shadowConn.end()
+	if dropped := c.shadow.stop(); dropped != 0 {
+		o.debugf("Stopped copying %v to shadow backend %s/%v as it fell behind", c.frontendAddr, o.shadowBackend.Network(), o.shadowBackend)
+	}
+}
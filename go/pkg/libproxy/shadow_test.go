@@ -0,0 +1,155 @@
+package libproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// shadowServer records what each connection sends it in received, and
+// answers with something the clients of the proxy mustn't see.
+func shadowServer(t *testing.T, received *teeBuffer) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("not from the backend"))
+				io.Copy(received, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestShadowBackend(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	var received teeBuffer
+	shadow := shadowServer(t, &received)
+	defer shadow.Close()
+	proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.LocalAddr(), WithShadowBackend(shadow.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	roundTrip(t, client)
+	received.waitFor(t, append(append([]byte(nil), testBuf...), testBuf...))
+}
+
+func TestShadowBackendUnreachable(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.LocalAddr(), WithShadowBackend(unusedTCPAddr(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	roundTrip(t, client)
+}
+
+func TestShadowBackendWhichStopsReading(t *testing.T) {
+	// The shadow backend accepts, and then never reads.
+	shadow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuck := make(chan net.Conn, 16)
+	go func() {
+		defer close(stuck)
+		for {
+			conn, err := shadow.Accept()
+			if err != nil {
+				return
+			}
+			stuck <- conn
+		}
+	}()
+	defer func() {
+		shadow.Close()
+		for conn := range stuck {
+			conn.Close()
+		}
+	}()
+	// The backend takes everything, and closes once the client has.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, backend.Addr(), WithShadowBackend(shadow.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	before := runtime.NumGoroutine()
+	// Enough to fill the shadow connection's socket buffers.
+	big := bytes.Repeat(testBuf, 1<<18)
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := conn.(*net.TCPConn)
+		if _, err := client.Write(big); err != nil {
+			t.Fatal(err)
+		}
+		client.CloseWrite()
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.Copy(ioutil.Discard, client); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+	}
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 0 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", proxy.Stats()) })
+	// The shadow connections are closed, and their goroutines gone,
+	// once they have lingered.
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the shadow connections to be closed but there are %d goroutines, up from %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
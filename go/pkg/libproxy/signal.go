@@ -0,0 +1,43 @@
+package libproxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// SignalDrainDeadline is how long RunUntilSignal lets the connections of a
+// proxy finish after a signal before closing them.
+var SignalDrainDeadline = 30 * time.Second
+
+// RunUntilSignal runs p until Run returns, returning its error, or until one
+// of sig is received. On a signal p is closed with CloseWithDeadline, given
+// SignalDrainDeadline, when it supports that and with Close otherwise, and
+// RunUntilSignal returns once Run has. SIGINT and SIGTERM are used if no
+// signals are given. The signals get their previous handling back before it
+// returns.
+func RunUntilSignal(p Proxy, sig ...os.Signal) error {
+	if len(sig) == 0 {
+		sig = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig...)
+	defer signal.Stop(signals)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- p.Run()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-signals:
+	}
+	if drainer, ok := p.(interface{ CloseWithDeadline(time.Duration) int }); ok {
+		drainer.CloseWithDeadline(SignalDrainDeadline)
+	} else {
+		p.Close()
+	}
+	return <-result
+}
@@ -0,0 +1,73 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunUntilSignal(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	result := make(chan error, 1)
+	go func() {
+		result <- RunUntilSignal(proxy, syscall.SIGUSR1)
+	}()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	// The proxy drains: the open connection keeps working but no new ones
+	// are accepted.
+	waitFor(t, func() bool { return proxy.(*TCPProxy).State() == StateClosing }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateClosing, proxy.(*TCPProxy).State())
+	})
+	roundTrip(t, client)
+	select {
+	case err := <-result:
+		t.Fatalf("RunUntilSignal returned with a connection still open: %v", err)
+	default:
+	}
+	client.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Expected RunUntilSignal to return nil but got %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("RunUntilSignal didn't return after the connection closed")
+	}
+}
+
+// failingProxy is a StubProxy whose Run fails.
+type failingProxy struct {
+	*StubProxy
+	err error
+}
+
+func (p *failingProxy) Run() error { return p.err }
+
+func TestRunUntilSignalRunError(t *testing.T) {
+	failed := errors.New("listener broke")
+	proxy := &failingProxy{StubProxy: &StubProxy{}, err: failed}
+	if err := RunUntilSignal(proxy, syscall.SIGUSR1); err != failed {
+		t.Fatalf("Expected the error from Run but got %v", err)
+	}
+}
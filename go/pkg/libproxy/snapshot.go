@@ -0,0 +1,76 @@
+package libproxy
+
+import (
+	"net"
+	"time"
+)
+
+// ProxySnapshot summarises a proxy at one moment, as returned by Snapshot.
+// It only holds plain values, so that it can be encoded as JSON as it is,
+// for example by a status endpoint which is polled often.
+type ProxySnapshot struct {
+	// Frontend and Backend are the FrontendAddr and BackendAddr of the
+	// proxy as "network/address", or empty if it has no such address.
+	Frontend string `json:"frontend"`
+	Backend  string `json:"backend"`
+	// State is the State of the proxy, such as "running".
+	State           string `json:"state"`
+	BytesToBackend  uint64 `json:"bytes_to_backend"`
+	BytesToFrontend uint64 `json:"bytes_to_frontend"`
+	ActiveConns     int64  `json:"active_conns"`
+	TotalConns      int64  `json:"total_conns"`
+	// Uptime is how long the proxy has been running since Run was
+	// called, or how long it ran for once Run has returned, in
+	// nanoseconds. It is zero for a proxy which hasn't been run.
+	Uptime time.Duration `json:"uptime"`
+	// LastError is the latest error which ended a connection or session
+	// or stopped the proxy, and LastErrorTime when it happened. Both are
+	// empty if there hasn't been one.
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	Tag           string     `json:"tag,omitempty"`
+}
+
+// Snapshot returns a summary of the proxy, which is cheaper than Stats and
+// Connections.
+func (proxy *TCPProxy) Snapshot() ProxySnapshot {
+	return proxy.stats.proxySnapshot(proxy.frontendAddr, proxy.BackendAddr(), proxy.status)
+}
+
+// Snapshot returns a summary of the proxy, which is cheaper than Stats and
+// Connections.
+func (proxy *UDPProxy) Snapshot() ProxySnapshot {
+	return proxy.stats.proxySnapshot(proxy.frontendAddr, proxy.BackendAddr(), proxy.status)
+}
+
+// proxySnapshot reads the counters with countM held exclusively, so that
+// they agree with each other, and the state with its uptime in one go.
+func (s *stats) proxySnapshot(frontend, backend net.Addr, status func() (State, time.Duration)) ProxySnapshot {
+	state, uptime := status()
+	s.countM.Lock()
+	defer s.countM.Unlock()
+	snapshot := ProxySnapshot{
+		Frontend:        networkAddrString(frontend),
+		Backend:         networkAddrString(backend),
+		State:           state.String(),
+		BytesToBackend:  s.bytesToBackend,
+		BytesToFrontend: s.bytesToFrontend,
+		ActiveConns:     s.activeConns,
+		TotalConns:      s.totalConns,
+		Uptime:          uptime,
+		Tag:             s.tag,
+	}
+	if s.lastErr != "" {
+		lastErrTime := s.lastErrTime
+		snapshot.LastError, snapshot.LastErrorTime = s.lastErr, &lastErrTime
+	}
+	return snapshot
+}
+
+// networkAddrString returns addr as "network/address", or "" for nil.
+func networkAddrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.Network() + "/" + addr.String()
+}
@@ -0,0 +1,152 @@
+package libproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snapshotter is a proxy with a Snapshot, a TCPProxy or a UDPProxy.
+type snapshotter interface {
+	Snapshot() ProxySnapshot
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			backend := NewEchoServer(t, network, "127.0.0.1:0")
+			defer backend.Close()
+			backend.Run()
+			var frontendAddr net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			if network == "udp" {
+				frontendAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			}
+			p, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithTag("status"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			proxy := p.(snapshotter)
+			if snapshot := proxy.Snapshot(); snapshot.State != "new" || snapshot.Uptime != 0 {
+				t.Fatalf("Expected a new proxy which hasn't been up but got %+v", snapshot)
+			}
+			go p.Run()
+			client, err := net.Dial(network, p.FrontendAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			roundTrip(t, client)
+			var snapshot ProxySnapshot
+			waitFor(t, func() bool {
+				snapshot = proxy.Snapshot()
+				return snapshot.BytesToFrontend == uint64(testBufSize)
+			}, func() string {
+				return fmt.Sprintf("Timed out waiting for BytesToFrontend == %d in %+v", testBufSize, snapshot)
+			})
+			expected := ProxySnapshot{
+				Frontend:        network + "/" + p.FrontendAddr().String(),
+				Backend:         network + "/" + backend.LocalAddr().String(),
+				State:           "running",
+				BytesToBackend:  uint64(testBufSize),
+				BytesToFrontend: uint64(testBufSize),
+				ActiveConns:     1,
+				TotalConns:      1,
+				Uptime:          snapshot.Uptime,
+				Tag:             "status",
+			}
+			if snapshot != expected || snapshot.Uptime <= 0 {
+				t.Fatalf("Expected %+v but got %+v", expected, snapshot)
+			}
+
+			b, err := json.Marshal(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded ProxySnapshot
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded != snapshot {
+				t.Fatalf("Expected %+v to survive JSON but got %+v from %s", snapshot, decoded, b)
+			}
+			if bytes.Contains(b, []byte("last_error")) {
+				t.Fatalf("Expected no last error in %s", b)
+			}
+
+			p.Close()
+			p.Wait()
+			closed := proxy.Snapshot()
+			if closed.State != "closed" {
+				t.Fatalf("Expected a closed proxy but got %+v", closed)
+			}
+			if again := proxy.Snapshot(); again.Uptime != closed.Uptime {
+				t.Fatalf("Expected the uptime to stop at %s but got %s", closed.Uptime, again.Uptime)
+			}
+		})
+	}
+}
+
+func TestSnapshotLastError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, unusedTCPAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	if snapshot := proxy.Snapshot(); snapshot.LastError != "" || snapshot.LastErrorTime != nil {
+		t.Fatalf("Expected no error yet but got %+v", snapshot)
+	}
+	before := time.Now()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var snapshot ProxySnapshot
+	waitFor(t, func() bool {
+		snapshot = proxy.Snapshot()
+		return snapshot.LastError != ""
+	}, func() string { return fmt.Sprintf("Timed out waiting for LastError in %+v", snapshot) })
+	if snapshot.LastErrorTime == nil || snapshot.LastErrorTime.Before(before) {
+		t.Fatalf("Expected the error after %s but got %+v", before, snapshot)
+	}
+}
+
+func TestSnapshotCountersAgree(t *testing.T) {
+	s := &stats{}
+	status := func() (State, time.Duration) { return StateRunning, time.Second }
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.connOpened()
+				s.connClosed()
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(stop)
+	for i := 0; i < 10000; i++ {
+		snapshot := s.proxySnapshot(nil, nil, status)
+		if snapshot.ActiveConns < 0 || snapshot.ActiveConns > snapshot.TotalConns {
+			t.Fatalf("Expected no more active connections than connections but got %+v", snapshot)
+		}
+	}
+}
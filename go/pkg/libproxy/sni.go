@@ -0,0 +1,112 @@
+package libproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrNoSNI is returned by ParseTLSClientHelloSNI for a ClientHello without a
+// server name.
+var ErrNoSNI = errors.New("no server name in the TLS ClientHello")
+
+var errTruncatedHello = errors.New("Can't parse TLS ClientHello: it is truncated")
+
+// ParseTLSClientHelloSNI returns the server name a TLS client asked for in
+// its ClientHello, given the first bytes it sent, for example those returned
+// by Peeker.Peek in a backend selector. The ClientHello must be complete and
+// within the first TLS record, as clients send it. It returns ErrNoSNI if
+// the client didn't send a server name.
+func ParseTLSClientHelloSNI(data []byte) (string, error) {
+	record := &tlsReader{data: data}
+	recordType := record.uint8()
+	record.next(2) // version
+	hello := &tlsReader{data: record.vector(2)}
+	if record.err != nil {
+		return "", record.err
+	}
+	if recordType != 22 {
+		return "", fmt.Errorf("Can't parse TLS ClientHello: record type %d isn't a handshake", recordType)
+	}
+	helloType := hello.uint8()
+	hello.next(3)   // length
+	hello.next(34)  // version and random
+	hello.vector(1) // session ID
+	hello.vector(2) // cipher suites
+	hello.vector(1) // compression methods
+	extensions := &tlsReader{data: hello.vector(2)}
+	if hello.err != nil {
+		return "", hello.err
+	}
+	if helloType != 1 {
+		return "", fmt.Errorf("Can't parse TLS ClientHello: handshake type %d isn't a ClientHello", helloType)
+	}
+	for extensions.off < len(extensions.data) {
+		extensionType := extensions.uint16()
+		body := &tlsReader{data: extensions.vector(2)}
+		if extensions.err != nil {
+			return "", extensions.err
+		}
+		if extensionType != 0 {
+			continue
+		}
+		names := &tlsReader{data: body.vector(2)}
+		for names.off < len(names.data) {
+			nameType := names.uint8()
+			name := names.vector(2)
+			if names.err != nil {
+				return "", names.err
+			}
+			if nameType == 0 {
+				return string(name), nil
+			}
+		}
+		if body.err != nil {
+			return "", body.err
+		}
+	}
+	return "", ErrNoSNI
+}
+
+// tlsReader reads the fields of a TLS message, remembering whether it ran
+// out of data.
+type tlsReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *tlsReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.off+n > len(r.data) {
+		r.err = errTruncatedHello
+		return nil
+	}
+	field := r.data[r.off : r.off+n]
+	r.off += n
+	return field
+}
+
+func (r *tlsReader) uint8() int {
+	if b := r.next(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *tlsReader) uint16() int {
+	if b := r.next(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+// vector reads a field prefixed by its length in lengthSize bytes, 1 or 2.
+func (r *tlsReader) vector(lengthSize int) []byte {
+	if lengthSize == 1 {
+		return r.next(r.uint8())
+	}
+	return r.next(r.uint16())
+}
@@ -0,0 +1,50 @@
+package libproxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first TLS record a client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestParseTLSClientHelloSNI(t *testing.T) {
+	hello := clientHello(t, "backend.example.com")
+	name, err := ParseTLSClientHelloSNI(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "backend.example.com" {
+		t.Fatalf("Expected backend.example.com but got %q", name)
+	}
+	if _, err := ParseTLSClientHelloSNI(clientHello(t, "")); err != ErrNoSNI {
+		t.Fatalf("Expected ErrNoSNI without a server name but got %v", err)
+	}
+	for _, n := range []int{0, 3, 5, 40, len(hello) - 1} {
+		if _, err := ParseTLSClientHelloSNI(hello[:n]); err == nil || err == ErrNoSNI {
+			t.Fatalf("Expected an error for a ClientHello truncated to %d bytes but got %v", n, err)
+		}
+	}
+	if _, err := ParseTLSClientHelloSNI([]byte("GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Fatal("Expected an error for data which isn't TLS")
+	}
+}
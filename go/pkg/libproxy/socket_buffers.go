@@ -0,0 +1,74 @@
+package libproxy
+
+import (
+	"syscall"
+)
+
+// WithReceiveBuffer sets SO_RCVBUF to n bytes on the frontend listener, the
+// accepted frontend connections and the backend connections, TCP and UDP
+// alike. Connections without socket buffers, such as vsock and Hyper-V
+// socket connections, are left alone.
+//
+// The kernel caps the size: on Linux at net.core.rmem_max unless the process
+// has CAP_NET_ADMIN, and the value it reports back is double the one set to
+// leave room for its bookkeeping; on macOS and the BSDs at kern.ipc.maxsockbuf.
+// A size over the cap isn't an error, so raise the sysctl as well when tuning
+// for throughput.
+func WithReceiveBuffer(n int) Option {
+	return func(o *options) {
+		o.receiveBuffer = n
+	}
+}
+
+// WithSendBuffer sets SO_SNDBUF to n bytes on the same sockets as
+// WithReceiveBuffer. On Linux the size is capped at net.core.wmem_max.
+func WithSendBuffer(n int) Option {
+	return func(o *options) {
+		o.sendBuffer = n
+	}
+}
+
+// bufferedSocket is implemented by *net.TCPConn, *net.UDPConn and
+// *net.UnixConn.
+type bufferedSocket interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketBuffers applies WithReceiveBuffer and WithSendBuffer to conn,
+// skipping connections which have no socket buffers.
+func (o *options) setSocketBuffers(conn interface{}) {
+	if o.receiveBuffer <= 0 && o.sendBuffer <= 0 {
+		return
+	}
+	socket, ok := conn.(bufferedSocket)
+	if !ok {
+		return
+	}
+	if o.receiveBuffer > 0 {
+		if err := socket.SetReadBuffer(o.receiveBuffer); err != nil {
+			o.logf("Can't set SO_RCVBUF on %v: %s", remoteAddr(conn), err)
+		}
+	}
+	if o.sendBuffer > 0 {
+		if err := socket.SetWriteBuffer(o.sendBuffer); err != nil {
+			o.logf("Can't set SO_SNDBUF on %v: %s", remoteAddr(conn), err)
+		}
+	}
+}
+
+// setListenerBuffers applies the socket buffer sizes to a frontend while it
+// is being bound. Accepted TCP connections inherit them, which matters for
+// the receive buffer because it determines the window scale negotiated in
+// the handshake.
+func (o *options) setListenerBuffers(network, address string, c syscall.RawConn) error {
+	if o.receiveBuffer > 0 {
+		if err := setSocketBuffer(o, network, address, c, syscall.SO_RCVBUF, o.receiveBuffer); err != nil {
+			return err
+		}
+	}
+	if o.sendBuffer > 0 {
+		return setSocketBuffer(o, network, address, c, syscall.SO_SNDBUF, o.sendBuffer)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package libproxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Linux reports double the size set, to account for its bookkeeping.
+const testSocketBuffer = 32 * 1024
+
+func socketBuffers(t *testing.T, conn syscall.Conn) (int, int) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rcv, snd int
+	var rcvErr, sndErr error
+	raw.Control(func(fd uintptr) {
+		rcv, rcvErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		snd, sndErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	if rcvErr != nil {
+		t.Fatal(rcvErr)
+	}
+	if sndErr != nil {
+		t.Fatal(sndErr)
+	}
+	return rcv, snd
+}
+
+func checkSocketBuffers(t *testing.T, what string, conn syscall.Conn) {
+	if rcv, snd := socketBuffers(t, conn); rcv != 2*testSocketBuffer || snd != 2*testSocketBuffer {
+		t.Fatalf("Expected the %s to have %d byte buffers but got SO_RCVBUF=%d, SO_SNDBUF=%d", what, 2*testSocketBuffer, rcv, snd)
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	o := newOptions([]Option{WithReceiveBuffer(testSocketBuffer), WithSendBuffer(testSocketBuffer)})
+
+	listener, err := o.listenTCP(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	checkSocketBuffers(t, "TCP listener", listener.(*net.TCPListener))
+
+	packetConn, err := o.listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	checkSocketBuffers(t, "UDP listener", packetConn.(*net.UDPConn))
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	o.setSocketBuffers(server)
+	checkSocketBuffers(t, "accepted connection", server)
+
+	backend, err := o.dialStream(listener.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	checkSocketBuffers(t, "backend connection", backend.(*net.TCPConn))
+
+	datagrams, err := o.dialDatagram(packetConn.LocalAddr(), client.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer datagrams.Close()
+	checkSocketBuffers(t, "datagram backend connection", datagrams.(*net.UDPConn))
+
+	// Connections with no socket buffers are skipped.
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	o.setSocketBuffers(pipe)
+}
+
+func TestSocketBuffersProxy(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		backend := NewEchoServer(t, network, "127.0.0.1:0")
+		defer backend.Close()
+		backend.Run()
+		var frontendAddr net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		if network == "udp" {
+			frontendAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		}
+		proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithReceiveBuffer(testSocketBuffer), WithSendBuffer(testSocketBuffer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+		go proxy.Run()
+		client, err := net.Dial(network, proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		roundTrip(t, client)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package libproxy
+
+import "syscall"
+
+func setSocketBuffer(o *options, network, address string, c syscall.RawConn, opt, n int) error {
+	o.logf("Can't size the socket buffers of %s/%s on this platform: only its connections will be sized", network, address)
+	return nil
+}
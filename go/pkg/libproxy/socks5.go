@@ -0,0 +1,215 @@
+package libproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthUnacceptable = 0xff
+
+	socks5PasswordVersion = 1
+
+	socks5Connect = 1
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5Succeeded            = 0x00
+	socks5GeneralFailure       = 0x01
+	socks5NotAllowed           = 0x02
+	socks5NetworkUnreachable   = 0x03
+	socks5HostUnreachable      = 0x04
+	socks5ConnectionRefused    = 0x05
+	socks5CommandNotSupported  = 0x07
+	socks5AddrTypeNotSupported = 0x08
+)
+
+// WithSOCKS5Auth makes a SOCKS5 proxy require clients to authenticate with a
+// username and password, which are checked by valid. Without it clients
+// don't need to authenticate.
+func WithSOCKS5Auth(valid func(username, password string) bool) Option {
+	return func(o *options) {
+		o.socks5Auth = valid
+	}
+}
+
+// NewSOCKS5Proxy creates a new TCPProxy which acts as a SOCKS5 server on
+// listener, so that each client chooses its own backend. Only the CONNECT
+// command is supported. The destinations clients may ask for can be limited
+// with WithAllowDestinationCIDRs and WithDenyDestinationCIDRs.
+func NewSOCKS5Proxy(listener net.Listener, opts ...Option) (*TCPProxy, error) {
+	proxy, err := NewTCPProxy(listener, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.negotiator = &socks5{auth: proxy.opts.socks5Auth}
+	return proxy, nil
+}
+
+// socks5 is the negotiator for SOCKS5, as described in RFC 1928 and, for
+// username/password authentication, RFC 1929.
+type socks5 struct {
+	auth func(username, password string) bool
+}
+
+func (s *socks5) String() string { return "socks5" }
+
+func (s *socks5) request(client Conn) (Conn, string, error) {
+	if err := s.authenticate(client); err != nil {
+		return client, "", err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return client, "", err
+	}
+	if header[0] != socks5Version {
+		return client, "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(client, ip); err != nil {
+			return client, "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(client, length); err != nil {
+			return client, "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(client, name); err != nil {
+			return client, "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(client, socks5AddrTypeNotSupported, nil)
+		return client, "", fmt.Errorf("unsupported address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(client, port); err != nil {
+		return client, "", err
+	}
+	if header[1] != socks5Connect {
+		writeSOCKS5Reply(client, socks5CommandNotSupported, nil)
+		return client, "", fmt.Errorf("unsupported command %d", header[1])
+	}
+	return client, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// authenticate negotiates the authentication method and, if a password is
+// needed, checks it.
+func (s *socks5) authenticate(client Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return err
+	}
+	wanted := byte(socks5AuthNone)
+	if s.auth != nil {
+		wanted = socks5AuthPassword
+	}
+	method := byte(socks5AuthUnacceptable)
+	for _, m := range methods {
+		if m == wanted {
+			method = wanted
+		}
+	}
+	if _, err := client.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	switch method {
+	case socks5AuthUnacceptable:
+		return errors.New("no acceptable authentication method")
+	case socks5AuthPassword:
+		return s.checkPassword(client)
+	}
+	return nil
+}
+
+func (s *socks5) checkPassword(client Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(client, header); err != nil {
+		return err
+	}
+	if header[0] != socks5PasswordVersion {
+		return fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(client, username); err != nil {
+		return err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(client, length); err != nil {
+		return err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(client, password); err != nil {
+		return err
+	}
+	if !s.auth(string(username), string(password)) {
+		client.Write([]byte{socks5PasswordVersion, 1})
+		return fmt.Errorf("authentication failed for %s", username)
+	}
+	_, err := client.Write([]byte{socks5PasswordVersion, 0})
+	return err
+}
+
+func (s *socks5) reply(client Conn, backend net.Addr, err error) error {
+	if err == nil {
+		return writeSOCKS5Reply(client, socks5Succeeded, backend)
+	}
+	code := byte(socks5GeneralFailure)
+	switch {
+	case err == errNotPermitted:
+		code = socks5NotAllowed
+	case bindErrno(err) == syscall.ECONNREFUSED:
+		code = socks5ConnectionRefused
+	case bindErrno(err) == syscall.ENETUNREACH:
+		code = socks5NetworkUnreachable
+	case bindErrno(err) == syscall.EHOSTUNREACH:
+		code = socks5HostUnreachable
+	}
+	return writeSOCKS5Reply(client, code, nil)
+}
+
+// writeSOCKS5Reply sends a reply with the bound address addr, or 0.0.0.0:0 if
+// it isn't a TCP address.
+func writeSOCKS5Reply(w io.Writer, code byte, addr net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip, port = tcpAddr.IP, tcpAddr.Port
+	}
+	reply := []byte{socks5Version, code, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socks5AddrIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socks5AddrIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	reply = append(reply, byte(port>>8), byte(port))
+	_, err := w.Write(reply)
+	return err
+}
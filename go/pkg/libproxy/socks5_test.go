@@ -0,0 +1,151 @@
+package libproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSOCKS5Proxy(t *testing.T, opts ...Option) *TCPProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewSOCKS5Proxy(listener, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	return proxy
+}
+
+// socks5Handshake performs a SOCKS5 handshake asking for host:port, with a
+// username and password if user isn't empty, and returns the reply code.
+func socks5Handshake(t *testing.T, proxy Proxy, cmd byte, host string, port int, user, password string) (net.Conn, byte) {
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	method := byte(socks5AuthNone)
+	if user != "" {
+		method = socks5AuthPassword
+	}
+	client.Write([]byte{socks5Version, 1, method})
+	choice := make([]byte, 2)
+	if _, err := io.ReadFull(client, choice); err != nil {
+		t.Fatal(err)
+	}
+	if choice[1] != method {
+		return client, choice[1]
+	}
+	if user != "" {
+		auth := append([]byte{socks5PasswordVersion, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		client.Write(auth)
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(client, status); err != nil {
+			t.Fatal(err)
+		}
+		if status[1] != 0 {
+			return client, socks5AuthUnacceptable
+		}
+	}
+	request := []byte{socks5Version, cmd, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(append(request, socks5AddrIPv4), ip.To4()...)
+	} else {
+		request = append(append(request, socks5AddrDomain, byte(len(host))), host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(port))
+	client.Write(request)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	return client, reply[1]
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	backendAddr := backend.LocalAddr().(*net.TCPAddr)
+	proxy := newTestSOCKS5Proxy(t)
+	defer proxy.Close()
+	client, code := socks5Handshake(t, proxy, socks5Connect, "127.0.0.1", backendAddr.Port, "", "")
+	defer client.Close()
+	if code != socks5Succeeded {
+		t.Fatalf("Expected success but got reply %d", code)
+	}
+	roundTrip(t, client)
+}
+
+func TestSOCKS5ConnectHostname(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy := newTestSOCKS5Proxy(t)
+	defer proxy.Close()
+	proxy.Resolver = &fakeResolver{addrs: []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}}
+	client, code := socks5Handshake(t, proxy, socks5Connect, "service.local", backend.LocalAddr().(*net.TCPAddr).Port, "", "")
+	defer client.Close()
+	if code != socks5Succeeded {
+		t.Fatalf("Expected success but got reply %d", code)
+	}
+	roundTrip(t, client)
+}
+
+func TestSOCKS5Password(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	port := backend.LocalAddr().(*net.TCPAddr).Port
+	proxy := newTestSOCKS5Proxy(t, WithSOCKS5Auth(func(user, password string) bool {
+		return user == "alice" && password == "secret"
+	}))
+	defer proxy.Close()
+
+	client, code := socks5Handshake(t, proxy, socks5Connect, "127.0.0.1", port, "", "")
+	client.Close()
+	if code != socks5AuthUnacceptable {
+		t.Fatalf("Expected no auth to be refused but got %d", code)
+	}
+	client, code = socks5Handshake(t, proxy, socks5Connect, "127.0.0.1", port, "alice", "guess")
+	client.Close()
+	if code != socks5AuthUnacceptable {
+		t.Fatalf("Expected a bad password to be refused but got %d", code)
+	}
+	client, code = socks5Handshake(t, proxy, socks5Connect, "127.0.0.1", port, "alice", "secret")
+	defer client.Close()
+	if code != socks5Succeeded {
+		t.Fatalf("Expected success but got reply %d", code)
+	}
+	roundTrip(t, client)
+}
+
+func TestSOCKS5Failures(t *testing.T) {
+	proxy := newTestSOCKS5Proxy(t, WithDenyDestinationCIDRs(mustParseCIDRs(t, "10.0.0.0/8")))
+	defer proxy.Close()
+	tests := []struct {
+		cmd  byte
+		host string
+		port int
+		code byte
+	}{
+		{2, "127.0.0.1", 80, socks5CommandNotSupported},
+		{socks5Connect, "10.1.2.3", 80, socks5NotAllowed},
+		{socks5Connect, "127.0.0.1", unusedTCPAddr(t).Port, socks5ConnectionRefused},
+	}
+	for _, test := range tests {
+		client, code := socks5Handshake(t, proxy, test.cmd, test.host, test.port, "", "")
+		client.Close()
+		if code != test.code {
+			t.Errorf("Expected reply %d for %d %s but got %d", test.code, test.cmd, net.JoinHostPort(test.host, strconv.Itoa(test.port)), code)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// ParseProxySpec parses a URL-style address into the net.Addr the proxy
+// constructors expect. The schemes are:
+//
+//	tcp://127.0.0.1:3000        a *net.TCPAddr; host names are resolved
+//	udp://[::1]:53              a *net.UDPAddr
+//	vsock://2:1234              a *vsock.VsockAddr for CID 2, port 1234;
+//	                            vsock://:1234 means any CID
+//	unix:///run/app.sock        a *net.UnixAddr for a stream socket
+//	unixgram:///run/app.sock    a *net.UnixAddr for a datagram socket
+func ParseProxySpec(spec string) (net.Addr, error) {
+	i := strings.Index(spec, "://")
+	if i < 0 {
+		return nil, fmt.Errorf("Can't parse proxy spec %q: expected scheme://address", spec)
+	}
+	scheme, address := spec[:i], spec[i+3:]
+	if address == "" {
+		return nil, fmt.Errorf("Can't parse proxy spec %q: the address is empty", spec)
+	}
+	switch scheme {
+	case "tcp":
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse proxy spec %q: %s", spec, err)
+		}
+		return addr, nil
+	case "udp":
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse proxy spec %q: %s", spec, err)
+		}
+		return addr, nil
+	case "vsock":
+		addr, err := parseVsockAddr(address)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse proxy spec %q: %s", spec, err)
+		}
+		return addr, nil
+	case "unix", "unixgram":
+		return &net.UnixAddr{Name: address, Net: scheme}, nil
+	default:
+		return nil, fmt.Errorf("Can't parse proxy spec %q: unsupported scheme %q", spec, scheme)
+	}
+}
+
+// parseVsockAddr parses "cid:port", where an empty CID means any.
+func parseVsockAddr(address string) (*vsock.VsockAddr, error) {
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("missing port in vsock address %s", address)
+	}
+	cid := uint64(vsock.CIDAny)
+	if i > 0 {
+		var err error
+		if cid, err = strconv.ParseUint(address[:i], 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid vsock CID %s", address[:i])
+		}
+	}
+	port, err := strconv.ParseUint(address[i+1:], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vsock port %s", address[i+1:])
+	}
+	return &vsock.VsockAddr{CID: uint32(cid), Port: uint32(port)}, nil
+}
+
+// NewProxyFromSpecs creates a Proxy from frontend and backend addresses in
+// the form accepted by ParseProxySpec.
+func NewProxyFromSpecs(frontendSpec, backendSpec string, opts ...Option) (Proxy, error) {
+	frontend, err := ParseProxySpec(frontendSpec)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := ParseProxySpec(backendSpec)
+	if err != nil {
+		return nil, err
+	}
+	if vsockAddr, ok := frontend.(*vsock.VsockAddr); ok {
+		switch backend.(type) {
+		case *net.TCPAddr, *net.UDPAddr:
+			return NewVsockProxy(vsockAddr, backend, opts...)
+		}
+		return nil, fmt.Errorf("Unsupported backend %s for vsock frontend %s", backendSpec, frontendSpec)
+	}
+	return NewIPProxy(frontend, backend, opts...)
+}
@@ -0,0 +1,71 @@
+package libproxy
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+func TestParseProxySpec(t *testing.T) {
+	for _, c := range []struct {
+		spec string
+		addr net.Addr
+	}{
+		{"tcp://127.0.0.1:3000", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3000}},
+		{"udp://[::1]:53", &net.UDPAddr{IP: net.IPv6loopback, Port: 53}},
+		{"vsock://2:1234", &vsock.VsockAddr{CID: 2, Port: 1234}},
+		{"vsock://:1234", &vsock.VsockAddr{CID: vsock.CIDAny, Port: 1234}},
+		{"unix:///run/app.sock", &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}},
+		{"unixgram:///run/app.sock", &net.UnixAddr{Name: "/run/app.sock", Net: "unixgram"}},
+	} {
+		addr, err := ParseProxySpec(c.spec)
+		if err != nil {
+			t.Fatalf("Can't parse %s: %s", c.spec, err)
+		}
+		if addr.Network() != c.addr.Network() || addr.String() != c.addr.String() || reflect.TypeOf(addr) != reflect.TypeOf(c.addr) {
+			t.Fatalf("Expected %s to parse as %T %s/%v, got %T %s/%v", c.spec, c.addr, c.addr.Network(), c.addr, addr, addr.Network(), addr)
+		}
+	}
+}
+
+func TestParseProxySpecErrors(t *testing.T) {
+	for _, c := range []struct {
+		spec    string
+		message string
+	}{
+		{"127.0.0.1:3000", "expected scheme://address"},
+		{"sctp://127.0.0.1:3000", `unsupported scheme "sctp"`},
+		{"tcp://", "the address is empty"},
+		{"tcp://127.0.0.1", "missing port"},
+		{"udp://127.0.0.1:http-alt-nope", "unknown port"},
+		{"vsock://1234", "missing port"},
+		{"vsock://x:1234", "invalid vsock CID"},
+		{"vsock://2:99999999999", "invalid vsock port"},
+	} {
+		_, err := ParseProxySpec(c.spec)
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("Expected an error about %q parsing %s, got %v", c.message, c.spec, err)
+		}
+	}
+}
+
+func TestNewProxyFromSpecs(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewProxyFromSpecs("tcp://127.0.0.1:0", "tcp://"+backend.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+
+	if _, err := NewProxyFromSpecs("tcp://127.0.0.1:0", "udp://127.0.0.1:53"); err == nil {
+		t.Fatal("Expected a TCP frontend with a UDP backend to be refused")
+	}
+	if _, err := NewProxyFromSpecs("vsock://:1234", "unix:///run/app.sock"); err == nil {
+		t.Fatal("Expected a vsock frontend with a Unix backend to be refused")
+	}
+}
@@ -0,0 +1,105 @@
+package libproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// State is a stage in the lifecycle of a proxy, as returned by its State
+// method.
+type State int
+
+const (
+	// StateNew is a proxy whose Run hasn't been called yet.
+	StateNew State = iota
+	// StateRunning is a proxy which is forwarding.
+	StateRunning
+	// StatePaused is a running proxy which isn't taking new connections
+	// or sessions, see Pause.
+	StatePaused
+	// StateClosing is a proxy which has stopped taking new connections or
+	// sessions but still has some to finish.
+	StateClosing
+	// StateClosed is a proxy which has stopped altogether, so that Wait
+	// returns straight away.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// status works out the State of a proxy with this runState, and how long
+// Run has been running or ran for, from one look at the runState so that
+// the two agree.
+func (r *runState) status(paused bool) (State, time.Duration) {
+	var done, stopped bool
+	select {
+	case <-r.stopped:
+		stopped = true
+	default:
+	}
+	select {
+	case <-r.done:
+		done = true
+	default:
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	var uptime time.Duration
+	switch {
+	case !r.started:
+	case done:
+		uptime = r.stoppedAt.Sub(r.startedAt)
+	default:
+		uptime = time.Since(r.startedAt)
+	}
+	switch {
+	case stopped:
+		return StateClosed, uptime
+	case done, r.closed:
+		return StateClosing, uptime
+	case !r.started:
+		return StateNew, uptime
+	case paused:
+		return StatePaused, uptime
+	}
+	return StateRunning, uptime
+}
+
+// State returns where the proxy is in its lifecycle.
+func (proxy *TCPProxy) State() State {
+	state, _ := proxy.status()
+	return state
+}
+
+func (proxy *TCPProxy) status() (State, time.Duration) {
+	return proxy.running.status(proxy.paused.isPaused())
+}
+
+// State returns where the proxy is in its lifecycle. It is StateClosing
+// throughout CloseWithDeadline.
+func (proxy *UDPProxy) State() State {
+	state, _ := proxy.status()
+	return state
+}
+
+func (proxy *UDPProxy) status() (State, time.Duration) {
+	state, uptime := proxy.running.status(atomic.LoadInt32(&proxy.paused) != 0)
+	if state < StateClosing && atomic.LoadInt32(&proxy.draining) != 0 {
+		return StateClosing, uptime
+	}
+	return state, uptime
+}
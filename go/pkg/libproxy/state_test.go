@@ -0,0 +1,103 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPProxyState(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := proxy.(*TCPProxy)
+	if state := tcp.State(); state != StateNew {
+		t.Fatalf("Expected a new proxy but it is %s", state)
+	}
+	go proxy.Run()
+	waitFor(t, func() bool { return tcp.State() == StateRunning }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateRunning, tcp.State())
+	})
+	tcp.Pause()
+	waitFor(t, func() bool { return tcp.State() == StatePaused }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StatePaused, tcp.State())
+	})
+	tcp.Resume()
+	waitFor(t, func() bool { return tcp.State() == StateRunning }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateRunning, tcp.State())
+	})
+	proxy.Close()
+	waitFor(t, func() bool { return tcp.State() == StateClosed }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateClosed, tcp.State())
+	})
+}
+
+func TestTCPProxyStateClosedBeforeRun(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Close()
+	waitFor(t, func() bool { return proxy.(*TCPProxy).State() == StateClosed }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateClosed, proxy.(*TCPProxy).State())
+	})
+}
+
+func TestUDPProxyState(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithUDPIdleTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := proxy.(*UDPProxy)
+	if state := udp.State(); state != StateNew {
+		t.Fatalf("Expected a new proxy but it is %s", state)
+	}
+	go proxy.Run()
+	waitFor(t, func() bool { return udp.State() == StateRunning }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateRunning, udp.State())
+	})
+	udp.Pause()
+	waitFor(t, func() bool { return udp.State() == StatePaused }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StatePaused, udp.State())
+	})
+	udp.Resume()
+	waitFor(t, func() bool { return udp.State() == StateRunning }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateRunning, udp.State())
+	})
+
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	// The session keeps the proxy closing until the deadline.
+	closed := make(chan struct{})
+	go func() {
+		udp.CloseWithDeadline(200 * time.Millisecond)
+		close(closed)
+	}()
+	waitFor(t, func() bool { return udp.State() == StateClosing }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateClosing, udp.State())
+	})
+	<-closed
+	waitFor(t, func() bool { return udp.State() == StateClosed }, func() string {
+		return fmt.Sprintf("Expected the proxy to be %s but it is %s", StateClosed, udp.State())
+	})
+}
+
+func TestStateString(t *testing.T) {
+	for state, name := range map[State]string{StateNew: "new", StateRunning: "running", StatePaused: "paused", StateClosing: "closing", StateClosed: "closed", State(42): "unknown"} {
+		if state.String() != name {
+			t.Errorf("Expected %d to be %q but got %q", state, name, state.String())
+		}
+	}
+}
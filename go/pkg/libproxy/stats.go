@@ -0,0 +1,241 @@
+package libproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyStats is a snapshot of the traffic forwarded by a Proxy.
+type ProxyStats struct {
+	// BytesToBackend is the number of bytes forwarded from the frontend to
+	// the backend.
+	BytesToBackend uint64
+	// BytesToFrontend is the number of bytes forwarded from the backend to
+	// the frontend.
+	BytesToFrontend uint64
+	// ActiveConns is the number of connections (or UDP sessions) currently
+	// being forwarded.
+	ActiveConns int64
+	// TotalConns is the number of connections (or UDP sessions) forwarded
+	// since the proxy was created.
+	TotalConns int64
+	// TruncatedDatagrams is the number of UDP datagrams which filled the
+	// receive buffer, and so were probably truncated. See
+	// WithUDPMaxDatagramSize.
+	TruncatedDatagrams uint64
+	// OversizedDatagrams is the number of UDP datagrams which couldn't be
+	// sent to the backend because they were too large for it. See
+	// DatagramTooLargeError.
+	OversizedDatagrams uint64
+	// FrontendReadErrors, FrontendWriteErrors, BackendReadErrors and
+	// BackendWriteErrors count the TCP connections ended by an error
+	// copying through them, by where the error came from. See ErrSource.
+	FrontendReadErrors  uint64
+	FrontendWriteErrors uint64
+	BackendReadErrors   uint64
+	BackendWriteErrors  uint64
+	// BackendDials is the number of TCP connections whose backend
+	// connection was established, and DialTimeTotal the time it took them
+	// all, from accepting the connection to connecting to the backend
+	// including any retries, so that the average is DialTimeTotal divided
+	// by BackendDials. LastDialTime and MaxDialTime are the time taken by
+	// the latest connection and the slowest. Connections which never reach
+	// their backend aren't counted. For a proxy made of several, such as
+	// one from NewPortRangeProxy, LastDialTime is the largest of theirs.
+	BackendDials  uint64
+	DialTimeTotal time.Duration
+	LastDialTime  time.Duration
+	MaxDialTime   time.Duration
+	// DroppedEvents is the number of OnConnection events, and so
+	// WithFlowLog records, dropped because the callback was too far
+	// behind.
+	DroppedEvents uint64
+	// Tag is the label given with WithTag.
+	Tag string
+}
+
+// WithTag labels the proxy with tag, for example the tenant it serves. The
+// tag is only passed through: it is reported in Stats, Connections and
+// OnConnection events.
+func WithTag(tag string) Option {
+	return func(o *options) {
+		o.tag = tag
+	}
+}
+
+// stats holds the counters behind ProxyStats. All the counters are updated
+// atomically and the 64-bit fields are kept first for alignment. The ones
+// which a snapshot reads together, and the last error, are also updated
+// with countM held shared, so that updates don't wait for each other but a
+// snapshot holding it exclusively sees none of them half done.
+type stats struct {
+	bytesToBackend     uint64
+	bytesToFrontend    uint64
+	truncatedDatagrams uint64
+	oversizedDatagrams uint64
+	copyErrors         [4]uint64 // indexed by ErrSource - 1
+	dials              uint64
+	dialNanos          uint64
+	lastDialNanos      int64
+	maxDialNanos       int64
+	droppedEvents      uint64
+	activeConns        int64
+	totalConns         int64
+	countM             sync.RWMutex
+	errM               sync.Mutex // held with countM shared by failed
+	lastErr            string     // guarded by errM
+	lastErrTime        time.Time
+	tag                string // set before the proxy starts
+}
+
+func (s *stats) connOpened() {
+	s.countM.RLock()
+	defer s.countM.RUnlock()
+	atomic.AddInt64(&s.totalConns, 1)
+	atomic.AddInt64(&s.activeConns, 1)
+}
+
+func (s *stats) connClosed() {
+	s.countM.RLock()
+	defer s.countM.RUnlock()
+	atomic.AddInt64(&s.activeConns, -1)
+}
+
+func (s *stats) addToBackend(n int) {
+	s.countM.RLock()
+	defer s.countM.RUnlock()
+	atomic.AddUint64(&s.bytesToBackend, uint64(n))
+}
+
+func (s *stats) addToFrontend(n int) {
+	s.countM.RLock()
+	defer s.countM.RUnlock()
+	atomic.AddUint64(&s.bytesToFrontend, uint64(n))
+}
+
+// failed records err as the latest error of the proxy.
+func (s *stats) failed(err error) {
+	if err == nil {
+		return
+	}
+	s.countM.RLock()
+	defer s.countM.RUnlock()
+	s.errM.Lock()
+	defer s.errM.Unlock()
+	s.lastErr = err.Error()
+	s.lastErrTime = time.Now()
+}
+
+// dialed records that a backend connection took d to establish.
+func (s *stats) dialed(d time.Duration) {
+	atomic.AddUint64(&s.dials, 1)
+	atomic.AddUint64(&s.dialNanos, uint64(d))
+	atomic.StoreInt64(&s.lastDialNanos, int64(d))
+	for {
+		max := atomic.LoadInt64(&s.maxDialNanos)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&s.maxDialNanos, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// checkTruncated counts a datagram of n bytes read into buf as truncated if
+// it filled buf.
+func (s *stats) checkTruncated(n int, buf []byte) {
+	if n == len(buf) {
+		atomic.AddUint64(&s.truncatedDatagrams, 1)
+	}
+}
+
+func (s *stats) snapshot() ProxyStats {
+	s.countM.Lock()
+	defer s.countM.Unlock()
+	return ProxyStats{
+		BytesToBackend:      s.bytesToBackend,
+		BytesToFrontend:     s.bytesToFrontend,
+		ActiveConns:         s.activeConns,
+		TotalConns:          s.totalConns,
+		TruncatedDatagrams:  atomic.LoadUint64(&s.truncatedDatagrams),
+		OversizedDatagrams:  atomic.LoadUint64(&s.oversizedDatagrams),
+		FrontendReadErrors:  atomic.LoadUint64(&s.copyErrors[FrontendRead-1]),
+		FrontendWriteErrors: atomic.LoadUint64(&s.copyErrors[FrontendWrite-1]),
+		BackendReadErrors:   atomic.LoadUint64(&s.copyErrors[BackendRead-1]),
+		BackendWriteErrors:  atomic.LoadUint64(&s.copyErrors[BackendWrite-1]),
+		BackendDials:        atomic.LoadUint64(&s.dials),
+		DialTimeTotal:       time.Duration(atomic.LoadUint64(&s.dialNanos)),
+		LastDialTime:        time.Duration(atomic.LoadInt64(&s.lastDialNanos)),
+		MaxDialTime:         time.Duration(atomic.LoadInt64(&s.maxDialNanos)),
+		DroppedEvents:       atomic.LoadUint64(&s.droppedEvents),
+		Tag:                 s.tag,
+	}
+}
+
+// connection tracks a single forwarded TCP connection or UDP session.
+type connection struct {
+	// bytesToBackend and bytesToFrontend are updated atomically.
+	bytesToBackend  uint64
+	bytesToFrontend uint64
+	errSource       int32    // an ErrSource, set atomically by copyFailed
+	frontendAddr    net.Addr // the remote address of the frontend client
+	backendAddr     net.Addr
+	start           time.Time
+	dialDuration    time.Duration // set once the backend is connected
+	dialFailed      bool          // set if it couldn't be
+	ctx             context.Context
+	traceID         string
+	stopSampling    func() // set by startSampling
+	teeToBackend    *tee   // set by startTee
+	teeToFrontend   *tee
+	shadow          *tee        // set by startShadow
+	shadowConn      *shadowConn // the writer of shadow
+	proxyStats      *stats
+	// accepted, if set, is stopped by the first bytes in either direction.
+	accepted *acceptTimer
+}
+
+func newConnection(frontendAddr net.Addr, s *stats) *connection {
+	return &connection{
+		frontendAddr: frontendAddr,
+		start:        time.Now(),
+		proxyStats:   s,
+	}
+}
+
+// dialed records that the backend has just been connected.
+func (c *connection) dialed() {
+	c.dialDuration = time.Since(c.start)
+	c.proxyStats.dialed(c.dialDuration)
+}
+
+func (c *connection) addToBackend(n int) {
+	if n > 0 {
+		c.accepted.stop()
+	}
+	atomic.AddUint64(&c.bytesToBackend, uint64(n))
+	c.proxyStats.addToBackend(n)
+}
+
+func (c *connection) addToFrontend(n int) {
+	if n > 0 {
+		c.accepted.stop()
+	}
+	atomic.AddUint64(&c.bytesToFrontend, uint64(n))
+	c.proxyStats.addToFrontend(n)
+}
+
+// countingWriter counts the bytes written as they are written, rather than
+// once the copy has completed.
+type countingWriter struct {
+	w   io.Writer
+	add func(int)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.add(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package libproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPProxyStats(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatalf("Can't connect to the proxy: %v", err)
+		}
+		client.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err = client.Write(testBuf); err != nil {
+			t.Fatal(err)
+		}
+		recvBuf := make([]byte, testBufSize)
+		if _, err = io.ReadFull(client, recvBuf); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+	}
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 0
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", stats) })
+	if stats.TotalConns != 2 {
+		t.Fatalf("Expected 2 connections in total but got %d", stats.TotalConns)
+	}
+	if stats.BytesToBackend != uint64(2*testBufSize) || stats.BytesToFrontend != uint64(2*testBufSize) {
+		t.Fatalf("Expected %d bytes each way but got %+v", 2*testBufSize, stats)
+	}
+}
+
+func TestWithTag(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		backend := NewEchoServer(t, network, "127.0.0.1:0")
+		backend.Run()
+		events := make(chan ConnEvent, 2)
+		var frontendAddr net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		if network == "udp" {
+			frontendAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		}
+		proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithTag("tenant-a"), OnConnection(func(e ConnEvent) { events <- e }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go proxy.Run()
+		client, err := net.Dial(network, proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		if tag := proxy.Stats().Tag; tag != "tenant-a" {
+			t.Errorf("%s: expected the stats to be tagged, got %q", network, tag)
+		}
+		if conns := proxy.Connections(); len(conns) != 1 || conns[0].Tag != "tenant-a" {
+			t.Errorf("%s: expected one tagged connection, got %+v", network, conns)
+		}
+		client.Close()
+		proxy.Close()
+		for _, want := range []ConnEventType{ConnOpened, ConnClosed} {
+			if e := <-events; e.Type != want || e.Tag != "tenant-a" {
+				t.Errorf("%s: expected a tagged event of type %v, got %+v", network, want, e)
+			}
+		}
+		backend.Close()
+	}
+}
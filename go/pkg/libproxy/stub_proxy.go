@@ -11,10 +11,23 @@ type StubProxy struct {
 }
 
 // Run does nothing.
-func (p *StubProxy) Run() {}
+func (p *StubProxy) Run() error { return nil }
 
 // Close does nothing.
-func (p *StubProxy) Close() {}
+func (p *StubProxy) Close() error { return nil }
+
+// Wait returns immediately.
+func (p *StubProxy) Wait() {}
+
+// closedChan is a channel which is already closed.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Done returns a closed channel.
+func (p *StubProxy) Done() <-chan struct{} { return closedChan }
 
 // FrontendAddr returns the frontend address.
 func (p *StubProxy) FrontendAddr() net.Addr { return p.frontendAddr }
@@ -22,6 +35,15 @@ func (p *StubProxy) FrontendAddr() net.Addr { return p.frontendAddr }
 // BackendAddr returns the backend address.
 func (p *StubProxy) BackendAddr() net.Addr { return p.backendAddr }
 
+// BackendAddrs returns the backend address.
+func (p *StubProxy) BackendAddrs() []net.Addr { return []net.Addr{p.backendAddr} }
+
+// Stats returns empty stats.
+func (p *StubProxy) Stats() ProxyStats { return ProxyStats{} }
+
+// Connections returns no connections.
+func (p *StubProxy) Connections() []ConnInfo { return nil }
+
 // NewStubProxy creates a new StubProxy
 func NewStubProxy(frontendAddr, backendAddr net.Addr) (Proxy, error) {
 	return &StubProxy{
@@ -0,0 +1,99 @@
+package libproxy
+
+import (
+	"net"
+	"time"
+)
+
+// WithNoDelay sets TCP_NODELAY on both the accepted frontend connection and
+// the dialed backend connection. Go already disables Nagle's algorithm on new
+// TCP connections, so this mostly matters for WithNoDelay(false) or for
+// connections made by a custom BackendDialer. WithNoDelay(true) can't be
+// combined with WithCork.
+func WithNoDelay(noDelay bool) Option {
+	return func(o *options) {
+		o.noDelay = &noDelay
+	}
+}
+
+// WithKeepAlive enables TCP keepalives on both the frontend and backend
+// connections. The first probe is sent after the connection has been idle
+// for idle, and further probes every interval until the peer answers or the
+// kernel gives up. Where the interval can't be set separately it is left at
+// the platform default.
+func WithKeepAlive(idle, interval time.Duration) Option {
+	return func(o *options) {
+		o.keepAliveIdle = idle
+		o.keepAliveInterval = interval
+	}
+}
+
+// WithLinger sets SO_LINGER on both the frontend and backend TCP connections
+// so that closing one waits for up to d, rounded up to a whole second, for
+// the data still queued on it to be sent. With d == 0 a close discards the
+// queued data and resets the connection straight away. Without the option
+// the data is flushed in the background after the close, as the OS does by
+// default.
+func WithLinger(d time.Duration) Option {
+	return func(o *options) {
+		o.linger = &d
+	}
+}
+
+// WithResetOnDialFailure makes the proxy reset the frontend connection, by
+// closing it with SO_LINGER set to 0, when the backend can't be dialed. By
+// default the connection is closed gracefully, so that the client sees EOF
+// as if the backend had accepted and then closed the connection; a reset lets
+// it tell that the backend was unreachable. Connections which aren't a
+// *net.TCPConn are always closed gracefully.
+func WithResetOnDialFailure() Option {
+	return func(o *options) {
+		o.resetOnDialFailure = true
+	}
+}
+
+// abortTCP arranges for conn to be reset rather than closed gracefully when
+// it is closed.
+func (o *options) abortTCP(conn interface{}) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcp.SetLinger(0); err != nil {
+		o.logf("Can't set SO_LINGER on %s: %s", tcp.RemoteAddr(), err)
+	}
+}
+
+// tuneTCP applies the TCP socket options to conn. Connections which aren't a
+// *net.TCPConn, such as vsock connections, are left alone.
+func (o *options) tuneTCP(conn interface{}) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if o.noDelay != nil {
+		if err := tcp.SetNoDelay(*o.noDelay); err != nil {
+			o.logf("Can't set TCP_NODELAY on %s: %s", tcp.RemoteAddr(), err)
+		}
+	}
+	if o.linger != nil {
+		secs := int((*o.linger + time.Second - 1) / time.Second)
+		if err := tcp.SetLinger(secs); err != nil {
+			o.logf("Can't set SO_LINGER on %s: %s", tcp.RemoteAddr(), err)
+		}
+	}
+	if o.keepAliveIdle > 0 {
+		if err := tcp.SetKeepAlive(true); err != nil {
+			o.logf("Can't enable keepalives on %s: %s", tcp.RemoteAddr(), err)
+			return
+		}
+		if err := tcp.SetKeepAlivePeriod(o.keepAliveIdle); err != nil {
+			o.logf("Can't set the keepalive idle time on %s: %s", tcp.RemoteAddr(), err)
+		}
+		if o.keepAliveInterval > 0 {
+			if err := setKeepAliveInterval(tcp, o.keepAliveInterval); err != nil {
+				o.logf("Can't set the keepalive interval on %s: %s", tcp.RemoteAddr(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package libproxy
+
+import (
+	"net"
+	"time"
+)
+
+func setKeepAliveInterval(conn *net.TCPConn, interval time.Duration) error {
+	return nil
+}
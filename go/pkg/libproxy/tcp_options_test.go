@@ -0,0 +1,142 @@
+package libproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func getsockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		value, sockErr = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value
+}
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestTuneTCP(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	o := newOptions([]Option{WithNoDelay(false), WithKeepAlive(30*time.Second, 5*time.Second)})
+	o.tuneTCP(client)
+	if getsockopt(t, client, unix.IPPROTO_TCP, unix.TCP_NODELAY) != 0 {
+		t.Fatal("Expected TCP_NODELAY to be cleared")
+	}
+	if getsockopt(t, client, unix.SOL_SOCKET, unix.SO_KEEPALIVE) == 0 {
+		t.Fatal("Expected SO_KEEPALIVE to be set")
+	}
+	if idle := getsockopt(t, client, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); idle != 30 {
+		t.Fatalf("Expected a keepalive idle time of 30s but got %ds", idle)
+	}
+	if interval := getsockopt(t, client, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL); interval != 5 {
+		t.Fatalf("Expected a keepalive interval of 5s but got %ds", interval)
+	}
+}
+
+func TestWithLinger(t *testing.T) {
+	// Lingering keeps the close graceful: the peer gets the data and EOF.
+	client, server := tcpPair(t)
+	defer client.Close()
+	o := newOptions([]Option{WithLinger(time.Second)})
+	o.tuneTCP(server)
+	if _, err := server.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if received, err := io.ReadAll(client); err != nil || len(received) != testBufSize {
+		t.Fatalf("Expected %d bytes then EOF but got %d bytes and %v", testBufSize, len(received), err)
+	}
+
+	// A zero linger resets the connection on close.
+	client, server = tcpPair(t)
+	defer client.Close()
+	o = newOptions([]Option{WithLinger(0)})
+	o.tuneTCP(server)
+	server.Close()
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Expected a reset but got %v", err)
+	}
+}
+
+func TestTuneTCPSkipsOtherConns(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	o := newOptions([]Option{WithNoDelay(true), WithKeepAlive(time.Second, time.Second)})
+	o.tuneTCP(a)
+}
+
+func TestTCPProxyWithSocketOptions(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithNoDelay(true), WithKeepAlive(time.Minute, 10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+}
+
+// readAfterDialFailure connects to a proxy whose backend is unreachable and
+// returns the error from reading the frontend connection.
+func readAfterDialFailure(t *testing.T, opts ...Option) error {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		// The reset can arrive before Dial has finished.
+		return err
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	return err
+}
+
+func TestResetOnDialFailure(t *testing.T) {
+	if err := readAfterDialFailure(t); err != io.EOF {
+		t.Fatalf("Expected EOF by default but got %v", err)
+	}
+	if err := readAfterDialFailure(t, WithResetOnDialFailure()); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Expected a connection reset but got %v", err)
+	}
+}
@@ -1,10 +1,14 @@
 package libproxy
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Conn defines a network connection
@@ -21,84 +25,505 @@ type Conn interface {
 type TCPProxy struct {
 	listener     net.Listener
 	frontendAddr net.Addr
-	backendAddr  *net.TCPAddr
+	target       atomic.Value // holds the backendTarget new connections dial
+	ctx          context.Context
+	cancel       context.CancelFunc
+	stopping     chan struct{} // closed once the listener is closed
+	stopOnce     sync.Once
+	stopErr      error         // from closing the listener
+	quit         chan struct{} // closed to tear down the connections
+	closeOnce    sync.Once
+	conns        connTracker
+	active       connRegistry
+	running      *runState
+	slots        chan struct{} // holds a token per connection if limited
+	acceptRate   *tokenBucket  // used by the accept loop only
+	paused       pauseGate
+	stats        stats
+	events       *eventDispatcher
+	opts         options
+	backendHost  string
+	backendPort  int
+	multi        *multiBackend
+	resolved     atomic.Value // holds a resolvedAddr once backendHost has been dialed
+	negotiator   negotiator
+	tlsConfig    *tls.Config // set by NewTLSProxy
+	selfTests    selfTests
+	pool         *backendPool
+
+	// Resolver is used to look up the backend of proxies created with
+	// NewTCPProxyHostname, and the destinations asked for by clients of
+	// SOCKS5 and HTTP CONNECT proxies. If nil, net.DefaultResolver is
+	// used.
+	Resolver Resolver
 }
 
 // NewTCPProxy creates a new TCPProxy.
-func NewTCPProxy(listener net.Listener, backendAddr *net.TCPAddr) (*TCPProxy, error) {
+func NewTCPProxy(listener net.Listener, backendAddr *net.TCPAddr, opts ...Option) (*TCPProxy, error) {
+	return NewTCPProxyContext(context.Background(), listener, backendAddr, opts...)
+}
+
+// NewTCPProxyContext creates a new TCPProxy which is closed, along with all
+// of its connections, when ctx is cancelled.
+func NewTCPProxyContext(ctx context.Context, listener net.Listener, backendAddr *net.TCPAddr, opts ...Option) (*TCPProxy, error) {
+	return newStreamProxy(ctx, listener, backendAddr, opts...)
+}
+
+// newStreamProxy creates a TCPProxy for any stream backend, TCP or Unix.
+func newStreamProxy(ctx context.Context, listener net.Listener, backendAddr net.Addr, opts ...Option) (*TCPProxy, error) {
+	o := newOptions(opts)
+	if err := o.checkBackendNetwork(backendAddr); err != nil {
+		return nil, err
+	}
+	if o.clientSource && !transparentSupported {
+		return nil, errTransparentUnsupported
+	}
+	if err := o.checkCork(); err != nil {
+		return nil, err
+	}
+	if err := o.checkCompression(); err != nil {
+		return nil, err
+	}
+	pool, err := o.newBackendPool()
+	if err != nil {
+		return nil, err
+	}
+	if err := o.probeStream(backendAddr); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	// If the port in frontendAddr was 0 then ListenTCP will have a picked
 	// a port to listen on, hence the call to Addr to get that actual port:
-	return &TCPProxy{
+	proxy := &TCPProxy{
 		listener:     listener,
 		frontendAddr: listener.Addr(),
-		backendAddr:  backendAddr,
-	}, nil
+		ctx:          ctx,
+		cancel:       cancel,
+		stopping:     make(chan struct{}),
+		quit:         make(chan struct{}),
+		running:      newRunState(),
+		opts:         o,
+		pool:         pool,
+	}
+	proxy.target.Store(backendTarget{backendAddr})
+	proxy.stats.tag = proxy.opts.tag
+	proxy.events = newEventDispatcher(proxy.opts.eventHandler(), &proxy.stats)
+	if proxy.opts.originalDst {
+		fallback, _ := backendAddr.(*net.TCPAddr)
+		proxy.negotiator = &transparent{frontend: listener.Addr(), fallback: fallback}
+	}
+	if proxy.opts.maxConns > 0 {
+		proxy.slots = make(chan struct{}, proxy.opts.maxConns)
+	}
+	if proxy.opts.acceptRate > 0 {
+		proxy.acceptRate = newTokenBucket(proxy.opts.acceptRate)
+	}
+	go func() {
+		<-ctx.Done()
+		proxy.Close()
+	}()
+	return proxy, nil
 }
 
 // HandleTCPConnection forwards the TCP traffic to a specified backend address
 func HandleTCPConnection(client Conn, backendAddr *net.TCPAddr, quit chan struct{}) error {
+	return handleTCPConnection(client, backendAddr, quit, &stats{})
+}
+
+func handleTCPConnection(client Conn, backendAddr *net.TCPAddr, quit chan struct{}, s *stats) error {
 	backend, err := net.DialTCP("tcp", nil, backendAddr)
 	if err != nil {
 		return fmt.Errorf("Can't forward traffic to backend tcp/%v: %s\n", backendAddr, err)
 	}
+	forwardTCP(client, backend, quit, newConnection(remoteAddr(client), s), &options{})
+	return nil
+}
 
-	event := make(chan int64)
-	var broker = func(to, from Conn) {
-		written, err := io.Copy(to, from)
-		if err != nil {
-			log.Println("error copying:", err)
+// forwardTCP copies traffic both ways between client and backend until both
+// directions have finished or quit is closed. The backend is closed before
+// returning. The first copy error, if any, is returned.
+func forwardTCP(client, backend Conn, quit chan struct{}, c *connection, o *options) error {
+	event := make(chan error)
+	var broker = func(to, from Conn, add func(int)) {
+		w, r := o.withDeadlines(&countingWriter{w: to, add: add}, from, to, from)
+		w, r = o.withRateLimit(w), c.teeing(r, to == backend)
+		uncork := func() {}
+		if to == backend {
+			uncork = o.corkBackend(to)
 		}
-		err = from.CloseRead()
-		if err != nil {
-			log.Println("error CloseRead from:", err)
+		source, err := o.copySides(w, r, to == backend)
+		if err == nil {
+			source, err = flushTo(to, to == backend)
 		}
-		err = to.CloseWrite()
+		uncork()
 		if err != nil {
-			log.Println("error CloseWrite to:", err)
+			select {
+			case <-quit:
+				// Torn down by the proxy rather than by a failure.
+			default:
+				c.copyFailed(source)
+			}
+			o.logf("error copying: %v", err)
+			// A broken or stalled transfer ends the whole
+			// connection.
+			client.Close()
+			backend.Close()
+		}
+		// On EOF only this direction is shut down so that the other
+		// one keeps flowing until it reaches EOF too. Connections
+		// which can't be half-closed are closed completely.
+		closeErr := from.CloseRead()
+		if closeErr != nil {
+			o.logf("error CloseRead from: %v", closeErr)
 		}
-		event <- written
+		closeErr = to.CloseWrite()
+		if closeErr != nil {
+			o.logf("error CloseWrite to: %v", closeErr)
+		}
+		event <- err
 	}
 
-	go broker(client, backend)
-	go broker(backend, client)
+	directions := 2
+	go broker(backend, client, c.addToBackend)
+	if o.unidirectional {
+		// Nothing is copied back, so the backend isn't read at all.
+		if err := backend.CloseRead(); err != nil {
+			o.logf("error CloseRead from: %v", err)
+		}
+		directions = 1
+	} else {
+		go broker(client, backend, c.addToFrontend)
+	}
 
-	var transferred int64
-	for i := 0; i < 2; i++ {
+	var result error
+	for i := 0; i < directions; i++ {
 		select {
-		case written := <-event:
-			transferred += written
+		case err := <-event:
+			if result == nil {
+				result = err
+			}
 		case <-quit:
-			// Interrupt the two brokers and "join" them.
+			// Interrupt the two brokers and "join" them. Both
+			// sockets are closed so that neither io.Copy stays
+			// blocked on a Read.
 			backend.Close()
-			for ; i < 2; i++ {
-				transferred += <-event
+			client.Close()
+			for ; i < directions; i++ {
+				<-event
 			}
-			return nil
+			return result
 		}
 	}
 	backend.Close()
+	return result
+}
+
+// handleConnection forwards client, which was accepted at start, to the
+// backend.
+func (proxy *TCPProxy) handleConnection(client Conn, start time.Time, quit chan struct{}) error {
+	accepted := proxy.opts.startAcceptTimer(client)
+	defer accepted.stop()
+	if proxy.opts.acceptProxyProtocol {
+		conn, err := acceptProxyProtocol(client)
+		if err != nil {
+			return accepted.end(err)
+		}
+		client = conn
+	}
+	if proxy.tlsConfig != nil {
+		conn, err := proxy.terminateTLS(client)
+		if err = accepted.end(err); err != nil {
+			return err
+		}
+		client = conn
+	}
+	c := newConnection(remoteAddr(client), &proxy.stats)
+	// The PROXY header and TLS handshake count as part of the time taken.
+	c.start = start
+	proxy.opts.startConn(proxy.ctx, c)
+	ctx := proxy.multi.hashing(proxy.opts.dialingFor(c.ctx, c.frontendAddr), c.frontendAddr)
+	var backend Conn
+	var err error
+	// Taken before dialing so that a connection to a backend replaced by
+	// SetBackend in the meantime isn't pooled.
+	gen := proxy.pool.generation()
+	if proxy.negotiator != nil {
+		proxy.selfTests.report(c.frontendAddr, nil)
+		client, backend, err = proxy.negotiateBackend(ctx, c, client, accepted)
+	} else if proxy.opts.backendSelector != nil {
+		client, backend, err = proxy.selectBackend(ctx, c, client, accepted)
+		proxy.selfTests.report(c.frontendAddr, err)
+	} else {
+		c.accepted = accepted
+		if proxy.failingFast() {
+			err = fmt.Errorf("Can't forward traffic from %v to tcp/%v: %s", c.frontendAddr, proxy.frontendAddr, errNoHealthyBackend)
+		} else if backend = proxy.pool.get(); backend == nil {
+			accepted.pause()
+			backend, err = proxy.dialBackendWithRetry(ctx)
+			accepted.resume()
+			c.dialFailed = err != nil
+		}
+		proxy.selfTests.report(c.frontendAddr, err)
+		if err != nil && proxy.opts.resetOnDialFailure {
+			proxy.opts.abortTCP(client)
+		}
+	}
+	if err != nil {
+		proxy.events.closed(c, err)
+		return err
+	}
+	c.dialed()
+	c.backendAddr = remoteAddr(backend)
+	proxy.opts.logForwarding(proxy.frontendAddr.Network(), c, localAddr(client), localAddr(backend))
+	if proxy.opts.proxyProtocol != 0 {
+		src, dst := remoteAddr(client), localAddr(client)
+		if err := writeProxyProtocolHeader(backend, proxy.opts.proxyProtocol, src, dst); err != nil {
+			backend.Close()
+			err = fmt.Errorf("Can't send PROXY protocol header to backend %v: %s", proxy.BackendAddr(), err)
+			proxy.events.closed(c, err)
+			return err
+		}
+	}
+	client, backend = proxy.opts.compress(client, backend)
+	if compressed, ok := client.(*compressedConn); ok {
+		// Nothing else closes the client's decompressor.
+		defer compressed.Close()
+	}
+	proxy.events.opened(c)
+	proxy.active.add(c)
+	proxy.opts.startSampling(c)
+	proxy.opts.startTee(c)
+	if proxy.negotiator == nil && proxy.opts.backendSelector == nil {
+		proxy.opts.startShadow(c)
+	}
+	if proxy.pool != nil && proxy.negotiator == nil {
+		err = proxy.forwardPooled(client, backend, gen, quit, c)
+	} else {
+		err = forwardTCP(client, backend, quit, c, &proxy.opts)
+	}
+	err = accepted.end(err)
+	c.endSampling()
+	c.endTee(&proxy.opts)
+	c.endShadow(&proxy.opts)
+	proxy.active.remove(c)
+	proxy.events.closed(c, err)
+	return nil
+}
+
+// remoteAddr returns the remote address of a connection, or nil if it
+// doesn't have one.
+func remoteAddr(c interface{}) net.Addr {
+	if conn, ok := c.(interface{ RemoteAddr() net.Addr }); ok {
+		return conn.RemoteAddr()
+	}
 	return nil
 }
 
-// Run starts forwarding the traffic using TCP.
-func (proxy *TCPProxy) Run() {
-	quit := make(chan struct{})
-	defer close(quit)
+func localAddr(c interface{}) net.Addr {
+	if conn, ok := c.(interface{ LocalAddr() net.Addr }); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+func (proxy *TCPProxy) dialBackend(ctx context.Context) (Conn, error) {
+	if proxy.backendHost != "" {
+		return proxy.dialHostname(ctx)
+	}
+	if proxy.multi != nil {
+		return proxy.dialMulti(ctx)
+	}
+	target := proxy.backendTarget()
+	backend, err := proxy.opts.dialStreamContext(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("Can't forward traffic to backend %s/%v: %s\n", target.Network(), target, err)
+	}
+	return backend, nil
+}
+
+// Run starts forwarding the traffic using TCP. It returns nil after Close
+// and the Accept error otherwise. Temporary Accept errors are retried, see
+// WithAcceptBackoff.
+func (proxy *TCPProxy) Run() error {
+	if !proxy.running.start() {
+		return nil
+	}
+	defer proxy.running.finish()
+	backoff := acceptBackoff{max: proxy.opts.acceptBackoff}
 	for {
+		if !proxy.paused.wait(proxy.stopping) || !proxy.acquireSlot() {
+			return nil
+		}
+		if !proxy.acceptToken() {
+			proxy.releaseSlot()
+			return nil
+		}
 		client, err := proxy.listener.Accept()
 		if err != nil {
-			log.Printf("Stopping proxy on tcp/%v for tcp/%v (%s)", proxy.frontendAddr, proxy.backendAddr, err)
-			return
+			proxy.releaseSlot()
+			select {
+			case <-proxy.stopping:
+				return nil
+			default:
+			}
+			if isTemporaryAcceptError(err) {
+				proxy.opts.logf("Can't accept on %s/%v, retrying: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+				if !backoff.wait(proxy.stopping) {
+					return nil
+				}
+				continue
+			}
+			proxy.opts.logf("Stopping proxy on %s/%v for %s/%v (%s)", proxy.frontendAddr.Network(), proxy.frontendAddr, proxy.BackendAddr().Network(), proxy.BackendAddr(), err)
+			proxy.Close()
+			err = fmt.Errorf("Can't accept on %s/%v: %s", proxy.frontendAddr.Network(), proxy.frontendAddr, err)
+			proxy.stats.failed(err)
+			return err
 		}
-		go HandleTCPConnection(client.(Conn), proxy.backendAddr, quit)
+		start := time.Now()
+		backoff.reset()
+		// Pause may have been called during Accept.
+		if !proxy.paused.wait(proxy.stopping) {
+			client.Close()
+			proxy.releaseSlot()
+			return nil
+		}
+		if !proxy.opts.permitted(client.RemoteAddr()) {
+			proxy.opts.logf("Refusing connection from %v to %s/%v", client.RemoteAddr(), proxy.frontendAddr.Network(), proxy.frontendAddr)
+			client.Close()
+			proxy.releaseSlot()
+			continue
+		}
+		proxy.opts.tuneTCP(client)
+		proxy.opts.setSocketBuffers(client)
+		proxy.conns.add()
+		proxy.stats.connOpened()
+		proxy.running.conns.Add(1)
+		go func() {
+			defer proxy.running.conns.Done()
+			defer proxy.releaseSlot()
+			defer proxy.conns.done()
+			defer proxy.stats.connClosed()
+			defer client.Close()
+			if err := proxy.handleConnection(asConn(client), start, proxy.quit); err != nil {
+				proxy.opts.logf("%v", err)
+				proxy.stats.failed(err)
+			}
+		}()
+	}
+}
+
+// acquireSlot waits until the connection limit allows another connection to
+// be accepted. It returns false if the proxy stops accepting meanwhile.
+func (proxy *TCPProxy) acquireSlot() bool {
+	if proxy.slots == nil {
+		return true
+	}
+	select {
+	case proxy.slots <- struct{}{}:
+		return true
+	case <-proxy.stopping:
+		return false
 	}
 }
 
-// Close stops forwarding the traffic.
-func (proxy *TCPProxy) Close() { proxy.listener.Close() }
+func (proxy *TCPProxy) releaseSlot() {
+	if proxy.slots != nil {
+		<-proxy.slots
+	}
+}
+
+func (proxy *TCPProxy) stopAccepting() {
+	proxy.stopOnce.Do(func() {
+		close(proxy.stopping)
+		proxy.stopErr = proxy.listener.Close()
+	})
+}
+
+// Close stops forwarding the traffic. It returns the error from closing the
+// listener, if any. Calling it again does nothing and returns nil.
+func (proxy *TCPProxy) Close() error {
+	var err error
+	proxy.closeOnce.Do(func() {
+		proxy.cancel()
+		proxy.stopAccepting()
+		close(proxy.quit)
+		proxy.pool.close()
+		proxy.running.close()
+		err = proxy.stopErr
+	})
+	return err
+}
+
+// Wait blocks until Run has returned and every connection has finished.
+func (proxy *TCPProxy) Wait() { proxy.running.wait() }
+
+// Done returns a channel which is closed when Wait would return.
+func (proxy *TCPProxy) Done() <-chan struct{} { return proxy.running.stopped }
+
+// CloseWithDeadline stops accepting new connections immediately but lets the
+// existing ones finish for up to d before closing them. It returns once every
+// connection has finished, with the number of connections which had to be
+// forcibly closed.
+func (proxy *TCPProxy) CloseWithDeadline(d time.Duration) int {
+	proxy.stopAccepting()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-proxy.conns.idle():
+		proxy.Close()
+		return 0
+	case <-timer.C:
+	}
+	forced := proxy.conns.count()
+	proxy.Close()
+	<-proxy.conns.idle()
+	return forced
+}
 
 // FrontendAddr returns the TCP address on which the proxy is listening.
 func (proxy *TCPProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
 
-// BackendAddr returns the TCP proxied address.
-func (proxy *TCPProxy) BackendAddr() net.Addr { return proxy.backendAddr }
+// BackendAddr returns the TCP proxied address. For a proxy created with
+// NewTCPProxyHostname it is the address the host name last resolved to when
+// connecting, or the host name itself before the first connection. For a
+// proxy created with NewTCPProxyMulti it is the first backend. Proxies which
+// pick the backend from what each client asks for return a placeholder naming
+// the protocol, such as "socks5".
+func (proxy *TCPProxy) BackendAddr() net.Addr {
+	if proxy.backendHost != "" {
+		if resolved, ok := proxy.resolved.Load().(resolvedAddr); ok {
+			return resolved.addr
+		}
+		return proxy.hostnameAddr()
+	}
+	if proxy.multi != nil {
+		return proxy.multi.addrs[0]
+	}
+	if proxy.negotiator != nil {
+		return &hostnameAddr{network: "tcp", address: proxy.negotiator.String()}
+	}
+	return proxy.backendTarget()
+}
+
+// BackendAddrs returns the backends the proxy was configured with: every one
+// given to NewTCPProxyMulti, the unresolved host name given to
+// NewTCPProxyHostname, or just BackendAddr otherwise.
+func (proxy *TCPProxy) BackendAddrs() []net.Addr {
+	if proxy.backendHost != "" {
+		return []net.Addr{proxy.hostnameAddr()}
+	}
+	if proxy.multi != nil {
+		addrs := make([]net.Addr, len(proxy.multi.addrs))
+		for i, addr := range proxy.multi.addrs {
+			addrs[i] = addr
+		}
+		return addrs
+	}
+	return []net.Addr{proxy.BackendAddr()}
+}
+
+// Stats returns a snapshot of the traffic forwarded by the proxy.
+func (proxy *TCPProxy) Stats() ProxyStats { return proxy.stats.snapshot() }
+
+// Connections returns the connections currently being forwarded.
+func (proxy *TCPProxy) Connections() []ConnInfo { return proxy.active.snapshot() }
@@ -0,0 +1,185 @@
+package libproxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// teeQueueLength is how many reads of one direction of a connection are kept
+// for a tee which is slower than the connection, before more are dropped.
+const teeQueueLength = 64
+
+// WithTee copies everything the proxy reads from the clients of TCP
+// connections and UDP sessions to frontendToBackend, and everything it reads
+// from their backends to backendToFrontend, for example to look at the
+// payload of a protocol being debugged. Either may be nil. The bytes of all
+// the connections are written to the same writer, one read at a time, so
+// they are interleaved; UDP datagrams are written without any framing.
+//
+// The copies are written by a goroutine of each connection and direction,
+// so that forwarding never waits for them: each read is copied into a queue
+// holding up to 64, and dropped if the queue is full. What was dropped is
+// logged when the connection closes. Teeing costs a copy of every read and a
+// goroutine per direction, so it is meant for debugging rather than for
+// busy proxies, and the writers see the traffic later than the backends and
+// clients do.
+func WithTee(frontendToBackend, backendToFrontend io.Writer) Option {
+	// The sinks are made here rather than when the option is applied, as
+	// the options are applied again for each of the proxies making up a
+	// dual-stack, port range or multi-frontend proxy, and they all have to
+	// share the lock. The writers may be the same, so they share it too.
+	m := &sync.Mutex{}
+	toBackend, toFrontend := newTeeSink(m, frontendToBackend), newTeeSink(m, backendToFrontend)
+	return func(o *options) {
+		o.teeToBackend = toBackend
+		o.teeToFrontend = toFrontend
+	}
+}
+
+// teeSink is a tee writer, shared by the connections of a proxy.
+type teeSink struct {
+	m *sync.Mutex
+	w io.Writer
+}
+
+func newTeeSink(m *sync.Mutex, w io.Writer) *teeSink {
+	if w == nil {
+		return nil
+	}
+	return &teeSink{m: m, w: w}
+}
+
+// tee copies one direction of one connection to a teeSink. A nil tee copies
+// nothing.
+type tee struct {
+	sink    *teeSink
+	queue   chan []byte
+	stopped chan struct{}
+	dropped uint64 // updated atomically
+	// gapless tees write nothing more once anything has been dropped.
+	gapless bool
+	// finished, if set, is called once everything queued has been
+	// written.
+	finished func()
+}
+
+func newTee(sink *teeSink) *tee {
+	if sink == nil {
+		return nil
+	}
+	return startTee(&tee{sink: sink})
+}
+
+func startTee(t *tee) *tee {
+	t.queue = make(chan []byte, teeQueueLength)
+	t.stopped = make(chan struct{})
+	go t.run()
+	return t
+}
+
+func (t *tee) run() {
+	if t.finished != nil {
+		defer t.finished()
+	}
+	for {
+		select {
+		case b := <-t.queue:
+			t.writeOut(b)
+		case <-t.stopped:
+			for {
+				select {
+				case b := <-t.queue:
+					t.writeOut(b)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *tee) writeOut(b []byte) {
+	if t.gapless && atomic.LoadUint64(&t.dropped) != 0 {
+		return
+	}
+	t.sink.m.Lock()
+	defer t.sink.m.Unlock()
+	t.sink.w.Write(b)
+}
+
+// write queues a copy of b, or drops it if the queue is full.
+func (t *tee) write(b []byte) {
+	if t == nil || len(b) == 0 {
+		return
+	}
+	select {
+	case <-t.stopped:
+		return
+	default:
+	}
+	select {
+	case t.queue <- append([]byte(nil), b...):
+	default:
+		atomic.AddUint64(&t.dropped, uint64(len(b)))
+	}
+}
+
+// stop stops queueing, leaving what is queued already to be written, and
+// returns the number of bytes dropped.
+func (t *tee) stop() uint64 {
+	if t == nil {
+		return 0
+	}
+	close(t.stopped)
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// teeReader copies what is read from r to tees.
+type teeReader struct {
+	r    io.Reader
+	tees []*tee
+}
+
+func (r *teeReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	for _, t := range r.tees {
+		t.write(b[:n])
+	}
+	return n, err
+}
+
+// startTee starts teeing c, which has just been opened, until c.endTee is
+// called.
+func (o *options) startTee(c *connection) {
+	c.teeToBackend = newTee(o.teeToBackend)
+	c.teeToFrontend = newTee(o.teeToFrontend)
+}
+
+// teeing returns r, which reads from the client if toBackend is set and from
+// the backend otherwise, copying what it reads to the tee and, from the
+// client, to the shadow backend.
+func (c *connection) teeing(r io.Reader, toBackend bool) io.Reader {
+	candidates := []*tee{c.teeToFrontend}
+	if toBackend {
+		candidates = []*tee{c.teeToBackend, c.shadow}
+	}
+	var tees []*tee
+	for _, t := range candidates {
+		if t != nil {
+			tees = append(tees, t)
+		}
+	}
+	if len(tees) == 0 {
+		return r
+	}
+	return &teeReader{r: r, tees: tees}
+}
+
+// endTee stops teeing c once it has been closed.
+func (c *connection) endTee(o *options) {
+	toBackend, toFrontend := c.teeToBackend.stop(), c.teeToFrontend.stop()
+	if toBackend != 0 || toFrontend != 0 {
+		o.logf("The tee of %v dropped %d bytes to the backend and %d bytes back", c.frontendAddr, toBackend, toFrontend)
+	}
+}
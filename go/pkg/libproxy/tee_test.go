@@ -0,0 +1,160 @@
+package libproxy
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// teeBuffer is a bytes.Buffer which is safe to read while the tee writes it.
+type teeBuffer struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *teeBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *teeBuffer) waitFor(t *testing.T, expected []byte) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b.m.Lock()
+		got := append([]byte(nil), b.buf.Bytes()...)
+		b.m.Unlock()
+		if bytes.Equal(got, expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the tee to get %q but got %q", expected, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTee(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			backend := NewEchoServer(t, network, "127.0.0.1:0")
+			defer backend.Close()
+			backend.Run()
+			var toBackend, toFrontend teeBuffer
+			var frontendAddr net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			if network == "udp" {
+				frontendAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			}
+			proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithTee(&toBackend, &toFrontend))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxy.Close()
+			go proxy.Run()
+			client, err := net.Dial(network, proxy.FrontendAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			roundTrip(t, client)
+			roundTrip(t, client)
+			expected := append(append([]byte(nil), testBuf...), testBuf...)
+			toBackend.waitFor(t, expected)
+			toFrontend.waitFor(t, expected)
+		})
+	}
+}
+
+// unsyncedWriter appends to a slice without any locking, so that the race
+// detector catches writes which aren't serialised by the tee.
+type unsyncedWriter struct {
+	written []byte
+	n       int64 // updated atomically once written has been
+}
+
+func (w *unsyncedWriter) Write(p []byte) (int, error) {
+	w.written = append(w.written, p...)
+	atomic.AddInt64(&w.n, int64(len(p)))
+	return len(p), nil
+}
+
+func TestTeeSharedBySubProxies(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontends := []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0},
+	}
+	var w unsyncedWriter
+	proxy, err := NewMultiFrontendProxy(frontends, backend.LocalAddr(), WithTee(&w, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	const rounds = 10
+	var wg sync.WaitGroup
+	for _, p := range proxy.(*compositeProxy).proxies {
+		client, err := net.Dial("tcp", p.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				roundTrip(t, client)
+			}
+		}()
+	}
+	wg.Wait()
+	expected := int64(2 * rounds * testBufSize)
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt64(&w.n) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the tee to get %d bytes but got %d", expected, atomic.LoadInt64(&w.n))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stalledWriter blocks every write until it is released.
+type stalledWriter struct {
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestTeeDoesntStallForwarding(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	stalled := &stalledWriter{release: make(chan struct{})}
+	defer close(stalled.release)
+	logger := &recordingLogger{}
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithTee(stalled, nil), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every round trip is a read of its own, so the queue overflows.
+	for i := 0; i < 2*teeQueueLength; i++ {
+		roundTrip(t, client)
+	}
+	client.Close()
+	logger.waitFor(t, "dropped")
+}
@@ -0,0 +1,100 @@
+package libproxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnSample is the traffic of one connection or UDP session over one
+// interval of WithThroughputSampler.
+type ConnSample struct {
+	// FrontendAddr is the remote address of the frontend client.
+	FrontendAddr net.Addr
+	BackendAddr  net.Addr
+	// Start is when the connection was accepted.
+	Start time.Time
+	// Time is when the sample was taken and Interval the time since the
+	// previous one, or since the connection was opened.
+	Time     time.Time
+	Interval time.Duration
+	// BytesToBackend and BytesToFrontend are the bytes forwarded during
+	// the interval.
+	BytesToBackend  uint64
+	BytesToFrontend uint64
+	Tag             string
+	TraceID         string
+}
+
+// WithThroughputSampler makes the proxy call fn every interval with the
+// traffic forwarded by each open TCP connection and UDP session since the
+// previous call, for example to chart long-lived tunnels as they run. A final
+// sample covers the remainder of the last interval when a connection which
+// forwarded anything in it closes. The samples of a connection are taken by a
+// goroutine of its own and delivered in order, but fn may be called for
+// several connections at once; the copies are never delayed by it, as the
+// counters are read atomically.
+func WithThroughputSampler(interval time.Duration, fn func(ConnSample)) Option {
+	return func(o *options) {
+		o.sampleInterval = interval
+		o.sampler = fn
+	}
+}
+
+// startSampling starts sampling c, which has just been opened, until
+// c.stopSampling is called.
+func (o *options) startSampling(c *connection) {
+	if o.sampler == nil || o.sampleInterval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	c.stopSampling = func() {
+		close(stop)
+		<-stopped
+	}
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(o.sampleInterval)
+		defer ticker.Stop()
+		last := time.Now()
+		var toBackend, toFrontend uint64
+		sample := func(final bool) {
+			now := time.Now()
+			b := atomic.LoadUint64(&c.bytesToBackend)
+			f := atomic.LoadUint64(&c.bytesToFrontend)
+			if final && b == toBackend && f == toFrontend {
+				return
+			}
+			o.sampler(ConnSample{
+				FrontendAddr:    c.frontendAddr,
+				BackendAddr:     c.backendAddr,
+				Start:           c.start,
+				Time:            now,
+				Interval:        now.Sub(last),
+				BytesToBackend:  b - toBackend,
+				BytesToFrontend: f - toFrontend,
+				Tag:             c.proxyStats.tag,
+				TraceID:         c.traceID,
+			})
+			last, toBackend, toFrontend = now, b, f
+		}
+		for {
+			select {
+			case <-ticker.C:
+				sample(false)
+			case <-stop:
+				sample(true)
+				return
+			}
+		}
+	}()
+}
+
+// endSampling stops sampling c, once it has been closed, after its final
+// sample.
+func (c *connection) endSampling() {
+	if c.stopSampling != nil {
+		c.stopSampling()
+	}
+}
@@ -0,0 +1,109 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sampleRecorder keeps the samples it is given.
+type sampleRecorder struct {
+	m       sync.Mutex
+	samples []ConnSample
+}
+
+func (r *sampleRecorder) record(s ConnSample) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.samples = append(r.samples, s)
+}
+
+func (r *sampleRecorder) snapshot() []ConnSample {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]ConnSample(nil), r.samples...)
+}
+
+func (r *sampleRecorder) totals() (uint64, uint64) {
+	var toBackend, toFrontend uint64
+	for _, s := range r.snapshot() {
+		toBackend += s.BytesToBackend
+		toFrontend += s.BytesToFrontend
+	}
+	return toBackend, toFrontend
+}
+
+func TestThroughputSamplerTCP(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	samples := &sampleRecorder{}
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithThroughputSampler(20*time.Millisecond, samples.record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		roundTrip(t, client)
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Samples are taken while the connection is idle too.
+	if n := len(samples.snapshot()); n < 3 {
+		t.Fatalf("Expected a sample every interval but got %d", n)
+	}
+	client.Close()
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 0 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", proxy.Stats()) })
+	// The samples add up to the whole connection.
+	stats := proxy.Stats()
+	if toBackend, toFrontend := samples.totals(); toBackend != stats.BytesToBackend || toFrontend != stats.BytesToFrontend {
+		t.Fatalf("Expected the samples to add up to %+v but got %d and %d", stats, toBackend, toFrontend)
+	}
+	var last time.Time
+	for _, s := range samples.snapshot() {
+		if s.FrontendAddr.String() != client.LocalAddr().String() || s.BackendAddr.String() != backend.LocalAddr().String() || s.Interval <= 0 || s.Time.Before(last) {
+			t.Fatalf("Unexpected sample %+v", s)
+		}
+		last = s.Time
+	}
+	// No more samples once the connection has closed.
+	n := len(samples.snapshot())
+	time.Sleep(50 * time.Millisecond)
+	if len(samples.snapshot()) != n {
+		t.Fatal("Still sampling after the connection closed")
+	}
+}
+
+func TestThroughputSamplerUDP(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	samples := &sampleRecorder{}
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithThroughputSampler(20*time.Millisecond, samples.record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	time.Sleep(50 * time.Millisecond)
+	// Close ends the session, which takes its final sample.
+	proxy.Close()
+	waitReturns(t, proxy)
+	stats := proxy.Stats()
+	if toBackend, toFrontend := samples.totals(); toBackend != stats.BytesToBackend || toFrontend != stats.BytesToFrontend {
+		t.Fatalf("Expected the samples to add up to %+v but got %d and %d", stats, toBackend, toFrontend)
+	}
+}
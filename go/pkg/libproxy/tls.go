@@ -0,0 +1,54 @@
+package libproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout is how long a client has to complete the TLS handshake.
+var tlsHandshakeTimeout = 10 * time.Second
+
+// NewTLSProxy creates a TCPProxy which terminates TLS, with config, on the
+// connections accepted by listener and forwards the plaintext to backend.
+// config must provide a certificate, either statically or through one of
+// its callbacks; GetConfigForClient can pick one by SNI. Clients which fail
+// the handshake are logged and disconnected.
+func NewTLSProxy(listener net.Listener, backend net.Addr, config *tls.Config, opts ...Option) (*TCPProxy, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return nil, fmt.Errorf("Can't terminate TLS on %s/%v without a certificate", listener.Addr().Network(), listener.Addr())
+	}
+	proxy, err := NewIPProxyWithListener(listener, backend, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tcp := proxy.(*TCPProxy)
+	tcp.tlsConfig = config
+	return tcp, nil
+}
+
+// terminateTLS completes the TLS handshake with client.
+func (proxy *TCPProxy) terminateTLS(client Conn) (Conn, error) {
+	raw, ok := client.(net.Conn)
+	if !ok {
+		return nil, fmt.Errorf("Can't terminate TLS on a %T", client)
+	}
+	conn := tls.Server(raw, proxy.tlsConfig)
+	ctx, cancel := context.WithTimeout(proxy.ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %v failed: %s", raw.RemoteAddr(), err)
+	}
+	return &tlsConn{conn}, nil
+}
+
+// tlsConn is a Conn for either side of a TLS connection. CloseWrite
+// sends a close_notify alert and then shuts down the write side of the
+// underlying connection; CloseRead does nothing.
+type tlsConn struct {
+	*tls.Conn
+}
+
+func (c *tlsConn) CloseRead() error { return nil }
@@ -0,0 +1,192 @@
+package libproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert returns a certificate for 127.0.0.1 and a pool trusting it.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "libproxy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLSProxy(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	cert, pool := selfSignedCert(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTLSProxy(listener, backend.LocalAddr(), &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	// A client which doesn't speak TLS is disconnected...
+	plain, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Depending on what it had read, it sees EOF or a reset.
+	if _, err := io.ReadAll(plain); isTimeout(err) {
+		t.Fatal("Expected the plaintext client to be disconnected")
+	}
+	plain.Close()
+
+	// ...without stopping the proxy.
+	client, err := tls.Dial("tcp", proxy.FrontendAddr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	// The half-close reaches the backend, whose echo then finishes.
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatalf("Expected EOF after the half-close but got %v", err)
+	}
+}
+
+func TestTLSProxyNeedsCertificate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := NewTLSProxy(listener, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, &tls.Config{}); err == nil {
+		t.Fatal("Expected an error without a certificate")
+	}
+}
+
+// tlsEchoServer echoes back what each TLS client sends until it closes.
+func tlsEchoServer(t *testing.T, cert tls.Certificate) net.Listener {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestBackendTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	backend := tlsEchoServer(t, cert)
+	defer backend.Close()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendTLS(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+}
+
+func TestBackendTLSHandshakeFailure(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	backend := tlsEchoServer(t, cert)
+	defer backend.Close()
+	events := make(chan ConnEvent, 1)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	// The backend's certificate isn't trusted.
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendTLS(&tls.Config{}), OnConnection(func(e ConnEvent) { events <- e }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case e := <-events:
+		if e.Type != ConnClosed || e.BackendAddr != nil || e.Err == nil {
+			t.Fatalf("Expected the connection to fail like a dial but got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the handshake to fail")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// A backend which accepts connections but never answers the handshake.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithBackendTLS(&tls.Config{}), WithDialTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the client to be disconnected once the dial timed out but got %v", err)
+	}
+}
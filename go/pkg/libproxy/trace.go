@@ -0,0 +1,52 @@
+package libproxy
+
+import (
+	"context"
+	"net"
+)
+
+// WithConnContext makes the proxy call fn for each new TCP connection or UDP
+// session to make its context, for example to carry tracing state. parent is
+// the proxy's context, and the context returned must be derived from it so
+// that dialing the backend is still cancelled when the proxy is closed. The
+// context is passed to a BackendDialer with a DialContext method and reported
+// in ConnEvent.Context.
+func WithConnContext(fn func(parent context.Context, client net.Addr) context.Context) Option {
+	return func(o *options) {
+		o.connContext = fn
+	}
+}
+
+// WithTraceIDs makes the proxy label each new TCP connection or UDP session
+// with an ID from gen, called with the connection's context, so that it can
+// be correlated with the logs of a tracing backend. The ID is reported in
+// ConnEvent, FlowRecord and ConnInfo, logged by WithVerboseLogging, and
+// carried by the connection's context: see TraceID.
+func WithTraceIDs(gen func(ctx context.Context) string) Option {
+	return func(o *options) {
+		o.traceIDs = gen
+	}
+}
+
+type traceIDKey struct{}
+
+// TraceID returns the ID given by WithTraceIDs to the connection whose
+// context is ctx, or "" if there is none.
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// startConn makes the context of c, a new connection for the proxy whose
+// context is parent, and gives it its trace ID.
+func (o *options) startConn(parent context.Context, c *connection) {
+	ctx := parent
+	if o.connContext != nil {
+		ctx = o.connContext(parent, c.frontendAddr)
+	}
+	if o.traceIDs != nil {
+		c.traceID = o.traceIDs(ctx)
+		ctx = context.WithValue(ctx, traceIDKey{}, c.traceID)
+	}
+	c.ctx = ctx
+}
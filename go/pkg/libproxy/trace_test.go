@@ -0,0 +1,124 @@
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type spanKey struct{}
+
+// tracingDialer records the trace IDs of the contexts it dials with.
+type tracingDialer struct {
+	ids chan string
+}
+
+func (d *tracingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *tracingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.ids <- TraceID(ctx)
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// tracingOptions label connections span-1, span-2..., taking the prefix from
+// the connection's context.
+func tracingOptions() []Option {
+	var next int32
+	return []Option{
+		WithConnContext(func(parent context.Context, client net.Addr) context.Context {
+			return context.WithValue(parent, spanKey{}, "span")
+		}),
+		WithTraceIDs(func(ctx context.Context) string {
+			return fmt.Sprintf("%s-%d", ctx.Value(spanKey{}), atomic.AddInt32(&next, 1))
+		}),
+	}
+}
+
+func TestTraceIDsTCP(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	events := make(chan ConnEvent, 16)
+	flows := &flowBuffer{}
+	dialer := &tracingDialer{ids: make(chan string, 16)}
+	opts := append(tracingOptions(), WithBackendDialer(dialer), WithFlowLog(flows), OnConnection(func(e ConnEvent) { events <- e }))
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	for i := 1; i <= 2; i++ {
+		client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, client)
+		want := fmt.Sprintf("span-%d", i)
+		if id := <-dialer.ids; id != want {
+			t.Fatalf("Expected the backend to be dialed with trace %s but got %q", want, id)
+		}
+		if conns := proxy.Connections(); len(conns) != 1 || conns[0].TraceID != want {
+			t.Fatalf("Expected connection %s but got %+v", want, conns)
+		}
+		client.Close()
+		for _, kind := range []ConnEventType{ConnOpened, ConnClosed} {
+			select {
+			case e := <-events:
+				if e.Type != kind || e.TraceID != want || TraceID(e.Context) != want || e.Context.Value(spanKey{}) != "span" {
+					t.Fatalf("Expected event %d of %s to carry its context but got %+v", kind, want, e)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Didn't get the connection events")
+			}
+		}
+	}
+	records := flows.waitForRecords(t, 2)
+	for i, record := range records {
+		if want := fmt.Sprintf("span-%d", i+1); record.TraceID != want {
+			t.Fatalf("Expected flow record %d to have trace %s but got %+v", i, want, record)
+		}
+	}
+}
+
+func TestTraceIDsUDP(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	events := make(chan ConnEvent, 16)
+	opts := append(tracingOptions(), OnConnection(func(e ConnEvent) { events <- e }))
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	select {
+	case e := <-events:
+		if e.TraceID != "span-1" || TraceID(e.Context) != "span-1" {
+			t.Fatalf("Expected the session to be traced but got %+v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Didn't get the session event")
+	}
+}
+
+func TestTraceIDWithoutOption(t *testing.T) {
+	if id := TraceID(context.Background()); id != "" {
+		t.Fatalf("Expected no trace ID but got %q", id)
+	}
+}
@@ -0,0 +1,140 @@
+package libproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	errTransparentUnsupported = errors.New("Transparent proxying is only supported on Linux")
+	// errNoOriginalDestination is returned by OriginalDestination for
+	// connections which weren't redirected by an iptables NAT rule.
+	errNoOriginalDestination = errors.New("connection has no original destination: it wasn't redirected")
+)
+
+// NewTransparentProxy creates a TCPProxy which forwards each connection
+// accepted by listener to the destination the client originally connected
+// to. Connections either reach the listener through an iptables REDIRECT
+// rule, in which case the destination is read back with OriginalDestination,
+// or through a TPROXY rule to a listener bound with ListenTransparent, in
+// which case it is the connection's local address. Connections made to the
+// listener itself are refused. It is only supported on Linux.
+func NewTransparentProxy(listener net.Listener, opts ...Option) (*TCPProxy, error) {
+	if !transparentSupported {
+		return nil, errTransparentUnsupported
+	}
+	proxy, err := NewTCPProxy(listener, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	proxy.negotiator = &transparent{frontend: listener.Addr(), tproxy: true}
+	return proxy, nil
+}
+
+// WithOriginalDestination makes a TCP proxy forward each connection which
+// was redirected to it by an iptables REDIRECT rule to its original
+// destination, as returned by OriginalDestination, so that one listener can
+// serve many redirected destinations. Connections which weren't redirected
+// go to the proxy's own backend, or are refused if it hasn't got one.
+func WithOriginalDestination() Option {
+	return func(o *options) {
+		o.originalDst = true
+	}
+}
+
+// WithClientSource makes a TCP proxy connect to its backend from the IP
+// address of each client rather than one of its own, so that the backend
+// sees who its clients really are. The backend socket is bound with
+// IP_TRANSPARENT, as the client's address usually isn't local, and the
+// replies only find their way back to the proxy with policy routing to divert
+// them to it, as for TPROXY. It applies to the default dialer only, needs
+// CAP_NET_ADMIN and is only supported on Linux.
+func WithClientSource() Option {
+	return func(o *options) {
+		o.clientSource = true
+	}
+}
+
+type clientSourceKey struct{}
+
+// dialingFor returns the context to dial the backend for client with.
+func (o *options) dialingFor(ctx context.Context, client net.Addr) context.Context {
+	if !o.clientSource || client == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientSourceKey{}, client)
+}
+
+// transparent is the negotiator for proxies which recover the backend from
+// the client's socket. The client itself doesn't take part.
+type transparent struct {
+	frontend net.Addr
+	// tproxy means that connections which weren't NATed were diverted by
+	// TPROXY, so that their local address is their destination.
+	tproxy bool
+	// fallback, if not nil, is where connections which weren't redirected
+	// are sent.
+	fallback *net.TCPAddr
+}
+
+func (t *transparent) String() string { return "transparent" }
+
+func (t *transparent) request(client Conn) (Conn, string, error) {
+	dst, err := t.destination(client)
+	if err != nil {
+		return client, "", err
+	}
+	if t.isFrontend(dst) {
+		return client, "", fmt.Errorf("connection to %v was made to the proxy itself", dst)
+	}
+	return client, dst.String(), nil
+}
+
+func (t *transparent) reply(client Conn, backend net.Addr, err error) error {
+	return nil
+}
+
+func (t *transparent) destination(client Conn) (*net.TCPAddr, error) {
+	conn, ok := client.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("Can't find the original destination of a %T", client)
+	}
+	dst, err := OriginalDestination(conn)
+	if err != errNoOriginalDestination {
+		return dst, err
+	}
+	if t.tproxy {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+	if t.fallback != nil {
+		return t.fallback, nil
+	}
+	return nil, err
+}
+
+// isFrontend reports whether dst is the address the proxy listens on, in
+// which case forwarding to it would loop.
+func (t *transparent) isFrontend(dst *net.TCPAddr) bool {
+	frontend, ok := t.frontend.(*net.TCPAddr)
+	if !ok || frontend.Port != dst.Port {
+		return false
+	}
+	if !frontend.IP.IsUnspecified() {
+		return frontend.IP.Equal(dst.IP)
+	}
+	if dst.IP.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const transparentSupported = true
+
+// These aren't in the vendored x/sys/unix.
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST for IPv6
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// ListenTransparent binds a TCP listener at addr with IP_TRANSPARENT set, so
+// that it can accept connections diverted to it by a TPROXY rule whatever
+// their destination. This needs CAP_NET_ADMIN.
+func ListenTransparent(addr *net.TCPAddr) (net.Listener, error) {
+	lc := net.ListenConfig{Control: setTransparent}
+	return lc.Listen(context.Background(), "tcp", addr.String())
+}
+
+// setTransparent sets IP_TRANSPARENT, or its IPv6 equivalent, on a socket
+// before it is bound.
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, ipv6Transparent, 1)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	}); err != nil {
+		return err
+	}
+	if sockErr == unix.EPERM {
+		return fmt.Errorf("Can't make %s transparent without CAP_NET_ADMIN: %s", address, sockErr)
+	}
+	if sockErr != nil {
+		return fmt.Errorf("Can't make %s transparent: %s", address, sockErr)
+	}
+	return nil
+}
+
+// dialFromClient connects to addr from the IP address of client, with
+// IP_TRANSPARENT set so that the address doesn't have to be local.
+func dialFromClient(ctx context.Context, network string, addr, client net.Addr) (net.Conn, error) {
+	src, ok := client.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("Can't connect from the address of %s client %v", client.Network(), client)
+	}
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: src.IP, Zone: src.Zone},
+		Control:   setTransparent,
+	}
+	conn, err := dialer.DialContext(ctx, network, addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("using client source address %s: %s", src.IP, err)
+	}
+	return conn, nil
+}
+
+// OriginalDestination returns the address conn was sent to before an
+// iptables REDIRECT rule diverted it to this host, as recorded by conntrack.
+// It fails if the connection wasn't redirected.
+func OriginalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("Can't find the original destination of %v", conn.LocalAddr())
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		dst, sockErr = getOriginalDst(int(fd), local.IP.To4() == nil)
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr == unix.ENOENT || sockErr == unix.ENOPROTOOPT {
+		// No conntrack entry, or conntrack isn't even loaded.
+		return nil, errNoOriginalDestination
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("Can't read SO_ORIGINAL_DST: %s", sockErr)
+	}
+	return dst, nil
+}
+
+func getOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	if ipv6 {
+		var sa unix.RawSockaddrInet6
+		if err := getsockoptStruct(fd, unix.SOL_IPV6, soOriginalDst, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+			return nil, err
+		}
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: networkPort(sa.Port), Zone: zoneName(sa.Scope_id)}, nil
+	}
+	var sa unix.RawSockaddrInet4
+	if err := getsockoptStruct(fd, unix.SOL_IP, soOriginalDst, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: networkPort(sa.Port)}, nil
+}
+
+// getsockoptStruct reads an option into a struct of exactly size bytes,
+// which the conntrack options insist on.
+func getsockoptStruct(fd, level, opt int, value unsafe.Pointer, size uintptr) error {
+	length := uint32(size)
+	_, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(value), uintptr(unsafe.Pointer(&length)), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// networkPort converts a port from a raw sockaddr, which is in network byte
+// order.
+func networkPort(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
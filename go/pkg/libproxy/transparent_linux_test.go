@@ -0,0 +1,181 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestTransparentProxyRefusesDirectConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTransparentProxy(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	// Without a REDIRECT or TPROXY rule the original destination is the
+	// proxy itself, which must not be dialed.
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(client); err != nil || len(b) != 0 {
+		t.Fatalf("Expected the connection to be closed, got %q, %v", b, err)
+	}
+}
+
+func TestOriginalDestinationNotRedirected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if dst, err := OriginalDestination(conn.(*net.TCPConn)); err != errNoOriginalDestination {
+		t.Fatalf("Expected %q, got %v, %v", errNoOriginalDestination, dst, err)
+	}
+}
+
+func TestWithOriginalDestinationFallsBackToBackend(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithOriginalDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+}
+
+func TestWithOriginalDestinationWithoutBackend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewTCPProxy(listener, nil, WithOriginalDestination())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(client); err != nil || len(b) != 0 {
+		t.Fatalf("Expected the connection to be closed, got %q, %v", b, err)
+	}
+}
+
+func TestNetworkPort(t *testing.T) {
+	var port uint16
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	b[0], b[1] = 0x1f, 0x90
+	if got := networkPort(port); got != 8080 {
+		t.Fatalf("Expected port 8080, got %d", got)
+	}
+}
+
+func TestTransparentIsFrontend(t *testing.T) {
+	wildcard := &transparent{frontend: &net.TCPAddr{IP: net.IPv4zero, Port: 15001}}
+	specific := &transparent{frontend: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 15001}}
+	for _, c := range []struct {
+		t        *transparent
+		dst      *net.TCPAddr
+		frontend bool
+	}{
+		{wildcard, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 15001}, true},
+		{wildcard, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, false},
+		{wildcard, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 15001}, false},
+		{specific, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 15001}, true},
+		{specific, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 15001}, false},
+	} {
+		if got := c.t.isFrontend(c.dst); got != c.frontend {
+			t.Errorf("isFrontend(%v) with frontend %v: expected %v, got %v", c.dst, c.t.frontend, c.frontend, got)
+		}
+	}
+}
+
+func TestListenTransparent(t *testing.T) {
+	listener, err := ListenTransparent(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Can't bind a transparent listener here: %s", err)
+	}
+	listener.Close()
+}
+
+func TestClientSource(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	seen := make(chan net.Addr, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		seen <- conn.RemoteAddr()
+		conn.Close()
+	}()
+	closed := make(chan error, 1)
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.Addr(), WithClientSource(), WithLogger(&recordingLogger{}), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnClosed {
+			closed <- e.Err
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	// Connect from another loopback address than the one the proxy would
+	// pick itself.
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	client, err := dialer.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Skipf("Can't connect from 127.0.0.2: %s", err)
+	}
+	defer client.Close()
+	select {
+	case addr := <-seen:
+		if ip := addr.(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+			t.Fatalf("Expected the backend to see the client's address but got %v", addr)
+		}
+	case err := <-closed:
+		if err == nil || !strings.Contains(err.Error(), "CAP_NET_ADMIN") {
+			t.Fatalf("Expected the dial to fail for lack of CAP_NET_ADMIN but got %v", err)
+		}
+		t.Skipf("No CAP_NET_ADMIN here: %s", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("The backend wasn't connected to")
+	}
+}
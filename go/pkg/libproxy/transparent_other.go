@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package libproxy
+
+import (
+	"context"
+	"net"
+)
+
+const transparentSupported = false
+
+// ListenTransparent always fails: transparent proxying relies on Linux's
+// TPROXY support.
+func ListenTransparent(addr *net.TCPAddr) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func dialFromClient(ctx context.Context, network string, addr, client net.Addr) (net.Conn, error) {
+	return nil, errTransparentUnsupported
+}
+
+// OriginalDestination always fails: SO_ORIGINAL_DST is Linux-only.
+func OriginalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,104 @@
+package libproxy
+
+import (
+	"net"
+	"time"
+)
+
+// udpFlushTimeout bounds how long Close waits for a session's queued
+// datagrams to be written to the backend.
+const udpFlushTimeout = time.Second
+
+// WithUDPBatchWrites makes each UDP session queue the datagrams it forwards
+// to the backend and send up to max of them at a time, so that a burst costs
+// fewer system calls. On Linux a batch is sent with a single sendmmsg; on
+// other platforms, and for backends which aren't plain sockets, the
+// datagrams of a batch are still written one by one.
+func WithUDPBatchWrites(max int) Option {
+	return func(o *options) {
+		o.udpBatchWrites = max
+	}
+}
+
+// writeEach writes datagrams to conn one at a time. It returns how many were
+// written before the first error.
+func writeEach(conn net.Conn, datagrams [][]byte) (int, error) {
+	for i, b := range datagrams {
+		if _, err := conn.Write(b); err != nil {
+			return i, err
+		}
+	}
+	return len(datagrams), nil
+}
+
+// startBatching gives session a queue of datagrams which writeLoop sends to
+// the backend, until the session ends.
+func (proxy *UDPProxy) startBatching(session *udpSession, key *connTrackKey) {
+	session.queue = make(chan []byte, proxy.opts.udpBatchWrites)
+	session.ended = make(chan struct{})
+	session.flushed = make(chan struct{})
+	proxy.running.conns.Add(1)
+	go proxy.writeLoop(session, key)
+}
+
+// enqueue copies a datagram from the client onto the session's queue. It
+// waits while the queue is full, as a direct write would while the socket
+// buffer is.
+func (session *udpSession) enqueue(b []byte) {
+	select {
+	case session.queue <- append([]byte(nil), b...):
+	case <-session.ended:
+	}
+}
+
+// writeLoop sends the datagrams queued by enqueue to the backend, in
+// batches, until the session ends. When the proxy is closed it sends what is
+// still queued, bounded by udpFlushTimeout, and returns.
+func (proxy *UDPProxy) writeLoop(session *udpSession, key *connTrackKey) {
+	defer proxy.running.conns.Done()
+	defer close(session.flushed)
+	batch := make([][]byte, 0, proxy.opts.udpBatchWrites)
+	closing := false
+	for {
+		if !closing {
+			select {
+			case b := <-session.queue:
+				batch = append(batch, b)
+			case <-session.ended:
+				return
+			case <-proxy.closing:
+				closing = true
+				session.backend().SetWriteDeadline(time.Now().Add(udpFlushTimeout))
+			}
+		}
+	more:
+		for len(batch) < cap(batch) {
+			select {
+			case b := <-session.queue:
+				batch = append(batch, b)
+			default:
+				break more
+			}
+		}
+		if len(batch) == 0 {
+			// Only once closing, with the queue drained.
+			return
+		}
+		conn := session.backend()
+		for sent := 0; sent < len(batch); {
+			n, err := writeBatch(conn, batch[sent:])
+			for _, b := range batch[sent : sent+n] {
+				session.c.addToBackend(len(b))
+			}
+			sent += n
+			if err != nil {
+				if !proxy.backendWriteFailed(session, conn, key, len(batch[sent]), err) {
+					break
+				}
+				// Skip the datagram which was too large.
+				sent++
+			}
+		}
+		batch = batch[:0]
+	}
+}
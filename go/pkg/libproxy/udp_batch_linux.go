@@ -0,0 +1,62 @@
+package libproxy
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr from <sys/socket.h>.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// writeBatch sends datagrams on the connected socket conn with one sendmmsg,
+// returning how many the kernel took, which may be fewer than all of them.
+// Connections which don't expose their socket fall back to writeEach.
+func writeBatch(conn net.Conn, datagrams [][]byte) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok || len(datagrams) == 1 {
+		return writeEach(conn, datagrams)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return writeEach(conn, datagrams)
+	}
+	iovs := make([]unix.Iovec, len(datagrams))
+	hdrs := make([]mmsghdr, len(datagrams))
+	for i, b := range datagrams {
+		if len(b) > 0 {
+			iovs[i].Base = &b[0]
+		}
+		iovs[i].SetLen(len(b))
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.Iovlen = 1
+	}
+	var n int
+	var sendErr error
+	err = raw.Write(func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+		if e == unix.EAGAIN {
+			// Wait for the socket to become writable.
+			return false
+		}
+		if e != 0 {
+			sendErr = os.NewSyscallError("sendmmsg", e)
+		} else {
+			n = int(r)
+		}
+		return true
+	})
+	if err == nil {
+		err = sendErr
+	}
+	if err != nil {
+		return n, &net.OpError{Op: "write", Net: conn.LocalAddr().Network(), Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: err}
+	}
+	return n, nil
+}
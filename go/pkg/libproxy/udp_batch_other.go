@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package libproxy
+
+import (
+	"net"
+)
+
+// writeBatch writes datagrams one at a time: sendmmsg is Linux only.
+func writeBatch(conn net.Conn, datagrams [][]byte) (int, error) {
+	return writeEach(conn, datagrams)
+}
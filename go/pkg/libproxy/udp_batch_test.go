@@ -0,0 +1,210 @@
+package libproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpSink returns a UDP socket and a client socket connected to it.
+func udpSink(t testing.TB) (*net.UDPConn, net.Conn) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", sink.LocalAddr().String())
+	if err != nil {
+		sink.Close()
+		t.Fatal(err)
+	}
+	return sink, conn
+}
+
+func TestWriteBatch(t *testing.T) {
+	sink, conn := udpSink(t)
+	defer sink.Close()
+	defer conn.Close()
+	var datagrams [][]byte
+	for i := 0; i < 8; i++ {
+		datagrams = append(datagrams, []byte(fmt.Sprintf("datagram %d", i)))
+	}
+	n, err := writeBatch(conn, datagrams)
+	if err != nil || n != len(datagrams) {
+		t.Fatalf("Expected %d datagrams to be sent but got %d: %v", len(datagrams), n, err)
+	}
+	buf := make([]byte, 64)
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range datagrams {
+		n, err := sink.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("Expected %q but got %q", expected, buf[:n])
+		}
+	}
+}
+
+func TestUDPBatchWrites(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithUDPBatchWrites(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// A burst, so that some of it is batched.
+	const burst = 32
+	for i := 0; i < burst; i++ {
+		if _, err := client.Write([]byte(fmt.Sprintf("%02d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]bool)
+	buf := make([]byte, 16)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(seen) < burst {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Got %d of %d replies: %v", len(seen), burst, err)
+		}
+		seen[string(buf[:n])] = true
+	}
+	waitFor(t, func() bool { return proxy.Stats().BytesToBackend == 2*burst }, func() string {
+		return fmt.Sprintf("Timed out waiting for BytesToBackend == 2*burst in %+v", proxy.Stats())
+	})
+}
+
+// gatedDialer dials connections whose writes wait until gate is closed.
+type gatedDialer struct {
+	gate chan struct{}
+}
+
+func (d *gatedDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedConn{Conn: conn, gate: d.gate}, nil
+}
+
+type gatedConn struct {
+	net.Conn
+	gate chan struct{}
+}
+
+func (c *gatedConn) Write(b []byte) (int, error) {
+	<-c.gate
+	return c.Conn.Write(b)
+}
+
+func TestUDPCloseFlushesBatchedWrites(t *testing.T) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	gate := make(chan struct{})
+	frontend := newMemPacketConn()
+	proxy, err := NewIPProxyWithPacketConn(frontend, sink.LocalAddr(), WithUDPBatchWrites(16), WithBackendDialer(&gatedDialer{gate: gate}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	// The datagrams are held in the session's queue by the gated backend.
+	const queued = 8
+	for i := 0; i < queued; i++ {
+		frontend.send([]byte(fmt.Sprintf("%02d", i)), memAddr("client"))
+	}
+	for len(frontend.in) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan struct{})
+	go func() {
+		proxy.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the queued datagrams were sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(gate)
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+	// Every session has finished by the time Close returns.
+	if active := proxy.Stats().ActiveConns; active != 0 {
+		t.Fatalf("Expected no sessions left after Close but got %d", active)
+	}
+	buf := make([]byte, 16)
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < queued; i++ {
+		n, err := sink.Read(buf)
+		if err != nil {
+			t.Fatalf("Got %d of %d datagrams: %v", i, queued, err)
+		}
+		if expected := fmt.Sprintf("%02d", i); string(buf[:n]) != expected {
+			t.Fatalf("Expected %q but got %q", expected, buf[:n])
+		}
+	}
+}
+
+// BenchmarkUDPBurst sends bursts of 64 datagrams one write at a time and
+// with writeBatch, and reports the system calls each burst takes.
+func BenchmarkUDPBurst(b *testing.B) {
+	const burst = 64
+	datagrams := make([][]byte, burst)
+	for i := range datagrams {
+		datagrams[i] = make([]byte, 128)
+	}
+	// Each returns the number of datagrams sent by one system call.
+	writers := []struct {
+		name  string
+		write func(conn net.Conn, datagrams [][]byte) (int, error)
+	}{
+		{"each", func(conn net.Conn, datagrams [][]byte) (int, error) {
+			_, err := conn.Write(datagrams[0])
+			return 1, err
+		}},
+		{"batch", writeBatch},
+	}
+	for _, w := range writers {
+		b.Run(w.name, func(b *testing.B) {
+			sink, conn := udpSink(b)
+			defer sink.Close()
+			defer conn.Close()
+			go func() {
+				buf := make([]byte, 128)
+				for {
+					if _, err := sink.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+			syscalls := 0
+			for i := 0; i < b.N; i++ {
+				for sent := 0; sent < burst; syscalls++ {
+					n, err := w.write(conn, datagrams[sent:])
+					if err != nil {
+						b.Fatal(err)
+					}
+					sent += n
+				}
+			}
+			b.ReportMetric(float64(syscalls)/float64(b.N), "syscalls/burst")
+		})
+	}
+}
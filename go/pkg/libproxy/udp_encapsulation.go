@@ -3,10 +3,11 @@ package libproxy
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 // UDPListener defines a listener interface to read, write and close a UDP connection
@@ -16,6 +17,64 @@ type UDPListener interface {
 	Close() error
 }
 
+// listenerPacketConn is a net.PacketConn on top of a UDPListener, for the
+// UDPProxy which reads from packet conns.
+type listenerPacketConn struct {
+	UDPListener
+	addr net.Addr
+}
+
+// asPacketConn returns listener as a net.PacketConn, wrapping it unless it is
+// one already. addr is its local address unless it reports its own.
+func asPacketConn(listener UDPListener, addr net.Addr) net.PacketConn {
+	if conn, ok := listener.(net.PacketConn); ok {
+		return conn
+	}
+	if local, ok := listener.(interface{ LocalAddr() net.Addr }); ok {
+		addr = local.LocalAddr()
+	}
+	return &listenerPacketConn{UDPListener: listener, addr: addr}
+}
+
+func (l *listenerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := l.ReadFromUDP(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, addr, nil
+}
+
+func (l *listenerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("Can't write to %v: not a UDP address", addr)
+	}
+	return l.WriteToUDP(b, udpAddr)
+}
+
+func (l *listenerPacketConn) LocalAddr() net.Addr { return l.addr }
+
+func (l *listenerPacketConn) SetDeadline(t time.Time) error {
+	if conn, ok := l.UDPListener.(interface{ SetDeadline(time.Time) error }); ok {
+		return conn.SetDeadline(t)
+	}
+	return fmt.Errorf("Can't set a deadline on %v", l.addr)
+}
+
+func (l *listenerPacketConn) SetReadDeadline(t time.Time) error {
+	if conn, ok := l.UDPListener.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return fmt.Errorf("Can't set a deadline on %v", l.addr)
+}
+
+func (l *listenerPacketConn) SetWriteDeadline(t time.Time) error {
+	if conn, ok := l.UDPListener.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return conn.SetWriteDeadline(t)
+	}
+	return fmt.Errorf("Can't set a deadline on %v", l.addr)
+}
+
 // udpEncapsulator encapsulates a UDP connection and listener
 type udpEncapsulator struct {
 	conn     *net.Conn
@@ -23,6 +82,7 @@ type udpEncapsulator struct {
 	m        *sync.Mutex
 	r        *sync.Mutex
 	w        *sync.Mutex
+	opts     options
 }
 
 func (u *udpEncapsulator) getConn() (net.Conn, error) {
@@ -33,7 +93,7 @@ func (u *udpEncapsulator) getConn() (net.Conn, error) {
 	}
 	conn, err := u.listener.Accept()
 	if err != nil {
-		log.Printf("Failed to accept connection: %#v", err)
+		u.opts.logf("Failed to accept connection: %#v", err)
 		return nil, err
 	}
 	u.conn = &conn
@@ -95,8 +155,9 @@ func NewUDPConn(conn net.Conn) UDPListener {
 	}
 }
 
-// NewUDPListener initializes a new UDP listener
-func NewUDPListener(listener net.Listener) UDPListener {
+// NewUDPListener initializes a new UDP listener. Only WithLogger applies to
+// it.
+func NewUDPListener(listener net.Listener, opts ...Option) UDPListener {
 	var m sync.Mutex
 	var r sync.Mutex
 	var w sync.Mutex
@@ -106,9 +167,31 @@ func NewUDPListener(listener net.Listener) UDPListener {
 		m:        &m,
 		r:        &r,
 		w:        &w,
+		opts:     newOptions(opts),
 	}
 }
 
+// encapsulatedConn carries the datagrams of one client over a stream
+// connection, framed as by NewUDPConn and labelled with the client's address.
+type encapsulatedConn struct {
+	net.Conn
+	frames UDPListener
+	from   *net.UDPAddr
+}
+
+func newEncapsulatedConn(conn net.Conn, from *net.UDPAddr) net.Conn {
+	return &encapsulatedConn{Conn: conn, frames: NewUDPConn(conn), from: from}
+}
+
+func (c *encapsulatedConn) Read(b []byte) (int, error) {
+	n, _, err := c.frames.ReadFromUDP(b)
+	return n, err
+}
+
+func (c *encapsulatedConn) Write(b []byte) (int, error) {
+	return c.frames.WriteToUDP(b, c.from)
+}
+
 type udpDatagram struct {
 	payload []byte
 	IP      *net.IP
@@ -0,0 +1,44 @@
+package libproxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+// DatagramTooLargeError is the Err of a ConnDatagramTooLarge event. Sending a
+// datagram of Size bytes to the backend failed with EMSGSIZE, usually because
+// it is larger than the path MTU. Only that datagram is dropped: the session
+// carries on, so the client can retry with smaller ones.
+type DatagramTooLargeError struct {
+	Size int
+	Err  error
+}
+
+func (e *DatagramTooLargeError) Error() string {
+	return fmt.Sprintf("Datagram of %d bytes is too large for the backend: %s", e.Size, e.Err)
+}
+
+func (e *DatagramTooLargeError) Unwrap() error { return e.Err }
+
+// WithDatagramTooLargeEvents makes a UDP proxy report every datagram which
+// was too large to send to its backend as a ConnDatagramTooLarge event, as
+// well as counting it in ProxyStats.OversizedDatagrams.
+func WithDatagramTooLargeEvents() Option {
+	return func(o *options) {
+		o.datagramTooLargeEvents = true
+	}
+}
+
+// datagramTooLarge reports whether err, from writing a datagram of size bytes
+// for session, was EMSGSIZE, counting and reporting it if so.
+func (proxy *UDPProxy) datagramTooLarge(session *udpSession, size int, err error) bool {
+	if bindErrno(err) != syscall.EMSGSIZE {
+		return false
+	}
+	atomic.AddUint64(&proxy.stats.oversizedDatagrams, 1)
+	if proxy.opts.datagramTooLargeEvents {
+		proxy.events.datagramTooLarge(session.c, &DatagramTooLargeError{Size: size, Err: err})
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package libproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// mtuConn is a backend socket which refuses datagrams larger than mtu.
+type mtuConn struct {
+	net.Conn
+	mtu  int
+	m    sync.Mutex
+	sent [][]byte
+}
+
+func (c *mtuConn) Write(b []byte) (int, error) {
+	if len(b) > c.mtu {
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", syscall.EMSGSIZE)}
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.sent = append(c.sent, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *mtuConn) Close() error { return nil }
+
+func (c *mtuConn) sentCount() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.sent)
+}
+
+func TestUDPDatagramTooLarge(t *testing.T) {
+	events := make(chan ConnEvent, 10)
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, WithUDPBatchWrites(8), WithDatagramTooLargeEvents(), OnConnection(func(e ConnEvent) {
+		events <- e
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	udp := proxy.(*UDPProxy)
+	backend := &mtuConn{mtu: 100}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	key := newConnTrackKey(from)
+	session := &udpSession{conn: backend, c: newConnection(from, &udp.stats)}
+	udp.connTrackTable[*key] = session
+	udp.startBatching(session, key)
+	defer close(session.ended)
+
+	session.enqueue(make([]byte, 10))
+	session.enqueue(make([]byte, 1000))
+	session.enqueue(make([]byte, 10))
+	select {
+	case e := <-events:
+		var tooLarge *DatagramTooLargeError
+		if e.Type != ConnDatagramTooLarge || !errors.As(e.Err, &tooLarge) || tooLarge.Size != 1000 {
+			t.Fatalf("Expected a 1000 byte datagram to be reported but got %+v", e)
+		}
+		if bindErrno(e.Err) != syscall.EMSGSIZE {
+			t.Fatalf("Expected EMSGSIZE but got %v", e.Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The oversized datagram wasn't reported")
+	}
+	// The datagrams either side of it are still sent.
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.BytesToBackend == 20
+	}, func() string { return fmt.Sprintf("Timed out waiting for BytesToBackend == 20 in %+v", stats) })
+	if stats.OversizedDatagrams != 1 {
+		t.Fatalf("Expected 1 oversized datagram but got %+v", stats)
+	}
+	if n := backend.sentCount(); n != 2 {
+		t.Fatalf("Expected 2 datagrams to be sent but got %d", n)
+	}
+	udp.connTrackLock.Lock()
+	kept := udp.connTrackTable[*key] == session
+	udp.connTrackLock.Unlock()
+	if !kept {
+		t.Fatal("Expected the session to carry on")
+	}
+}
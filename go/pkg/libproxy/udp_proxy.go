@@ -1,11 +1,13 @@
 package libproxy
 
 import (
+	"context"
 	"encoding/binary"
-	"log"
+	"errors"
+	"fmt"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -13,19 +15,34 @@ import (
 const (
 	// UDPConnTrackTimeout is the timeout used for UDP connection tracking
 	UDPConnTrackTimeout = 90 * time.Second
-	// UDPBufSize is the buffer size for the UDP proxy
-	UDPBufSize = 65507
+	// UDPBufSize is the default buffer size for the UDP proxy, enough for
+	// the largest datagram UDP can carry.
+	UDPBufSize = 65535
 )
 
 // A net.Addr where the IP is split into two fields so you can use it as a key
-// in a map:
+// in a map. Addresses other than UDP ones are keyed by their network and
+// string form instead:
 type connTrackKey struct {
 	IPHigh uint64
 	IPLow  uint64
 	Port   int
+	Zone   string // of link-local clients, which may differ only by it
+	Addr   string
 }
 
-func newConnTrackKey(addr *net.UDPAddr) *connTrackKey {
+func newConnTrackKey(addr net.Addr) *connTrackKey {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		if addr == nil {
+			return &connTrackKey{}
+		}
+		return &connTrackKey{Addr: addr.Network() + "/" + addr.String()}
+	}
+	return newUDPConnTrackKey(udpAddr)
+}
+
+func newUDPConnTrackKey(addr *net.UDPAddr) *connTrackKey {
 	if len(addr.IP) == net.IPv4len {
 		return &connTrackKey{
 			IPHigh: 0,
@@ -37,129 +54,438 @@ func newConnTrackKey(addr *net.UDPAddr) *connTrackKey {
 		IPHigh: binary.BigEndian.Uint64(addr.IP[:8]),
 		IPLow:  binary.BigEndian.Uint64(addr.IP[8:]),
 		Port:   addr.Port,
+		Zone:   addr.Zone,
 	}
 }
 
-type connTrackMap map[connTrackKey]*net.UDPConn
+// udpSession is the backend socket used to forward the datagrams of one
+// frontend source address.
+type udpSession struct {
+	connLock sync.Mutex
+	conn     net.Conn // replaced when the backend is re-dialed
+	c        *connection
+	// lastActivity is the time of the last datagram in either direction,
+	// in nanoseconds since the epoch. It is accessed atomically.
+	lastActivity int64
+	// dropErr holds a sessionError once the session has been dropped.
+	dropErr atomic.Value
+	// queue holds the datagrams for writeLoop to send to the backend
+	// when writes are batched, until ended is closed.
+	queue chan []byte
+	ended chan struct{}
+	// flushed is closed once writeLoop has returned.
+	flushed chan struct{}
+	// oneWay sessions, of WithUnidirectional proxies, have no replyLoop.
+	oneWay     bool
+	finishOnce sync.Once
+}
+
+type sessionError struct {
+	err error
+}
+
+// backend returns the current backend socket of the session.
+func (session *udpSession) backend() net.Conn {
+	session.connLock.Lock()
+	defer session.connLock.Unlock()
+	return session.conn
+}
+
+// setBackend replaces the backend socket of the session, returning the old
+// one.
+func (session *udpSession) setBackend(conn net.Conn) net.Conn {
+	session.connLock.Lock()
+	defer session.connLock.Unlock()
+	old := session.conn
+	session.conn = conn
+	return old
+}
+
+func (session *udpSession) touch() {
+	atomic.StoreInt64(&session.lastActivity, time.Now().UnixNano())
+}
+
+func (session *udpSession) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&session.lastActivity))
+}
+
+type connTrackMap map[connTrackKey]*udpSession
 
 // UDPProxy is proxy for which handles UDP datagrams. It implements the Proxy
 // interface to handle UDP traffic forwarding between the frontend and backend
 // addresses.
 type UDPProxy struct {
-	listener       UDPListener
+	listener       net.PacketConn
 	frontendAddr   net.Addr
-	backendAddr    *net.UDPAddr
+	target         atomic.Value // holds the backendTarget new sessions dial
 	connTrackTable connTrackMap
 	connTrackLock  sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	closeOnce      sync.Once
+	closing        chan struct{} // closed by Close to flush the batched writes
+	draining       int32         // set atomically once no new sessions are allowed
+	paused         int32         // set atomically by Pause
+	sessions       connTracker
+	active         connRegistry
+	running        *runState
+	stats          stats
+	events         *eventDispatcher
+	opts           options
 }
 
-// NewUDPProxy creates a new UDPProxy.
-func NewUDPProxy(frontendAddr net.Addr, listener UDPListener, backendAddr *net.UDPAddr) (*UDPProxy, error) {
+// NewUDPProxy creates a new UDPProxy. A listener which is also a
+// net.PacketConn, such as a *net.UDPConn, is used as one; use
+// NewIPProxyWithPacketConn for packet conns which aren't UDPListeners.
+func NewUDPProxy(frontendAddr net.Addr, listener UDPListener, backendAddr *net.UDPAddr, opts ...Option) (*UDPProxy, error) {
+	return NewUDPProxyContext(context.Background(), frontendAddr, listener, backendAddr, opts...)
+}
 
-	return &UDPProxy{
+// NewUDPProxyContext creates a new UDPProxy which is closed, along with all
+// of its sessions, when ctx is cancelled.
+func NewUDPProxyContext(ctx context.Context, frontendAddr net.Addr, listener UDPListener, backendAddr *net.UDPAddr, opts ...Option) (*UDPProxy, error) {
+	return newDatagramProxy(ctx, frontendAddr, asPacketConn(listener, frontendAddr), backendAddr, opts...)
+}
+
+// newDatagramProxy creates a UDPProxy for any datagram backend, UDP or Unix,
+// reading from any packet conn. Clients are told apart by the addresses it
+// returns, which needn't be UDP ones.
+func newDatagramProxy(ctx context.Context, frontendAddr net.Addr, listener net.PacketConn, backendAddr net.Addr, opts ...Option) (*UDPProxy, error) {
+	o := newOptions(opts)
+	if err := o.checkBackendNetwork(backendAddr); err != nil {
+		return nil, err
+	}
+	if err := o.checkUDPMaxDatagram(); err != nil {
+		return nil, err
+	}
+	if err := o.probeDatagram(backendAddr); err != nil {
+		return nil, err
+	}
+	// Report the address actually bound, with the port picked for port 0.
+	if addr := listener.LocalAddr(); addr != nil {
+		frontendAddr = addr
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	proxy := &UDPProxy{
 		listener:       listener,
 		frontendAddr:   frontendAddr,
-		backendAddr:    backendAddr,
 		connTrackTable: make(connTrackMap),
-	}, nil
+		ctx:            ctx,
+		cancel:         cancel,
+		closing:        make(chan struct{}),
+		running:        newRunState(),
+		opts:           o,
+	}
+	proxy.target.Store(backendTarget{backendAddr})
+	proxy.stats.tag = proxy.opts.tag
+	proxy.events = newEventDispatcher(proxy.opts.eventHandler(), &proxy.stats)
+	go func() {
+		<-ctx.Done()
+		proxy.Close()
+	}()
+	return proxy, nil
 }
 
-func (proxy *UDPProxy) replyLoop(proxyConn *net.UDPConn, clientAddr *net.UDPAddr, clientKey *connTrackKey) {
-	defer func() {
+// finishSession forgets session, closes its backend socket and reports it
+// closed with err. It is called when replyLoop returns or, for sessions
+// without one, when they are dropped, expire or the proxy is closed. Only
+// the first call does anything.
+func (proxy *UDPProxy) finishSession(session *udpSession, clientKey *connTrackKey, err error) {
+	session.finishOnce.Do(func() {
 		proxy.connTrackLock.Lock()
-		delete(proxy.connTrackTable, *clientKey)
+		if proxy.connTrackTable[*clientKey] == session {
+			delete(proxy.connTrackTable, *clientKey)
+		}
 		proxy.connTrackLock.Unlock()
-		proxyConn.Close()
+		if peers, ok := proxy.listener.(peerForgetter); ok {
+			peers.forget(session.c.frontendAddr)
+		}
+		session.backend().Close()
+		proxy.stats.connClosed()
+		if proxy.ctx.Err() != nil {
+			err = nil
+		}
+		proxy.stats.failed(err)
+		if session.ended != nil {
+			close(session.ended)
+		}
+		session.c.endSampling()
+		session.c.endTee(&proxy.opts)
+		proxy.active.remove(session.c)
+		proxy.events.closed(session.c, err)
+		proxy.sessions.done()
+	})
+}
+
+func (proxy *UDPProxy) replyLoop(session *udpSession, clientAddr net.Addr, clientKey *connTrackKey) {
+	proxyConn := session.backend()
+	var sessionErr error
+	failures := 0
+	defer func() {
+		proxy.finishSession(session, clientKey, sessionErr)
+		proxy.running.conns.Done()
 	}()
 
-	readBuf := make([]byte, UDPBufSize)
+	readBuf := make([]byte, proxy.opts.udpMaxDatagram)
 	for {
-		proxyConn.SetReadDeadline(time.Now().Add(UDPConnTrackTimeout))
-	again:
+		if proxy.opts.udpSweepInterval <= 0 {
+			proxyConn.SetReadDeadline(session.idleSince().Add(proxy.opts.udpIdleTimeout))
+		}
 		read, err := proxyConn.Read(readBuf)
 		if err != nil {
-			if err, ok := err.(*net.OpError); ok && err.Err == syscall.ECONNREFUSED {
-				// This will happen if the last write failed
-				// (e.g: nothing is actually listening on the
-				// proxied port on the container), ignore it
-				// and continue until UDPConnTrackTimeout
-				// expires:
-				goto again
+			if proxy.redial(session, clientAddr, &failures, err) {
+				proxyConn = session.backend()
+				continue
+			}
+			if bindErrno(err) == syscall.ECONNREFUSED {
+				// The backend answered an earlier datagram
+				// with an ICMP port unreachable: nothing is
+				// listening on the proxied port. Drop the
+				// session so that the client's next datagram
+				// starts a fresh one.
+				sessionErr = err
+				return
+			}
+			if dropped := session.dropErr.Load(); dropped != nil {
+				sessionErr = dropped.(sessionError).err
+				return
+			}
+			if err, ok := err.(net.Error); ok && err.Timeout() && proxy.stillActive(session, clientKey) {
+				// Datagrams were sent to the backend since
+				// the deadline was set.
+				continue
+			}
+			if !isTimeout(err) {
+				sessionErr = err
 			}
 			return
 		}
+		failures = 0
+		session.touch()
+		proxy.stats.checkTruncated(read, readBuf)
+		session.c.teeToFrontend.write(readBuf[:read])
 		for i := 0; i != read; {
-			written, err := proxy.listener.WriteToUDP(readBuf[i:read], clientAddr)
+			written, err := proxy.listener.WriteTo(readBuf[i:read], clientAddr)
 			if err != nil {
+				sessionErr = err
 				return
 			}
+			session.c.addToFrontend(written)
 			i += written
 		}
 	}
 }
 
-// Run starts forwarding the traffic using UDP.
-func (proxy *UDPProxy) Run() {
-	readBuf := make([]byte, UDPBufSize)
+// stillActive reports whether the session has seen traffic within the idle
+// timeout. Sessions which haven't are removed from the table while holding
+// the lock so that Run cannot pick them up again.
+func (proxy *UDPProxy) stillActive(session *udpSession, clientKey *connTrackKey) bool {
+	proxy.connTrackLock.Lock()
+	defer proxy.connTrackLock.Unlock()
+	if time.Since(session.idleSince()) < proxy.opts.udpIdleTimeout {
+		return true
+	}
+	delete(proxy.connTrackTable, *clientKey)
+	return false
+}
+
+// Run starts forwarding the traffic using UDP. It returns nil after Close
+// and the listener error otherwise.
+func (proxy *UDPProxy) Run() error {
+	if !proxy.running.start() {
+		return nil
+	}
+	defer proxy.running.finish()
+	if interval := proxy.sweepInterval(); interval > 0 {
+		proxy.running.conns.Add(1)
+		go proxy.sweep(interval)
+	}
+	readBuf := make([]byte, proxy.opts.udpMaxDatagram)
 	for {
-		read, from, err := proxy.listener.ReadFromUDP(readBuf)
+		read, from, err := proxy.listener.ReadFrom(readBuf)
 		if err != nil {
 			// NOTE: Apparently ReadFrom doesn't return
 			// ECONNREFUSED like Read do (see comment in
 			// UDPProxy.replyLoop)
-			if !isClosedError(err) {
-				log.Printf("Stopping proxy on %v for udp/%v (%s)", proxy.frontendAddr, proxy.backendAddr, err)
+			if proxy.ctx.Err() != nil {
+				return nil
 			}
-			break
+			target := proxy.backendTarget()
+			proxy.opts.logf("Stopping proxy on %v for %s/%v (%s)", proxy.frontendAddr, target.Network(), target, err)
+			err = fmt.Errorf("Can't read from %v: %s", proxy.frontendAddr, err)
+			proxy.stats.failed(err)
+			return err
 		}
 
+		proxy.stats.checkTruncated(read, readBuf)
 		fromKey := newConnTrackKey(from)
 		proxy.connTrackLock.Lock()
-		proxyConn, hit := proxy.connTrackTable[*fromKey]
+		session, hit := proxy.connTrackTable[*fromKey]
+		if !hit && (atomic.LoadInt32(&proxy.draining) != 0 || atomic.LoadInt32(&proxy.paused) != 0 || !proxy.opts.permitted(from)) {
+			proxy.connTrackLock.Unlock()
+			continue
+		}
 		if !hit {
-			proxyConn, err = net.DialUDP("udp", nil, proxy.backendAddr)
+			target := proxy.backendTarget()
+			proxyConn, err := proxy.opts.dialDatagram(target, from)
 			if err != nil {
-				log.Printf("Can't proxy a datagram to udp/%s: %s\n", proxy.backendAddr, err)
+				proxy.opts.logf("Can't proxy a datagram to %s/%s: %s\n", target.Network(), target, err)
 				proxy.connTrackLock.Unlock()
 				continue
 			}
-			proxy.connTrackTable[*fromKey] = proxyConn
-			go proxy.replyLoop(proxyConn, from, fromKey)
+			session = &udpSession{conn: proxyConn, c: newConnection(from, &proxy.stats), oneWay: proxy.opts.unidirectional}
+			proxy.opts.startConn(proxy.ctx, session.c)
+			session.c.backendAddr = proxyConn.RemoteAddr()
+			proxy.opts.logForwarding("udp", session.c, proxy.listener.LocalAddr(), proxyConn.LocalAddr())
+			session.touch()
+			proxy.connTrackTable[*fromKey] = session
+			proxy.stats.connOpened()
+			proxy.sessions.add()
+			proxy.events.opened(session.c)
+			proxy.active.add(session.c)
+			proxy.opts.startSampling(session.c)
+			proxy.opts.startTee(session.c)
+			if proxy.opts.udpBatchWrites > 0 {
+				proxy.startBatching(session, fromKey)
+			}
+			if !session.oneWay {
+				proxy.running.conns.Add(1)
+				go proxy.replyLoop(session, from, fromKey)
+			}
 		}
+		session.touch()
 		proxy.connTrackLock.Unlock()
+		session.c.teeToBackend.write(readBuf[:read])
+		if session.queue != nil {
+			session.enqueue(readBuf[:read])
+			continue
+		}
+		conn := session.backend()
 		for i := 0; i != read; {
-			written, err := proxyConn.Write(readBuf[i:read])
+			written, err := conn.Write(readBuf[i:read])
 			if err != nil {
-				log.Printf("Can't proxy a datagram to udp/%s: %s\n", proxy.backendAddr, err)
+				proxy.backendWriteFailed(session, conn, fromKey, read-i, err)
 				break
 			}
+			session.c.addToBackend(written)
 			i += written
 		}
 	}
 }
 
-// Close stops forwarding the traffic.
-func (proxy *UDPProxy) Close() {
-	proxy.listener.Close()
-	proxy.connTrackLock.Lock()
-	defer proxy.connTrackLock.Unlock()
-	for _, conn := range proxy.connTrackTable {
+// backendWriteFailed handles an error writing a datagram of size bytes to
+// conn, the backend socket of session. It returns true if the session can
+// carry on with the next datagram.
+func (proxy *UDPProxy) backendWriteFailed(session *udpSession, conn net.Conn, key *connTrackKey, size int, err error) bool {
+	if proxy.datagramTooLarge(session, size, err) {
+		return true
+	}
+	target := proxy.backendTarget()
+	proxy.opts.logf("Can't proxy a datagram to %s/%s: %s\n", target.Network(), target, err)
+	if bindErrno(err) != syscall.ECONNREFUSED {
+		return false
+	}
+	if proxy.opts.udpRedialAttempts > 0 && !session.oneWay {
+		// replyLoop re-dials once its read fails.
 		conn.Close()
+	} else {
+		proxy.dropSession(session, key, err)
 	}
+	return false
+}
+
+// dropSession forgets session straight away, so that the next datagram from
+// the client starts a new one, and makes its replyLoop finish with err.
+func (proxy *UDPProxy) dropSession(session *udpSession, key *connTrackKey, err error) {
+	proxy.connTrackLock.Lock()
+	if proxy.connTrackTable[*key] == session {
+		delete(proxy.connTrackTable, *key)
+	}
+	proxy.connTrackLock.Unlock()
+	session.dropErr.Store(sessionError{err})
+	session.backend().Close()
+	if session.oneWay {
+		proxy.finishSession(session, key, err)
+	}
+}
+
+// Close stops forwarding the traffic. Datagrams which Run has already read
+// but which are still queued for the backend, with WithUDPBatchWrites, are
+// sent before the backend sockets are closed. Close returns once Run and
+// every session have finished, with the first error from closing the
+// listener or the backend connections, if any. Calling it again does nothing
+// and returns nil.
+func (proxy *UDPProxy) Close() error {
+	var err error
+	proxy.closeOnce.Do(func() {
+		proxy.cancel()
+		err = proxy.listener.Close()
+		proxy.running.close()
+		// Once Run has returned nothing more is queued.
+		<-proxy.running.done
+		close(proxy.closing)
+		proxy.connTrackLock.Lock()
+		sessions := make(connTrackMap, len(proxy.connTrackTable))
+		for key, session := range proxy.connTrackTable {
+			sessions[key] = session
+		}
+		proxy.connTrackLock.Unlock()
+		for key, session := range sessions {
+			if session.flushed != nil {
+				<-session.flushed
+			}
+			// Sessions on their way out may have closed theirs already.
+			if closeErr := session.backend().Close(); err == nil && !errors.Is(closeErr, net.ErrClosed) {
+				err = closeErr
+			}
+			if session.oneWay {
+				key := key
+				proxy.finishSession(session, &key, nil)
+			}
+		}
+		<-proxy.running.stopped
+	})
+	return err
+}
+
+// Wait blocks until Run has returned and every session has finished.
+func (proxy *UDPProxy) Wait() { proxy.running.wait() }
+
+// Done returns a channel which is closed when Wait would return.
+func (proxy *UDPProxy) Done() <-chan struct{} { return proxy.running.stopped }
+
+// CloseWithDeadline stops creating sessions for new source addresses
+// immediately but keeps forwarding for the existing sessions until they go
+// idle or d elapses, whichever comes first. It returns once every session has
+// finished, with the number of sessions which had to be forcibly closed.
+func (proxy *UDPProxy) CloseWithDeadline(d time.Duration) int {
+	atomic.StoreInt32(&proxy.draining, 1)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-proxy.sessions.idle():
+		proxy.Close()
+		return 0
+	case <-timer.C:
+	}
+	forced := proxy.sessions.count()
+	proxy.Close()
+	<-proxy.sessions.idle()
+	return forced
 }
 
 // FrontendAddr returns the UDP address on which the proxy is listening.
 func (proxy *UDPProxy) FrontendAddr() net.Addr { return proxy.frontendAddr }
 
-// BackendAddr returns the proxied UDP address.
-func (proxy *UDPProxy) BackendAddr() net.Addr { return proxy.backendAddr }
+// BackendAddr returns the proxied UDP address, the one new sessions are
+// forwarded to if SetBackend has changed it.
+func (proxy *UDPProxy) BackendAddr() net.Addr { return proxy.backendTarget() }
 
-func isClosedError(err error) bool {
-	/* This comparison is ugly, but unfortunately, net.go doesn't export errClosing.
-	 * See:
-	 * http://golang.org/src/pkg/net/net.go
-	 * https://code.google.com/p/go/issues/detail?id=4337
-	 * https://groups.google.com/forum/#!msg/golang-nuts/0_aaCvBmOcM/SptmDyX1XJMJ
-	 */
-	return strings.HasSuffix(err.Error(), "use of closed network connection")
-}
+// BackendAddrs returns the proxied UDP address, the only one.
+func (proxy *UDPProxy) BackendAddrs() []net.Addr { return []net.Addr{proxy.backendTarget()} }
+
+// Stats returns a snapshot of the traffic forwarded by the proxy.
+func (proxy *UDPProxy) Stats() ProxyStats { return proxy.stats.snapshot() }
+
+// Connections returns the sessions currently being forwarded.
+func (proxy *UDPProxy) Connections() []ConnInfo { return proxy.active.snapshot() }
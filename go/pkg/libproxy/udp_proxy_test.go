@@ -0,0 +1,213 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func roundTrip(t *testing.T, client net.Conn) {
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	if _, err := client.Read(recvBuf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPIdleTimeout(t *testing.T) {
+	testUDPIdleSessions(t)
+}
+
+func TestUDPSweepInterval(t *testing.T) {
+	var m sync.Mutex
+	var closedErrs []error
+	proxy := testUDPIdleSessions(t, WithUDPSweepInterval(50*time.Millisecond), OnConnection(func(e ConnEvent) {
+		if e.Type == ConnClosed {
+			m.Lock()
+			closedErrs = append(closedErrs, e.Err)
+			m.Unlock()
+		}
+	}))
+	m.Lock()
+	for _, err := range closedErrs {
+		if err != nil {
+			t.Errorf("Expected idle sessions to close without an error, got %v", err)
+		}
+	}
+	m.Unlock()
+	// The sweeper must stop with the proxy.
+	proxy.Close()
+	waitReturns(t, proxy)
+}
+
+// testUDPIdleSessions checks that a silent session is reaped after the idle
+// timeout while a busy one is kept.
+func testUDPIdleSessions(t *testing.T, opts ...Option) Proxy {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	idle := 300 * time.Millisecond
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), append(opts, WithUDPIdleTimeout(idle))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+
+	silent, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	busy, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	roundTrip(t, silent)
+	roundTrip(t, busy)
+	if active := proxy.Stats().ActiveConns; active != 2 {
+		t.Fatalf("Expected 2 active sessions but got %d", active)
+	}
+	// Keep one session busy for several idle periods: only the silent one
+	// should be reaped.
+	for end := time.Now().Add(3 * idle); time.Now().Before(end); {
+		roundTrip(t, busy)
+		time.Sleep(idle / 4)
+	}
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 1
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 1 in %+v", stats) })
+	if stats.TotalConns != 2 {
+		t.Fatalf("Expected the busy session to be kept but got %+v", stats)
+	}
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 0 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", proxy.Stats()) })
+	return proxy
+}
+
+func TestUDPSessionDroppedOnPortUnreachable(t *testing.T) {
+	unused, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := unused.LocalAddr().String()
+	unused.Close()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, unused.LocalAddr(), WithUDPIdleTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	// The session goes as soon as the backend refuses, long before the
+	// idle timeout.
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.TotalConns == 1 && stats.ActiveConns == 0
+	}, func() string {
+		return fmt.Sprintf("Timed out waiting for TotalConns == 1 && ActiveConns == 0 in %+v", stats)
+	})
+
+	backend := NewEchoServer(t, "udp", backendAddr)
+	defer backend.Close()
+	backend.Run()
+	roundTrip(t, client)
+	if total := proxy.Stats().TotalConns; total != 2 {
+		t.Fatalf("Expected a fresh session but got %d sessions", total)
+	}
+}
+
+func TestUDPMaxDatagramSize(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithUDPMaxDatagramSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, testBufSize)
+	n, err := client.Read(recvBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 {
+		t.Fatalf("Expected the datagram to be truncated to 16 bytes but got %d", n)
+	}
+	waitFor(t, func() bool { return proxy.Stats().TruncatedDatagrams > 0 }, func() string {
+		return fmt.Sprintf("Timed out waiting for TruncatedDatagrams > 0 in %+v", proxy.Stats())
+	})
+}
+
+func TestUDPMaxDatagramSizeInvalid(t *testing.T) {
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	backendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	for _, n := range []int{0, -1} {
+		proxy, err := NewIPProxy(frontendAddr, backendAddr, WithUDPMaxDatagramSize(n))
+		if err == nil {
+			proxy.Close()
+			t.Fatalf("Expected WithUDPMaxDatagramSize(%d) to be rejected", n)
+		}
+	}
+}
+
+func TestUDPJumboDatagram(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	jumbo := make([]byte, 9000)
+	if _, err := client.Write(jumbo); err != nil {
+		t.Fatal(err)
+	}
+	n, err := client.Read(make([]byte, len(jumbo)+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(jumbo) {
+		t.Fatalf("Expected %d bytes but got %d", len(jumbo), n)
+	}
+	if truncated := proxy.Stats().TruncatedDatagrams; truncated != 0 {
+		t.Fatalf("Expected no truncation but got %d", truncated)
+	}
+}
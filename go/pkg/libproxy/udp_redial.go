@@ -0,0 +1,72 @@
+package libproxy
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// WithUDPRedial makes a UDP session re-create its backend socket when
+// forwarding to the backend fails, for instance with an ICMP port unreachable
+// while the backend restarts, rather than ending the session straight away.
+// Up to attempts re-dials are made, the first after about backoff and each
+// subsequent one after about twice as long as the last, with random jitter
+// so that many sessions don't all re-dial at once. The client keeps its
+// session meanwhile, so its replies still come from the same frontend
+// address. The count is reset whenever the backend replies: a session whose
+// backend stays unreachable is dropped once the attempts are used up.
+func WithUDPRedial(attempts int, backoff time.Duration) Option {
+	return func(o *options) {
+		o.udpRedialAttempts = attempts
+		o.udpRedialBackoff = backoff
+	}
+}
+
+// jitter returns a duration picked at random between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// redial replaces the backend socket of session after reading from it failed
+// with err, once *failures has been incremented and the backoff has elapsed.
+// It returns false, leaving the session to end, if re-dialing isn't enabled,
+// err doesn't call for it, the attempts are used up or the session is
+// closed meanwhile.
+func (proxy *UDPProxy) redial(session *udpSession, clientAddr net.Addr, failures *int, err error) bool {
+	if proxy.opts.udpRedialAttempts <= 0 || isTimeout(err) {
+		return false
+	}
+	for *failures < proxy.opts.udpRedialAttempts {
+		if proxy.ctx.Err() != nil || session.dropErr.Load() != nil {
+			return false
+		}
+		timer := time.NewTimer(jitter(proxy.opts.udpRedialBackoff << uint(*failures)))
+		*failures++
+		select {
+		case <-timer.C:
+		case <-proxy.ctx.Done():
+			timer.Stop()
+			return false
+		}
+		target := proxy.backendTarget()
+		conn, dialErr := proxy.opts.dialDatagram(target, clientAddr)
+		if dialErr != nil {
+			proxy.opts.logf("Can't re-dial %s/%v for %v: %s", target.Network(), target, clientAddr, dialErr)
+			continue
+		}
+		session.setBackend(conn).Close()
+		// Close, the sweeper or dropSession may have closed the old socket
+		// just before it was replaced.
+		if proxy.ctx.Err() != nil || session.dropErr.Load() != nil {
+			conn.Close()
+			return false
+		}
+		proxy.opts.logf("Re-dialed %s/%v for %v after: %s", target.Network(), target, clientAddr, err)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package libproxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionEvents records the events of a proxy's UDP sessions.
+type sessionEvents struct {
+	m      sync.Mutex
+	opened int
+	closed []error
+}
+
+func (e *sessionEvents) option() Option {
+	return OnConnection(func(event ConnEvent) {
+		e.m.Lock()
+		defer e.m.Unlock()
+		switch event.Type {
+		case ConnOpened:
+			e.opened++
+		case ConnClosed:
+			e.closed = append(e.closed, event.Err)
+		}
+	})
+}
+
+func (e *sessionEvents) counts() (int, []error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.opened, append([]error(nil), e.closed...)
+}
+
+func TestUDPRedialKeepsSession(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	backend.Run()
+	backendAddr := backend.LocalAddr()
+	events := &sessionEvents{}
+	proxy, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, backendAddr, WithUDPRedial(10, 20*time.Millisecond), events.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+
+	// Restart the backend: the datagrams sent meanwhile are refused.
+	backend.Close()
+	client.Write(testBuf)
+	time.Sleep(50 * time.Millisecond)
+	backend = NewEchoServer(t, "udp", backendAddr.String())
+	defer backend.Close()
+	backend.Run()
+
+	recvBuf := make([]byte, testBufSize)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("No reply after the backend was restarted")
+		}
+		client.Write(testBuf)
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := client.Read(recvBuf); err == nil {
+			break
+		}
+	}
+	if opened, closed := events.counts(); opened != 1 || len(closed) != 0 {
+		t.Fatalf("Expected the session to be kept but got %d opened and %v closed", opened, closed)
+	}
+	if conns := proxy.Connections(); len(conns) != 1 || conns[0].BytesToFrontend == 0 {
+		t.Fatalf("Unexpected sessions %+v", conns)
+	}
+}
+
+func TestUDPRedialGivesUp(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	backendAddr := backend.LocalAddr()
+	backend.Close()
+	events := &sessionEvents{}
+	proxy, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, backendAddr, WithUDPRedial(2, 5*time.Millisecond), events.option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the session with a dead backend to be dropped")
+		}
+		client.Write(testBuf)
+		time.Sleep(20 * time.Millisecond)
+		if _, closed := events.counts(); len(closed) > 0 {
+			if closed[0] == nil {
+				t.Fatal("Expected the session to end with the backend error")
+			}
+			break
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Second); d < 500*time.Millisecond || d >= time.Second {
+			t.Fatalf("Expected jitter(1s) to be in [500ms, 1s) but got %v", d)
+		}
+	}
+	if d := jitter(1); d != 1 {
+		t.Fatalf("Expected jitter(1ns) to be 1ns but got %v", d)
+	}
+}
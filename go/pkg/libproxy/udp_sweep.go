@@ -0,0 +1,60 @@
+package libproxy
+
+import (
+	"time"
+)
+
+// WithUDPSweepInterval makes a UDP proxy expire idle sessions from a single
+// background sweeper which runs every d, rather than with a read deadline
+// per session. This scales better to thousands of sessions, at the cost of
+// sessions living up to d beyond the idle timeout. The sweeper stops when
+// the proxy is closed.
+func WithUDPSweepInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.udpSweepInterval = d
+	}
+}
+
+// sweepInterval returns how often the sweeper runs, or 0 if it doesn't.
+// Sessions of unidirectional proxies have no replyLoop to notice that they
+// are idle, so the sweeper expires them, checking every idle timeout unless
+// WithUDPSweepInterval says otherwise.
+func (proxy *UDPProxy) sweepInterval() time.Duration {
+	if proxy.opts.udpSweepInterval <= 0 && proxy.opts.unidirectional {
+		return proxy.opts.udpIdleTimeout
+	}
+	return proxy.opts.udpSweepInterval
+}
+
+// sweep closes the sessions which have been idle for longer than the idle
+// timeout, every interval until the proxy is closed.
+func (proxy *UDPProxy) sweep(interval time.Duration) {
+	defer proxy.running.conns.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-proxy.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		idle := make(connTrackMap)
+		proxy.connTrackLock.Lock()
+		for key, session := range proxy.connTrackTable {
+			if time.Since(session.idleSince()) >= proxy.opts.udpIdleTimeout {
+				delete(proxy.connTrackTable, key)
+				idle[key] = session
+			}
+		}
+		proxy.connTrackLock.Unlock()
+		for key, session := range idle {
+			// Timing out isn't an error.
+			session.dropErr.Store(sessionError{})
+			session.backend().Close()
+			if session.oneWay {
+				key := key
+				proxy.finishSession(session, &key, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package libproxy
+
+// WithUnidirectional makes the proxy only forward from the frontend to the
+// backend, for traffic which is never answered such as syslog or metrics.
+// A TCP proxy shuts down the read side of each backend connection rather
+// than copying from it. A UDP proxy doesn't read from its backend sockets at
+// all, saving a goroutine per session, and expires idle sessions with the
+// sweeper, see WithUDPSweepInterval. Backend sockets which aren't read can't
+// notice that the backend refused a datagram until the next one is written,
+// so re-dialing with WithUDPRedial doesn't apply. The option can't be
+// combined with WithBackendPool.
+func WithUnidirectional() Option {
+	return func(o *options) {
+		o.unidirectional = true
+	}
+}
@@ -0,0 +1,137 @@
+package libproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPUnidirectional(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Anything written back must not reach the client.
+		conn.Write([]byte("unexpected reply"))
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, listener.Addr(), WithUnidirectional())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, testBuf) {
+			t.Fatalf("Expected the backend to get %d bytes but got %d", testBufSize, len(data))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The backend didn't get EOF")
+	}
+	if reply, err := io.ReadAll(client); err != nil || len(reply) != 0 {
+		t.Fatalf("Expected nothing back from the backend but got %q, %v", reply, err)
+	}
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 0
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", stats) })
+	if stats.BytesToFrontend != 0 {
+		t.Fatalf("Expected nothing to be forwarded to the frontend but got %+v", stats)
+	}
+	if _, err := NewIPProxy(frontendAddr, listener.Addr(), WithUnidirectional(), WithBackendPool(1)); err == nil {
+		t.Fatal("Expected WithBackendPool and WithUnidirectional to be refused together")
+	}
+}
+
+func TestUDPUnidirectional(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithUnidirectional(), WithUDPIdleTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write(testBuf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return proxy.Stats().BytesToBackend == 3*uint64(testBufSize) }, func() string {
+		return fmt.Sprintf("Timed out waiting for BytesToBackend == 3*uint64(testBufSize) in %+v", proxy.Stats())
+	})
+	// The echo is never read from the backend socket.
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, testBufSize)); err == nil {
+		t.Fatalf("Expected no reply but got %d bytes", n)
+	}
+	// The sweeper expires the session without a replyLoop.
+	var stats ProxyStats
+	waitFor(t, func() bool {
+		stats = proxy.Stats()
+		return stats.ActiveConns == 0
+	}, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 0 in %+v", stats) })
+	if stats.TotalConns != 1 || stats.BytesToFrontend != 0 {
+		t.Fatalf("Expected one session which forwarded nothing back but got %+v", stats)
+	}
+	proxy.Close()
+	waitReturns(t, proxy)
+}
+
+func TestUDPUnidirectionalClose(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr(), WithUnidirectional())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(testBuf); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return proxy.Stats().ActiveConns == 1 }, func() string { return fmt.Sprintf("Timed out waiting for ActiveConns == 1 in %+v", proxy.Stats()) })
+	proxy.Close()
+	if active := proxy.Stats().ActiveConns; active != 0 {
+		t.Fatalf("Expected Close to finish the session but %d are active", active)
+	}
+	waitReturns(t, proxy)
+}
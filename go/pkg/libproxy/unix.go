@@ -0,0 +1,186 @@
+package libproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// removeStaleSocket removes a socket file left behind at path by a previous
+// process so that it can be bound again. The file is only removed if
+// connecting to it is refused: if a process is still listening on it the
+// bind fails with EADDRINUSE instead. Anything other than a socket is left
+// alone, as are abstract socket names.
+func removeStaleSocket(network, path string) error {
+	if path == "" || strings.HasPrefix(path, "@") {
+		return nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Can't bind %s: it exists and isn't a socket", path)
+	}
+	addr := &net.UnixAddr{Name: path, Net: network}
+	conn, err := net.DialUnix(network, nil, addr)
+	if err == nil {
+		conn.Close()
+		return &net.OpError{Op: "listen", Net: network, Addr: addr, Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	}
+	if bindErrno(err) != syscall.ECONNREFUSED {
+		// Let the bind fail, rather than remove a socket which is in use.
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// listenUnix binds a Unix stream socket at addr. The socket file is removed
+// when the listener is closed.
+func listenUnix(addr *net.UnixAddr) (net.Listener, error) {
+	if err := removeStaleSocket("unix", addr.Name); err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(true)
+	return listener, nil
+}
+
+// listenUnixgram binds a Unix datagram socket at addr for use as the
+// frontend of a UDPProxy. The socket file is removed when it is closed.
+func listenUnixgram(addr *net.UnixAddr) (*unixgramListener, error) {
+	if err := removeStaleSocket("unixgram", addr.Name); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &unixgramListener{
+		conn:   conn,
+		path:   addr.Name,
+		byName: make(map[string]*net.UDPAddr),
+		byKey:  make(map[connTrackKey]*net.UnixAddr),
+	}, nil
+}
+
+// unixgramListener is a UDPListener, and a net.PacketConn, on top of a Unix
+// datagram socket. The vsock framing labels each datagram with a UDP
+// address, so each client socket is given a made up address in fd00::/8
+// which is mapped back to the socket when a reply is written, and so gets a
+// UDP session of its own. The mapping is forgotten when the session ends.
+// Clients which haven't bound their socket can send but can't be replied
+// to, and all share one session as they can't be told apart.
+type unixgramListener struct {
+	conn   *net.UnixConn
+	path   string
+	m      sync.Mutex
+	byName map[string]*net.UDPAddr
+	byKey  map[connTrackKey]*net.UnixAddr
+	next   uint64
+}
+
+func (u *unixgramListener) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	n, from, err := u.conn.ReadFromUnix(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, u.udpAddr(from), nil
+}
+
+func (u *unixgramListener) udpAddr(from *net.UnixAddr) *net.UDPAddr {
+	name := ""
+	if from != nil {
+		name = from.Name
+	}
+	u.m.Lock()
+	defer u.m.Unlock()
+	if addr, ok := u.byName[name]; ok {
+		return addr
+	}
+	u.next++
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfd
+	binary.BigEndian.PutUint64(ip[8:], u.next)
+	addr := &net.UDPAddr{IP: ip}
+	u.byName[name] = addr
+	u.byKey[*newUDPConnTrackKey(addr)] = from
+	return addr
+}
+
+func (u *unixgramListener) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	u.m.Lock()
+	to := u.byKey[*newUDPConnTrackKey(addr)]
+	u.m.Unlock()
+	if to == nil || to.Name == "" {
+		return 0, fmt.Errorf("Can't reply to %v: the client hasn't bound its unixgram socket", addr)
+	}
+	return u.conn.WriteToUnix(b, to)
+}
+
+// forget drops the mapping of addr, whose session has ended. A datagram
+// which the client sent meanwhile may have been given addr already: the
+// replies to it are lost, as if it had been dropped.
+func (u *unixgramListener) forget(addr net.Addr) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	key := *newUDPConnTrackKey(udpAddr)
+	u.m.Lock()
+	defer u.m.Unlock()
+	if from, ok := u.byKey[key]; ok {
+		name := ""
+		if from != nil {
+			name = from.Name
+		}
+		delete(u.byName, name)
+		delete(u.byKey, key)
+	}
+}
+
+func (u *unixgramListener) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := u.ReadFromUDP(b)
+	if err != nil {
+		return n, nil, err
+	}
+	return n, addr, nil
+}
+
+func (u *unixgramListener) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("Can't reply to %v: not a unixgram client", addr)
+	}
+	return u.WriteToUDP(b, udpAddr)
+}
+
+func (u *unixgramListener) LocalAddr() net.Addr                { return u.conn.LocalAddr() }
+func (u *unixgramListener) SetDeadline(t time.Time) error      { return u.conn.SetDeadline(t) }
+func (u *unixgramListener) SetReadDeadline(t time.Time) error  { return u.conn.SetReadDeadline(t) }
+func (u *unixgramListener) SetWriteDeadline(t time.Time) error { return u.conn.SetWriteDeadline(t) }
+
+func (u *unixgramListener) Close() error {
+	err := u.conn.Close()
+	if u.path != "" && !strings.HasPrefix(u.path, "@") {
+		os.Remove(u.path)
+	}
+	return err
+}
+
+// peerForgetter is a frontend which keeps state for each client address,
+// to be dropped once the client's session has ended.
+type peerForgetter interface {
+	forget(addr net.Addr)
+}
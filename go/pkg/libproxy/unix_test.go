@@ -0,0 +1,271 @@
+package libproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func tempSocketDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "libproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func assertNoFile(t *testing.T, path string) {
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to have been removed: %v", path, err)
+	}
+}
+
+func TestUnixToTCPProxy(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontend.sock")
+	// Leave a stale socket file behind, as a crashed process would.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewIPProxy(&net.UnixAddr{Name: path, Net: "unix"}, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxyAt(t, "unix", proxy, path)
+	assertNoFile(t, path)
+}
+
+func TestTCPToUnixProxy(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	backend := NewEchoServer(t, "unix", filepath.Join(dir, "backend.sock"))
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "tcp", proxy)
+}
+
+func TestUnixgramToUDPProxy(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontend.sock")
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewIPProxy(&net.UnixAddr{Name: path, Net: "unixgram"}, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	// The client has to bind its socket for the reply to reach it.
+	client, err := net.DialUnix("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"}, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	proxy.Close()
+	assertNoFile(t, path)
+}
+
+func TestUDPToUnixgramProxy(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	backend := NewEchoServer(t, "unixgram", filepath.Join(dir, "backend.sock"))
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy(t, "udp", proxy)
+}
+
+func TestUnixProxyWontReplaceFile(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "important")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+	if proxy, err := NewIPProxy(&net.UnixAddr{Name: path, Net: "unix"}, backendAddr); err == nil {
+		proxy.Close()
+		t.Fatal("Expected binding over a regular file to fail")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("The file was removed: %s", err)
+	}
+}
+
+func TestUnixProxyWontReplaceLiveSocket(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+	for _, network := range []string{"unix", "unixgram"} {
+		path := filepath.Join(dir, network+".sock")
+		var live io.Closer
+		var err error
+		if network == "unix" {
+			live, err = net.Listen(network, path)
+		} else {
+			live, err = net.ListenPacket(network, path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer live.Close()
+		if proxy, err := NewIPProxy(&net.UnixAddr{Name: path, Net: network}, backendAddr); bindErrno(err) != syscall.EADDRINUSE {
+			if err == nil {
+				proxy.Close()
+			}
+			t.Fatalf("Expected EADDRINUSE binding over a live %s socket but got %v", network, err)
+		}
+		if _, err := os.Lstat(path); err != nil {
+			t.Fatalf("The live %s socket was removed: %s", network, err)
+		}
+	}
+}
+
+func TestUnixgramProxyWrongBackend(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontend.sock")
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25587}
+	if proxy, err := NewIPProxy(&net.UnixAddr{Name: path, Net: "unixgram"}, backendAddr); err == nil {
+		proxy.Close()
+		t.Fatal("Expected a unixgram frontend with a TCP backend to be rejected")
+	}
+	assertNoFile(t, path)
+}
+
+// exchangeDatagrams sends each of datagrams on client and expects each one
+// back whole, in a read of its own.
+func exchangeDatagrams(t *testing.T, client net.Conn, datagrams [][]byte) {
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	for _, datagram := range datagrams {
+		if _, err := client.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 1024)
+	for _, datagram := range datagrams {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Fatalf("Expected the datagram %q but got %q", datagram, buf[:n])
+		}
+	}
+}
+
+var sizedDatagrams = [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 100), bytes.Repeat([]byte("c"), 1000)}
+
+func TestUnixgramToUDPSessions(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontend.sock")
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	proxy, err := NewIPProxy(&net.UnixAddr{Name: path, Net: "unixgram"}, backend.LocalAddr(), WithUDPIdleTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	var clients []net.Conn
+	for _, name := range []string{"alice.sock", "bob.sock"} {
+		client, err := net.DialUnix("unixgram", &net.UnixAddr{Name: filepath.Join(dir, name), Net: "unixgram"}, &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	for _, client := range clients {
+		exchangeDatagrams(t, client, sizedDatagrams)
+	}
+	if stats := proxy.Stats(); stats.TotalConns != 2 {
+		t.Fatalf("Expected a session per client socket but got %+v", stats)
+	}
+
+	// Once the sessions have expired the clients' addresses are
+	// forgotten, and they get new sessions.
+	listener := proxy.(*UDPProxy).listener.(*unixgramListener)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		listener.m.Lock()
+		mapped := len(listener.byName) + len(listener.byKey)
+		listener.m.Unlock()
+		if mapped == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the client addresses to be forgotten but %d are mapped", mapped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	exchangeDatagrams(t, clients[0], sizedDatagrams[:1])
+	proxy.Close()
+	assertNoFile(t, path)
+}
+
+func TestUDPToUnixgramDatagrams(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	backend := NewEchoServer(t, "unixgram", filepath.Join(dir, "backend.sock"))
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("udp", proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		exchangeDatagrams(t, client, sizedDatagrams)
+	}
+	if stats := proxy.Stats(); stats.TotalConns != 2 {
+		t.Fatalf("Expected a session per client but got %+v", stats)
+	}
+}
+
+func TestUnixgramProxyRemovesFileOnError(t *testing.T) {
+	dir := tempSocketDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontend.sock")
+	backendAddr := &net.UnixAddr{Name: filepath.Join(dir, "backend.sock"), Net: "unixgram"}
+	if proxy, err := NewIPProxy(&net.UnixAddr{Name: path, Net: "unixgram"}, backendAddr, WithBackendNetwork("udp")); err == nil {
+		proxy.Close()
+		t.Fatal("Expected a unixgram backend to be refused with the network pinned to udp")
+	}
+	assertNoFile(t, path)
+}
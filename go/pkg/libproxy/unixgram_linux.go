@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+var unixgramClients uint64
+
+// dialUnixgram connects to a Unix datagram backend. The local end is bound
+// to a unique abstract name so that the backend can reply to it without a
+// file being left behind.
+func dialUnixgram(addr *net.UnixAddr) (net.Conn, error) {
+	local := &net.UnixAddr{
+		Name: fmt.Sprintf("@libproxy-%d-%d", os.Getpid(), atomic.AddUint64(&unixgramClients, 1)),
+		Net:  "unixgram",
+	}
+	return net.DialUnix("unixgram", local, addr)
+}
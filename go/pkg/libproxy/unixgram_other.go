@@ -0,0 +1,45 @@
+//go:build !linux
+// +build !linux
+
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var unixgramClients uint64
+
+// dialUnixgram connects to a Unix datagram backend. There are no abstract
+// socket names outside Linux, so the local end is bound to a unique path in
+// the temporary directory for the backend to reply to, and the file is
+// removed when the connection is closed.
+func dialUnixgram(addr *net.UnixAddr) (net.Conn, error) {
+	local := &net.UnixAddr{
+		Name: filepath.Join(os.TempDir(), fmt.Sprintf("libproxy-%d-%d.sock", os.Getpid(), atomic.AddUint64(&unixgramClients, 1))),
+		Net:  "unixgram",
+	}
+	conn, err := net.DialUnix("unixgram", local, addr)
+	if err != nil {
+		// The bind may have succeeded before the connect failed.
+		os.Remove(local.Name)
+		return nil, err
+	}
+	return &unlinkOnCloseConn{UnixConn: conn, path: local.Name}, nil
+}
+
+// unlinkOnCloseConn removes the file its local end is bound to when it is
+// closed.
+type unlinkOnCloseConn struct {
+	*net.UnixConn
+	path string
+}
+
+func (c *unlinkOnCloseConn) Close() error {
+	err := c.UnixConn.Close()
+	os.Remove(c.path)
+	return err
+}
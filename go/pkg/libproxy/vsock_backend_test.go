@@ -0,0 +1,148 @@
+package libproxy
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// vsockLocal is VMADDR_CID_LOCAL, which reaches listeners on this host when
+// the vsock_loopback transport is available.
+const vsockLocal = 1
+
+var (
+	vsockLoopback    sync.Once
+	vsockLoopbackErr error
+)
+
+// listenVsockLoopback listens on a vsock port which can be dialed from this
+// host, or skips the test.
+func listenVsockLoopback(t *testing.T) (net.Listener, *vsock.VsockAddr) {
+	port := uint32(40000 + os.Getpid()%20000)
+	listener, err := vsock.Listen(vsock.CIDAny, port)
+	if err != nil {
+		t.Skipf("Can't listen on vsock: %v", err)
+	}
+	addr := &vsock.VsockAddr{CID: vsockLocal, Port: port}
+	// Without the loopback transport the dial only fails after a timeout,
+	// so it is tried once for all the tests.
+	vsockLoopback.Do(func() {
+		var conn net.Conn
+		conn, vsockLoopbackErr = vsock.Dial(addr.CID, addr.Port)
+		if vsockLoopbackErr != nil {
+			return
+		}
+		conn.Close()
+		if server, err := listener.Accept(); err == nil {
+			server.Close()
+		}
+	})
+	if vsockLoopbackErr != nil {
+		listener.Close()
+		t.Skipf("Can't dial vsock loopback: %v", vsockLoopbackErr)
+	}
+	return listener, addr
+}
+
+func TestTCPToVsockBackend(t *testing.T) {
+	listener, addr := listenVsockLoopback(t)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, testBufSize)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	proxy, err := NewIPProxy(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+}
+
+func TestUDPToVsockBackend(t *testing.T) {
+	listener, addr := listenVsockLoopback(t)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		frames := NewUDPConn(conn)
+		buf := make([]byte, testBufSize)
+		for {
+			n, from, err := frames.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			frames.WriteToUDP(buf[:n], from)
+		}
+	}()
+	proxy, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+}
+
+func TestEncapsulatedConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	conn := newEncapsulatedConn(local, from)
+	frames := NewUDPConn(remote)
+
+	msg := []byte("hello")
+	go conn.Write(msg)
+	buf := make([]byte, 64)
+	n, addr, err := frames.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) || addr.String() != from.String() {
+		t.Fatalf("Expected %q from %v but got %q from %v", msg, from, buf[:n], addr)
+	}
+
+	reply := []byte("world")
+	go frames.WriteToUDP(reply, from)
+	n, err = conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], reply) {
+		t.Fatalf("Expected %q but got %q", reply, buf[:n])
+	}
+}
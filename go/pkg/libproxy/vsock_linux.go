@@ -0,0 +1,110 @@
+package libproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/vsock"
+	"golang.org/x/sys/unix"
+)
+
+// listenVsock listens for vsock connections from any CID on port. As for TCP,
+// port 0 lets the kernel pick a free port, which Addr reports. Unlike
+// vsock.Listen, closing the listener wakes up a pending Accept.
+func listenVsock(port uint32) (net.Listener, error) {
+	bindPort := port
+	if bindPort == 0 {
+		bindPort = unix.VMADDR_PORT_ANY
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Can't listen on vsock port %d: %s", port, os.NewSyscallError("socket", err))
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: vsock.CIDAny, Port: bindPort}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Can't listen on vsock port %d: %s", port, os.NewSyscallError("bind", err))
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Can't listen on vsock port %d: %s", port, os.NewSyscallError("listen", err))
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Can't listen on vsock port %d: %s", port, os.NewSyscallError("getsockname", err))
+	}
+	local := &vsock.VsockAddr{CID: vsock.CIDAny, Port: sa.(*unix.SockaddrVM).Port}
+	return &vsockListener{f: os.NewFile(uintptr(fd), "vsock:"+local.String()), addr: local}, nil
+}
+
+// vsockListener is a vsock net.Listener using the runtime poller.
+type vsockListener struct {
+	f    *os.File
+	addr *vsock.VsockAddr
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	raw, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	err = raw.Read(func(s uintptr) bool {
+		fd, sa, acceptErr = unix.Accept4(int(s), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept", acceptErr)
+	}
+	remote := &vsock.VsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote.CID, remote.Port = vm.CID, vm.Port
+	}
+	return &vsockConn{f: os.NewFile(uintptr(fd), "vsock:"+remote.String()), local: l.addr, remote: remote}, nil
+}
+
+func (l *vsockListener) Close() error { return l.f.Close() }
+
+func (l *vsockListener) Addr() net.Addr { return l.addr }
+
+// vsockConn is an accepted vsock connection.
+type vsockConn struct {
+	f      *os.File
+	local  *vsock.VsockAddr
+	remote *vsock.VsockAddr
+}
+
+func (c *vsockConn) Read(b []byte) (int, error)  { return c.f.Read(b) }
+func (c *vsockConn) Write(b []byte) (int, error) { return c.f.Write(b) }
+func (c *vsockConn) Close() error                { return c.f.Close() }
+
+func (c *vsockConn) CloseRead() error  { return c.shutdown(unix.SHUT_RD) }
+func (c *vsockConn) CloseWrite() error { return c.shutdown(unix.SHUT_WR) }
+
+func (c *vsockConn) shutdown(how int) error {
+	raw, err := c.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var shutdownErr error
+	if err := raw.Control(func(fd uintptr) {
+		shutdownErr = unix.Shutdown(int(fd), how)
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("shutdown", shutdownErr)
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *vsockConn) SetDeadline(t time.Time) error      { return c.f.SetDeadline(t) }
+func (c *vsockConn) SetReadDeadline(t time.Time) error  { return c.f.SetReadDeadline(t) }
+func (c *vsockConn) SetWriteDeadline(t time.Time) error { return c.f.SetWriteDeadline(t) }
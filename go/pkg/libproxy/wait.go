@@ -0,0 +1,64 @@
+package libproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// runState lets Wait block until a proxy's Run has returned and all of its
+// connection goroutines have finished. A proxy which is closed before Run is
+// called never runs, so Wait doesn't block on it.
+type runState struct {
+	m         sync.Mutex
+	started   bool
+	startedAt time.Time
+	closed    bool
+	done      chan struct{} // closed once Run has returned or can't be called
+	doneOnce  sync.Once
+	stoppedAt time.Time // set before done is closed
+	conns     sync.WaitGroup
+	stopped   chan struct{} // closed once conns have finished too
+}
+
+func newRunState() *runState {
+	return &runState{done: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// start is called at the beginning of Run and reports whether Run should go
+// ahead, which it mustn't if the proxy has already been closed.
+func (r *runState) start() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		return false
+	}
+	r.started = true
+	r.startedAt = time.Now()
+	return true
+}
+
+// finish is called when Run returns. No connections are added after it.
+func (r *runState) finish() {
+	r.doneOnce.Do(func() {
+		r.stoppedAt = time.Now()
+		close(r.done)
+		go func() {
+			r.conns.Wait()
+			close(r.stopped)
+		}()
+	})
+}
+
+// close is called by Close.
+func (r *runState) close() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.closed = true
+	if !r.started {
+		r.finish()
+	}
+}
+
+func (r *runState) wait() {
+	<-r.stopped
+}
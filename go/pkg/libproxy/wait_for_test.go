@@ -0,0 +1,18 @@
+package libproxy
+
+import (
+	"testing"
+	"time"
+)
+
+// waitFor polls ok until it holds, failing the test with what describe says
+// if it doesn't within ten seconds.
+func waitFor(t *testing.T, ok func() bool, describe func() string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal(describe())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
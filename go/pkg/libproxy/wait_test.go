@@ -0,0 +1,150 @@
+package libproxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitReturns(t *testing.T, proxy Proxy) {
+	done := make(chan struct{})
+	go func() {
+		proxy.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait didn't return")
+	}
+}
+
+func TestTCPProxyWait(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+
+	waited := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxy.Wait()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while the proxy was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	proxy.Close()
+	select {
+	case <-waited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait didn't return after Close")
+	}
+	if active := proxy.Stats().ActiveConns; active != 0 {
+		t.Fatalf("Wait returned with %d connections still active", active)
+	}
+	// Once stopped, Wait returns immediately.
+	waitReturns(t, proxy)
+}
+
+func TestUDPProxyWait(t *testing.T) {
+	backend := NewEchoServer(t, "udp", "127.0.0.1:0")
+	defer backend.Close()
+	backend.Run()
+	frontendAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Run()
+	client, err := net.Dial("udp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTrip(t, client)
+	proxy.Close()
+	waitReturns(t, proxy)
+	if active := proxy.Stats().ActiveConns; active != 0 {
+		t.Fatalf("Wait returned with %d sessions still active", active)
+	}
+}
+
+func TestWaitWithoutRun(t *testing.T) {
+	backend := NewEchoServer(t, "tcp", "127.0.0.1:0")
+	defer backend.Close()
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	proxy, err := NewIPProxy(frontendAddr, backend.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Close()
+	waitReturns(t, proxy)
+	if err := proxy.Run(); err != nil {
+		t.Fatalf("Expected Run to return nil after Close but got %s", err)
+	}
+}
+
+func TestDone(t *testing.T) {
+	frontendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+	backendAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	tcp, err := NewIPProxy(frontendAddr, backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := NewIPProxy(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi, err := NewMultiFrontendProxy([]net.Addr{frontendAddr, frontendAddr}, backendAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, _ := NewStubProxy(frontendAddr, backendAddr)
+	select {
+	case <-stub.Done():
+	default:
+		t.Fatal("Expected a stub proxy to be done already")
+	}
+	for _, proxy := range []Proxy{tcp, udp, multi} {
+		if proxy.Done() != proxy.Done() {
+			t.Fatal("Expected Done to return the same channel every time")
+		}
+		go proxy.Run()
+		select {
+		case <-proxy.Done():
+			t.Fatalf("%s/%v was done while running", proxy.FrontendAddr().Network(), proxy.FrontendAddr())
+		case <-time.After(50 * time.Millisecond):
+		}
+		proxy.Close()
+		select {
+		case <-proxy.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s/%v wasn't done after Close", proxy.FrontendAddr().Network(), proxy.FrontendAddr())
+		}
+		// Still closed, and Wait agrees.
+		<-proxy.Done()
+		waitReturns(t, proxy)
+	}
+}
@@ -0,0 +1,46 @@
+package libproxy
+
+import (
+	"net"
+	"strconv"
+)
+
+// addrZone returns the IPv6 zone of a TCP or UDP address, if any.
+func addrZone(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.Zone
+	case *net.UDPAddr:
+		return a.Zone
+	}
+	return ""
+}
+
+// zoneName returns the zone of an address scoped to the interface with the
+// given index: the name of the interface, or the index itself if there is no
+// such interface, as the net package does.
+func zoneName(index uint32) string {
+	if index == 0 {
+		return ""
+	}
+	if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+		return iface.Name
+	}
+	return strconv.FormatUint(uint64(index), 10)
+}
+
+// sourceAddr returns the local address to dial addr from for WithSourceAddr.
+// A link-local source is scoped to the zone of addr, which it must share.
+func (o *options) sourceAddr(network string, addr net.Addr) net.Addr {
+	var zone string
+	if o.sourceIP.IsLinkLocalUnicast() {
+		zone = addrZone(addr)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return &net.TCPAddr{IP: o.sourceIP, Zone: zone}
+	case "udp", "udp4", "udp6":
+		return &net.UDPAddr{IP: o.sourceIP, Zone: zone}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package libproxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// addressRecorder records the addresses it is asked to dial without
+// connecting, as link-local backends aren't reachable here.
+type addressRecorder struct {
+	dials chan string
+}
+
+func newAddressRecorder() *addressRecorder {
+	return &addressRecorder{dials: make(chan string, 16)}
+}
+
+func (d *addressRecorder) Dial(network, address string) (net.Conn, error) {
+	d.dials <- network + " " + address
+	return nil, errors.New("not dialing in a test")
+}
+
+func (d *addressRecorder) waitFor(t *testing.T, want string) {
+	select {
+	case got := <-d.dials:
+		if got != want {
+			t.Fatalf("Expected to dial %s but dialed %s", want, got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected to dial %s", want)
+	}
+}
+
+func TestLinkLocalBackendZone(t *testing.T) {
+	zone := loopbackInterface(t)
+	ip := net.ParseIP("fe80::1")
+	want := "[fe80::1%" + zone + "]:80"
+	for _, network := range []string{"tcp", "udp"} {
+		dialer := newAddressRecorder()
+		var frontendAddr, backendAddr net.Addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.TCPAddr{IP: ip, Port: 80, Zone: zone}
+		if network == "udp" {
+			frontendAddr, backendAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.UDPAddr{IP: ip, Port: 80, Zone: zone}
+		}
+		proxy, err := NewIPProxy(frontendAddr, backendAddr, WithBackendDialer(dialer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer proxy.Close()
+		go proxy.Run()
+		client, err := net.Dial(network, proxy.FrontendAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if _, err := client.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		dialer.waitFor(t, network+" "+want)
+	}
+}
+
+func TestLinkLocalHostnameZone(t *testing.T) {
+	zone := loopbackInterface(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := newAddressRecorder()
+	proxy, err := NewTCPProxyHostname(listener, "service.local:80", WithBackendDialer(dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	proxy.Resolver = &fakeResolver{addrs: []net.IPAddr{{IP: net.ParseIP("fe80::1"), Zone: zone}}}
+	go proxy.Run()
+	client, err := net.Dial("tcp", proxy.FrontendAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	dialer.waitFor(t, "tcp [fe80::1%"+zone+"]:80")
+}
+
+func TestLinkLocalSourceAddr(t *testing.T) {
+	backend := &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 80, Zone: "eth1"}
+	o := newOptions([]Option{WithSourceAddr(net.ParseIP("fe80::1"))})
+	if local := o.sourceAddr("tcp", backend).(*net.TCPAddr); local.Zone != "eth1" {
+		t.Fatalf("Expected the source to take the backend's zone but got %v", local)
+	}
+	o = newOptions([]Option{WithSourceAddr(net.ParseIP("2001:db8::1"))})
+	if local := o.sourceAddr("udp", &net.UDPAddr{IP: backend.IP, Port: 80, Zone: "eth1"}).(*net.UDPAddr); local.Zone != "" {
+		t.Fatalf("Expected a global source to have no zone but got %v", local)
+	}
+}
+
+func TestLinkLocalClientZones(t *testing.T) {
+	ip := net.ParseIP("fe80::1")
+	a := newConnTrackKey(&net.UDPAddr{IP: ip, Port: 53, Zone: "eth0"})
+	b := newConnTrackKey(&net.UDPAddr{IP: ip, Port: 53, Zone: "eth1"})
+	if *a == *b {
+		t.Fatal("Expected clients in different zones to have their own sessions")
+	}
+}
+
+func TestZoneName(t *testing.T) {
+	zone := loopbackInterface(t)
+	iface, err := net.InterfaceByName(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := zoneName(uint32(iface.Index)); name != zone {
+		t.Fatalf("Expected interface %d to be %s but got %s", iface.Index, zone, name)
+	}
+	if name := zoneName(0); name != "" {
+		t.Fatalf("Expected no zone for index 0 but got %s", name)
+	}
+	if name := zoneName(1 << 30); name != strconv.Itoa(1<<30) {
+		t.Fatalf("Expected an unknown interface to be named by index but got %s", name)
+	}
+	if addr := selfTestAddr(net.ParseIP("fe80::1"), zone, 80); addr != "[fe80::1%"+zone+"]:80" {
+		t.Fatalf("Expected the self-test to keep the frontend's zone but got %s", addr)
+	}
+}
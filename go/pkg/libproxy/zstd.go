@@ -0,0 +1,21 @@
+package libproxy
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// newZstdWriter and newZstdReader work on the calling goroutine, so that
+// once they are closed nothing of theirs outlives the connection.
+func newZstdWriter(w io.Writer) (compressor, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}